@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package client
+
+import "net"
+
+// alive can not peek at connections on this platform, the health check
+// and the errors of the commands sent are all there is to go by
+func alive(netConn net.Conn) bool {
+
+	return true
+}
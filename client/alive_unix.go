@@ -0,0 +1,36 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+// alive peeks at a connection that is not being read without blocking,
+// which tells whether the server closed it. It also fails if something
+// is waiting to be read, since no reply is expected.
+func alive(netConn net.Conn) bool {
+
+	syscallConn, ok := netConn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	idle := false
+	err = rawConn.Read(func(fd uintptr) bool {
+
+		var b [1]byte
+		// sockets are non-blocking in Go, so with nothing to read
+		// this fails with EAGAIN rather than wait
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK)
+		idle = err == syscall.EAGAIN || err == syscall.EWOULDBLOCK
+		return true
+	})
+	return err == nil && idle
+}
@@ -0,0 +1,292 @@
+// Package client talks to a retain server. A Client keeps a pool of
+// connections and is safe to use from several goroutines:
+//
+//	c := client.New(client.DefaultOptions())
+//	defer c.Close()
+//
+//	err := c.Set(ctx, "key", []byte("value"), 0)
+//	value, err := c.Get(ctx, "key")
+//	if err == client.ErrNil {
+//		// no such key
+//	}
+//
+// Do sends any other command. Commands that change the state of the
+// connection, like SELECT, MULTI or SUBSCRIBE, should not go through
+// Do: the connection goes back to the pool for anyone to use.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+var (
+	// ErrNil is returned when the server replies with nil, as GET
+	// does for a key that does not exist
+	ErrNil = errors.New("retain: nil reply")
+
+	// ErrClosed is returned by the commands of a closed Client
+	ErrClosed = errors.New("retain: client is closed")
+)
+
+// Error is an error reply from the server, such as
+// "WRONGTYPE Operation against a key holding the wrong kind of value"
+type Error string
+
+func (err Error) Error() string {
+
+	return string(err)
+}
+
+// Code returns the first word of the error, like ERR or WRONGTYPE
+func (err Error) Code() string {
+
+	code := string(err)
+	if i := strings.IndexByte(code, ' '); i >= 0 {
+		return code[:i]
+	}
+	return code
+}
+
+// Options configure a Client, start from DefaultOptions
+type Options struct {
+	// Addr is the host:port of the server
+	Addr string
+
+	// DB is the database every connection selects
+	DB int
+
+	// TLSConfig makes the connections use TLS when it is set. The
+	// server name is that of Addr unless the configuration has one.
+	TLSConfig *tls.Config
+
+	// Username and Password authenticate every connection, the default
+	// user being used when Username is empty. No password skips AUTH.
+	Username string
+	Password string
+
+	// Protocol is the version of RESP the replies come in,
+	// protocol.RESP2 or protocol.RESP3
+	Protocol int
+
+	// DialTimeout, ReadTimeout and WriteTimeout bound connecting and
+	// each read or write, on top of the deadline of the context.
+	// Zero means no bound.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxIdle is how many connections are kept open when nobody uses
+	// them, MaxActive how many may be open at once, zero meaning no
+	// limit. Once MaxActive are in use, commands wait for one of them.
+	MaxIdle   int
+	MaxActive int
+
+	// IdleTimeout closes connections that were idle for longer
+	IdleTimeout time.Duration
+
+	// HealthCheckInterval is how long a connection may go without
+	// talking to the server before it is sent a PING on its way out
+	// of the pool, negative to never check
+	HealthCheckInterval time.Duration
+
+	// MaxRetries is how many times a command is sent again on a new
+	// connection when a connection from the pool turns out to be
+	// dead before any of it was written, because the server restarted
+	// for instance
+	MaxRetries int
+}
+
+// DefaultOptions connect to a server on the default port of retain
+func DefaultOptions() Options {
+
+	return Options{
+		Addr:                "127.0.0.1:8000",
+		Protocol:            protocol.RESP2,
+		DialTimeout:         5 * time.Second,
+		ReadTimeout:         3 * time.Second,
+		WriteTimeout:        3 * time.Second,
+		MaxIdle:             8,
+		IdleTimeout:         5 * time.Minute,
+		HealthCheckInterval: 10 * time.Second,
+		MaxRetries:          1,
+	}
+}
+
+// Client sends commands to the server over a pool of connections
+type Client struct {
+	options Options
+	pool    *pool
+}
+
+// New returns a Client for the server options point to. It does not
+// connect until the first command, see Ping.
+func New(options Options) *Client {
+
+	client := &Client{options: options}
+	client.pool = newPool(&client.options)
+	return client
+}
+
+// Do sends a command made of args, which may be strings, byte slices,
+// ints or float64s, and returns the reply as the protocol package
+// decodes it. Error replies are returned as an Error, nil replies as
+// ErrNil.
+func (client *Client) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+
+	for attempt := 0; ; attempt++ {
+		cn, reused, err := client.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := cn.do(ctx, args)
+		broken, sent := cn.broken, cn.sent
+		client.pool.put(cn)
+
+		// a connection that sat in the pool may have been closed by
+		// the server, which does not mean a new one would fail too.
+		// Once the command was written the server may have run it,
+		// so it is not sent again.
+		if broken && reused && !sent && attempt < client.options.MaxRetries && ctx.Err() == nil && isConnectionError(err) {
+			continue
+		}
+		return reply, err
+	}
+}
+
+// isConnectionError reports whether err comes from the connection
+// rather than from the server or the context
+func isConnectionError(err error) bool {
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return err != nil && err != ErrNil && !errors.As(err, new(Error))
+}
+
+// Ping checks that the server answers
+func (client *Client) Ping(ctx context.Context) error {
+
+	_, err := client.Do(ctx, "PING")
+	return err
+}
+
+// Get returns the value of key, ErrNil if there is none
+func (client *Client) Get(ctx context.Context, key string) ([]byte, error) {
+
+	reply, err := client.Do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	return asBytes(reply)
+}
+
+// Set sets key to value, which expires after ttl unless ttl is zero
+func (client *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+
+	args := []interface{}{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+
+	_, err := client.Do(ctx, args...)
+	return err
+}
+
+// Del deletes key
+func (client *Client) Del(ctx context.Context, key string) error {
+
+	_, err := client.Do(ctx, "DEL", key)
+	return err
+}
+
+// MGet returns the values of keys in order, nil for those that do not
+// exist or do not hold a string
+func (client *Client) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+
+	args := []interface{}{"MGET"}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	reply, err := client.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, unexpected(reply)
+	}
+
+	values := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if item == nil {
+			values = append(values, nil)
+			continue
+		}
+		value, err := asBytes(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// MSet sets every key of values at once
+func (client *Client) MSet(ctx context.Context, values map[string][]byte) error {
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []interface{}{"MSET"}
+	for _, key := range keys {
+		args = append(args, key, values[key])
+	}
+
+	_, err := client.Do(ctx, args...)
+	return err
+}
+
+// Stats describes the connections of the pool
+func (client *Client) Stats() PoolStats {
+
+	return client.pool.stats()
+}
+
+// Close closes the connections of the Client, commands sent afterwards
+// fail with ErrClosed
+func (client *Client) Close() error {
+
+	return client.pool.close()
+}
+
+func asBytes(reply interface{}) ([]byte, error) {
+
+	switch reply := reply.(type) {
+	case []byte:
+		return reply, nil
+	case string:
+		return []byte(reply), nil
+	}
+	return nil, unexpected(reply)
+}
+
+func unexpected(reply interface{}) error {
+
+	return fmt.Errorf("retain: unexpected reply %q", protocol.Encode(reply))
+}
@@ -0,0 +1,556 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+func handleError(text string, err error) {
+
+	if err != nil {
+		log.Fatalf("%s: %v", text, err)
+	}
+}
+
+// testServer answers the few commands the tests need from a map, HANG
+// never gets a reply and DROP closes the connection instead
+type testServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	password    string
+	values      map[string][]byte
+	connections map[net.Conn]struct{}
+	accepted    int
+	dropped     int
+}
+
+func newTestServer() *testServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError("failed to listen", err)
+	return serveOn(listener)
+}
+
+// newTLSTestServer is a testServer that only speaks TLS, as config says
+func newTLSTestServer(config *tls.Config) *testServer {
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	handleError("failed to listen", err)
+	return serveOn(listener)
+}
+
+func serveOn(listener net.Listener) *testServer {
+
+	server := &testServer{
+		listener:    listener,
+		values:      make(map[string][]byte),
+		connections: make(map[net.Conn]struct{}),
+	}
+	go server.accept()
+	return server
+}
+
+func (server *testServer) options() Options {
+
+	options := DefaultOptions()
+	options.Addr = server.listener.Addr().String()
+	return options
+}
+
+func (server *testServer) accept() {
+
+	for {
+		connection, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mu.Lock()
+		server.connections[connection] = struct{}{}
+		server.accepted++
+		server.mu.Unlock()
+		go server.serve(connection)
+	}
+}
+
+func (server *testServer) serve(connection net.Conn) {
+
+	defer connection.Close()
+	reader := protocol.NewReader(connection)
+	writer := protocol.NewWriter(connection)
+
+	// the password is asked of every connection if it is set
+	server.mu.Lock()
+	password := server.password
+	server.mu.Unlock()
+	authenticated := password == ""
+
+	for {
+		value, err := reader.ReadValue()
+		if err != nil {
+			return
+		}
+
+		args := value.([]interface{})
+		name := strings.ToUpper(string(args[0].([]byte)))
+		var reply interface{}
+		switch {
+		case name == "AUTH":
+			authenticated = string(args[len(args)-1].([]byte)) == password
+			reply = "OK"
+			if !authenticated {
+				reply = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+		case !authenticated:
+			reply = errors.New("NOAUTH Authentication required.")
+		default:
+			reply = server.execute(name, args[1:])
+		}
+		if reply == nil && strings.EqualFold(string(args[0].([]byte)), "HANG") {
+			continue
+		}
+		if reply == nil && strings.EqualFold(string(args[0].([]byte)), "DROP") {
+			return
+		}
+		writer.WriteValue(reply)
+		writer.Flush()
+	}
+}
+
+func (server *testServer) execute(name string, args []interface{}) interface{} {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	switch name {
+	case "PING":
+		return "PONG"
+	case "ECHO":
+		return args[0].([]byte)
+	case "SET":
+		server.values[string(args[0].([]byte))] = args[1].([]byte)
+		return "OK"
+	case "GET":
+		if value, ok := server.values[string(args[0].([]byte))]; ok {
+			return value
+		}
+		return nil
+	case "DEL":
+		delete(server.values, string(args[0].([]byte)))
+		return "OK"
+	case "MSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			server.values[string(args[i].([]byte))] = args[i+1].([]byte)
+		}
+		return "OK"
+	case "MGET":
+		values := make([]interface{}, 0)
+		for _, key := range args {
+			if value, ok := server.values[string(key.([]byte))]; ok {
+				values = append(values, value)
+				continue
+			}
+			values = append(values, nil)
+		}
+		return values
+	case "HANG":
+		return nil
+	case "DROP":
+		server.dropped++
+		return nil
+	}
+	return errors.New("ERR unknown command '" + strings.ToLower(name) + "'")
+}
+
+// drop closes every connection, as a restarting server would
+func (server *testServer) drop() {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for connection := range server.connections {
+		connection.Close()
+		delete(server.connections, connection)
+	}
+}
+
+func (server *testServer) close() {
+
+	server.listener.Close()
+	server.drop()
+}
+
+func TestClient(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+	client := New(server.options())
+	defer client.Close()
+	ctx := context.Background()
+
+	handleError("failed Ping", client.Ping(ctx))
+	handleError("failed Set", client.Set(ctx, "key", []byte("value"), time.Minute))
+	value, err := client.Get(ctx, "key")
+	if err != nil || string(value) != "value" {
+		log.Fatalf("failed Get, got: %q %v", value, err)
+	}
+
+	handleError("failed Del", client.Del(ctx, "key"))
+	if _, err := client.Get(ctx, "key"); err != ErrNil {
+		log.Fatalf("failed Get of a missing key, got: %v", err)
+	}
+
+	handleError("failed MSet", client.MSet(ctx, map[string][]byte{"a": []byte("1"), "b": []byte("2")}))
+	values, err := client.MGet(ctx, "a", "missing", "b")
+	if err != nil || !reflect.DeepEqual(values, [][]byte{[]byte("1"), nil, []byte("2")}) {
+		log.Fatalf("failed MGet, got: %q %v", values, err)
+	}
+
+	// error replies are told apart from failures
+	_, err = client.Do(ctx, "NOPE", 1, 2.5)
+	var replyErr Error
+	if !errors.As(err, &replyErr) || replyErr.Code() != "ERR" {
+		log.Fatalf("failed Do of an unknown command, got: %v", err)
+	}
+	if _, err := client.Do(ctx, "GET", struct{}{}); err == nil {
+		log.Fatalf("failed Do, an argument of no known type was sent")
+	}
+
+	// a single connection did all of that
+	if stats := client.Stats(); stats.Active != 1 || stats.Idle != 1 {
+		log.Fatalf("failed pool, got: %+v", stats)
+	}
+
+	client.Close()
+	if err := client.Ping(ctx); err != ErrClosed {
+		log.Fatalf("failed Ping after Close, got: %v", err)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+
+	options := server.options()
+	options.MaxActive = 4
+	options.MaxIdle = 4
+	client := New(options)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				handleError("failed concurrent Ping", client.Ping(context.Background()))
+			}
+		}()
+	}
+	wg.Wait()
+
+	server.mu.Lock()
+	accepted := server.accepted
+	server.mu.Unlock()
+	if accepted > options.MaxActive {
+		log.Fatalf("failed MaxActive, %d connections were made", accepted)
+	}
+
+	// with every connection in use, commands wait for one
+	held := make([]*conn, 0)
+	for i := 0; i < options.MaxActive; i++ {
+		cn, _, err := client.pool.get(context.Background())
+		handleError("failed get", err)
+		held = append(held, cn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); err != context.DeadlineExceeded {
+		log.Fatalf("failed to wait for a connection, got: %v", err)
+	}
+
+	client.pool.put(held[0])
+	handleError("failed Ping once a connection is back", client.Ping(context.Background()))
+
+	// those that do not fit among the idle ones are closed
+	client.options.MaxIdle = 2
+	for _, cn := range held[1:] {
+		client.pool.put(cn)
+	}
+	if stats := client.Stats(); stats.Active != 2 || stats.Idle != 2 {
+		log.Fatalf("failed MaxIdle, got: %+v", stats)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+	client := New(server.options())
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Do(ctx, "HANG"); err != context.DeadlineExceeded {
+		log.Fatalf("failed deadline, got: %v", err)
+	}
+
+	// cancelling works without a deadline too
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Do(ctx, "HANG"); err != context.Canceled {
+		log.Fatalf("failed cancel, got: %v", err)
+	}
+
+	// the connections that were cut short are not reused
+	if stats := client.Stats(); stats.Active != 0 {
+		log.Fatalf("failed to drop interrupted connections, got: %+v", stats)
+	}
+	handleError("failed Ping after a timeout", client.Ping(context.Background()))
+
+	options := server.options()
+	options.ReadTimeout = 50 * time.Millisecond
+	client = New(options)
+	defer client.Close()
+	var netErr net.Error
+	if _, err := client.Do(context.Background(), "HANG"); !errors.As(err, &netErr) || !netErr.Timeout() {
+		log.Fatalf("failed ReadTimeout, got: %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+	client := New(server.options())
+	defer client.Close()
+	ctx := context.Background()
+
+	pipeline := client.Pipeline()
+	pipeline.Do("SET", "key", "value")
+	pipeline.Do("GET", "key")
+	pipeline.Do("GET", "missing")
+	pipeline.Do("NOPE")
+	if pipeline.Len() != 4 {
+		log.Fatalf("failed Len, got: %d", pipeline.Len())
+	}
+
+	results, err := pipeline.Exec(ctx)
+	handleError("failed Exec", err)
+	if len(results) != 4 || results[0].Reply != "OK" || string(results[1].Reply.([]byte)) != "value" {
+		log.Fatalf("failed Exec, got: %+v", results)
+	}
+	if results[2].Err != ErrNil || !errors.As(results[3].Err, new(Error)) {
+		log.Fatalf("failed Exec errors, got: %+v", results)
+	}
+	if pipeline.Len() != 0 {
+		log.Fatalf("failed Exec, the pipeline was not emptied")
+	}
+
+	// commands and replies that would not fit in the buffers of the
+	// connection if one side waited for the other
+	value := []byte(strings.Repeat("x", 64*1024))
+	for i := 0; i < 500; i++ {
+		pipeline.Do("ECHO", value)
+	}
+	results, err = pipeline.Exec(ctx)
+	handleError("failed Exec of a large pipeline", err)
+	for _, result := range results {
+		if result.Err != nil || len(result.Reply.([]byte)) != len(value) {
+			log.Fatalf("failed Exec of a large pipeline, got: %v", result.Err)
+		}
+	}
+	if len(results) != 500 {
+		log.Fatalf("failed Exec of a large pipeline, got %d results", len(results))
+	}
+
+	// a pipeline cut short leaves no connection behind
+	pipeline.Do("PING")
+	pipeline.Do("HANG")
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := pipeline.Exec(timeout); err != context.DeadlineExceeded {
+		log.Fatalf("failed deadline of Exec, got: %v", err)
+	}
+	if stats := client.Stats(); stats.Active != 0 {
+		log.Fatalf("failed to drop the interrupted connection, got: %+v", stats)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+	server.mu.Lock()
+	server.password = "secret"
+	server.mu.Unlock()
+	ctx := context.Background()
+
+	client := New(server.options())
+	defer client.Close()
+	if err := client.Ping(ctx); err == nil || Error(err.Error()).Code() != "NOAUTH" {
+		log.Fatalf("failed Ping without a password, got: %v", err)
+	}
+
+	options := server.options()
+	options.Password = "wrong"
+	client = New(options)
+	defer client.Close()
+	if err := client.Ping(ctx); err == nil || Error(err.Error()).Code() != "WRONGPASS" {
+		log.Fatalf("failed Ping with the wrong password, got: %v", err)
+	}
+
+	options.Password = "secret"
+	client = New(options)
+	defer client.Close()
+	handleError("failed Ping with the password", client.Ping(ctx))
+}
+
+// issue makes a certificate for name signed by parent, a self-signed
+// certificate authority when parent is nil
+func issue(name string, parent *tls.Certificate) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handleError("failed to generate a key", err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	handleError("failed to create a certificate", err)
+	leaf, err := x509.ParseCertificate(der)
+	handleError("failed to parse a certificate", err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientTLS(t *testing.T) {
+
+	authority := issue("authority", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(authority.Leaf)
+
+	server := newTLSTestServer(&tls.Config{
+		Certificates: []tls.Certificate{issue("server", &authority)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer server.close()
+	ctx := context.Background()
+
+	options := server.options()
+	options.TLSConfig = &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{issue("app", &authority)},
+	}
+	client := New(options)
+	defer client.Close()
+	handleError("failed Ping over TLS", client.Ping(ctx))
+
+	// the server is checked against the authorities
+	options.TLSConfig = &tls.Config{Certificates: options.TLSConfig.Certificates}
+	client = New(options)
+	defer client.Close()
+	if err := client.Ping(ctx); err == nil {
+		log.Fatalf("failed Ping, a server signed by an unknown authority was trusted")
+	}
+
+	// and the client by the server
+	options.TLSConfig = &tls.Config{RootCAs: pool}
+	client = New(options)
+	defer client.Close()
+	if err := client.Ping(ctx); err == nil {
+		log.Fatalf("failed Ping, the server took a client without a certificate")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+
+	server := newTestServer()
+	defer server.close()
+	ctx := context.Background()
+
+	// a connection the server closed while it sat in the pool is
+	// found dead before it is used
+	options := server.options()
+	options.HealthCheckInterval = -1
+	options.MaxRetries = 0
+	client := New(options)
+	defer client.Close()
+
+	handleError("failed Set", client.Set(ctx, "key", []byte("value"), 0))
+	server.drop()
+	value, err := client.Get(ctx, "key")
+	if err != nil || string(value) != "value" {
+		log.Fatalf("failed to reconnect, got: %q %v", value, err)
+	}
+
+	// or by the health check
+	options.HealthCheckInterval = 0
+	client = New(options)
+	defer client.Close()
+
+	handleError("failed Ping", client.Ping(ctx))
+	server.drop()
+	handleError("failed Ping after the server dropped the connection", client.Ping(ctx))
+
+	// a command the server may have run is not sent again, alone or
+	// in a pipeline, even with retries
+	options.HealthCheckInterval = -1
+	options.MaxRetries = 3
+	client = New(options)
+	defer client.Close()
+
+	handleError("failed Ping", client.Ping(ctx))
+	if _, err := client.Do(ctx, "DROP"); err == nil {
+		log.Fatalf("failed Do, a dropped connection was not noticed")
+	}
+	handleError("failed Ping", client.Ping(ctx))
+	pipeline := client.Pipeline()
+	pipeline.Do("PING")
+	pipeline.Do("DROP")
+	if _, err := pipeline.Exec(ctx); err == nil {
+		log.Fatalf("failed Exec, a dropped connection was not noticed")
+	}
+
+	server.mu.Lock()
+	dropped := server.dropped
+	server.mu.Unlock()
+	if dropped != 2 {
+		log.Fatalf("failed Do and Exec, the connection was dropped %d times", dropped)
+	}
+	handleError("failed Ping on a new connection", client.Ping(ctx))
+}
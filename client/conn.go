@@ -0,0 +1,363 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+// aLongTimeAgo is a deadline in the past, setting it makes every
+// pending read or write on a connection return at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+// conn is a single connection to the server. It is used by one
+// goroutine at a time, the pool hands it out.
+type conn struct {
+	netConn net.Conn
+	reader  *protocol.Reader
+	writer  *protocol.Writer
+	options *Options
+
+	// tcpConn is netConn without TLS, which alive looks at
+	tcpConn net.Conn
+
+	// usedAt is when the connection last went back to the pool,
+	// checkedAt when it last talked to the server successfully
+	usedAt    time.Time
+	checkedAt time.Time
+
+	// broken is set once the connection can not be trusted to be in
+	// step with the server, after an I/O error or a cancelled command
+	broken bool
+
+	// sent is set once any of the commands being sent was written to
+	// the connection, the server may have run them from then on
+	sent bool
+}
+
+// sentWriter is what the writer of a conn writes to, it notes when
+// bytes make it to the connection
+type sentWriter struct {
+	cn *conn
+}
+
+func (w sentWriter) Write(p []byte) (int, error) {
+
+	n, err := w.cn.netConn.Write(p)
+	if n > 0 {
+		w.cn.sent = true
+	}
+	return n, err
+}
+
+// dial connects to the server and prepares the connection as options
+// say: AUTH for a password, HELLO for RESP3, SELECT for a database
+// other than 0
+func dial(ctx context.Context, options *Options) (*conn, error) {
+
+	if options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.DialTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	tcpConn, err := dialer.DialContext(ctx, "tcp", options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn := tcpConn
+	if options.TLSConfig != nil {
+		// as tls.Dialer does, but keeping the connection under TLS
+		config := options.TLSConfig
+		if config.ServerName == "" {
+			host, _, _ := net.SplitHostPort(options.Addr)
+			config = config.Clone()
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(tcpConn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+
+	cn := &conn{
+		netConn:   netConn,
+		tcpConn:   tcpConn,
+		reader:    protocol.NewReader(netConn),
+		options:   options,
+		checkedAt: time.Now(),
+	}
+	cn.writer = protocol.NewWriter(sentWriter{cn})
+
+	err = cn.setup(ctx)
+	if err != nil {
+		cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// setup runs the commands every new connection starts with
+func (cn *conn) setup(ctx context.Context) error {
+
+	username := cn.options.Username
+	if username == "" {
+		username = "default"
+	}
+
+	// HELLO authenticates too, saving a round trip
+	if cn.options.Protocol == protocol.RESP3 {
+		args := []interface{}{"HELLO", protocol.RESP3}
+		if cn.options.Password != "" {
+			args = append(args, "AUTH", username, cn.options.Password)
+		}
+		_, err := cn.do(ctx, args)
+		if err != nil {
+			return err
+		}
+	} else if cn.options.Password != "" {
+		_, err := cn.do(ctx, []interface{}{"AUTH", username, cn.options.Password})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cn.options.DB != 0 {
+		_, err := cn.do(ctx, []interface{}{"SELECT", cn.options.DB})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends one command and reads its reply. An error reply is returned
+// as an Error, the error result is reserved for failures that leave the
+// connection broken and for ErrNil.
+func (cn *conn) do(ctx context.Context, args []interface{}) (interface{}, error) {
+
+	replies, err := cn.doMany(ctx, [][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	return replyOrError(replies[0])
+}
+
+// doMany sends commands and reads their replies, as they are: error
+// replies are among them. The error result is for failures that leave
+// the connection broken.
+func (cn *conn) doMany(ctx context.Context, commands [][]interface{}) ([]interface{}, error) {
+
+	encoded := make([][][]byte, 0, len(commands))
+	for _, args := range commands {
+		command, err := encodeArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, command)
+	}
+
+	stop := cn.watch(ctx)
+	defer stop()
+
+	cn.sent = false
+
+	replies, err := cn.roundTrip(ctx, encoded)
+	if err != nil {
+		cn.broken = true
+		// report why the commands were cut short, rather than the
+		// deadline that was set to cut them
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	cn.checkedAt = time.Now()
+	return replies, nil
+}
+
+// roundTrip writes commands and reads their replies. Several commands
+// are written while the replies are read, or both sides could wait for
+// the other to read once the replies fill the buffers of the connection.
+func (cn *conn) roundTrip(ctx context.Context, commands [][][]byte) ([]interface{}, error) {
+
+	err := cn.netConn.SetWriteDeadline(cn.deadline(ctx, cn.options.WriteTimeout))
+	if err == nil {
+		err = cn.netConn.SetReadDeadline(cn.deadline(ctx, cn.options.ReadTimeout))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	written := make(chan error, 1)
+	write := func() {
+
+		for _, command := range commands {
+			err := cn.writer.WriteValue(command)
+			if err != nil {
+				// the replies that would be read are not coming
+				_ = cn.netConn.SetReadDeadline(aLongTimeAgo)
+				written <- err
+				return
+			}
+		}
+		written <- cn.writer.Flush()
+	}
+
+	if len(commands) == 1 {
+		write()
+		if err := <-written; err != nil {
+			return nil, err
+		}
+		written <- nil
+	} else {
+		go write()
+	}
+
+	replies := make([]interface{}, 0, len(commands))
+	var readErr error
+	for range commands {
+		reply, err := cn.reader.ReadValue()
+		if err != nil {
+			readErr = err
+			// nor are the commands that would be written read
+			_ = cn.netConn.SetWriteDeadline(aLongTimeAgo)
+			break
+		}
+		replies = append(replies, reply)
+	}
+
+	writeErr := <-written
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return replies, nil
+}
+
+// deadline is the earliest of the deadline of ctx and timeout from now,
+// the zero time if there is neither
+func (cn *conn) deadline(ctx context.Context, timeout time.Duration) time.Time {
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// watch interrupts the connection if ctx is cancelled before the
+// returned function is called, which waits for the watcher to be done
+// so that it can not interrupt the next command
+func (cn *conn) watch(ctx context.Context) func() {
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = cn.netConn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// ping checks that the server still answers on the connection
+func (cn *conn) ping(ctx context.Context) error {
+
+	reply, err := cn.do(ctx, []interface{}{"PING"})
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		cn.broken = true
+		return fmt.Errorf("retain: unexpected reply to PING: %v", reply)
+	}
+	return nil
+}
+
+// idle reports whether the connection can be used after sitting in the
+// pool: the server must not have closed it, nor sent anything since the
+// last reply was read
+func (cn *conn) idle() bool {
+
+	return cn.reader.Buffered() == 0 && alive(cn.tcpConn)
+}
+
+func (cn *conn) close() error {
+
+	return cn.netConn.Close()
+}
+
+// encodeArgs turns the arguments of a command into the bulk strings it
+// is sent as
+func encodeArgs(args []interface{}) ([][]byte, error) {
+
+	if len(args) == 0 {
+		return nil, errors.New("retain: no command given")
+	}
+
+	command := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			command = append(command, []byte(arg))
+		case []byte:
+			command = append(command, arg)
+		case int:
+			command = append(command, strconv.AppendInt(nil, int64(arg), 10))
+		case int64:
+			command = append(command, strconv.AppendInt(nil, arg, 10))
+		case float64:
+			command = append(command, strconv.AppendFloat(nil, arg, 'f', -1, 64))
+		default:
+			return nil, fmt.Errorf("retain: can not send an argument of type %T", arg)
+		}
+	}
+	return command, nil
+}
+
+// replyOrError turns error replies into an Error and nil replies
+// into ErrNil
+func replyOrError(reply interface{}) (interface{}, error) {
+
+	switch reply := reply.(type) {
+	case nil:
+		return nil, ErrNil
+	case error:
+		return nil, Error(reply.Error())
+	}
+	return reply, nil
+}
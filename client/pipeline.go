@@ -0,0 +1,83 @@
+package client
+
+import "context"
+
+// Pipeline queues commands and sends them at once on one connection,
+// saving a round trip per command. It is not safe for concurrent use.
+//
+//	pipeline := c.Pipeline()
+//	for _, key := range keys {
+//		pipeline.Do("SET", key, value)
+//	}
+//	results, err := pipeline.Exec(ctx)
+type Pipeline struct {
+	client   *Client
+	commands [][]interface{}
+}
+
+// Result is the reply to one command of a Pipeline. Err is an Error
+// for error replies and ErrNil for nil replies, as Do returns them.
+type Result struct {
+	Reply interface{}
+	Err   error
+}
+
+// Pipeline returns an empty Pipeline
+func (client *Client) Pipeline() *Pipeline {
+
+	return &Pipeline{client: client}
+}
+
+// Do queues a command made of args, as Client.Do takes them
+func (pipeline *Pipeline) Do(args ...interface{}) {
+
+	pipeline.commands = append(pipeline.commands, args)
+}
+
+// Len returns the number of queued commands
+func (pipeline *Pipeline) Len() int {
+
+	return len(pipeline.commands)
+}
+
+// Exec sends the queued commands and returns their results in order,
+// the Pipeline is empty afterwards. The error is for failures no result
+// can be told apart from, like a broken connection: none of the commands
+// or only some of them may have run. ReadTimeout and WriteTimeout bound
+// the whole of the replies and of the commands.
+func (pipeline *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+
+	commands := pipeline.commands
+	pipeline.commands = nil
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	client := pipeline.client
+	for attempt := 0; ; attempt++ {
+		cn, reused, err := client.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		replies, err := cn.doMany(ctx, commands)
+		broken, sent := cn.broken, cn.sent
+		client.pool.put(cn)
+
+		// as in Client.Do, only commands none of which was written
+		// are sent again
+		if broken && reused && !sent && attempt < client.options.MaxRetries && ctx.Err() == nil && isConnectionError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]Result, 0, len(replies))
+		for _, reply := range replies {
+			reply, err := replyOrError(reply)
+			results = append(results, Result{Reply: reply, Err: err})
+		}
+		return results, nil
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolStats describes the connections of a Client
+type PoolStats struct {
+	// Active is the number of open connections, idle or in use
+	Active int
+
+	// Idle is the number of connections waiting in the pool
+	Idle int
+}
+
+// pool keeps the connections of a Client. Connections that went back to
+// it are handed out again, most recently used first, after checking
+// that they are still alive if they sat idle for a while.
+type pool struct {
+	options *Options
+
+	// tokens holds one token per connection that may be in use at
+	// once, it is nil when there is no limit
+	tokens chan struct{}
+
+	mu     sync.Mutex
+	idle   []*conn
+	active int
+	closed bool
+}
+
+func newPool(options *Options) *pool {
+
+	p := &pool{options: options}
+	if options.MaxActive > 0 {
+		p.tokens = make(chan struct{}, options.MaxActive)
+	}
+	return p
+}
+
+// get returns a connection for one goroutine to use, it waits for one
+// to go back to the pool when MaxActive are in use. The boolean reports
+// whether the connection was used before.
+func (p *pool) get(ctx context.Context) (*conn, bool, error) {
+
+	if p.tokens != nil {
+		select {
+		case p.tokens <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+
+	for {
+		cn, err := p.popIdle()
+		if err != nil {
+			p.release()
+			return nil, false, err
+		}
+		if cn == nil {
+			break
+		}
+
+		if p.healthy(ctx, cn) {
+			return cn, true, nil
+		}
+		p.discard(cn)
+	}
+
+	cn, err := dial(ctx, p.options)
+	if err != nil {
+		p.release()
+		return nil, false, err
+	}
+
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+	return cn, false, nil
+}
+
+// popIdle takes the most recently used idle connection, if any
+func (p *pool) popIdle() (*conn, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if len(p.idle) == 0 {
+		return nil, nil
+	}
+
+	cn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return cn, nil
+}
+
+// healthy checks an idle connection before it is handed out: it must
+// not have been idle for longer than IdleTimeout nor closed by the
+// server, and it has to answer a PING if it has not talked to the
+// server for HealthCheckInterval
+func (p *pool) healthy(ctx context.Context, cn *conn) bool {
+
+	if p.options.IdleTimeout > 0 && time.Since(cn.usedAt) > p.options.IdleTimeout {
+		return false
+	}
+	if !cn.idle() {
+		return false
+	}
+	if p.options.HealthCheckInterval < 0 || time.Since(cn.checkedAt) < p.options.HealthCheckInterval {
+		return true
+	}
+	return cn.ping(ctx) == nil
+}
+
+// put gives back a connection get returned, broken ones are closed
+// along with those that do not fit among the MaxIdle idle ones
+func (p *pool) put(cn *conn) {
+
+	defer p.release()
+
+	p.mu.Lock()
+	if cn.broken || p.closed || len(p.idle) >= p.options.MaxIdle {
+		p.mu.Unlock()
+		p.discard(cn)
+		return
+	}
+
+	cn.usedAt = time.Now()
+	p.idle = append(p.idle, cn)
+	p.mu.Unlock()
+}
+
+// discard closes a connection that is not in the pool anymore
+func (p *pool) discard(cn *conn) {
+
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+
+	cn.close()
+}
+
+// release gives back the token get took
+func (p *pool) release() {
+
+	if p.tokens != nil {
+		<-p.tokens
+	}
+}
+
+func (p *pool) stats() PoolStats {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolStats{Active: p.active, Idle: len(p.idle)}
+}
+
+// close closes the idle connections, those in use are closed as they
+// go back to the pool
+func (p *pool) close() error {
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	var err error
+	for _, cn := range idle {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+
+		if closeErr := cn.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
 	"os/signal"
-	"reflect"
 	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/viveknathani/retain/protocol"
 )
@@ -34,9 +43,25 @@ func main() {
 
 	host := flag.String("host", "127.0.0.1", "host")
 	port := flag.Int("port", 8000, "port")
+	resp3 := flag.Bool("resp3", false, "negotiate RESP3 replies with HELLO")
+	useTLS := flag.Bool("tls", false, "connect over TLS, implied by the other -tls flags")
+	tlsCert := flag.String("tls-cert", "", "certificate to present to the server")
+	tlsKey := flag.String("tls-key", "", "private key of -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "certificate authorities to check the server against instead of those of the system")
+	pipe := flag.Bool("pipe", false, "send the commands read from stdin, one per line, without waiting for replies")
+	pipeTimeout := flag.Duration("pipe-timeout", 30*time.Second, "with -pipe, give up if no reply comes for this long once everything is sent; 0 to wait forever")
 	flag.Parse()
 
-	connection, err := net.Dial("tcp", *host+":"+fmt.Sprint(*port))
+	address := *host + ":" + fmt.Sprint(*port)
+	var connection net.Conn
+	var err error
+	if *useTLS || *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		config, configErr := tlsConfig(*host, *tlsCert, *tlsKey, *tlsCA)
+		handleError("client main: ", configErr)
+		connection, err = tls.Dial("tcp", address, config)
+	} else {
+		connection, err = net.Dial("tcp", address)
+	}
 	handleError("client main: ", err)
 
 	printColor(colorGreen)
@@ -44,10 +69,33 @@ func main() {
 	fmt.Printf("connected to %s\n", connection.RemoteAddr().String())
 	printColor(colorReset)
 
+	reader := protocol.NewReader(connection)
+	writer := protocol.NewWriter(connection)
+
+	if *resp3 {
+		err = writer.WriteValue([][]byte{[]byte("HELLO"), []byte("3")})
+		if err == nil {
+			err = writer.Flush()
+		}
+		handleError("client main: ", err)
+
+		reply, err := reader.ReadValue()
+		handleError("client main: ", err)
+		if replyErr, ok := reply.(error); ok {
+			handleError("client main: ", replyErr)
+		}
+	}
+
+	if *pipe {
+		pipeline(connection, reader, writer, os.Stdin, *pipeTimeout)
+		return
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	done := make(chan bool, 1)
 	go waitForSignal(connection, sig, done)
+	userReader := bufio.NewReader(os.Stdin)
 
 	go func() {
 
@@ -55,31 +103,26 @@ func main() {
 
 			printColor(colorCyan)
 			fmt.Print("> ")
-			userReader := bufio.NewReader(os.Stdin)
 			userInput, err := userReader.ReadBytes('\n')
 			handleError("client main: ", err)
 
 			arr := customSplit(userInput[0 : len(userInput)-1])
-			_, err = connection.Write(protocol.Encode(arr))
+			err = writer.WriteValue(arr)
+			if err == nil {
+				err = writer.Flush()
+			}
 			handleError("client main: ", err)
 
-			buffer := make([]byte, 65535)
-			bytesRead, err := connection.Read(buffer)
+			decoded, err := reader.ReadValue()
 			handleError("client main: ", err)
-			buffer = buffer[0:bytesRead]
-			decoded := protocol.Decode(buffer)
 
 			printColor(colorPink)
-			switch decoded.(type) {
-			case []interface{}:
-				list := reflect.ValueOf(decoded)
-				for i := 0; i < list.Len(); i++ {
-					fmt.Printf(">>(%d) %s\n", i+1, list.Index(i))
-				}
-			default:
-				fmt.Printf(">> %s\n", decoded)
-			}
+			printReply(decoded, ">>")
 			printColor(colorReset)
+
+			if len(arr) > 0 && isSubscribe(arr[0]) {
+				listen(reader)
+			}
 		}
 	}()
 
@@ -87,6 +130,211 @@ func main() {
 	fmt.Println("goodbye!")
 }
 
+// tlsConfig checks the server against the certificate authorities in
+// caFile, or those of the system, and presents the certificate in
+// certFile if there is one
+func tlsConfig(host string, certFile string, keyFile string, caFile string) (*tls.Config, error) {
+
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+// pipeline streams the commands of input to the server while the replies
+// are read, then sends a PING with a random marker: its reply, which
+// carries the marker even once the input subscribed, is the last one to
+// wait for. Error replies are printed as they come. Once all is sent, a
+// reply has to come within timeout, in case the PING can not be answered,
+// say inside a MULTI that never ends.
+func pipeline(connection net.Conn, reader *protocol.Reader, writer *protocol.Writer, input *os.File, timeout time.Duration) {
+
+	random := make([]byte, 20)
+	_, err := rand.Read(random)
+	handleError("client pipeline: ", err)
+	marker := []byte(hex.EncodeToString(random))
+
+	var sent int32
+	go func() {
+
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimRight(scanner.Bytes(), "\r")
+			if len(line) == 0 {
+				continue
+			}
+			err := writer.WriteValue(customSplit(line))
+			handleError("client pipeline: ", err)
+		}
+		handleError("client pipeline: ", scanner.Err())
+
+		err := writer.WriteValue([][]byte{[]byte("PING"), marker})
+		if err == nil {
+			err = writer.Flush()
+		}
+		handleError("client pipeline: ", err)
+
+		atomic.StoreInt32(&sent, 1)
+		if timeout > 0 {
+			_ = connection.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		printColor(colorGreen)
+		fmt.Println("all data transferred, waiting for the last reply...")
+		printColor(colorReset)
+	}()
+
+	replies, errors := 0, 0
+	for {
+		decoded, err := reader.ReadValue()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = fmt.Errorf("no reply for %s once all data was sent", timeout)
+		}
+		handleError("client pipeline: ", err)
+
+		if atomic.LoadInt32(&sent) == 1 && timeout > 0 {
+			_ = connection.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		if isMarker(decoded, marker) {
+			break
+		}
+
+		replies++
+		if replyErr, ok := decoded.(error); ok {
+			errors++
+			printColor(colorRed)
+			fmt.Println(replyErr)
+			printColor(colorReset)
+		}
+	}
+
+	printColor(colorGreen)
+	fmt.Printf("errors: %d, replies: %d\n", errors, replies)
+	printColor(colorReset)
+}
+
+// isMarker reports whether reply is that of PING marker, which is
+// ["pong", marker] for a subscribed client
+func isMarker(reply interface{}, marker []byte) bool {
+
+	switch reply := reply.(type) {
+	case string:
+		return reply == string(marker)
+	case []byte:
+		return bytes.Equal(reply, marker)
+	case []interface{}:
+		return len(reply) == 2 && isMarker(reply[1], marker)
+	case protocol.Push:
+		return len(reply) == 2 && isMarker(reply[1], marker)
+	}
+	return false
+}
+
+// isSubscribe reports whether command puts the connection in subscriber mode
+func isSubscribe(command []byte) bool {
+
+	name := strings.ToUpper(string(command))
+	return name == "SUBSCRIBE" || name == "PSUBSCRIBE"
+}
+
+// listen prints whatever the server pushes until the connection goes away,
+// a subscribed connection only receives from then on
+func listen(reader *protocol.Reader) {
+
+	printColor(colorGreen)
+	fmt.Println("listening for messages, press ctrl-c to quit")
+	printColor(colorReset)
+
+	for {
+		decoded, err := reader.ReadValue()
+		handleError("client listen: ", err)
+
+		printColor(colorPink)
+		printReply(decoded, ">>")
+		printColor(colorReset)
+	}
+}
+
+// printReply renders a decoded reply, every element of an aggregate
+// gets its position appended to the label
+func printReply(reply interface{}, label string) {
+
+	switch reply := reply.(type) {
+
+	case []interface{}:
+		printList(reply, label)
+
+	case protocol.Set:
+		printList(reply, label)
+
+	case protocol.Push:
+		printList(reply, label)
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(reply))
+		for key := range reply {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if len(keys) == 0 {
+			fmt.Printf("%s (empty)\n", label)
+		}
+		for _, key := range keys {
+			printReply(reply[key], fmt.Sprintf("%s(%s)", label, key))
+		}
+
+	case protocol.Attribute:
+		printReply(reply.Value, label)
+
+	case protocol.Verbatim:
+		fmt.Printf("%s %s\n", label, reply.Text)
+
+	case nil:
+		fmt.Printf("%s (nil)\n", label)
+
+	case error:
+		fmt.Printf("%s (error) %s\n", label, reply)
+
+	case bool, int, float64, *big.Int:
+		fmt.Printf("%s %v\n", label, reply)
+
+	default:
+		fmt.Printf("%s %s\n", label, reply)
+	}
+}
+
+func printList(list []interface{}, label string) {
+
+	if len(list) == 0 {
+		fmt.Printf("%s (empty)\n", label)
+	}
+
+	for i, item := range list {
+		printReply(item, fmt.Sprintf("%s(%d)", label, i+1))
+	}
+}
+
 func waitForSignal(connection net.Conn, sig <-chan os.Signal, done chan<- bool) {
 
 	captured := <-sig
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorNoAuth      = errors.New("NOAUTH Authentication required.")
+	errorWrongPass   = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errorNoKeyAccess = errors.New("NOPERM No permissions to access a key")
+	errorNoACLFile   = errors.New("ERR There is no ACL file configured, see -aclfile")
+)
+
+// defaultUser is the user every connection starts as. It may run
+// anything without a password until it is given one.
+const defaultUser = "default"
+
+// user is an ACL user: whether it may log in, with which passwords, and
+// the commands and keys it has access to
+type user struct {
+	name    string
+	enabled bool
+
+	// nopass lets the user in with any password, passwords holds the
+	// SHA-256 of each password that works otherwise
+	nopass    bool
+	passwords []string
+
+	// commands holds the names of the commands the user may run,
+	// patterns those of the keys they may touch
+	commands map[string]bool
+	patterns []string
+}
+
+// newUser returns a user that can do nothing, as ACL SETUSER creates them
+func newUser(name string) *user {
+
+	return &user{name: name, commands: make(map[string]bool)}
+}
+
+func (u *user) clone() *user {
+
+	clone := *u
+	clone.passwords = append([]string{}, u.passwords...)
+	clone.patterns = append([]string{}, u.patterns...)
+	clone.commands = make(map[string]bool, len(u.commands))
+	for name := range u.commands {
+		clone.commands[name] = true
+	}
+	return &clone
+}
+
+func hashPassword(password string) string {
+
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply changes u as one rule of ACL SETUSER says, using the syntax of
+// Redis: on, off, >password, <password, #hash, !hash, nopass,
+// resetpass, ~pattern, allkeys, resetkeys, +command, -command,
+// +@category, -@category, allcommands, nocommands and reset
+func (u *user) apply(rule string) error {
+
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+		return nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+		return nil
+	case "allkeys":
+		return u.apply("~*")
+	case "resetkeys":
+		u.patterns = nil
+		return nil
+	case "allcommands":
+		return u.apply("+@all")
+	case "nocommands":
+		return u.apply("-@all")
+	case "reset":
+		*u = *newUser(u.name)
+		return nil
+	}
+
+	if rule == "" {
+		return errors.New("empty rule")
+	}
+
+	switch argument := rule[1:]; rule[0] {
+	case '>':
+		return u.addPassword(hashPassword(argument))
+	case '<':
+		return u.removePassword(hashPassword(argument))
+	case '#':
+		if _, err := hex.DecodeString(argument); err != nil || len(argument) != 2*sha256.Size {
+			return errors.New("the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		return u.addPassword(strings.ToLower(argument))
+	case '!':
+		return u.removePassword(strings.ToLower(argument))
+	case '~':
+		for _, pattern := range u.patterns {
+			if pattern == argument {
+				return nil
+			}
+		}
+		u.patterns = append(u.patterns, argument)
+		return nil
+	case '+', '-':
+		return u.allow(strings.ToLower(argument), rule[0] == '+')
+	}
+	return errors.New("syntax error")
+}
+
+func (u *user) addPassword(hash string) error {
+
+	u.nopass = false
+	for _, password := range u.passwords {
+		if password == hash {
+			return nil
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+	return nil
+}
+
+func (u *user) removePassword(hash string) error {
+
+	for i, password := range u.passwords {
+		if password == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such password")
+}
+
+// allow lets u run, or stops it from running, a command or the commands
+// of a category when name starts with @
+func (u *user) allow(name string, allowed bool) error {
+
+	if !strings.HasPrefix(name, "@") {
+		if _, ok := commands[name]; !ok {
+			return errors.New("unknown command")
+		}
+		u.setCommand(name, allowed)
+		return nil
+	}
+
+	if _, ok := aclCategories()[name]; !ok {
+		return errors.New("unknown command category")
+	}
+	for _, cmd := range commands {
+		if name == "@all" || cmd.inCategory(name) {
+			u.setCommand(cmd.name, allowed)
+		}
+	}
+	return nil
+}
+
+func (u *user) setCommand(name string, allowed bool) {
+
+	if allowed {
+		u.commands[name] = true
+		return
+	}
+	delete(u.commands, name)
+}
+
+// authenticate reports whether password lets u in
+func (u *user) authenticate(password string) bool {
+
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+
+	hash := []byte(hashPassword(password))
+	for _, password := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns the reason u may not run cmd with the arguments of
+// respArray, nil if it may
+func (u *user) permits(cmd *command, respArray []interface{}) error {
+
+	if !u.commands[cmd.name] {
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, cmd.name)
+	}
+
+	for _, key := range cmd.keysIn(respArray) {
+		if !u.canAccess(string(key)) {
+			return errorNoKeyAccess
+		}
+	}
+	return nil
+}
+
+func (u *user) canAccess(key string) bool {
+
+	for _, pattern := range u.patterns {
+		if store.MatchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// rules describes u as the rules that would make a new user the same,
+// which is how ACL LIST and the ACL file show it
+func (u *user) rules() []string {
+
+	rules := []string{"off"}
+	if u.enabled {
+		rules[0] = "on"
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, password := range u.passwords {
+		rules = append(rules, "#"+password)
+	}
+	for _, pattern := range u.patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return append(rules, u.commandRules())
+}
+
+// commandRules describes the commands u may run, as +@all when they
+// are all of them and as the list of their names otherwise
+func (u *user) commandRules() string {
+
+	if len(u.commands) == len(commands) {
+		return "+@all"
+	}
+
+	names := make([]string, 0, len(u.commands))
+	for name := range u.commands {
+		names = append(names, "+"+name)
+	}
+	sort.Strings(names)
+	return strings.Join(append([]string{"-@all"}, names...), " ")
+}
+
+// accessList holds the ACL users by name, and the file they are saved to
+type accessList struct {
+	mu    sync.RWMutex
+	users map[string]*user
+	path  string
+}
+
+// acl is filled by main, once every command is registered
+var acl = &accessList{}
+
+// defaultUsers are the users of a server with no ACL file: the default
+// user alone, which may do anything
+func defaultUsers() map[string]*user {
+
+	u := newUser(defaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "allcommands"} {
+		_ = u.apply(rule)
+	}
+	return map[string]*user{defaultUser: u}
+}
+
+// lookup returns the user called name, if it exists and is enabled
+func (list *accessList) lookup(name string) *user {
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	u, ok := list.users[name]
+	if !ok || !u.enabled {
+		return nil
+	}
+	return u
+}
+
+// login returns the user a new connection is logged in as: the default
+// user unless it needs a password, nobody then
+func (list *accessList) login() string {
+
+	u := list.lookup(defaultUser)
+	if u == nil || !u.nopass {
+		return ""
+	}
+	return defaultUser
+}
+
+// authenticate logs client in as the user called name
+func (list *accessList) authenticate(client *session, name string, password string) error {
+
+	u := list.lookup(name)
+	if u == nil || !u.authenticate(password) {
+		return errorWrongPass
+	}
+	client.user = name
+	return nil
+}
+
+// authorize returns why client may not run cmd with the arguments of
+// respArray, nil if it may. Users are looked up by name every time so
+// that changes to them apply at once.
+func (list *accessList) authorize(client *session, cmd *command, respArray []interface{}) error {
+
+	if cmd.has("no_auth") {
+		return nil
+	}
+
+	u := list.lookup(client.user)
+	if u == nil {
+		return errorNoAuth
+	}
+	return u.permits(cmd, respArray)
+}
+
+// setUser creates or changes the user called name, with all of rules or
+// none of them if one is wrong
+func (list *accessList) setUser(name string, rules []string) error {
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	u := newUser(name)
+	if existing, ok := list.users[name]; ok {
+		u = existing.clone()
+	}
+
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	list.users[name] = u
+	return nil
+}
+
+// deleteUsers deletes the users called names, returning how many
+// existed. Their connections can not run commands anymore.
+func (list *accessList) deleteUsers(names []string) (int, error) {
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for _, name := range names {
+		if name == defaultUser {
+			return 0, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if _, ok := list.users[name]; ok {
+			delete(list.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// describe returns the lines of the ACL file, one per user by name
+func (list *accessList) describe() []string {
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	names := make([]string, 0, len(list.users))
+	for name := range list.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, "user "+name+" "+strings.Join(list.users[name].rules(), " "))
+	}
+	return lines
+}
+
+// load replaces the users with those of the ACL file, or keeps them all
+// if the file has a mistake. Without a file, or with one that does not
+// exist yet, there is the default user alone.
+func (list *accessList) load() error {
+
+	users, err := readACLFile(list.path)
+	if err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	list.users = users
+	list.mu.Unlock()
+	return nil
+}
+
+func readACLFile(path string) (map[string]*user, error) {
+
+	users := defaultUsers()
+	if path == "" {
+		return users, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the default user is only there if the file leaves it out
+	delete(users, defaultUser)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: lines must start with user <name>", path, line)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s'", path, line, fields[1])
+		}
+
+		u := newUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.apply(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: error in rule '%s': %s", path, line, rule, err)
+			}
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := users[defaultUser]; !ok {
+		users[defaultUser] = defaultUsers()[defaultUser]
+	}
+	return users, nil
+}
+
+// save writes the users to the ACL file, replacing it only once the new
+// one is complete
+func (list *accessList) save() error {
+
+	file, err := os.CreateTemp(filepath.Dir(list.path), filepath.Base(list.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, line := range list.describe() {
+		_, _ = writer.WriteString(line + "\n")
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), list.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// aclCategories returns every ACL category a command belongs to, along
+// with @all
+func aclCategories() map[string]struct{} {
+
+	categories := map[string]struct{}{"@all": {}}
+	for _, cmd := range commands {
+		for _, category := range cmd.categories() {
+			categories[category] = struct{}{}
+		}
+	}
+	return categories
+}
+
+// auth implements AUTH [username] password
+func auth(client *session, respArray []interface{}) interface{} {
+
+	if len(respArray) > 3 {
+		return errorSyntax
+	}
+
+	name, password := defaultUser, string(respArray[len(respArray)-1].([]byte))
+	if len(respArray) == 3 {
+		name = string(respArray[1].([]byte))
+	} else if u := acl.lookup(defaultUser); u != nil && u.nopass {
+		return errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	if err := acl.authenticate(client, name, password); err != nil {
+		return err
+	}
+	return "OK"
+}
+
+// aclCommand implements ACL SETUSER username [rule ...], ACL GETUSER
+// username, ACL DELUSER username [username ...], ACL LIST, ACL USERS,
+// ACL WHOAMI, ACL CAT [category], ACL LOAD and ACL SAVE
+func aclCommand(client *session, respArray []interface{}) interface{} {
+
+	args := make([]string, 0, len(respArray)-2)
+	for _, arg := range respArray[2:] {
+		args = append(args, string(arg.([]byte)))
+	}
+
+	subcommand := strings.ToUpper(string(respArray[1].([]byte)))
+	switch {
+
+	case subcommand == "SETUSER" && len(args) >= 1:
+		if err := acl.setUser(args[0], args[1:]); err != nil {
+			return err
+		}
+		return "OK"
+
+	case subcommand == "GETUSER" && len(args) == 1:
+		return getUser(args[0])
+
+	case subcommand == "DELUSER" && len(args) >= 1:
+		deleted, err := acl.deleteUsers(args)
+		if err != nil {
+			return err
+		}
+		return deleted
+
+	case subcommand == "LIST" && len(args) == 0:
+		lines := make([]interface{}, 0)
+		for _, line := range acl.describe() {
+			lines = append(lines, []byte(line))
+		}
+		return lines
+
+	case subcommand == "USERS" && len(args) == 0:
+		names := make([]interface{}, 0)
+		for _, line := range acl.describe() {
+			names = append(names, []byte(strings.Fields(line)[1]))
+		}
+		return names
+
+	case subcommand == "WHOAMI" && len(args) == 0:
+		return []byte(client.user)
+
+	case subcommand == "CAT" && len(args) <= 1:
+		return categoryList(args)
+
+	case subcommand == "LOAD" && len(args) == 0:
+		if acl.path == "" {
+			return errorNoACLFile
+		}
+		if err := acl.load(); err != nil {
+			return errors.New("ERR " + err.Error())
+		}
+		return "OK"
+
+	case subcommand == "SAVE" && len(args) == 0:
+		if acl.path == "" {
+			return errorNoACLFile
+		}
+		if err := acl.save(); err != nil {
+			return errors.New("ERR " + err.Error())
+		}
+		return "OK"
+	}
+
+	return errors.New("ERR unknown subcommand or wrong number of arguments for ACL " + subcommand)
+}
+
+// getUser describes the user called name for ACL GETUSER, nil if there
+// is no such user
+func getUser(name string) interface{} {
+
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+
+	u, ok := acl.users[name]
+	if !ok {
+		return nil
+	}
+
+	flags := []interface{}{[]byte("off")}
+	if u.enabled {
+		flags[0] = []byte("on")
+	}
+	if u.nopass {
+		flags = append(flags, []byte("nopass"))
+	}
+
+	passwords := make([]interface{}, 0, len(u.passwords))
+	for _, password := range u.passwords {
+		passwords = append(passwords, []byte(password))
+	}
+
+	patterns := make([]string, 0, len(u.patterns))
+	for _, pattern := range u.patterns {
+		patterns = append(patterns, "~"+pattern)
+	}
+
+	return map[string]interface{}{
+		"flags":     flags,
+		"passwords": passwords,
+		"commands":  []byte(u.commandRules()),
+		"keys":      []byte(strings.Join(patterns, " ")),
+	}
+}
+
+// categoryList implements ACL CAT: the categories without a name, the
+// commands of the category named otherwise
+func categoryList(args []string) interface{} {
+
+	names := make([]string, 0)
+	if len(args) == 0 {
+		for category := range aclCategories() {
+			names = append(names, strings.TrimPrefix(category, "@"))
+		}
+	} else {
+		category := "@" + strings.ToLower(args[0])
+		if _, ok := aclCategories()[category]; !ok {
+			return errors.New("ERR Unknown category '" + args[0] + "'")
+		}
+		for _, cmd := range commands {
+			if category == "@all" || cmd.inCategory(category) {
+				names = append(names, cmd.name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	list := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		list = append(list, []byte(name))
+	}
+	return list
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// resetACL puts back the users every other test runs with
+func resetACL() {
+
+	acl.path = ""
+	acl.users = defaultUsers()
+}
+
+// isError reports whether reply is an error reply starting with prefix
+func isError(reply interface{}, prefix string) bool {
+
+	err, ok := reply.(error)
+	return ok && strings.HasPrefix(err.Error(), prefix)
+}
+
+func TestAuth(t *testing.T) {
+
+	defer resetACL()
+	storage := newTestStorage(t)
+	admin := newAdminSession()
+
+	run(storage, admin, "ACL", "SETUSER", "default", "resetpass", ">secret")
+	if reply := run(storage, admin, "ACL", "SETUSER", "alice", "on", ">wonderland", "~*", "+@all"); reply != "OK" {
+		log.Fatalf("failed ACL SETUSER, got: %v", reply)
+	}
+
+	// the default user needs its password from now on
+	client := newTestSession()
+	if reply := run(storage, client, "GET", "key"); reply != errorNoAuth {
+		log.Fatalf("failed GET before AUTH, got: %v", reply)
+	}
+	if reply := run(storage, client, "AUTH", "wrong"); reply != errorWrongPass {
+		log.Fatalf("failed AUTH with a wrong password, got: %v", reply)
+	}
+	if reply := run(storage, client, "AUTH", "secret"); reply != "OK" {
+		log.Fatalf("failed AUTH, got: %v", reply)
+	}
+	if reply := run(storage, client, "AUTH", "alice", "wonderland"); reply != "OK" {
+		log.Fatalf("failed AUTH as alice, got: %v", reply)
+	}
+	if reply := run(storage, client, "ACL", "WHOAMI"); !reflect.DeepEqual(reply, []byte("alice")) {
+		log.Fatalf("failed ACL WHOAMI, got: %q", reply)
+	}
+
+	// a disabled user can not run anything more, even logged in
+	run(storage, admin, "ACL", "SETUSER", "alice", "off")
+	if reply := run(storage, client, "GET", "key"); reply != errorNoAuth {
+		log.Fatalf("failed GET as a disabled user, got: %v", reply)
+	}
+	if reply := run(storage, client, "AUTH", "alice", "wonderland"); reply != errorWrongPass {
+		log.Fatalf("failed AUTH as a disabled user, got: %v", reply)
+	}
+}
+
+func TestCommandPermissions(t *testing.T) {
+
+	defer resetACL()
+	storage := newTestStorage(t)
+	client := newTestSession()
+
+	run(storage, client, "ACL", "SETUSER", "app", "on", "nopass", "~*", "+@all", "-@dangerous")
+	if reply := run(storage, client, "AUTH", "app", "any"); reply != "OK" {
+		log.Fatalf("failed AUTH, got: %v", reply)
+	}
+
+	if reply := run(storage, client, "SET", "key", "value"); reply != "OK" {
+		log.Fatalf("failed SET, got: %v", reply)
+	}
+	for _, args := range [][]string{{"FLUSHALL"}, {"FLUSHDB"}, {"SWAPDB", "0", "1"}, {"KEYS", "*"}, {"ACL", "LIST"}} {
+		if reply := run(storage, client, args...); !isError(reply, "NOPERM") {
+			log.Fatalf("failed %s without @dangerous, got: %v", args[0], reply)
+		}
+	}
+	if storage.DBSize() != 1 {
+		log.Fatalf("failed FLUSHALL without @dangerous, the key is gone")
+	}
+
+	// like those of Redis, these wipe keys and belong with them
+	for _, name := range []string{"flushall", "flushdb", "swapdb"} {
+		if !commands[name].inCategory("@keyspace") || !commands[name].inCategory("@dangerous") {
+			log.Fatalf("failed categories of %s, got: %v", name, commands[name].categories())
+		}
+	}
+
+	// a command denied while queued aborts the transaction
+	run(storage, client, "MULTI")
+	run(storage, client, "SET", "key", "other")
+	if reply := run(storage, client, "FLUSHDB"); !isError(reply, "NOPERM") {
+		log.Fatalf("failed FLUSHDB in MULTI, got: %v", reply)
+	}
+	if reply := run(storage, client, "EXEC"); !isError(reply, "EXECABORT") {
+		log.Fatalf("failed EXEC after a denied command, got: %v", reply)
+	}
+
+	// and one denied after it was queued fails on its own
+	run(storage, client, "MULTI")
+	run(storage, client, "GET", "key")
+	run(storage, client, "DBSIZE")
+	run(storage, newAdminSession(), "ACL", "SETUSER", "app", "-get")
+	reply, ok := run(storage, client, "EXEC").([]interface{})
+	if !ok || len(reply) != 2 || !isError(reply[0], "NOPERM") || reply[1] != 1 {
+		log.Fatalf("failed EXEC after losing a permission, got: %v", reply)
+	}
+
+	// changes to a user are all or nothing
+	if reply := run(storage, newAdminSession(), "ACL", "SETUSER", "app", "+get", "+nosuchcommand"); !isError(reply, "ERR") {
+		log.Fatalf("failed ACL SETUSER with a wrong rule, got: %v", reply)
+	}
+	if reply := run(storage, client, "GET", "key"); !isError(reply, "NOPERM") {
+		log.Fatalf("failed ACL SETUSER, part of a wrong change was kept: %v", reply)
+	}
+}
+
+func TestKeyPatterns(t *testing.T) {
+
+	defer resetACL()
+	storage := newTestStorage(t)
+	client := newTestSession()
+
+	run(storage, client, "ACL", "SETUSER", "app", "on", "nopass", "~cache:*", "+@all")
+	run(storage, client, "AUTH", "app", "any")
+
+	if reply := run(storage, client, "SET", "cache:1", "value"); reply != "OK" {
+		log.Fatalf("failed SET on an allowed key, got: %v", reply)
+	}
+	if reply := run(storage, client, "GET", "session:1"); reply != errorNoKeyAccess {
+		log.Fatalf("failed GET on a denied key, got: %v", reply)
+	}
+
+	// every key of a command counts, wherever it is among the arguments
+	if reply := run(storage, client, "MSET", "cache:2", "value", "session:1", "value"); reply != errorNoKeyAccess {
+		log.Fatalf("failed MSET on an allowed and a denied key, got: %v", reply)
+	}
+	if run(storage, client, "EXISTS", "cache:2") != 0 {
+		log.Fatalf("failed MSET on a denied key, the allowed one was set")
+	}
+	if reply := run(storage, client, "LMOVE", "cache:list", "session:list", "LEFT", "RIGHT"); reply != errorNoKeyAccess {
+		log.Fatalf("failed LMOVE to a denied key, got: %v", reply)
+	}
+
+	// commands without keys are left alone
+	if reply := run(storage, client, "DBSIZE"); reply != 1 {
+		log.Fatalf("failed DBSIZE, got: %v", reply)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+
+	defer resetACL()
+	storage := newTestStorage(t)
+	client := newAdminSession()
+
+	if reply := run(storage, client, "ACL", "SAVE"); reply != errorNoACLFile {
+		log.Fatalf("failed ACL SAVE without a file, got: %v", reply)
+	}
+
+	acl.path = filepath.Join(t.TempDir(), "users.acl")
+	run(storage, client, "ACL", "SETUSER", "app", "on", ">secret", "~cache:*", "-@all", "+get", "+set")
+	if reply := run(storage, client, "ACL", "SAVE"); reply != "OK" {
+		log.Fatalf("failed ACL SAVE, got: %v", reply)
+	}
+	saved := acl.describe()
+
+	run(storage, client, "ACL", "DELUSER", "app")
+	if reply := run(storage, client, "ACL", "LOAD"); reply != "OK" {
+		log.Fatalf("failed ACL LOAD, got: %v", reply)
+	}
+	if !reflect.DeepEqual(acl.describe(), saved) {
+		log.Fatalf("failed ACL LOAD, expected: %q, got: %q", saved, acl.describe())
+	}
+
+	// a file with a mistake is refused as a whole
+	handleError("failed to write the ACL file", os.WriteFile(acl.path, []byte("user other on nopass\nuser broken +nosuchcommand\n"), 0600))
+	if reply := run(storage, client, "ACL", "LOAD"); !isError(reply, "ERR") {
+		log.Fatalf("failed ACL LOAD of a wrong file, got: %v", reply)
+	}
+	if !reflect.DeepEqual(acl.describe(), saved) {
+		log.Fatalf("failed ACL LOAD of a wrong file, the users changed to: %q", acl.describe())
+	}
+}
+
+// newAdminSession is a session logged in as the default user, whatever
+// password it has
+func newAdminSession() *session {
+
+	client := newTestSession()
+	client.user = defaultUser
+	return client
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorTimeout         = errors.New("ERR timeout is not a float or out of range")
+	errorNegativeTimeout = errors.New("ERR timeout is negative")
+)
+
+// lmove implements LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmove(storage store.Engine, respArray []interface{}) interface{} {
+
+	fromFront, toFront, err := directions(respArray[3], respArray[4])
+	if err != nil {
+		return err
+	}
+
+	value, err := storage.LMove(respArray[1].([]byte), respArray[2].([]byte), fromFront, toFront)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+// bpop implements BLPOP and BRPOP key [key ...] timeout. Unless wait
+// is set, as inside a transaction, it does not block.
+func bpop(storage store.Engine, client *session, respArray []interface{}, front bool, wait bool) interface{} {
+
+	timeout, err := blockingTimeout(respArray[len(respArray)-1], wait)
+	if err != nil {
+		return err
+	}
+
+	var key store.RetainKey
+	var value []byte
+	client.whileBlocked(wait, func(cancel <-chan struct{}) {
+		key, value, err = storage.BPop(keys(respArray[1:len(respArray)-1]), front, timeout, cancel)
+	})
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return protocol.NullArray{}
+	}
+	return [][]byte{key, value}
+}
+
+// blmove implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmove(storage store.Engine, client *session, respArray []interface{}, wait bool) interface{} {
+
+	fromFront, toFront, err := directions(respArray[3], respArray[4])
+	if err != nil {
+		return err
+	}
+
+	timeout, err := blockingTimeout(respArray[5], wait)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	client.whileBlocked(wait, func(cancel <-chan struct{}) {
+		value, err = storage.BLMove(respArray[1].([]byte), respArray[2].([]byte), fromFront, toFront, timeout, cancel)
+	})
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+// whileBlocked runs pop, which may block when wait is set. The channel
+// handed to pop is closed if the client hangs up in the meantime, so
+// that nothing gets popped for a client that is gone.
+func (client *session) whileBlocked(wait bool, pop func(cancel <-chan struct{})) {
+
+	if !wait {
+		pop(nil)
+		return
+	}
+
+	// the replies to the commands pipelined before this one
+	// are not held up for as long as it blocks
+	if client.outbox == nil {
+		_ = client.writer.Flush()
+	}
+
+	hangup := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+
+		defer close(finished)
+		err := client.reader.Wait()
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(hangup)
+		}
+	}()
+
+	pop(hangup)
+
+	// cut the wait for input short, the connection is usable
+	// again once the deadline is lifted
+	_ = client.connection.SetReadDeadline(time.Now())
+	<-finished
+	_ = client.connection.SetReadDeadline(time.Time{})
+}
+
+// blockingTimeout parses the timeout of a blocking command, given in
+// seconds with 0 meaning forever. Unless wait is set it is ignored.
+func blockingTimeout(value interface{}, wait bool) (time.Duration, error) {
+
+	seconds, err := strconv.ParseFloat(string(value.([]byte)), 64)
+	if err != nil || math.IsNaN(seconds) || seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, errorTimeout
+	}
+	if seconds < 0 {
+		return 0, errorNegativeTimeout
+	}
+
+	if !wait {
+		return store.NoWait, nil
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// directions parses the LEFT|RIGHT pair of LMOVE and BLMOVE
+func directions(from interface{}, to interface{}) (bool, bool, error) {
+
+	fromFront, ok := direction(from)
+	if !ok {
+		return false, false, errorSyntax
+	}
+
+	toFront, ok := direction(to)
+	if !ok {
+		return false, false, errorSyntax
+	}
+	return fromFront, toFront, nil
+}
+
+func direction(value interface{}) (bool, bool) {
+
+	switch strings.ToUpper(string(value.([]byte))) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+// handler runs a command for client, storage being the database the
+// client has selected
+type handler func(storage store.Engine, client *session, respArray []interface{}) interface{}
+
+// command describes a command the server understands, as COMMAND INFO
+// and COMMAND DOCS report it
+type command struct {
+	name string
+
+	// arity is the number of arguments the command takes, its name
+	// included, or minus the least number if it takes more
+	arity int
+
+	// flags are those of Redis: write, readonly, denyoom for the
+	// commands that may need more memory, admin, pubsub, blocking,
+	// fast for those that take constant or logarithmic time and
+	// no_auth for those that run before the client authenticates
+	flags []string
+
+	// extraCategories are the ACL categories the command is in on top
+	// of those its flags and group put it in, see categories
+	extraCategories []string
+
+	// firstKey, lastKey and step locate the keys among the arguments,
+	// a negative lastKey counting from the end. They are all 0 for
+	// commands without keys.
+	firstKey int
+	lastKey  int
+	step     int
+
+	group   string
+	summary string
+	run     handler
+}
+
+// commands holds every command by its lowercase name
+var commands = make(map[string]*command)
+
+// register adds a command to commands, flags being separated by spaces.
+// Those starting with @ are extra ACL categories rather than flags.
+func register(name string, arity int, flags string, firstKey int, lastKey int, step int, group string, summary string, run handler) {
+
+	cmd := &command{
+		name:     name,
+		arity:    arity,
+		flags:    make([]string, 0),
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		step:     step,
+		group:    group,
+		summary:  summary,
+		run:      run,
+	}
+	for _, flag := range strings.Fields(flags) {
+		if strings.HasPrefix(flag, "@") {
+			cmd.extraCategories = append(cmd.extraCategories, flag)
+		} else {
+			cmd.flags = append(cmd.flags, flag)
+		}
+	}
+	commands[name] = cmd
+}
+
+// onStorage adapts the handlers that only need the database
+func onStorage(run func(storage store.Engine, respArray []interface{}) interface{}) handler {
+
+	return func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return run(storage, respArray)
+	}
+}
+
+// onArguments adapts the handlers that need nothing but the arguments
+func onArguments(run func(respArray []interface{}) interface{}) handler {
+
+	return func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return run(respArray)
+	}
+}
+
+// onSession adapts the handlers that only need the client
+func onSession(run func(client *session, respArray []interface{}) interface{}) handler {
+
+	return func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return run(client, respArray)
+	}
+}
+
+// the table is filled in init, handlers like EXEC and COMMAND read it
+func init() {
+
+	register("ping", -1, "fast", 0, 0, 0, "connection", "Returns the server's liveliness response.", onArguments(ping))
+	register("echo", 2, "fast", 0, 0, 0, "connection", "Returns the given string.", onArguments(echo))
+	register("hello", -1, "no_auth fast", 0, 0, 0, "connection", "Handshakes with the server.", onSession(hello))
+	register("auth", -2, "no_auth fast", 0, 0, 0, "connection", "Authenticates the connection.", onSession(auth))
+	register("select", 2, "fast", 0, 0, 0, "connection", "Changes the selected database.", selectDatabase)
+
+	register("get", 2, "readonly fast", 1, 1, 1, "string", "Returns the string value of a key.", onStorage(get))
+	register("set", -3, "write denyoom", 1, 1, 1, "string", "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", onStorage(set))
+	register("mget", -2, "readonly fast", 1, -1, 1, "string", "Atomically returns the string values of one or more keys.", onStorage(mget))
+	register("mset", -3, "write denyoom", 1, -1, 2, "string", "Atomically creates or modifies the string values of one or more keys.", onStorage(mset))
+	register("incr", 2, "write denyoom fast", 1, 1, 1, "string", "Increments the integer value of a key by one.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return incr(storage, respArray, 1, false)
+	}))
+	register("decr", 2, "write denyoom fast", 1, 1, 1, "string", "Decrements the integer value of a key by one.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return incr(storage, respArray, -1, false)
+	}))
+	register("incrby", 3, "write denyoom fast", 1, 1, 1, "string", "Increments the integer value of a key by a number.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return incr(storage, respArray, 1, true)
+	}))
+	register("decrby", 3, "write denyoom fast", 1, 1, 1, "string", "Decrements a number from the integer value of a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return incr(storage, respArray, -1, true)
+	}))
+	register("incrbyfloat", 3, "write denyoom fast", 1, 1, 1, "string", "Increments the floating point value of a key by a number.", onStorage(incrbyfloat))
+	register("append", 3, "write denyoom fast", 1, 1, 1, "string", "Appends a string to the value of a key. Creates the key if it doesn't exist.", onStorage(appendValue))
+	register("strlen", 2, "readonly fast", 1, 1, 1, "string", "Returns the length of a string value.", onStorage(strlen))
+	register("getrange", 4, "readonly", 1, 1, 1, "string", "Returns a substring of the string stored at a key.", onStorage(getrange))
+	register("setrange", 4, "write denyoom", 1, 1, 1, "string", "Overwrites a part of a string value with another by an offset.", onStorage(setrange))
+	register("getset", 3, "write denyoom fast", 1, 1, 1, "string", "Returns the previous string value of a key after setting it to a new value.", onStorage(getset))
+	register("getdel", 2, "write fast", 1, 1, 1, "string", "Returns the string value of a key after deleting the key.", onStorage(getdel))
+	register("getex", -2, "write fast", 1, 1, 1, "string", "Returns the string value of a key after setting its expiration time.", onStorage(getex))
+
+	register("del", 2, "write", 1, 1, 1, "generic", "Deletes a key.", onStorage(del))
+	register("exists", -2, "readonly fast", 1, -1, 1, "generic", "Determines whether one or more keys exist.", onStorage(exists))
+	register("type", 2, "readonly fast", 1, 1, 1, "generic", "Determines the type of value stored at a key.", onStorage(typeCommand))
+	register("keys", 2, "readonly @dangerous", 0, 0, 0, "generic", "Returns all key names that match a pattern.", onStorage(keysCommand))
+	register("scan", -2, "readonly", 0, 0, 0, "generic", "Iterates over the key names in the database.", onStorage(scan))
+	register("randomkey", 1, "readonly", 0, 0, 0, "generic", "Returns a random key name from the database.", onStorage(randomkey))
+	register("move", 3, "write fast", 1, 1, 1, "generic", "Moves a key to another database.", onStorage(move))
+	register("expire", 3, "write fast", 1, 1, 1, "generic", "Sets the expiration time of a key in seconds.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return expire(storage, respArray, true, false)
+	}))
+	register("pexpire", 3, "write fast", 1, 1, 1, "generic", "Sets the expiration time of a key in milliseconds.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return expire(storage, respArray, false, false)
+	}))
+	register("expireat", 3, "write fast", 1, 1, 1, "generic", "Sets the expiration time of a key to a Unix timestamp.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return expire(storage, respArray, true, true)
+	}))
+	register("pexpireat", 3, "write fast", 1, 1, 1, "generic", "Sets the expiration time of a key to a Unix milliseconds timestamp.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return expire(storage, respArray, false, true)
+	}))
+	register("ttl", 2, "readonly fast", 1, 1, 1, "generic", "Returns the expiration time in seconds of a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return ttl(storage, respArray, time.Second)
+	}))
+	register("pttl", 2, "readonly fast", 1, 1, 1, "generic", "Returns the expiration time in milliseconds of a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return ttl(storage, respArray, time.Millisecond)
+	}))
+	register("persist", 2, "write fast", 1, 1, 1, "generic", "Removes the expiration time of a key.", onStorage(persist))
+
+	register("lpush", -3, "write denyoom fast", 1, 1, 1, "list", "Prepends one or more elements to a list. Creates the key if it doesn't exist.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return push(storage, respArray, true)
+	}))
+	register("rpush", -3, "write denyoom fast", 1, 1, 1, "list", "Appends one or more elements to a list. Creates the key if it doesn't exist.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return push(storage, respArray, false)
+	}))
+	register("lpop", -2, "write fast", 1, 1, 1, "list", "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return pop(storage, respArray, true)
+	}))
+	register("rpop", -2, "write fast", 1, 1, 1, "list", "Returns and removes the last elements of a list. Deletes the list if the last element was popped.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return pop(storage, respArray, false)
+	}))
+	register("lrange", 4, "readonly", 1, 1, 1, "list", "Returns a range of elements from a list.", onStorage(lrange))
+	register("lindex", 3, "readonly", 1, 1, 1, "list", "Returns an element from a list by its index.", onStorage(lindex))
+	register("llen", 2, "readonly fast", 1, 1, 1, "list", "Returns the length of a list.", onStorage(llen))
+	register("lrem", 4, "write", 1, 1, 1, "list", "Removes elements from a list. Deletes the list if the last element was removed.", onStorage(lrem))
+	register("ltrim", 4, "write", 1, 1, 1, "list", "Removes elements from both ends a list. Deletes the list if all elements were trimmed.", onStorage(ltrim))
+	register("lset", 4, "write denyoom", 1, 1, 1, "list", "Sets the value of an element in a list by its index.", onStorage(lset))
+	register("linsert", 5, "write denyoom", 1, 1, 1, "list", "Inserts an element before or after another element in a list.", onStorage(linsert))
+	register("lmove", 5, "write denyoom", 1, 2, 1, "list", "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.", onStorage(lmove))
+	register("blpop", -3, "write blocking", 1, -2, 1, "list", "Removes and returns the first element in a list. Blocks until an element is available otherwise.", func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return bpop(storage, client, respArray, true, !client.executing)
+	})
+	register("brpop", -3, "write blocking", 1, -2, 1, "list", "Removes and returns the last element in a list. Blocks until an element is available otherwise.", func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return bpop(storage, client, respArray, false, !client.executing)
+	})
+	register("blmove", 6, "write denyoom blocking", 1, 2, 1, "list", "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise.", func(storage store.Engine, client *session, respArray []interface{}) interface{} {
+		return blmove(storage, client, respArray, !client.executing)
+	})
+
+	register("hset", -4, "write denyoom fast", 1, 1, 1, "hash", "Creates or modifies the value of a field in a hash.", onStorage(hset))
+	register("hget", 3, "readonly fast", 1, 1, 1, "hash", "Returns the value of a field in a hash.", onStorage(hget))
+	register("hmget", -3, "readonly fast", 1, 1, 1, "hash", "Returns the values of all fields in a hash.", onStorage(hmget))
+	register("hdel", -3, "write fast", 1, 1, 1, "hash", "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.", onStorage(hdel))
+	register("hgetall", 2, "readonly", 1, 1, 1, "hash", "Returns all fields and values in a hash.", onStorage(hgetall))
+	register("hkeys", 2, "readonly", 1, 1, 1, "hash", "Returns all fields in a hash.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return hkeys(storage, respArray, false)
+	}))
+	register("hvals", 2, "readonly", 1, 1, 1, "hash", "Returns all values in a hash.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return hkeys(storage, respArray, true)
+	}))
+	register("hexists", 3, "readonly fast", 1, 1, 1, "hash", "Determines whether a field exists in a hash.", onStorage(hexists))
+	register("hlen", 2, "readonly fast", 1, 1, 1, "hash", "Returns the number of fields in a hash.", onStorage(hlen))
+	register("hincrby", 4, "write denyoom fast", 1, 1, 1, "hash", "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist.", onStorage(hincrby))
+	register("hincrbyfloat", 4, "write denyoom fast", 1, 1, 1, "hash", "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.", onStorage(hincrbyfloat))
+	register("hscan", -3, "readonly", 1, 1, 1, "hash", "Iterates over fields and values of a hash.", onStorage(hscan))
+
+	register("sadd", -3, "write denyoom fast", 1, 1, 1, "set", "Adds one or more members to a set. Creates the key if it doesn't exist.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return sadd(storage, respArray, false)
+	}))
+	register("srem", -3, "write fast", 1, 1, 1, "set", "Removes one or more members from a set. Deletes the set if the last member was removed.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return sadd(storage, respArray, true)
+	}))
+	register("smembers", 2, "readonly", 1, 1, 1, "set", "Returns all members of a set.", onStorage(smembers))
+	register("sismember", 3, "readonly fast", 1, 1, 1, "set", "Determines whether a member belongs to a set.", onStorage(sismember))
+	register("scard", 2, "readonly fast", 1, 1, 1, "set", "Returns the number of members in a set.", onStorage(scard))
+	register("sinter", -2, "readonly", 1, -1, 1, "set", "Returns the intersect of multiple sets.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebra(respArray, storage.SInter)
+	}))
+	register("sunion", -2, "readonly", 1, -1, 1, "set", "Returns the union of multiple sets.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebra(respArray, storage.SUnion)
+	}))
+	register("sdiff", -2, "readonly", 1, -1, 1, "set", "Returns the difference of multiple sets.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebra(respArray, storage.SDiff)
+	}))
+	register("sinterstore", -3, "write denyoom", 1, -1, 1, "set", "Stores the intersect of multiple sets in a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebraStore(respArray, storage.SInterStore)
+	}))
+	register("sunionstore", -3, "write denyoom", 1, -1, 1, "set", "Stores the union of multiple sets in a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebraStore(respArray, storage.SUnionStore)
+	}))
+	register("sdiffstore", -3, "write denyoom", 1, -1, 1, "set", "Stores the difference of multiple sets in a key.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return algebraStore(respArray, storage.SDiffStore)
+	}))
+	register("srandmember", -2, "readonly", 1, 1, 1, "set", "Get one or multiple random members from a set", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return srandmember(storage, respArray, false)
+	}))
+	register("spop", -2, "write fast", 1, 1, 1, "set", "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return srandmember(storage, respArray, true)
+	}))
+
+	register("zadd", -4, "write denyoom fast", 1, 1, 1, "sorted-set", "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.", onStorage(zadd))
+	register("zincrby", 4, "write denyoom fast", 1, 1, 1, "sorted-set", "Increments the score of a member in a sorted set.", onStorage(zincrby))
+	register("zrem", -3, "write fast", 1, 1, 1, "sorted-set", "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.", onStorage(zrem))
+	register("zscore", 3, "readonly fast", 1, 1, 1, "sorted-set", "Returns the score of a member in a sorted set.", onStorage(zscore))
+	register("zcard", 2, "readonly fast", 1, 1, 1, "sorted-set", "Returns the number of members in a sorted set.", onStorage(zcard))
+	register("zrank", 3, "readonly fast", 1, 1, 1, "sorted-set", "Returns the index of a member in a sorted set ordered by ascending scores.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrank(storage, respArray, false)
+	}))
+	register("zrevrank", 3, "readonly fast", 1, 1, 1, "sorted-set", "Returns the index of a member in a sorted set ordered by descending scores.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrank(storage, respArray, true)
+	}))
+	register("zcount", 4, "readonly fast", 1, 1, 1, "sorted-set", "Returns the count of members in a sorted set that have scores within a range.", onStorage(zcount))
+	register("zrange", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a range of indexes.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byRank, false)
+	}))
+	register("zrevrange", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a range of indexes in reverse order.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byRank, true)
+	}))
+	register("zrangebyscore", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a range of scores.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byScore, false)
+	}))
+	register("zrevrangebyscore", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a range of scores in reverse order.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byScore, true)
+	}))
+	register("zrangebylex", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a lexicographical range.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byLex, false)
+	}))
+	register("zrevrangebylex", -4, "readonly", 1, 1, 1, "sorted-set", "Returns members in a sorted set within a lexicographical range in reverse order.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zrange(storage, respArray, byLex, true)
+	}))
+	register("zpopmin", -2, "write fast", 1, 1, 1, "sorted-set", "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zpop(storage, respArray, false)
+	}))
+	register("zpopmax", -2, "write fast", 1, 1, 1, "sorted-set", "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return zpop(storage, respArray, true)
+	}))
+
+	register("multi", 1, "fast", 0, 0, 0, "transactions", "Starts a transaction.", onSession(multi))
+	register("exec", 1, "", 0, 0, 0, "transactions", "Executes all commands in a transaction.", exec)
+	register("discard", 1, "fast", 0, 0, 0, "transactions", "Discards a transaction.", discard)
+	register("watch", -2, "fast", 1, -1, 1, "transactions", "Monitors changes to keys to determine the execution of a transaction.", watch)
+	register("unwatch", 1, "fast", 0, 0, 0, "transactions", "Forgets about watched keys of a transaction.", onSession(unwatch))
+
+	register("subscribe", -2, "pubsub", 0, 0, 0, "pubsub", "Listens for messages published to channels.", onSession(func(client *session, respArray []interface{}) interface{} {
+		return subscribe(client, respArray, false)
+	}))
+	register("psubscribe", -2, "pubsub", 0, 0, 0, "pubsub", "Listens for messages published to channels that match one or more patterns.", onSession(func(client *session, respArray []interface{}) interface{} {
+		return subscribe(client, respArray, true)
+	}))
+	register("unsubscribe", -1, "pubsub", 0, 0, 0, "pubsub", "Stops listening to messages posted to channels.", onSession(func(client *session, respArray []interface{}) interface{} {
+		return unsubscribe(client, respArray, false)
+	}))
+	register("punsubscribe", -1, "pubsub", 0, 0, 0, "pubsub", "Stops listening to messages published to channels that match one or more patterns.", onSession(func(client *session, respArray []interface{}) interface{} {
+		return unsubscribe(client, respArray, true)
+	}))
+	register("publish", 3, "pubsub fast", 0, 0, 0, "pubsub", "Posts a message to a channel.", onArguments(publish))
+	register("pubsub", -2, "pubsub", 0, 0, 0, "pubsub", "Returns the active channels, their subscribers or the number of pattern subscriptions.", onArguments(pubsubCommand))
+
+	register("dbsize", 1, "readonly fast", 0, 0, 0, "server", "Returns the number of keys in the database.", onStorage(dbsize))
+	register("swapdb", 3, "write fast @keyspace @dangerous", 0, 0, 0, "server", "Swaps two databases.", onStorage(swapdb))
+	register("flushdb", -1, "write @keyspace @dangerous", 0, 0, 0, "server", "Removes all keys from the current database.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return flush(storage, respArray, false)
+	}))
+	register("flushall", -1, "write @keyspace @dangerous", 0, 0, 0, "server", "Removes all keys from all databases.", onStorage(func(storage store.Engine, respArray []interface{}) interface{} {
+		return flush(storage, respArray, true)
+	}))
+	register("info", -1, "", 0, 0, 0, "server", "Returns information and statistics about the server.", onStorage(info))
+	register("memory", -2, "readonly", 2, 2, 1, "server", "Estimates the memory usage of a key.", onStorage(memoryCommand))
+	register("save", 1, "admin", 0, 0, 0, "server", "Synchronously saves the database(s) to disk.", onStorage(save))
+	register("bgsave", 1, "admin", 0, 0, 0, "server", "Asynchronously saves the database(s) to disk.", onStorage(bgsave))
+	register("bgrewriteaof", 1, "admin", 0, 0, 0, "server", "Asynchronously rewrites the append-only file to disk.", onStorage(bgrewriteaof))
+	register("lastsave", 1, "fast", 0, 0, 0, "server", "Returns the Unix timestamp of the last successful save to disk.", onStorage(lastsave))
+	register("acl", -2, "admin", 0, 0, 0, "server", "Manages the users and their permissions, see ACL SETUSER.", onSession(aclCommand))
+	register("command", -1, "", 0, 0, 0, "server", "Returns detailed information about all commands.", onArguments(commandCommand))
+}
+
+// lookup finds the command respArray calls and checks that it is called
+// with a number of arguments it takes
+func lookup(respArray []interface{}) (*command, error) {
+
+	cmd, ok := commands[strings.ToLower(string(respArray[0].([]byte)))]
+	if !ok {
+		return nil, unknownCommand(respArray)
+	}
+
+	if (cmd.arity > 0 && len(respArray) != cmd.arity) || len(respArray) < -cmd.arity {
+		return nil, wrongArity(respArray)
+	}
+	return cmd, nil
+}
+
+// unknownCommand is the error for a command nobody registered, quoting
+// the first few arguments like Redis
+func unknownCommand(respArray []interface{}) error {
+
+	var args strings.Builder
+	for _, arg := range respArray[1:] {
+		if args.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&args, "'%s' ", arg)
+	}
+
+	// the name is cut short too, it could be anything
+	name := string(respArray[0].([]byte))
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", name, args.String())
+}
+
+// wrongArity is the error for a command called with a number of
+// arguments it does not take
+func wrongArity(respArray []interface{}) error {
+
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(respArray[0].([]byte))))
+}
+
+// has reports whether cmd carries flag
+func (cmd *command) has(flag string) bool {
+
+	for _, f := range cmd.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// keysIn returns the keys among the arguments of cmd in respArray
+func (cmd *command) keysIn(respArray []interface{}) [][]byte {
+
+	if cmd.firstKey == 0 {
+		return nil
+	}
+
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(respArray)
+	}
+
+	keys := make([][]byte, 0)
+	for i := cmd.firstKey; i <= last && i < len(respArray); i += cmd.step {
+		keys = append(keys, respArray[i].([]byte))
+	}
+	return keys
+}
+
+// categoryOfGroup maps the groups of commands to the ACL categories of
+// Redis, which also groups commands by their flags
+var categoryOfGroup = map[string]string{
+	"string":       "@string",
+	"generic":      "@keyspace",
+	"list":         "@list",
+	"hash":         "@hash",
+	"set":          "@set",
+	"sorted-set":   "@sortedset",
+	"connection":   "@connection",
+	"transactions": "@transaction",
+	"pubsub":       "@pubsub",
+}
+
+// categories returns the ACL categories cmd belongs to
+func (cmd *command) categories() []string {
+
+	categories := make([]string, 0)
+	if cmd.has("write") {
+		categories = append(categories, "@write")
+	}
+	if cmd.has("readonly") {
+		categories = append(categories, "@read")
+	}
+	if category, ok := categoryOfGroup[cmd.group]; ok {
+		categories = append(categories, category)
+	}
+	if cmd.has("admin") {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if cmd.has("blocking") {
+		categories = append(categories, "@blocking")
+	}
+	categories = append(categories, cmd.extraCategories...)
+	if cmd.has("fast") {
+		return append(categories, "@fast")
+	}
+	return append(categories, "@slow")
+}
+
+// inCategory reports whether cmd belongs to the ACL category
+func (cmd *command) inCategory(category string) bool {
+
+	for _, c := range cmd.categories() {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// info describes cmd as an element of the reply to COMMAND INFO: its
+// name, arity, flags, key positions, ACL categories and then the tips,
+// key specifications and subcommands of Redis 7, which are empty
+func (cmd *command) info() []interface{} {
+
+	flags := make(protocol.Set, 0, len(cmd.flags))
+	for _, flag := range cmd.flags {
+		flags = append(flags, flag)
+	}
+
+	categories := make(protocol.Set, 0)
+	for _, category := range cmd.categories() {
+		categories = append(categories, category)
+	}
+
+	return []interface{}{
+		[]byte(cmd.name), cmd.arity, flags, cmd.firstKey, cmd.lastKey, cmd.step,
+		categories, []interface{}{}, []interface{}{}, []interface{}{},
+	}
+}
+
+// docs describes cmd as a value of the reply to COMMAND DOCS
+func (cmd *command) docs() map[string]interface{} {
+
+	return map[string]interface{}{
+		"summary": []byte(cmd.summary),
+		"group":   []byte(cmd.group),
+	}
+}
+
+// commandCommand implements COMMAND, COMMAND COUNT, COMMAND INFO
+// [command-name ...] and COMMAND DOCS [command-name ...]. Without names
+// INFO and DOCS describe every command.
+func commandCommand(respArray []interface{}) interface{} {
+
+	if len(respArray) == 1 {
+		return commandCommand([]interface{}{respArray[0], []byte("INFO")})
+	}
+
+	names := make([]string, 0)
+	for _, name := range respArray[2:] {
+		names = append(names, strings.ToLower(string(name.([]byte))))
+	}
+	if len(names) == 0 {
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	subcommand := strings.ToUpper(string(respArray[1].([]byte)))
+	switch {
+
+	case subcommand == "COUNT" && len(respArray) == 2:
+		return len(commands)
+
+	case subcommand == "INFO":
+		infos := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			cmd, ok := commands[name]
+			if !ok {
+				infos = append(infos, nil)
+				continue
+			}
+			infos = append(infos, cmd.info())
+		}
+		return infos
+
+	case subcommand == "DOCS":
+		docs := make(map[string]interface{})
+		for _, name := range names {
+			if cmd, ok := commands[name]; ok {
+				docs[name] = cmd.docs()
+			}
+		}
+		return docs
+	}
+
+	return errors.New("ERR unknown subcommand or wrong number of arguments for COMMAND " + subcommand)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorSyntax      = errors.New("ERR syntax error")
+	errorNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errorInvalidTime = errors.New("ERR invalid expire time")
+)
+
+// largest number of milliseconds we accept for a deadline, anything
+// beyond would overflow time.Time arithmetic
+const maxMillis = int64(1) << 53
+
+// set implements SET key value [NX|XX] [GET] [EX s|PX ms|EXAT ts|PXAT ts|KEEPTTL]
+func set(storage store.Engine, respArray []interface{}) interface{} {
+
+	key := respArray[1].([]byte)
+	value := respArray[2].([]byte)
+
+	options := store.SetOptions{}
+	returnPrevious := false
+	hasExpiry := false
+
+	for i := 3; i < len(respArray); i++ {
+		option := strings.ToUpper(string(respArray[i].([]byte)))
+
+		switch option {
+
+		case "NX":
+			if options.OnlyIfExists {
+				return errorSyntax
+			}
+			options.OnlyIfMissing = true
+
+		case "XX":
+			if options.OnlyIfMissing {
+				return errorSyntax
+			}
+			options.OnlyIfExists = true
+
+		case "GET":
+			returnPrevious = true
+			options.Get = true
+
+		case "KEEPTTL":
+			if hasExpiry {
+				return errorSyntax
+			}
+			options.KeepTTL = true
+
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpiry || options.KeepTTL || i+1 == len(respArray) {
+				return errorSyntax
+			}
+			i++
+
+			at, err := parseDeadline(respArray[i].([]byte), option == "EX" || option == "EXAT", option == "EXAT" || option == "PXAT")
+			if err != nil {
+				return err
+			}
+			options.ExpireAt = at
+			hasExpiry = true
+
+		default:
+			return errorSyntax
+		}
+	}
+
+	previous, stored, err := storage.SetWithOptions(key, value, options)
+	if err != nil {
+		return replyError(err)
+	}
+
+	if returnPrevious {
+		if previous != nil {
+			if _, ok := previous.([]byte); !ok {
+				return store.ErrWrongType
+			}
+		}
+		return previous
+	}
+	if !stored {
+		return nil
+	}
+	return "OK"
+}
+
+// expire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT
+func expire(storage store.Engine, respArray []interface{}, seconds bool, absolute bool) interface{} {
+
+	number, err := strconv.ParseInt(string(respArray[2].([]byte)), 10, 64)
+	if err != nil {
+		return errorNotInteger
+	}
+
+	// unlike SET, a time that is not positive is allowed
+	// here and deletes the key right away
+	at := time.Now()
+	if number > 0 {
+		at, err = parseDeadline(respArray[2].([]byte), seconds, absolute)
+		if err != nil {
+			return err
+		}
+	}
+
+	found, err := storage.Expire(respArray[1].([]byte), at)
+	if err != nil {
+		return replyError(err)
+	}
+	if found {
+		return 1
+	}
+	return 0
+}
+
+// ttl implements TTL and PTTL: -2 means the key does not exist and
+// -1 that it exists without a deadline
+func ttl(storage store.Engine, respArray []interface{}, unit time.Duration) interface{} {
+
+	deadline, ok, err := storage.ExpireTime(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	if !ok {
+		return -2
+	}
+	if deadline.IsZero() {
+		return -1
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	// round up like Redis does, a key with 1500ms left has a TTL of 2
+	return int((remaining + unit - 1) / unit)
+}
+
+// persist implements PERSIST key
+func persist(storage store.Engine, respArray []interface{}) interface{} {
+
+	persisted, err := storage.Persist(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	if persisted {
+		return 1
+	}
+	return 0
+}
+
+// parseDeadline turns the argument of an expiry option into a point in
+// time. The argument is in seconds or milliseconds, and either relative
+// to now or a unix timestamp.
+func parseDeadline(arg []byte, seconds bool, absolute bool) (time.Time, error) {
+
+	number, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, errorNotInteger
+	}
+
+	millis := number
+	if seconds {
+		if number > maxMillis/1000 || number < -maxMillis/1000 {
+			return time.Time{}, errorInvalidTime
+		}
+		millis = number * 1000
+	}
+
+	if millis <= 0 || millis > maxMillis {
+		return time.Time{}, errorInvalidTime
+	}
+
+	if absolute {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	return time.Now().Add(time.Duration(millis) * time.Millisecond), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorNotFloat      = errors.New("ERR value is not a valid float")
+	errorInvalidCursor = errors.New("ERR invalid cursor")
+)
+
+// hset implements HSET key field value [field value ...]
+func hset(storage store.Engine, respArray []interface{}) interface{} {
+
+	if len(respArray)%2 != 0 {
+		return wrongArity(respArray)
+	}
+
+	added, err := storage.HSet(respArray[1].([]byte), arguments(respArray[2:])...)
+	if err != nil {
+		return err
+	}
+	return added
+}
+
+// hget implements HGET key field
+func hget(storage store.Engine, respArray []interface{}) interface{} {
+
+	value, ok, err := storage.HGet(respArray[1].([]byte), respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+// hmget implements HMGET key field [field ...]
+func hmget(storage store.Engine, respArray []interface{}) interface{} {
+
+	values, err := storage.HMGet(respArray[1].([]byte), arguments(respArray[2:])...)
+	if err != nil {
+		return err
+	}
+
+	arr := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		if value == nil {
+			arr = append(arr, nil)
+			continue
+		}
+		arr = append(arr, value)
+	}
+	return arr
+}
+
+// hdel implements HDEL key field [field ...]
+func hdel(storage store.Engine, respArray []interface{}) interface{} {
+
+	removed, err := storage.HDel(respArray[1].([]byte), arguments(respArray[2:])...)
+	if err != nil {
+		return err
+	}
+	return removed
+}
+
+// hgetall implements HGETALL key, the reply is a map in RESP3
+// and a flat list of fields and values in RESP2
+func hgetall(storage store.Engine, respArray []interface{}) interface{} {
+
+	fields, err := storage.HGetAll(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+
+	reply := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		reply[field] = value
+	}
+	return reply
+}
+
+// hkeys implements HKEYS key and, with values set, HVALS key
+func hkeys(storage store.Engine, respArray []interface{}, values bool) interface{} {
+
+	var items [][]byte
+	var err error
+	if values {
+		items, err = storage.HVals(respArray[1].([]byte))
+	} else {
+		items, err = storage.HKeys(respArray[1].([]byte))
+	}
+	if err != nil {
+		return err
+	}
+	return items
+}
+
+// hexists implements HEXISTS key field
+func hexists(storage store.Engine, respArray []interface{}) interface{} {
+
+	ok, err := storage.HExists(respArray[1].([]byte), respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// hlen implements HLEN key
+func hlen(storage store.Engine, respArray []interface{}) interface{} {
+
+	length, err := storage.HLen(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+	return length
+}
+
+// hincrby implements HINCRBY key field increment
+func hincrby(storage store.Engine, respArray []interface{}) interface{} {
+
+	delta, err := strconv.ParseInt(string(respArray[3].([]byte)), 10, 64)
+	if err != nil {
+		return errorNotInteger
+	}
+
+	result, err := storage.HIncrBy(respArray[1].([]byte), respArray[2].([]byte), delta)
+	if err != nil {
+		return replyError(err)
+	}
+	return int(result)
+}
+
+// hincrbyfloat implements HINCRBYFLOAT key field increment, the
+// new value comes back as a bulk string like in Redis
+func hincrbyfloat(storage store.Engine, respArray []interface{}) interface{} {
+
+	delta, err := strconv.ParseFloat(string(respArray[3].([]byte)), 64)
+	if err != nil {
+		return errorNotFloat
+	}
+
+	result, err := storage.HIncrByFloat(respArray[1].([]byte), respArray[2].([]byte), delta)
+	if err != nil {
+		return replyError(err)
+	}
+	return []byte(strconv.FormatFloat(result, 'f', -1, 64))
+}
+
+// hscan implements HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscan(storage store.Engine, respArray []interface{}) interface{} {
+
+	cursor, err := strconv.ParseUint(string(respArray[2].([]byte)), 10, 64)
+	if err != nil {
+		return errorInvalidCursor
+	}
+
+	pattern, count, err := scanOptions(respArray[3:])
+	if err != nil {
+		return err
+	}
+
+	next, pairs, err := storage.HScan(respArray[1].([]byte), cursor, pattern, count)
+	if err != nil {
+		return err
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), pairs}
+}
+
+// scanOptions parses the MATCH and COUNT options of the SCAN family
+func scanOptions(options []interface{}) (string, int, error) {
+
+	pattern := ""
+	count := 10
+	for i := 0; i < len(options); i += 2 {
+		if i+1 == len(options) {
+			return "", 0, errorSyntax
+		}
+
+		value := string(options[i+1].([]byte))
+		switch strings.ToUpper(string(options[i].([]byte))) {
+
+		case "MATCH":
+			pattern = value
+
+		case "COUNT":
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return "", 0, errorNotInteger
+			}
+			if number < 1 {
+				return "", 0, errorSyntax
+			}
+			count = number
+
+		default:
+			return "", 0, errorSyntax
+		}
+	}
+	return pattern, count, nil
+}
+
+// replyError turns an error of the store into a reply, prefixing
+// it with the generic error code unless it carries its own
+func replyError(err error) error {
+
+	if err == store.ErrWrongType || err == store.ErrOutOfMemory {
+		return err
+	}
+	return errors.New("ERR " + err.Error())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+var errorUnsupportedProtocol = errors.New("NOPROTO sorry, this protocol version is not supported")
+
+var errorHelloNoAuth = errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME
+// clientname]], switching the session to the requested protocol version
+// and describing the server
+func hello(client *session, respArray []interface{}) interface{} {
+
+	version := client.writer.Version()
+	name := client.name
+	user, password := "", ""
+
+	if len(respArray) > 1 {
+		requested, err := strconv.Atoi(string(respArray[1].([]byte)))
+		if err != nil {
+			return errors.New("ERR Protocol version is not an integer or out of range")
+		}
+
+		if requested != protocol.RESP2 && requested != protocol.RESP3 {
+			return errorUnsupportedProtocol
+		}
+		version = requested
+	}
+
+	for i := 2; i < len(respArray); i++ {
+		option := strings.ToUpper(string(respArray[i].([]byte)))
+		if option == "SETNAME" && i+1 < len(respArray) {
+			name = string(respArray[i+1].([]byte))
+			i++
+			continue
+		}
+		if option == "AUTH" && i+2 < len(respArray) {
+			user, password = string(respArray[i+1].([]byte)), string(respArray[i+2].([]byte))
+			i += 2
+			continue
+		}
+		return errors.New("ERR syntax error in HELLO option '" + option + "'")
+	}
+
+	if user != "" {
+		if err := acl.authenticate(client, user, password); err != nil {
+			return err
+		}
+	}
+	if acl.lookup(client.user) == nil {
+		return errorHelloNoAuth
+	}
+
+	client.writer.SetVersion(version)
+	atomic.StoreInt32(&client.version, int32(version))
+	client.name = name
+
+	return map[string]interface{}{
+		"server":  "retain",
+		"proto":   version,
+		"id":      int(client.id),
+		"mode":    "standalone",
+		"role":    "master",
+		"modules": []interface{}{},
+	}
+}
+
+// ping implements PING [message]
+func ping(respArray []interface{}) interface{} {
+
+	if len(respArray) > 1 {
+		return respArray[1].([]byte)
+	}
+	return "PONG"
+}
+
+// echo implements ECHO message
+func echo(respArray []interface{}) interface{} {
+
+	return respArray[1].([]byte)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+
+	storage := newTestStorage(t)
+	client := newTestSession()
+
+	// messages go back as bulk strings, which may hold line breaks
+	message := "line\r\n+OK"
+	for _, args := range [][]string{{"ECHO", message}, {"PING", message}} {
+		if reply := run(storage, client, args...); !reflect.DeepEqual(reply, []byte(message)) {
+			log.Fatalf("failed %s, got: %#v", args[0], reply)
+		}
+	}
+	if reply := run(storage, client, "PING"); reply != "PONG" {
+		log.Fatalf("failed PING, got: %#v", reply)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/viveknathani/retain/store"
+)
+
+// del implements DEL key
+func del(storage store.Engine, respArray []interface{}) interface{} {
+
+	err := storage.Delete(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	return "OK"
+}
+
+// keysCommand implements KEYS pattern
+func keysCommand(storage store.Engine, respArray []interface{}) interface{} {
+
+	found, err := storage.Keys(string(respArray[1].([]byte)))
+	if err != nil {
+		return replyError(err)
+	}
+	names := make([][]byte, 0, len(found))
+	for _, key := range found {
+		names = append(names, key)
+	}
+	return names
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scan(storage store.Engine, respArray []interface{}) interface{} {
+
+	cursor, err := strconv.ParseUint(string(respArray[1].([]byte)), 10, 64)
+	if err != nil {
+		return errorInvalidCursor
+	}
+
+	// TYPE is the one option HSCAN does not have
+	kind := ""
+	options := make([]interface{}, 0, len(respArray)-2)
+	for i := 2; i < len(respArray); i++ {
+		if strings.ToUpper(string(respArray[i].([]byte))) == "TYPE" && i+1 < len(respArray) {
+			kind = strings.ToLower(string(respArray[i+1].([]byte)))
+			i++
+			continue
+		}
+		options = append(options, respArray[i])
+	}
+
+	pattern, count, err := scanOptions(options)
+	if err != nil {
+		return err
+	}
+
+	next, found, err := storage.Scan(cursor, pattern, count, kind)
+	if err != nil {
+		return replyError(err)
+	}
+	names := make([][]byte, 0, len(found))
+	for _, key := range found {
+		names = append(names, key)
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), names}
+}
+
+// dbsize implements DBSIZE
+func dbsize(storage store.Engine, respArray []interface{}) interface{} {
+
+	return storage.DBSize()
+}
+
+// randomkey implements RANDOMKEY
+func randomkey(storage store.Engine, respArray []interface{}) interface{} {
+
+	key, ok, err := storage.RandomKey()
+	if err != nil {
+		return replyError(err)
+	}
+	if !ok {
+		return nil
+	}
+	return []byte(key)
+}
+
+// exists implements EXISTS key [key ...]
+func exists(storage store.Engine, respArray []interface{}) interface{} {
+
+	count, err := storage.Exists(keys(respArray[1:])...)
+	if err != nil {
+		return replyError(err)
+	}
+	return count
+}
+
+// typeCommand implements TYPE key
+func typeCommand(storage store.Engine, respArray []interface{}) interface{} {
+
+	kind, err := storage.Type(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	return kind
+}
+
+// selectDatabase implements SELECT index
+func selectDatabase(storage store.Engine, client *session, respArray []interface{}) interface{} {
+
+	index, err := strconv.Atoi(string(respArray[1].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+
+	if _, err := storage.DB(index); err != nil {
+		return replyError(err)
+	}
+	client.db = index
+	return "OK"
+}
+
+// move implements MOVE key db
+func move(storage store.Engine, respArray []interface{}) interface{} {
+
+	index, err := strconv.Atoi(string(respArray[2].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+
+	moved, err := storage.Move(respArray[1].([]byte), index)
+	if err != nil {
+		return replyError(err)
+	}
+	return moved
+}
+
+// swapdb implements SWAPDB index1 index2
+func swapdb(storage store.Engine, respArray []interface{}) interface{} {
+
+	first, second, err := integers(respArray[1], respArray[2])
+	if err != nil {
+		return err
+	}
+
+	err = storage.SwapDB(first, second)
+	if err != nil {
+		return replyError(err)
+	}
+	return "OK"
+}
+
+// flush implements FLUSHDB [ASYNC | SYNC] and, with all set, FLUSHALL.
+// Both are always done synchronously.
+func flush(storage store.Engine, respArray []interface{}, all bool) interface{} {
+
+	if len(respArray) > 2 {
+		return errorSyntax
+	}
+	if len(respArray) == 2 {
+		mode := strings.ToUpper(string(respArray[1].([]byte)))
+		if mode != "ASYNC" && mode != "SYNC" {
+			return errorSyntax
+		}
+	}
+
+	var err error
+	if all {
+		err = storage.FlushAll()
+	} else {
+		err = storage.FlushDB()
+	}
+	if err != nil {
+		return replyError(err)
+	}
+	return "OK"
+}
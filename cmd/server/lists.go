@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/viveknathani/retain/store"
+)
+
+var errorNotPositive = errors.New("ERR value is out of range, must be positive")
+
+// push implements LPUSH and RPUSH key element [element ...]
+func push(storage store.Engine, respArray []interface{}, front bool) interface{} {
+
+	key := respArray[1].([]byte)
+	values := arguments(respArray[2:])
+
+	var length int
+	var err error
+	if front {
+		length, err = storage.LPush(key, values...)
+	} else {
+		length, err = storage.RPush(key, values...)
+	}
+	if err != nil {
+		return err
+	}
+	return length
+}
+
+// pop implements LPOP and RPOP key [count]. Without a count the reply
+// is a single element, with one it is an array.
+func pop(storage store.Engine, respArray []interface{}, front bool) interface{} {
+
+	if len(respArray) > 3 {
+		return errorSyntax
+	}
+
+	count := 1
+	if len(respArray) == 3 {
+		number, err := strconv.Atoi(string(respArray[2].([]byte)))
+		if err != nil {
+			return errorNotInteger
+		}
+		if number < 0 {
+			return errorNotPositive
+		}
+		count = number
+	}
+
+	key := respArray[1].([]byte)
+	var popped [][]byte
+	var err error
+	if front {
+		popped, err = storage.LPop(key, count)
+	} else {
+		popped, err = storage.RPop(key, count)
+	}
+	if err != nil {
+		return err
+	}
+
+	if popped == nil {
+		return nil
+	}
+	if len(respArray) == 2 {
+		return popped[0]
+	}
+	return popped
+}
+
+// lrange implements LRANGE key start stop
+func lrange(storage store.Engine, respArray []interface{}) interface{} {
+
+	start, stop, err := integers(respArray[2], respArray[3])
+	if err != nil {
+		return err
+	}
+
+	items, err := storage.LRange(respArray[1].([]byte), start, stop)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		return [][]byte{}
+	}
+	return items
+}
+
+// lindex implements LINDEX key index
+func lindex(storage store.Engine, respArray []interface{}) interface{} {
+
+	index, err := strconv.Atoi(string(respArray[2].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+
+	value, ok, err := storage.LIndex(respArray[1].([]byte), index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+// llen implements LLEN key
+func llen(storage store.Engine, respArray []interface{}) interface{} {
+
+	length, err := storage.LLen(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+	return length
+}
+
+// lrem implements LREM key count element
+func lrem(storage store.Engine, respArray []interface{}) interface{} {
+
+	count, err := strconv.Atoi(string(respArray[2].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+
+	removed, err := storage.LRem(respArray[1].([]byte), count, respArray[3].([]byte))
+	if err != nil {
+		return err
+	}
+	return removed
+}
+
+// ltrim implements LTRIM key start stop
+func ltrim(storage store.Engine, respArray []interface{}) interface{} {
+
+	start, stop, err := integers(respArray[2], respArray[3])
+	if err != nil {
+		return err
+	}
+
+	err = storage.LTrim(respArray[1].([]byte), start, stop)
+	if err != nil {
+		return err
+	}
+	return "OK"
+}
+
+// lset implements LSET key index element
+func lset(storage store.Engine, respArray []interface{}) interface{} {
+
+	index, err := strconv.Atoi(string(respArray[2].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+
+	err = storage.LSet(respArray[1].([]byte), index, respArray[3].([]byte))
+	switch err {
+	case nil:
+		return "OK"
+	case store.ErrWrongType:
+		return err
+	}
+	return errors.New("ERR " + err.Error())
+}
+
+// linsert implements LINSERT key BEFORE|AFTER pivot element
+func linsert(storage store.Engine, respArray []interface{}) interface{} {
+
+	var before bool
+	switch strings.ToUpper(string(respArray[2].([]byte))) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return errorSyntax
+	}
+
+	length, err := storage.LInsert(respArray[1].([]byte), before, respArray[3].([]byte), respArray[4].([]byte))
+	if err != nil {
+		return err
+	}
+	return length
+}
+
+// arguments converts the bulk strings of a request into byte slices
+func arguments(respArray []interface{}) [][]byte {
+
+	result := make([][]byte, 0, len(respArray))
+	for _, item := range respArray {
+		result = append(result, item.([]byte))
+	}
+	return result
+}
+
+// integers parses the start and stop arguments of a range
+func integers(start interface{}, stop interface{}) (int, int, error) {
+
+	first, err := strconv.Atoi(string(start.([]byte)))
+	if err != nil {
+		return 0, 0, errorNotInteger
+	}
+
+	second, err := strconv.Atoi(string(stop.([]byte)))
+	if err != nil {
+		return 0, 0, errorNotInteger
+	}
+	return first, second, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/viveknathani/retain/store"
+)
+
+// memoryUnits are the suffixes parseMemory understands
+var memoryUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// parseMemory reads an amount of memory written as in the maxmemory
+// setting of Redis: a number of bytes, optionally followed by a unit
+// such as 100mb
+func parseMemory(config string) (int64, error) {
+
+	number, size := strings.ToLower(config), int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, size = strings.TrimSuffix(number, unit.suffix), unit.size
+			break
+		}
+	}
+
+	amount, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid amount of memory %q", config)
+	}
+	return amount * size, nil
+}
+
+// freeMemory makes room for cmd if it is one of those that may need
+// more memory, it returns an error if there is none to be made
+func freeMemory(storage store.Engine, cmd *command) error {
+
+	if !cmd.has("denyoom") {
+		return nil
+	}
+
+	err := storage.FreeMemory()
+	if err != nil {
+		return replyError(err)
+	}
+	return nil
+}
+
+// info implements INFO [section]. The memory section reports the memory
+// used and its limit, the stats section how many keys were evicted.
+func info(storage store.Engine, respArray []interface{}) interface{} {
+
+	if len(respArray) > 2 {
+		return errorSyntax
+	}
+
+	section := "all"
+	if len(respArray) == 2 {
+		section = strings.ToLower(string(respArray[1].([]byte)))
+	}
+
+	var builder strings.Builder
+	if section == "all" || section == "memory" {
+		maxMemory, policy := storage.MaxMemory()
+		builder.WriteString("# Memory\r\n")
+		fmt.Fprintf(&builder, "used_memory:%d\r\n", storage.UsedMemory())
+		fmt.Fprintf(&builder, "maxmemory:%d\r\n", maxMemory)
+		fmt.Fprintf(&builder, "maxmemory_policy:%s\r\n", policy)
+	}
+	if section == "all" || section == "stats" {
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# Stats\r\n")
+		fmt.Fprintf(&builder, "evicted_keys:%d\r\n", storage.EvictedKeys())
+	}
+	return []byte(builder.String())
+}
+
+// memoryCommand implements MEMORY USAGE key
+func memoryCommand(storage store.Engine, respArray []interface{}) interface{} {
+
+	subcommand := strings.ToUpper(string(respArray[1].([]byte)))
+	if subcommand != "USAGE" || len(respArray) != 3 {
+		return errors.New("ERR unknown subcommand or wrong number of arguments for MEMORY " + subcommand)
+	}
+
+	size, ok, err := storage.MemoryUsage(respArray[2].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	if !ok {
+		return nil
+	}
+	return int(size)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+var errorInTransaction = errors.New("ERR Command not allowed inside a transaction")
+
+// outboxSize is how many messages may wait for a slow subscriber,
+// one that falls further behind is disconnected
+const outboxSize = 1024
+
+// hub routes published messages to the sessions subscribed to them
+type hub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*session]struct{}
+	patterns map[string]map[*session]struct{}
+}
+
+var pubsub = &hub{
+	channels: make(map[string]map[*session]struct{}),
+	patterns: make(map[string]map[*session]struct{}),
+}
+
+// replies is a response made of several replies sent one after the
+// other, like the confirmations of a SUBSCRIBE to several channels
+type replies []interface{}
+
+// add subscribes client to a channel or a pattern in subscriptions
+func (h *hub) add(subscriptions map[string]map[*session]struct{}, name string, client *session) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if subscriptions[name] == nil {
+		subscriptions[name] = make(map[*session]struct{})
+	}
+	subscriptions[name][client] = struct{}{}
+}
+
+// remove undoes add
+func (h *hub) remove(subscriptions map[string]map[*session]struct{}, name string, client *session) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(subscriptions[name], client)
+	if len(subscriptions[name]) == 0 {
+		delete(subscriptions, name)
+	}
+}
+
+// publish delivers message to every session subscribed to channel,
+// directly or through a pattern, and returns how many it reached
+func (h *hub) publish(channel string, message []byte) int {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	receivers := 0
+	for client := range h.channels[channel] {
+		client.deliver(protocol.Push{[]byte("message"), []byte(channel), message})
+		receivers++
+	}
+
+	for pattern, clients := range h.patterns {
+		if !store.MatchPattern(pattern, channel) {
+			continue
+		}
+		for client := range clients {
+			client.deliver(protocol.Push{[]byte("pmessage"), []byte(pattern), []byte(channel), message})
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// deliver queues message for client without waiting for it to be
+// written. Called with the hub locked, so the outbox is still open.
+func (client *session) deliver(message interface{}) {
+
+	encoded := protocol.EncodeVersion(message, int(atomic.LoadInt32(&client.version)))
+	select {
+	case client.outbox <- encoded:
+	default:
+		// closing the connection makes serve clean up after the client
+		client.connection.Close()
+	}
+}
+
+// startOutbox hands every write to the connection over to a goroutine,
+// which is the only way to keep the replies of the client and the
+// messages published to it from interleaving
+func (client *session) startOutbox() {
+
+	client.outbox = make(chan protocol.RespEncodedString, outboxSize)
+	go func() {
+
+		for encoded := range client.outbox {
+			err := client.writer.WriteEncoded(encoded)
+
+			// flush once nothing else is waiting
+			if err == nil && len(client.outbox) == 0 {
+				err = client.writer.Flush()
+			}
+			if err != nil {
+				client.connection.Close()
+			}
+		}
+	}()
+}
+
+// subscriptions is how many channels and patterns client listens to
+func (client *session) subscriptions() int {
+
+	return len(client.channels) + len(client.patterns)
+}
+
+// subscribe implements SUBSCRIBE channel [channel ...] and, with
+// byPattern set, PSUBSCRIBE pattern [pattern ...]
+func subscribe(client *session, respArray []interface{}, byPattern bool) interface{} {
+
+	if client.transaction != nil {
+		return errorInTransaction
+	}
+
+	if client.outbox == nil {
+		client.startOutbox()
+	}
+
+	kind, own, subscriptions := "subscribe", &client.channels, pubsub.channels
+	if byPattern {
+		kind, own, subscriptions = "psubscribe", &client.patterns, pubsub.patterns
+	}
+	if *own == nil {
+		*own = make(map[string]struct{})
+	}
+
+	confirmations := make(replies, 0, len(respArray)-1)
+	for _, item := range respArray[1:] {
+		name := string(item.([]byte))
+		if _, ok := (*own)[name]; !ok {
+			(*own)[name] = struct{}{}
+			pubsub.add(subscriptions, name, client)
+		}
+		confirmations = append(confirmations, protocol.Push{[]byte(kind), []byte(name), client.subscriptions()})
+	}
+	return confirmations
+}
+
+// unsubscribe implements UNSUBSCRIBE [channel ...] and, with byPattern
+// set, PUNSUBSCRIBE [pattern ...]. Without arguments it drops them all.
+func unsubscribe(client *session, respArray []interface{}, byPattern bool) interface{} {
+
+	if client.transaction != nil {
+		return errorInTransaction
+	}
+
+	kind, own, subscriptions := "unsubscribe", client.channels, pubsub.channels
+	if byPattern {
+		kind, own, subscriptions = "punsubscribe", client.patterns, pubsub.patterns
+	}
+
+	names := make([]string, 0)
+	for _, item := range respArray[1:] {
+		names = append(names, string(item.([]byte)))
+	}
+	if len(respArray) == 1 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		return protocol.Push{[]byte(kind), nil, client.subscriptions()}
+	}
+
+	confirmations := make(replies, 0, len(names))
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			pubsub.remove(subscriptions, name, client)
+		}
+		confirmations = append(confirmations, protocol.Push{[]byte(kind), []byte(name), client.subscriptions()})
+	}
+	return confirmations
+}
+
+// unsubscribeAll drops every subscription of a client that is leaving
+// and closes its outbox
+func unsubscribeAll(client *session) {
+
+	for name := range client.channels {
+		pubsub.remove(pubsub.channels, name, client)
+	}
+	for name := range client.patterns {
+		pubsub.remove(pubsub.patterns, name, client)
+	}
+
+	// no publisher can be delivering to the client any more
+	if client.outbox != nil {
+		close(client.outbox)
+	}
+}
+
+// publish implements PUBLISH channel message
+func publish(respArray []interface{}) interface{} {
+
+	return pubsub.publish(string(respArray[1].([]byte)), respArray[2].([]byte))
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], PUBSUB NUMSUB
+// [channel ...] and PUBSUB NUMPAT
+func pubsubCommand(respArray []interface{}) interface{} {
+
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+
+	subcommand := strings.ToUpper(string(respArray[1].([]byte)))
+	switch {
+
+	case subcommand == "CHANNELS" && len(respArray) <= 3:
+		pattern := ""
+		if len(respArray) == 3 {
+			pattern = string(respArray[2].([]byte))
+		}
+
+		names := make([]string, 0)
+		for name := range pubsub.channels {
+			if pattern == "" || store.MatchPattern(pattern, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		channels := make([][]byte, 0, len(names))
+		for _, name := range names {
+			channels = append(channels, []byte(name))
+		}
+		return channels
+
+	case subcommand == "NUMSUB":
+		counts := make([]interface{}, 0, 2*(len(respArray)-2))
+		for _, item := range respArray[2:] {
+			counts = append(counts, item, len(pubsub.channels[string(item.([]byte))]))
+		}
+		return counts
+
+	case subcommand == "NUMPAT" && len(respArray) == 2:
+		return len(pubsub.patterns)
+	}
+
+	return errors.New("ERR unknown subcommand or wrong number of arguments for PUBSUB " + subcommand)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/store"
+)
+
+// saveRule asks for a snapshot once at least changes writes have
+// happened and seconds have passed since the last one
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+// after a failed automatic save, wait this long before trying again
+const saveRetryDelay = 5 * time.Second
+
+// parseSaveRules reads rules written as in the save setting of Redis,
+// pairs of "<seconds> <changes>" separated by spaces. An empty string
+// turns automatic saving off.
+func parseSaveRules(config string) ([]saveRule, error) {
+
+	fields := strings.Fields(config)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("save rules come in pairs of <seconds> <changes>")
+	}
+
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid number of seconds %q in save rules", fields[i])
+		}
+
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 1 {
+			return nil, fmt.Errorf("invalid number of changes %q in save rules", fields[i+1])
+		}
+
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+// save implements SAVE
+func save(storage store.Engine, respArray []interface{}) interface{} {
+
+	err := storage.Save()
+	if err != nil {
+		return errors.New("ERR " + err.Error())
+	}
+	return "OK"
+}
+
+// bgsave implements BGSAVE
+func bgsave(storage store.Engine, respArray []interface{}) interface{} {
+
+	err := storage.BackgroundSave()
+	if err != nil {
+		return errors.New("ERR " + err.Error())
+	}
+	return "Background saving started"
+}
+
+// bgrewriteaof implements BGREWRITEAOF
+func bgrewriteaof(storage store.Engine, respArray []interface{}) interface{} {
+
+	err := storage.RewriteAppendOnlyFile()
+	if err != nil {
+		return errors.New("ERR " + err.Error())
+	}
+	return "Background append only file rewriting started"
+}
+
+// lastsave implements LASTSAVE
+func lastsave(storage store.Engine, respArray []interface{}) interface{} {
+
+	return int(storage.LastSave().Unix())
+}
+
+// autoSave checks the rules every second and starts a background
+// save as soon as one of them is met
+func autoSave(storage store.Engine, rules []saveRule) {
+
+	if len(rules) == 0 {
+		return
+	}
+
+	var lastFailure time.Time
+	for range time.Tick(time.Second) {
+
+		if time.Since(lastFailure) < saveRetryDelay {
+			continue
+		}
+
+		since := int64(time.Since(storage.LastSave()) / time.Second)
+		dirty := storage.Dirty()
+		for _, rule := range rules {
+			if dirty < rule.changes || since < rule.seconds {
+				continue
+			}
+
+			fmt.Printf("%d changes in %d seconds, saving\n", rule.changes, rule.seconds)
+
+			// like a command, so that the snapshot does not
+			// catch a transaction halfway through
+			exclusive.RLock()
+			err := storage.BackgroundSave()
+			exclusive.RUnlock()
+			if err != nil && err != store.ErrSaveInProgress {
+				fmt.Println("automatic save:", err)
+				lastFailure = time.Now()
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestSave(t *testing.T) {
+
+	storage := newFakeEngine(t)
+	client := newTestSession()
+
+	// commands other than those about saving reach the wrapped engine
+	if reply := run(storage, client, "SET", "key", "value"); reply != "OK" {
+		log.Fatalf("failed SET through a fake engine, got: %v", reply)
+	}
+	if reply := run(storage, client, "GET", "key"); !reflect.DeepEqual(reply, []byte("value")) {
+		log.Fatalf("failed GET through a fake engine, got: %q", reply)
+	}
+
+	if reply := run(storage, client, "SAVE"); reply != "OK" {
+		log.Fatalf("failed SAVE, got: %v", reply)
+	}
+	if reply := run(storage, client, "BGSAVE"); reply != "Background saving started" {
+		log.Fatalf("failed BGSAVE, got: %v", reply)
+	}
+	if storage.saves != 2 {
+		log.Fatalf("failed SAVE and BGSAVE, the engine saved %d times", storage.saves)
+	}
+
+	// a failure of the engine makes it to the client
+	storage.err = errors.New("no space left on device")
+	for _, name := range []string{"SAVE", "BGSAVE", "BGREWRITEAOF"} {
+		reply, ok := run(storage, client, name).(error)
+		if !ok || reply.Error() != "ERR no space left on device" {
+			log.Fatalf("failed %s when the engine fails, got: %v", name, reply)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/viveknathani/retain/protocol"
@@ -29,32 +32,158 @@ func printColor(colorName string) {
 	}
 }
 
-func serve(store *store.Storage, connection net.Conn) {
+// session holds the state of one client connection
+type session struct {
+	id         int64
+	name       string
+	address    string
+	connection net.Conn
+	reader     *protocol.Reader
+	writer     *protocol.Writer
+
+	// version mirrors the protocol version of writer for the
+	// goroutines that publish messages to the session
+	version int32
+
+	// db is the number of the database SELECT picked
+	db int
+
+	// user is the name of the ACL user the client is logged in as,
+	// empty until it authenticates
+	user string
+
+	// transaction is set between MULTI and EXEC or DISCARD, watching
+	// holds the version of every watched key as of WATCH
+	transaction *transaction
+	watching    map[watchedKey]uint64
+
+	// executing is set while EXEC runs the queued commands
+	executing bool
+
+	// channels and patterns are the subscriptions of the session. Once
+	// it has subscribed, everything written to it goes through outbox.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	outbox   chan protocol.RespEncodedString
+}
+
+var lastSessionID int64
+
+func newSession(connection net.Conn) *session {
+
+	return &session{
+		id:         atomic.AddInt64(&lastSessionID, 1),
+		address:    connection.RemoteAddr().String(),
+		connection: connection,
+		reader:     protocol.NewReader(connection),
+		writer:     protocol.NewWriter(connection),
+		version:    protocol.RESP2,
+		user:       acl.login(),
+	}
+}
+
+// database returns the database the client has selected among
+// those of storage
+func (client *session) database(storage store.Engine) store.Engine {
+
+	db, err := storage.DB(client.db)
+	if err != nil {
+		// SELECT only takes numbers that exist
+		panic(err)
+	}
+	return db
+}
+
+// reply sends response to the client, directly or through its outbox
+// if it has one. Replies are flushed once every command the client sent
+// is answered, so that a pipeline gets them in as few writes as can be.
+func (client *session) reply(response interface{}) error {
+
+	responses, ok := response.(replies)
+	if !ok {
+		responses = replies{response}
+	}
+
+	if client.outbox != nil {
+		for _, response := range responses {
+			client.outbox <- protocol.EncodeVersion(response, client.writer.Version())
+		}
+		return nil
+	}
+
+	for _, response := range responses {
+		err := client.writer.WriteValue(response)
+		if err != nil {
+			return err
+		}
+	}
+
+	if client.reader.Buffered() > 0 {
+		return nil
+	}
+	return client.writer.Flush()
+}
+
+func serve(storage store.Engine, connection net.Conn) {
 
 	defer connection.Close()
 
-	address := connection.RemoteAddr().String()
+	client := newSession(connection)
+	defer unwatchAll(client)
+	defer unsubscribeAll(client)
+
+	address := client.address
 	printColor(colorGreen)
 	fmt.Printf("new client => %s\n", address)
 	printColor(colorReset)
 
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		err := handshake(client, tlsConnection)
+		if handleErrorWhileServing(address, err) {
+			return
+		}
+	}
+
 	for {
-		buffer := make([]byte, 65535)
-		bytesRead, err := connection.Read(buffer)
+		value, err := client.reader.ReadValue()
 		if handleErrorWhileServing(address, err) {
+			// let the client know why we are hanging up on it
+			if errors.Is(err, protocol.ErrInvalidSyntax) {
+				_ = client.writer.WriteValue(errors.New("ERR protocol error"))
+				_ = client.writer.Flush()
+			}
 			break
 		}
 
-		buffer = buffer[0:bytesRead]
-		arr := protocol.Decode(buffer)
-		response := executeCommand(store, arr.([]interface{}), address)
-		_, err = connection.Write(response)
+		var response interface{} = errorMessage
+		arr, ok := value.([]interface{})
+		if ok && isCommand(arr) {
+			response = dispatch(storage, client, arr)
+		}
+
+		err = client.reply(response)
 		if handleErrorWhileServing(address, err) {
 			break
 		}
 	}
 }
 
+// isCommand reports whether arr is a non-empty array of bulk strings,
+// which is the only shape of request executeCommand understands
+func isCommand(arr []interface{}) bool {
+
+	if len(arr) == 0 {
+		return false
+	}
+
+	for _, item := range arr {
+		if _, ok := item.([]byte); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func handleErrorWhileServing(address string, err error) bool {
 
 	if err == nil {
@@ -88,127 +217,146 @@ func checkIfWeLostConnection(err error) bool {
 	return errors.Is(err, syscall.ECONNRESET)
 }
 
-func executeCommand(store *store.Storage, respArray []interface{}, address string) protocol.RespEncodedString {
+var errorMessage = errors.New("invalid command syntax")
 
-	response := ""
-	errorMessage := protocol.Encode(errors.New("invalid command syntax"))
+// executeCommand runs cmd, the command in respArray, and returns the
+// reply, which the caller encodes with the protocol version of the
+// session. The arguments were checked against the table by lookup.
+func executeCommand(storage store.Engine, client *session, cmd *command, respArray []interface{}) interface{} {
 
-	command := string(respArray[0].([]byte))
 	printColor(colorYellow)
-	fmt.Printf("[%s] > request for %s\n", address, command)
+	fmt.Printf("[%s] > request for %s\n", client.address, respArray[0])
 	printColor(colorReset)
 
-	switch command {
+	return cmd.run(storage, client, respArray)
+}
 
-	case "PING":
-		if len(respArray) > 1 {
-			response = string(respArray[1].([]byte))
-			break
-		}
-		response = "PONG"
+func main() {
 
-	case "ECHO":
-		if len(respArray) > 1 {
-			response = string(respArray[1].([]byte))
-		}
+	host := flag.String("host", "127.0.0.1", "host")
+	port := flag.Int("port", 8000, "port of plaintext connections, 0 to only accept TLS")
+	tlsPort := flag.Int("tls-port", 0, "port of TLS connections, 0 for none")
+	tlsCert := flag.String("tls-cert", "", "certificate of the TLS port, reloaded on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "private key of the TLS port, reloaded on SIGHUP")
+	tlsCA := flag.String("tls-ca", "", "certificate authorities the certificates of clients must be signed by")
+	tlsAuthClients := flag.String("tls-auth-clients", "yes", "with -tls-ca, whether clients must send a certificate: yes, optional or no")
+	appendOnly := flag.Bool("appendonly", false, "log every write to an append only file and load from it at startup")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "path of the append only file")
+	appendFsync := flag.String("appendfsync", "everysec", "how often to fsync the append only file: always, everysec or no")
+	save := flag.String("save", "3600 1 300 100 60 10000", "save after <seconds> if at least <changes> writes happened, as pairs of numbers; empty to disable")
+	engine := flag.String("engine", store.MemoryEngine, "storage engine: "+strings.Join(store.Engines(), " or "))
+	lsmPath := flag.String("lsmpath", "retain.lsm", "directory of the lsm engine")
+	databases := flag.Int("databases", 16, "number of databases")
+	maxMemory := flag.String("maxmemory", "0", "roughly how much memory keys may take, e.g. 100mb; 0 for no limit")
+	requirePass := flag.String("requirepass", "", "password of the default user, which needs none otherwise")
+	aclFile := flag.String("aclfile", "", "file the ACL users are loaded from and saved to")
+	maxMemoryPolicy := flag.String("maxmemory-policy", "noeviction", "what to evict at the memory limit: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru or volatile-ttl")
+	flag.Parse()
 
-	case "SET":
-		if len(respArray) != 3 {
-			return errorMessage
-		}
+	saveRules, err := parseSaveRules(*save)
+	handleError("server main: ", err)
 
-		key := respArray[1].([]byte)
-		value := respArray[2].([]byte)
-		store.Set(key, value)
-		response = "OK"
+	fsyncPolicy, err := store.ParseFsyncPolicy(*appendFsync)
+	handleError("server main: ", err)
 
-	case "GET":
-		if len(respArray) != 2 {
-			return errorMessage
-		}
+	memoryLimit, err := parseMemory(*maxMemory)
+	handleError("server main: ", err)
 
-		key := respArray[1].([]byte)
-		value, ok := store.Get(key)
+	evictionPolicy, err := store.ParseEvictionPolicy(*maxMemoryPolicy)
+	handleError("server main: ", err)
 
-		if !ok {
-			return protocol.Encode(errors.New("(nil)"))
-		}
-		response = string(value.([]byte))
+	if *requirePass != "" && *aclFile != "" {
+		handleError("server main: ", errors.New("-requirepass can not be used with -aclfile, set the password of the default user in the file"))
+	}
 
-	case "DEL":
-		if len(respArray) != 2 {
-			return errorMessage
+	// the tree replaces the append only file and keeps keys on disk,
+	// so these would silently do nothing
+	if *engine == store.LSMEngine {
+		if *appendOnly {
+			handleError("server main: ", errors.New("-appendonly can not be used with -engine lsm, every write goes to its write-ahead log"))
 		}
-
-		key := respArray[1].([]byte)
-		store.Delete(key)
-		response = "OK"
-
-	case "MSET":
-
-		if len(respArray)%2 == 0 || len(respArray) == 1 {
-			return errorMessage
+		if memoryLimit != 0 || evictionPolicy != store.NoEviction {
+			handleError("server main: ", errors.New("-maxmemory and -maxmemory-policy can not be used with -engine lsm, keys are kept on disk"))
 		}
+	}
 
-		for i := 1; i < len(respArray); i += 2 {
-			key := respArray[i].([]byte)
-			value := respArray[i+1].([]byte)
-			store.Set(key, value)
-		}
+	acl.path = *aclFile
+	err = acl.load()
+	handleError("server main: ", err)
+	if *requirePass != "" {
+		err = acl.setUser(defaultUser, []string{">" + *requirePass})
+		handleError("server main: ", err)
+	}
 
-		response = "OK"
+	options := store.DefaultOptions()
+	options.Engine = *engine
+	options.LSMPath = *lsmPath
+	options.AppendOnly = *appendOnly
+	options.AppendOnlyPath = *appendFilename
+	options.AppendFsync = fsyncPolicy
+	options.Databases = *databases
+	options.MaxMemory = memoryLimit
+	options.MaxMemoryPolicy = evictionPolicy
+
+	if *tlsPort == 0 && (*tlsCert != "" || *tlsKey != "" || *tlsCA != "") {
+		handleError("server main: ", errors.New("the TLS certificates need a -tls-port"))
+	}
 
-	case "MGET":
+	listeners := make([]net.Listener, 0)
+	if *port != 0 {
+		listener, err := net.Listen("tcp", *host+":"+fmt.Sprint(*port))
+		handleError("server main: ", err)
+		listeners = append(listeners, listener)
 
-		if len(respArray) == 1 {
-			return errorMessage
-		}
+		printColor(colorGreen)
+		fmt.Printf("listening at %s\n", listener.Addr().String())
+		printColor(colorReset)
+	}
 
-		arr := make([][]byte, 0)
-		for i := 1; i < len(respArray); i++ {
-			key := respArray[i].([]byte)
-			value, ok := store.Get(key)
-			if !ok {
-				arr = append(arr, []byte("(nil)"))
-				continue
-			}
-			arr = append(arr, value.([]byte))
-		}
+	if *tlsPort != 0 {
+		authClients, err := parseAuthClients(*tlsAuthClients)
+		handleError("server main: ", err)
 
-		return protocol.Encode(arr)
+		certs := &certificates{certFile: *tlsCert, keyFile: *tlsKey, caFile: *tlsCA, authClients: authClients}
+		err = certs.load()
+		handleError("server main: ", err)
+		certs.reloadOnHangup()
 
-	case "SAVE":
-		if len(respArray) != 1 {
-			return errorMessage
-		}
-		store.Save()
+		listener, err := net.Listen("tcp", *host+":"+fmt.Sprint(*tlsPort))
+		handleError("server main: ", err)
+		listeners = append(listeners, tls.NewListener(listener, certs.serverConfig()))
 
-		response = "OK"
-	default:
-		return errorMessage
+		printColor(colorGreen)
+		fmt.Printf("listening for TLS at %s\n", listener.Addr().String())
+		printColor(colorReset)
 	}
 
-	return protocol.Encode(response)
-}
-
-func main() {
-
-	host := flag.String("host", "127.0.0.1", "host")
-	port := flag.Int("port", 8000, "port")
-	flag.Parse()
+	if len(listeners) == 0 {
+		handleError("server main: ", errors.New("nothing to listen on, set -port or -tls-port"))
+	}
 
-	listener, err := net.Listen("tcp", *host+":"+fmt.Sprint(*port))
+	storage, loadedFromDisk, err := store.Open(options)
 	handleError("server main: ", err)
 
-	printColor(colorGreen)
-	fmt.Printf("listening at %s\n", listener.Addr().String())
-	printColor(colorReset)
-	storage, loadedFromDisk := store.New()
-
-	if loadedFromDisk {
+	if loadedFromDisk && options.Engine == store.LSMEngine {
+		fmt.Printf("loaded from disk (%s)\n", options.LSMPath)
+	} else if loadedFromDisk && options.AppendOnly {
+		fmt.Printf("loaded from disk (%s)\n", options.AppendOnlyPath)
+	} else if loadedFromDisk {
 		fmt.Println("loaded from disk (retain.db)")
 	}
 
+	go autoSave(storage, saveRules)
+
+	for _, listener := range listeners[1:] {
+		go accept(storage, listener)
+	}
+	accept(storage, listeners[0])
+}
+
+// accept serves every connection listener accepts
+func accept(storage store.Engine, listener net.Listener) {
+
 	for {
 		connection, err := listener.Accept()
 		handleError("server main: ", err)
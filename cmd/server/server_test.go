@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/viveknathani/retain/store"
+)
+
+func TestMain(m *testing.M) {
+
+	// main fills the ACL once every command is registered
+	acl.users = defaultUsers()
+	os.Exit(m.Run())
+}
+
+// newTestStorage opens a memory engine that saves under a temporary
+// directory, if it saves at all
+func newTestStorage(t *testing.T) store.Engine {
+
+	options := store.DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), "retain.db")
+
+	storage, _, err := store.Open(options)
+	if err != nil {
+		log.Fatalf("failed to open the storage: %v", err)
+	}
+	return storage
+}
+
+// newTestSession is a session on one end of a pipe nobody reads, for
+// commands that do not block
+func newTestSession() *session {
+
+	connection, _ := net.Pipe()
+	return newSession(connection)
+}
+
+// run dispatches the command made of args as if client sent it
+func run(storage store.Engine, client *session, args ...string) interface{} {
+
+	respArray := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		respArray = append(respArray, []byte(arg))
+	}
+	return dispatch(storage, client, respArray)
+}
+
+// fakeEngine is a store.Engine that hands everything over to the engine
+// it wraps but the persistence calls, which it counts and fails with err
+// when err is set. Its databases share that with it.
+type fakeEngine struct {
+	store.Engine
+	*fakeState
+}
+
+type fakeState struct {
+	err   error
+	saves int
+}
+
+// newFakeEngine wraps a memory engine opened by newTestStorage
+func newFakeEngine(t *testing.T) *fakeEngine {
+
+	return &fakeEngine{Engine: newTestStorage(t), fakeState: &fakeState{}}
+}
+
+func (engine *fakeEngine) DB(index int) (store.Engine, error) {
+
+	db, err := engine.Engine.DB(index)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeEngine{Engine: db, fakeState: engine.fakeState}, nil
+}
+
+func (engine *fakeEngine) Save() error {
+
+	engine.saves++
+	return engine.err
+}
+
+func (engine *fakeEngine) BackgroundSave() error {
+
+	engine.saves++
+	return engine.err
+}
+
+func (engine *fakeEngine) RewriteAppendOnlyFile() error {
+
+	return engine.err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+var errorCountOutOfRange = errors.New("ERR value is out of range")
+
+// sadd implements SADD key member [member ...] and, with remove
+// set, SREM key member [member ...]
+func sadd(storage store.Engine, respArray []interface{}, remove bool) interface{} {
+
+	key := respArray[1].([]byte)
+	members := arguments(respArray[2:])
+
+	var changed int
+	var err error
+	if remove {
+		changed, err = storage.SRem(key, members...)
+	} else {
+		changed, err = storage.SAdd(key, members...)
+	}
+	if err != nil {
+		return err
+	}
+	return changed
+}
+
+// smembers implements SMEMBERS key
+func smembers(storage store.Engine, respArray []interface{}) interface{} {
+
+	members, err := storage.SMembers(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+	return toSet(members)
+}
+
+// sismember implements SISMEMBER key member
+func sismember(storage store.Engine, respArray []interface{}) interface{} {
+
+	isMember, err := storage.SIsMember(respArray[1].([]byte), respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+	if isMember {
+		return 1
+	}
+	return 0
+}
+
+// scard implements SCARD key
+func scard(storage store.Engine, respArray []interface{}) interface{} {
+
+	cardinality, err := storage.SCard(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+	return cardinality
+}
+
+// algebra implements SINTER, SUNION and SDIFF key [key ...]
+func algebra(respArray []interface{}, operation func(keys ...store.RetainKey) ([][]byte, error)) interface{} {
+
+	members, err := operation(keys(respArray[1:])...)
+	if err != nil {
+		return err
+	}
+	return toSet(members)
+}
+
+// algebraStore implements SINTERSTORE, SUNIONSTORE and
+// SDIFFSTORE destination key [key ...]
+func algebraStore(respArray []interface{}, operation func(destination store.RetainKey, keys ...store.RetainKey) (int, error)) interface{} {
+
+	size, err := operation(respArray[1].([]byte), keys(respArray[2:])...)
+	if err != nil {
+		return err
+	}
+	return size
+}
+
+// srandmember implements SRANDMEMBER key [count] and, with remove
+// set, SPOP key [count]. Without a count the reply is a single member,
+// with one it is an array.
+func srandmember(storage store.Engine, respArray []interface{}, remove bool) interface{} {
+
+	if len(respArray) > 3 {
+		return errorSyntax
+	}
+
+	count := 1
+	if len(respArray) == 3 {
+		number, err := strconv.Atoi(string(respArray[2].([]byte)))
+		if err != nil {
+			return errorNotInteger
+		}
+		if remove && number < 0 {
+			return errorNotPositive
+		}
+		count = number
+	}
+
+	key := respArray[1].([]byte)
+	var members [][]byte
+	var err error
+	if remove {
+		members, err = storage.SPop(key, count)
+	} else {
+		members, err = storage.SRandMember(key, count)
+	}
+	if err == store.ErrCountOutOfRange {
+		return errorCountOutOfRange
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(respArray) == 2 {
+		if len(members) == 0 {
+			return nil
+		}
+		return members[0]
+	}
+	if members == nil {
+		return [][]byte{}
+	}
+	return members
+}
+
+// keys converts the bulk strings of a request into keys
+func keys(respArray []interface{}) []store.RetainKey {
+
+	result := make([]store.RetainKey, 0, len(respArray))
+	for _, item := range respArray {
+		result = append(result, item.([]byte))
+	}
+	return result
+}
+
+// toSet makes members a set reply, which RESP2 clients see as an array
+func toSet(members [][]byte) protocol.Set {
+
+	result := make(protocol.Set, 0, len(members))
+	for _, member := range members {
+		result = append(result, member)
+	}
+	return result
+}
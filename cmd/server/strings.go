@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorOverflow    = errors.New("ERR increment or decrement would overflow")
+	errorNaN         = errors.New("ERR increment would produce NaN or Infinity")
+	errorOffset      = errors.New("ERR offset is out of range")
+	errorStringLimit = errors.New("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// get implements GET key
+func get(storage store.Engine, respArray []interface{}) interface{} {
+
+	value, ok, err := storage.Get(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	if !ok {
+		return nil
+	}
+
+	data, ok := value.([]byte)
+	if !ok {
+		return store.ErrWrongType
+	}
+	// reply with a bulk string, values can be larger than a simple line
+	return data
+}
+
+// mset implements MSET key value [key value ...]
+func mset(storage store.Engine, respArray []interface{}) interface{} {
+
+	if len(respArray)%2 == 0 {
+		return wrongArity(respArray)
+	}
+
+	err := storage.MSet(arguments(respArray[1:])...)
+	if err != nil {
+		return replyError(err)
+	}
+	return "OK"
+}
+
+// mget implements MGET key [key ...]
+func mget(storage store.Engine, respArray []interface{}) interface{} {
+
+	values, err := storage.MGet(keys(respArray[1:])...)
+	if err != nil {
+		return replyError(err)
+	}
+
+	arr := make([]interface{}, 0)
+	for _, value := range values {
+		data, isString := value.([]byte)
+		if !isString {
+			// like Redis, keys of other types read as missing
+			arr = append(arr, nil)
+			continue
+		}
+		arr = append(arr, data)
+	}
+	return arr
+}
+
+// incr implements INCR and DECR key, and with byArgument set INCRBY and
+// DECRBY key increment. sign is 1 for the first of each pair, -1 otherwise.
+func incr(storage store.Engine, respArray []interface{}, sign int64, byArgument bool) interface{} {
+
+	delta := sign
+	if byArgument {
+		number, err := strconv.ParseInt(string(respArray[2].([]byte)), 10, 64)
+		if err != nil {
+			return errorNotInteger
+		}
+		if sign < 0 && number == math.MinInt64 {
+			return errorOverflow
+		}
+		delta = sign * number
+	}
+
+	var result int64
+	_, err := storage.Update(respArray[1].([]byte), func(value store.RetainValue, exists bool) (store.RetainValue, error) {
+
+		current, err := integerValue(value, exists)
+		if err != nil {
+			return nil, err
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, errorOverflow
+		}
+		result = current + delta
+		return []byte(strconv.FormatInt(result, 10)), nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// incrbyfloat implements INCRBYFLOAT key increment, the new value
+// comes back as a bulk string like in Redis
+func incrbyfloat(storage store.Engine, respArray []interface{}) interface{} {
+
+	delta, err := strconv.ParseFloat(string(respArray[2].([]byte)), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return errorNotFloat
+	}
+
+	value, err := storage.Update(respArray[1].([]byte), func(value store.RetainValue, exists bool) (store.RetainValue, error) {
+
+		current := 0.0
+		if exists {
+			data, ok := value.([]byte)
+			if !ok {
+				return nil, store.ErrWrongType
+			}
+			current, err = strconv.ParseFloat(string(data), 64)
+			if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+				return nil, errorNotFloat
+			}
+		}
+
+		result := current + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, errorNaN
+		}
+		return []byte(strconv.FormatFloat(result, 'f', -1, 64)), nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return value
+}
+
+// appendValue implements APPEND key value
+func appendValue(storage store.Engine, respArray []interface{}) interface{} {
+
+	suffix := respArray[2].([]byte)
+	value, err := storage.Update(respArray[1].([]byte), func(value store.RetainValue, exists bool) (store.RetainValue, error) {
+
+		data, err := stringValue(value, exists)
+		if err != nil {
+			return nil, err
+		}
+		if len(data)+len(suffix) > protocol.MaxBulkLength {
+			return nil, errorStringLimit
+		}
+
+		// build a new slice, the current one may be in use by readers
+		result := make([]byte, 0, len(data)+len(suffix))
+		result = append(result, data...)
+		return append(result, suffix...), nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return len(value.([]byte))
+}
+
+// strlen implements STRLEN key
+func strlen(storage store.Engine, respArray []interface{}) interface{} {
+
+	value, exists, err := storage.Get(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	data, err := stringValue(value, exists)
+	if err != nil {
+		return err
+	}
+	return len(data)
+}
+
+// getrange implements GETRANGE key start end, negative offsets count
+// from the end of the string and both ends are inclusive
+func getrange(storage store.Engine, respArray []interface{}) interface{} {
+
+	start, end, err := integers(respArray[2], respArray[3])
+	if err != nil {
+		return err
+	}
+
+	value, exists, err := storage.Get(respArray[1].([]byte))
+	if err != nil {
+		return replyError(err)
+	}
+	data, err := stringValue(value, exists)
+	if err != nil {
+		return err
+	}
+
+	length := len(data)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || start > end {
+		return []byte{}
+	}
+	return data[start : end+1]
+}
+
+// setrange implements SETRANGE key offset value, the string is padded
+// with zero bytes when offset lies past its end
+func setrange(storage store.Engine, respArray []interface{}) interface{} {
+
+	offset, err := strconv.Atoi(string(respArray[2].([]byte)))
+	if err != nil {
+		return errorNotInteger
+	}
+	if offset < 0 {
+		return errorOffset
+	}
+
+	key := respArray[1].([]byte)
+	patch := respArray[3].([]byte)
+	if len(patch) == 0 {
+		// nothing to write, and a missing key is not created
+		return strlen(storage, respArray[:2])
+	}
+	// offset+len(patch) would overflow for offsets near the largest int
+	if offset > protocol.MaxBulkLength-len(patch) {
+		return errorStringLimit
+	}
+
+	value, err := storage.Update(key, func(value store.RetainValue, exists bool) (store.RetainValue, error) {
+
+		data, err := stringValue(value, exists)
+		if err != nil {
+			return nil, err
+		}
+
+		length := len(data)
+		if offset+len(patch) > length {
+			length = offset + len(patch)
+		}
+
+		result := make([]byte, length)
+		copy(result, data)
+		copy(result[offset:], patch)
+		return result, nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return len(value.([]byte))
+}
+
+// getdel implements GETDEL key
+func getdel(storage store.Engine, respArray []interface{}) interface{} {
+
+	var previous interface{}
+	_, err := storage.Update(respArray[1].([]byte), func(value store.RetainValue, exists bool) (store.RetainValue, error) {
+
+		if !exists {
+			return nil, nil
+		}
+
+		data, ok := value.([]byte)
+		if !ok {
+			return nil, store.ErrWrongType
+		}
+		previous = data
+		return nil, nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return previous
+}
+
+// getset implements GETSET key value, which is SET key value GET
+func getset(storage store.Engine, respArray []interface{}) interface{} {
+
+	return set(storage, []interface{}{[]byte("SET"), respArray[1], respArray[2], []byte("GET")})
+}
+
+// getex implements GETEX key [EX s|PX ms|EXAT ts|PXAT ts|PERSIST]
+func getex(storage store.Engine, respArray []interface{}) interface{} {
+
+	var at time.Time
+	persist := false
+	if len(respArray) > 2 {
+		option := strings.ToUpper(string(respArray[2].([]byte)))
+		switch {
+
+		case option == "PERSIST" && len(respArray) == 3:
+			persist = true
+
+		case (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT") && len(respArray) == 4:
+			deadline, err := parseDeadline(respArray[3].([]byte), option == "EX" || option == "EXAT", option == "EXAT" || option == "PXAT")
+			if err != nil {
+				return err
+			}
+			at = deadline
+
+		default:
+			return errorSyntax
+		}
+	}
+
+	value, exists, err := storage.GetEx(respArray[1].([]byte), at, persist)
+	if err != nil {
+		return replyError(err)
+	}
+	if !exists {
+		return nil
+	}
+
+	data, ok := value.([]byte)
+	if !ok {
+		return store.ErrWrongType
+	}
+	return data
+}
+
+// stringValue returns value as bytes, which are empty if the key
+// does not exist, or an error if it holds something else
+func stringValue(value store.RetainValue, exists bool) ([]byte, error) {
+
+	if !exists {
+		return []byte{}, nil
+	}
+
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, store.ErrWrongType
+	}
+	return data, nil
+}
+
+// integerValue reads value as a 64 bit integer, 0 if the key does not exist
+func integerValue(value store.RetainValue, exists bool) (int64, error) {
+
+	data, err := stringValue(value, exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	number, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, errorNotInteger
+	}
+	return number, nil
+}
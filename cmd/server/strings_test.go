@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+func TestSetRange(t *testing.T) {
+
+	storage := newTestStorage(t)
+	client := newTestSession()
+
+	if reply := run(storage, client, "SETRANGE", "key", "2", "ab"); reply != 4 {
+		log.Fatalf("failed SETRANGE on a missing key, got: %v", reply)
+	}
+	if reply := run(storage, client, "GET", "key"); !reflect.DeepEqual(reply, []byte("\x00\x00ab")) {
+		log.Fatalf("failed SETRANGE, got: %q", reply)
+	}
+
+	// offsets that would take the string past the largest bulk string,
+	// including those where offset plus length overflows
+	for _, offset := range []string{fmt.Sprint(protocol.MaxBulkLength - 1), "9223372036854775807"} {
+		if reply := run(storage, client, "SETRANGE", "key", offset, "xy"); reply != errorStringLimit {
+			log.Fatalf("failed SETRANGE at offset %s, got: %v", offset, reply)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// handshakeTimeout bounds how long a TLS client may take to handshake
+const handshakeTimeout = 10 * time.Second
+
+// certificates holds the TLS configuration made from the certificate,
+// key and certificate authorities on disk, which load reads again on
+// SIGHUP. Connections made before keep the configuration they started
+// with.
+type certificates struct {
+	certFile    string
+	keyFile     string
+	caFile      string
+	authClients tls.ClientAuthType
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// parseAuthClients reads -tls-auth-clients: yes to require a certificate
+// of the clients, optional to check those they send and no to ask none
+func parseAuthClients(value string) (tls.ClientAuthType, error) {
+
+	switch value {
+	case "yes":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "no":
+		return tls.NoClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid -tls-auth-clients %q, pick yes, optional or no", value)
+}
+
+// load reads the files again, keeping the configuration it had if one
+// of them is wrong
+func (certs *certificates) load() error {
+
+	certificate, err := tls.LoadX509KeyPair(certs.certFile, certs.keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if certs.caFile != "" {
+		pem, err := os.ReadFile(certs.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", certs.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = certs.authClients
+	}
+
+	certs.mu.Lock()
+	certs.config = config
+	certs.mu.Unlock()
+	return nil
+}
+
+// serverConfig is the configuration of the TLS listener, which picks
+// the current one for every connection
+func (certs *certificates) serverConfig() *tls.Config {
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certs.mu.RLock()
+			defer certs.mu.RUnlock()
+			return certs.config, nil
+		},
+	}
+}
+
+// reloadOnHangup loads the certificates again every time the server
+// gets a SIGHUP, from the moment it returns
+func (certs *certificates) reloadOnHangup() {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for range hangup {
+			err := certs.load()
+			if err != nil {
+				printColor(colorRed)
+				fmt.Printf("failed to reload the TLS certificates, keeping the previous ones: %v\n", err)
+				printColor(colorReset)
+				continue
+			}
+
+			printColor(colorGreen)
+			fmt.Println("reloaded the TLS certificates")
+			printColor(colorReset)
+		}
+	}()
+}
+
+// handshake completes the TLS handshake of client and logs it in as the
+// ACL user named by the common name of its certificate, if it sent one
+// and there is such a user
+func handshake(client *session, connection *tls.Conn) error {
+
+	err := connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err == nil {
+		err = connection.Handshake()
+	}
+	if err == nil {
+		err = connection.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		return errors.New("TLS handshake failed: " + err.Error())
+	}
+
+	peers := connection.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return nil
+	}
+
+	name := peers[0].Subject.CommonName
+	if name != "" && acl.lookup(name) != nil {
+		client.user = name
+	}
+	return nil
+}
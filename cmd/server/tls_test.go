@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// issue makes a certificate for name signed by parent, or a certificate
+// authority when parent is nil
+func issue(name string, parent *tls.Certificate) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handleError("failed to generate a key:", err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	handleError("failed to create a certificate:", err)
+	leaf, err := x509.ParseCertificate(der)
+	handleError("failed to parse a certificate:", err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes the certificate and key of certificate to the
+// files the flags of the server would name
+func writeCertificate(certificate tls.Certificate, certFile string, keyFile string) {
+
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	handleError("failed to encode a key:", err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600)
+	handleError("failed to write a certificate:", err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	handleError("failed to write a key:", err)
+}
+
+// connectTLS makes a connection to certs as a client configured by
+// config would, and returns the session of the server once handshake is
+// done along with what the client saw
+func connectTLS(certs *certificates, config *tls.Config) (*session, tls.ConnectionState, error) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError("failed to listen:", err)
+	defer listener.Close()
+
+	states := make(chan tls.ConnectionState, 1)
+	go func() {
+
+		connection, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			states <- tls.ConnectionState{}
+			return
+		}
+		defer connection.Close()
+
+		// the server has the last word with TLS 1.3, wait for it
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		connection.Read(make([]byte, 1))
+		states <- connection.ConnectionState()
+	}()
+
+	connection, err := listener.Accept()
+	handleError("failed to accept:", err)
+	defer connection.Close()
+
+	tlsConnection := tls.Server(connection, certs.serverConfig())
+	client := newSession(tlsConnection)
+	err = handshake(client, tlsConnection)
+	tlsConnection.Close()
+	return client, <-states, err
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+
+	defer resetACL()
+	handleError("failed ACL SETUSER:", acl.setUser("alice", []string{"on", "nopass", "~*", "+@all"}))
+
+	dir := t.TempDir()
+	authority := issue("authority", nil)
+	certs := &certificates{
+		certFile: filepath.Join(dir, "server.crt"),
+		keyFile:  filepath.Join(dir, "server.key"),
+		caFile:   filepath.Join(dir, "ca.crt"),
+	}
+	writeCertificate(issue("server", &authority), certs.certFile, certs.keyFile)
+	writeCertificate(authority, certs.caFile, filepath.Join(dir, "ca.key"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Leaf)
+	anonymous := &tls.Config{RootCAs: roots}
+	alice := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{issue("alice", &authority)}}
+	stranger := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{issue("bob", &authority)}}
+
+	// clients leave out certificates the server does not say it trusts
+	// the issuer of, unless they pick theirs themselves
+	forged := issue("alice", nil)
+	forger := &tls.Config{RootCAs: roots, GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &forged, nil
+	}}
+
+	tests := []struct {
+		authClients string
+		config      *tls.Config
+		user        string
+		fails       bool
+	}{
+		// the common name of a certificate names the ACL user
+		{"yes", alice, "alice", false},
+		{"yes", stranger, defaultUser, false},
+		{"yes", anonymous, "", true},
+		{"yes", forger, "", true},
+
+		// optional only checks the certificates clients send
+		{"optional", alice, "alice", false},
+		{"optional", anonymous, defaultUser, false},
+		{"optional", forger, "", true},
+
+		// and no asks for none, so there is nobody to log in as
+		{"no", alice, defaultUser, false},
+		{"no", anonymous, defaultUser, false},
+	}
+
+	for _, test := range tests {
+		authClients, err := parseAuthClients(test.authClients)
+		handleError("failed parseAuthClients:", err)
+		certs.authClients = authClients
+		handleError("failed to load the certificates:", certs.load())
+
+		client, _, err := connectTLS(certs, test.config)
+		if test.fails != (err != nil) {
+			log.Fatalf("failed handshake with -tls-auth-clients %s, expected it to fail: %v, got: %v", test.authClients, test.fails, err)
+		}
+		if !test.fails && client.user != test.user {
+			log.Fatalf("failed handshake with -tls-auth-clients %s, logged in as %q instead of %q", test.authClients, client.user, test.user)
+		}
+	}
+
+	if _, err := parseAuthClients("maybe"); err == nil {
+		log.Fatalf("failed parseAuthClients, maybe was taken")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+
+	dir := t.TempDir()
+	authority := issue("authority", nil)
+	certs := &certificates{
+		certFile: filepath.Join(dir, "server.crt"),
+		keyFile:  filepath.Join(dir, "server.key"),
+	}
+	writeCertificate(issue("first", &authority), certs.certFile, certs.keyFile)
+	handleError("failed to load the certificates:", certs.load())
+	certs.reloadOnHangup()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Leaf)
+	config := &tls.Config{RootCAs: roots}
+
+	// served is the common name of the certificate clients get
+	served := func() string {
+		_, state, err := connectTLS(certs, config)
+		handleError("failed handshake:", err)
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+	hangup := func() {
+		process, err := os.FindProcess(os.Getpid())
+		handleError("failed to find the test process:", err)
+		handleError("failed to send SIGHUP:", process.Signal(syscall.SIGHUP))
+	}
+
+	if name := served(); name != "first" {
+		log.Fatalf("failed to serve the certificate, got: %s", name)
+	}
+
+	writeCertificate(issue("second", &authority), certs.certFile, certs.keyFile)
+	hangup()
+	for deadline := time.Now().Add(5 * time.Second); served() != "second"; {
+		if time.Now().After(deadline) {
+			log.Fatalf("failed to reload the certificate on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken file is not loaded, the previous certificate stays
+	handleError("failed to write the key:", os.WriteFile(certs.keyFile, []byte("not a key"), 0600))
+	hangup()
+	time.Sleep(100 * time.Millisecond)
+	if name := served(); name != "second" {
+		log.Fatalf("failed to keep the certificate after a broken reload, got: %s", name)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/viveknathani/retain/protocol"
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorNestedMulti    = errors.New("ERR MULTI calls can not be nested")
+	errorExecNoMulti    = errors.New("ERR EXEC without MULTI")
+	errorDiscardNoMulti = errors.New("ERR DISCARD without MULTI")
+	errorWatchInMulti   = errors.New("ERR WATCH inside MULTI is not allowed")
+	errorExecAbort      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+)
+
+// exclusive keeps transactions from being seen half done. EXEC holds it
+// while it runs, every other command holds it shared.
+var exclusive sync.RWMutex
+
+// watchedKey is a key watched in one of the databases
+type watchedKey struct {
+	db  store.Engine
+	key string
+}
+
+// transaction holds the commands queued after MULTI. It fails when a
+// command could not be queued, EXEC then runs none of them.
+type transaction struct {
+	queued []queuedCommand
+	failed bool
+}
+
+// queuedCommand is a command queued after MULTI along with its arguments
+type queuedCommand struct {
+	cmd       *command
+	respArray []interface{}
+}
+
+// dispatch runs the command in respArray for client, or queues
+// it if client has a transaction open
+func dispatch(storage store.Engine, client *session, respArray []interface{}) interface{} {
+
+	db := client.database(storage)
+
+	cmd, err := lookup(respArray)
+	if err != nil {
+		if client.transaction != nil {
+			client.transaction.failed = true
+		}
+		return err
+	}
+
+	err = acl.authorize(client, cmd, respArray)
+	if err != nil {
+		if client.transaction != nil {
+			client.transaction.failed = true
+		}
+		return err
+	}
+
+	// RESP2 has no way to tell replies from published messages,
+	// so a subscribed client is limited to managing subscriptions
+	if client.subscriptions() > 0 && client.writer.Version() == protocol.RESP2 {
+		switch cmd.name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+		case "ping":
+			message := []byte{}
+			if len(respArray) > 1 {
+				message = respArray[1].([]byte)
+			}
+			return []interface{}{[]byte("pong"), message}
+		default:
+			return errors.New("ERR Can't execute '" + cmd.name + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+		}
+	}
+
+	// these are never queued
+	switch cmd.name {
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "multi", "exec", "discard", "watch":
+		return cmd.run(db, client, respArray)
+
+	case "unwatch":
+		if client.transaction == nil {
+			return cmd.run(db, client, respArray)
+		}
+	}
+
+	if client.transaction != nil {
+		client.transaction.queued = append(client.transaction.queued, queuedCommand{cmd, respArray})
+		return "QUEUED"
+	}
+
+	// a blocking command waits without the lock, holding it would
+	// keep the EXEC that could hand it an element from ever running,
+	// but it is refused for want of memory before it starts waiting
+	if cmd.has("blocking") {
+		exclusive.RLock()
+		err := freeMemory(storage, cmd)
+		exclusive.RUnlock()
+		if err != nil {
+			return err
+		}
+		return executeCommand(db, client, cmd, respArray)
+	}
+
+	exclusive.RLock()
+	defer exclusive.RUnlock()
+
+	if err := freeMemory(storage, cmd); err != nil {
+		return err
+	}
+	return executeCommand(db, client, cmd, respArray)
+}
+
+// multi implements MULTI
+func multi(client *session, respArray []interface{}) interface{} {
+
+	if client.transaction != nil {
+		return errorNestedMulti
+	}
+
+	client.transaction = &transaction{}
+	return "OK"
+}
+
+// exec implements EXEC. The queued commands run with no other command
+// in between, unless a watched key changed since WATCH in which case
+// none of them run and the reply is a null array. Blocking commands do
+// not block while they run.
+func exec(storage store.Engine, client *session, respArray []interface{}) interface{} {
+
+	if client.transaction == nil {
+		return errorExecNoMulti
+	}
+
+	queued, failed := client.transaction.queued, client.transaction.failed
+	client.transaction = nil
+	if failed {
+		unwatchAll(client)
+		return errorExecAbort
+	}
+
+	exclusive.Lock()
+	defer exclusive.Unlock()
+	defer unwatchAll(client)
+
+	// clients blocked on a list get served once the transaction is over
+	storage.BeginBatch()
+	defer storage.EndBatch()
+
+	for watched, version := range client.watching {
+		current, err := watched.db.Version(store.RetainKey(watched.key))
+		if err != nil {
+			return replyError(err)
+		}
+		if current != version {
+			return protocol.NullArray{}
+		}
+	}
+
+	// the transaction runs as a whole or not at all, so room is
+	// made for all of it before the first command
+	for _, command := range queued {
+		if err := freeMemory(storage, command.cmd); err != nil {
+			return err
+		}
+	}
+
+	client.executing = true
+	defer func() { client.executing = false }()
+
+	replies := make([]interface{}, 0, len(queued))
+	for _, command := range queued {
+		// a queued UNWATCH runs after the keys were checked, and
+		// they are all unwatched once EXEC is done anyway
+		if command.cmd.name == "unwatch" {
+			replies = append(replies, "OK")
+			continue
+		}
+		// the user may have lost permissions since the command was queued
+		if err := acl.authorize(client, command.cmd, command.respArray); err != nil {
+			replies = append(replies, err)
+			continue
+		}
+		// a queued SELECT changes the database of those after it
+		replies = append(replies, executeCommand(client.database(storage), client, command.cmd, command.respArray))
+	}
+	return replies
+}
+
+// discard implements DISCARD
+func discard(storage store.Engine, client *session, respArray []interface{}) interface{} {
+
+	if client.transaction == nil {
+		return errorDiscardNoMulti
+	}
+
+	client.transaction = nil
+	unwatchAll(client)
+	return "OK"
+}
+
+// watch implements WATCH key [key ...]
+func watch(storage store.Engine, client *session, respArray []interface{}) interface{} {
+
+	// like any other error while queueing, it dooms the EXEC
+	if client.transaction != nil {
+		client.transaction.failed = true
+		return errorWatchInMulti
+	}
+
+	if client.watching == nil {
+		client.watching = make(map[watchedKey]uint64)
+	}
+
+	for _, key := range keys(respArray[1:]) {
+		// watching a key twice keeps the first version
+		watched := watchedKey{storage, string(key)}
+		if _, ok := client.watching[watched]; ok {
+			continue
+		}
+		version, err := storage.Watch(key)
+		if err != nil {
+			return replyError(err)
+		}
+		client.watching[watched] = version
+	}
+	return "OK"
+}
+
+// unwatch implements UNWATCH
+func unwatch(client *session, respArray []interface{}) interface{} {
+
+	unwatchAll(client)
+	return "OK"
+}
+
+// unwatchAll forgets every key client watches
+func unwatchAll(client *session) {
+
+	for watched := range client.watching {
+		watched.db.Unwatch(store.RetainKey(watched.key))
+	}
+	client.watching = nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/viveknathani/retain/store"
+)
+
+func TestTransaction(t *testing.T) {
+
+	storage := newTestStorage(t)
+	client := newTestSession()
+
+	run(storage, client, "MULTI")
+	run(storage, client, "SET", "key", "value")
+	run(storage, client, "INCR", "counter")
+	reply := run(storage, client, "EXEC")
+	if !reflect.DeepEqual(reply, []interface{}{"OK", int64(1)}) {
+		log.Fatalf("failed EXEC, got: %v", reply)
+	}
+
+	// errors while queueing abort the transaction, whatever the command
+	for _, args := range [][]string{{"NOSUCHCOMMAND"}, {"GET"}, {"WATCH", "key"}} {
+		run(storage, client, "MULTI")
+		run(storage, client, "SET", "key", "other")
+		if reply := run(storage, client, args...); !isError(reply, "ERR") {
+			log.Fatalf("failed %s in MULTI, got: %v", args[0], reply)
+		}
+		if reply := run(storage, client, "EXEC"); reply != errorExecAbort {
+			log.Fatalf("failed EXEC after %s, got: %v", args[0], reply)
+		}
+	}
+	if reply := run(storage, client, "GET", "key"); !reflect.DeepEqual(reply, []byte("value")) {
+		log.Fatalf("failed EXEC, an aborted transaction wrote: %q", reply)
+	}
+}
+
+func TestBlockingOutOfMemory(t *testing.T) {
+
+	options := store.DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), "retain.db")
+	options.MaxMemory = 1
+	storage, _, err := store.Open(options)
+	handleError("failed to open the storage:", err)
+	client := newTestSession()
+
+	// the first write fits, and leaves no room for another
+	if reply := run(storage, client, "RPUSH", "source", "element"); reply != 1 {
+		log.Fatalf("failed RPUSH, got: %v", reply)
+	}
+	if reply := run(storage, client, "BLMOVE", "source", "destination", "LEFT", "RIGHT", "0"); !isError(reply, "OOM") {
+		log.Fatalf("failed BLMOVE without memory, got: %v", reply)
+	}
+	if run(storage, client, "EXISTS", "destination") != 0 {
+		log.Fatalf("failed BLMOVE without memory, the element was moved")
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/viveknathani/retain/store"
+)
+
+var (
+	errorNotScore      = errors.New("ERR min or max is not a float")
+	errorNotLex        = errors.New("ERR min or max not valid string range item")
+	errorNXAndXX       = errors.New("ERR XX and NX options at the same time are not compatible")
+	errorNXAndGTLT     = errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	errorIncrPairs     = errors.New("ERR INCR option supports a single increment-element pair")
+	errorLimitWithRank = errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errorScoresWithLex = errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+)
+
+// the ways a range of a sorted set can be given
+const (
+	byRank = iota
+	byScore
+	byLex
+)
+
+// zadd implements ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zadd(storage store.Engine, respArray []interface{}) interface{} {
+
+	options := store.ZAddOptions{}
+	increment := false
+
+	i := 2
+options:
+	for ; i < len(respArray); i++ {
+		switch strings.ToUpper(string(respArray[i].([]byte))) {
+		case "NX":
+			options.OnlyIfMissing = true
+		case "XX":
+			options.OnlyIfExists = true
+		case "GT":
+			options.OnlyIfGreater = true
+		case "LT":
+			options.OnlyIfLess = true
+		case "CH":
+			options.Changed = true
+		case "INCR":
+			increment = true
+		default:
+			break options
+		}
+	}
+
+	rest := respArray[i:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return errorSyntax
+	}
+	if options.OnlyIfMissing && options.OnlyIfExists {
+		return errorNXAndXX
+	}
+	if (options.OnlyIfGreater && options.OnlyIfLess) || (options.OnlyIfMissing && (options.OnlyIfGreater || options.OnlyIfLess)) {
+		return errorNXAndGTLT
+	}
+	if increment && len(rest) != 2 {
+		return errorIncrPairs
+	}
+
+	members := make([]store.ScoredMember, 0, len(rest)/2)
+	for j := 0; j < len(rest); j += 2 {
+		score, err := parseScore(rest[j].([]byte))
+		if err != nil {
+			return err
+		}
+		members = append(members, store.ScoredMember{Member: rest[j+1].([]byte), Score: score})
+	}
+
+	key := respArray[1].([]byte)
+	if increment {
+		score, ok, err := storage.ZAddIncr(key, members[0].Member, members[0].Score, options)
+		if err != nil {
+			return replyError(err)
+		}
+		if !ok {
+			return nil
+		}
+		return score
+	}
+
+	result, err := storage.ZAdd(key, members, options)
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// zincrby implements ZINCRBY key increment member
+func zincrby(storage store.Engine, respArray []interface{}) interface{} {
+
+	increment, err := parseScore(respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+
+	score, err := storage.ZIncrBy(respArray[1].([]byte), respArray[3].([]byte), increment)
+	if err != nil {
+		return replyError(err)
+	}
+	return score
+}
+
+// zrem implements ZREM key member [member ...]
+func zrem(storage store.Engine, respArray []interface{}) interface{} {
+
+	removed, err := storage.ZRem(respArray[1].([]byte), arguments(respArray[2:])...)
+	if err != nil {
+		return err
+	}
+	return removed
+}
+
+// zscore implements ZSCORE key member
+func zscore(storage store.Engine, respArray []interface{}) interface{} {
+
+	score, ok, err := storage.ZScore(respArray[1].([]byte), respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return score
+}
+
+// zcard implements ZCARD key
+func zcard(storage store.Engine, respArray []interface{}) interface{} {
+
+	cardinality, err := storage.ZCard(respArray[1].([]byte))
+	if err != nil {
+		return err
+	}
+	return cardinality
+}
+
+// zrank implements ZRANK key member and, with reverse set, ZREVRANK
+func zrank(storage store.Engine, respArray []interface{}, reverse bool) interface{} {
+
+	rank, ok, err := storage.ZRank(respArray[1].([]byte), respArray[2].([]byte), reverse)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return rank
+}
+
+// zcount implements ZCOUNT key min max
+func zcount(storage store.Engine, respArray []interface{}) interface{} {
+
+	min, err := parseScoreBound(respArray[2].([]byte))
+	if err != nil {
+		return err
+	}
+	max, err := parseScoreBound(respArray[3].([]byte))
+	if err != nil {
+		return err
+	}
+
+	count, err := storage.ZCount(respArray[1].([]byte), min, max)
+	if err != nil {
+		return err
+	}
+	return count
+}
+
+// zrange implements ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT
+// offset count] [WITHSCORES], and the older ZREVRANGE, ZRANGEBYSCORE,
+// ZREVRANGEBYSCORE, ZRANGEBYLEX and ZREVRANGEBYLEX which fix the mode
+// and the direction. Reversed ranges take the bounds highest first.
+func zrange(storage store.Engine, respArray []interface{}, mode int, reverse bool) interface{} {
+
+	command := strings.ToUpper(string(respArray[0].([]byte)))
+	withScores := false
+	hasLimit := false
+	limit := store.NoLimit
+
+	options := respArray[4:]
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(string(options[i].([]byte)))
+		switch {
+
+		case option == "WITHSCORES":
+			withScores = true
+
+		case option == "LIMIT" && i+2 < len(options):
+			offset, err := strconv.Atoi(string(options[i+1].([]byte)))
+			if err != nil {
+				return errorNotInteger
+			}
+			count, err := strconv.Atoi(string(options[i+2].([]byte)))
+			if err != nil {
+				return errorNotInteger
+			}
+			limit = store.Limit{Offset: offset, Count: count}
+			hasLimit = true
+			i += 2
+
+		// the remaining options only exist for ZRANGE itself
+		case option == "BYSCORE" && command == "ZRANGE":
+			mode = byScore
+
+		case option == "BYLEX" && command == "ZRANGE":
+			mode = byLex
+
+		case option == "REV" && command == "ZRANGE":
+			reverse = true
+
+		default:
+			return errorSyntax
+		}
+	}
+
+	if hasLimit && mode == byRank {
+		return errorLimitWithRank
+	}
+	if withScores && mode == byLex {
+		return errorScoresWithLex
+	}
+	if limit.Offset < 0 {
+		// Redis returns nothing for a negative offset
+		return [][]byte{}
+	}
+
+	key := respArray[1].([]byte)
+	start, stop := respArray[2].([]byte), respArray[3].([]byte)
+	if reverse && mode != byRank {
+		start, stop = stop, start
+	}
+
+	var members []store.ScoredMember
+	var err error
+	switch mode {
+
+	case byRank:
+		first, last, parseErr := integers(start, stop)
+		if parseErr != nil {
+			return parseErr
+		}
+		members, err = storage.ZRange(key, first, last, reverse)
+
+	case byScore:
+		min, parseErr := parseScoreBound(start)
+		if parseErr != nil {
+			return parseErr
+		}
+		max, parseErr := parseScoreBound(stop)
+		if parseErr != nil {
+			return parseErr
+		}
+		members, err = storage.ZRangeByScore(key, min, max, reverse, limit)
+
+	case byLex:
+		// "+" cannot be a minimum nor "-" a maximum
+		if string(start) == "+" || string(stop) == "-" {
+			return []interface{}{}
+		}
+		min, parseErr := parseLexBound(start)
+		if parseErr != nil {
+			return parseErr
+		}
+		max, parseErr := parseLexBound(stop)
+		if parseErr != nil {
+			return parseErr
+		}
+		members, err = storage.ZRangeByLex(key, min, max, reverse, limit)
+	}
+
+	if err != nil {
+		return err
+	}
+	return scoredReply(members, withScores)
+}
+
+// zpop implements ZPOPMIN and ZPOPMAX key [count]
+func zpop(storage store.Engine, respArray []interface{}, highest bool) interface{} {
+
+	if len(respArray) > 3 {
+		return errorSyntax
+	}
+
+	count := 1
+	if len(respArray) == 3 {
+		number, err := strconv.Atoi(string(respArray[2].([]byte)))
+		if err != nil {
+			return errorNotInteger
+		}
+		if number < 0 {
+			return errorNotPositive
+		}
+		count = number
+	}
+
+	var members []store.ScoredMember
+	var err error
+	if highest {
+		members, err = storage.ZPopMax(respArray[1].([]byte), count)
+	} else {
+		members, err = storage.ZPopMin(respArray[1].([]byte), count)
+	}
+	if err != nil {
+		return err
+	}
+	return scoredReply(members, true)
+}
+
+// scoredReply lists members, each followed by its score if withScores
+// is set. Scores are doubles in RESP3 and bulk strings in RESP2.
+func scoredReply(members []store.ScoredMember, withScores bool) []interface{} {
+
+	reply := make([]interface{}, 0, 2*len(members))
+	for _, member := range members {
+		reply = append(reply, member.Member)
+		if withScores {
+			reply = append(reply, member.Score)
+		}
+	}
+	return reply
+}
+
+func parseScore(arg []byte) (float64, error) {
+
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errorNotFloat
+	}
+	return score, nil
+}
+
+// parseScoreBound reads a score, exclusive when it starts with "("
+func parseScoreBound(arg []byte) (store.ScoreBound, error) {
+
+	bound := store.ScoreBound{}
+	if len(arg) > 0 && arg[0] == '(' {
+		bound.Exclusive = true
+		arg = arg[1:]
+	}
+
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return bound, errorNotScore
+	}
+	bound.Value = score
+	return bound, nil
+}
+
+// parseLexBound reads "-" or "+" for no bound, or a member starting
+// with "[" when inclusive and "(" when exclusive
+func parseLexBound(arg []byte) (store.LexBound, error) {
+
+	switch {
+	case len(arg) == 1 && (arg[0] == '-' || arg[0] == '+'):
+		return store.LexBound{Unbounded: true}, nil
+	case len(arg) > 0 && arg[0] == '[':
+		return store.LexBound{Value: arg[1:]}, nil
+	case len(arg) > 0 && arg[0] == '(':
+		return store.LexBound{Value: arg[1:], Exclusive: true}, nil
+	}
+	return store.LexBound{}, errorNotLex
+}
@@ -1,12 +1,16 @@
 // this package implements the RESP protocol (https://redis.io/topics/protocol)
+// along with the RESP3 additions (https://github.com/redis/redis-specifications)
 package protocol
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"log"
-	"reflect"
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type RespEncodedString []byte
@@ -19,87 +23,187 @@ const (
 	DOUBLE        = ','
 	BULK_STRINGS  = '$'
 	ARRAYS        = '*'
+
+	// RESP3 only
+	NULL       = '_'
+	BOOLEAN    = '#'
+	BLOB_ERROR = '!'
+	VERBATIM   = '='
+	BIG_NUMBER = '('
+	MAP        = '%'
+	SET        = '~'
+	ATTRIBUTE  = '|'
+	PUSH       = '>'
+)
+
+// protocol versions that can be negotiated with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 var (
-	errorMessageInvalidInput  = errors.New("failed to encode, invalid input")
-	errorMessageInvalidSyntax = errors.New("failed to decode, invalid syntax")
+	ErrInvalidInput  = errors.New("failed to encode, invalid input")
+	ErrInvalidSyntax = errors.New("failed to decode, invalid syntax")
 )
 
+// NullArray is the null reply of commands that otherwise reply with an
+// array. RESP2 has a null array of its own, RESP3 a single null type.
+type NullArray struct{}
+
+// Set is an unordered collection of values, encoded with the '~' type
+type Set []interface{}
+
+// Push is an out-of-band message, encoded with the '>' type
+type Push []interface{}
+
+// Verbatim is a string along with a three letter format hint
+// such as "txt" or "mkd", encoded with the '=' type
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+// Attribute carries auxiliary data alongside a reply,
+// encoded with the '|' type followed by Value
+type Attribute struct {
+	Attributes map[string]interface{}
+	Value      interface{}
+}
+
 // Encode will take variable type of input as content and
-// output a RESP-compliant string
+// output a RESP-compliant string, using RESP3 types where needed
 func Encode(content interface{}) RespEncodedString {
 
+	return EncodeVersion(content, RESP3)
+}
+
+// EncodeVersion is like Encode but restricts the output to the types
+// available in the given protocol version. RESP2 has no equivalent for
+// most RESP3 types so those are downgraded the same way Redis does it:
+// nulls become null bulk strings, booleans become integers, maps
+// become flat arrays and so on.
+func EncodeVersion(content interface{}, version int) RespEncodedString {
+
 	switch content := content.(type) {
 
+	case nil:
+		if version == RESP2 {
+			return RespEncodedString("$-1\r\n")
+		}
+		return RespEncodedString("_\r\n")
+
+	case NullArray:
+		if version == RESP2 {
+			return RespEncodedString("*-1\r\n")
+		}
+		return RespEncodedString("_\r\n")
+
 	case int:
 		return makeInt(content)
 
+	case int64:
+		return makeInt(int(content))
+
+	case bool:
+		if version == RESP2 {
+			if content {
+				return makeInt(1)
+			}
+			return makeInt(0)
+		}
+		return makeBool(content)
+
 	case float64:
+		if version == RESP2 {
+			return makeBulkString([]byte(formatDouble(content)))
+		}
 		return makeDouble(content)
 
+	case *big.Int:
+		if version == RESP2 {
+			return makeBulkString([]byte(content.String()))
+		}
+		return makeBigNumber(content)
+
 	case string:
 		return makeString(content)
 
 	case error:
+		if version == RESP3 && strings.ContainsAny(content.Error(), "\r\n") {
+			return makeBlobError(content)
+		}
 		return makeError(content)
 
 	case []byte:
 		return makeBulkString(content)
 
-	case [][]byte:
-		arr := reflect.ValueOf(content)
-		res := []byte(fmt.Sprintf("%c%d\r\n", ARRAYS, arr.Len()))
+	case Verbatim:
+		if version == RESP2 {
+			return makeBulkString([]byte(content.Text))
+		}
+		return makeVerbatim(content)
 
-		for i := 0; i < arr.Len(); i++ {
-			encoded := Encode(arr.Index(i).Interface().([]byte))
-			res = append(res, encoded...)
+	case [][]byte:
+		res := makeHeader(ARRAYS, len(content))
+		for _, item := range content {
+			res = append(res, makeBulkString(item)...)
 		}
 		return res
 
 	case []interface{}:
-		arr := reflect.ValueOf(content)
-		res := []byte(fmt.Sprintf("%c%d\r\n", ARRAYS, arr.Len()))
+		return makeAggregate(ARRAYS, content, version)
 
-		for i := 0; i < arr.Len(); i++ {
-			encoded := Encode(arr.Index(i).Interface())
-			res = append(res, encoded...)
+	case Set:
+		if version == RESP2 {
+			return makeAggregate(ARRAYS, content, version)
 		}
-		return res
+		return makeAggregate(SET, content, version)
+
+	case Push:
+		if version == RESP2 {
+			return makeAggregate(ARRAYS, content, version)
+		}
+		return makeAggregate(PUSH, content, version)
+
+	case map[string]interface{}:
+		return makeMap(MAP, content, version)
+
+	case Attribute:
+		if version == RESP2 {
+			return EncodeVersion(content.Value, version)
+		}
+		res := makeMap(ATTRIBUTE, content.Attributes, version)
+		return append(res, EncodeVersion(content.Value, version)...)
 	}
 
-	panic(errorMessageInvalidInput)
+	panic(ErrInvalidInput)
 }
 
 // Decode expects a RESP-compliant input and outputs the
 // corresponding data
 func Decode(content RespEncodedString) interface{} {
 
-	if len(content) == 0 {
-		return errorMessageInvalidSyntax
-	}
-
-	switch content[0] {
-
-	case SIMPLE_STRING:
-		return parseSimpleString(content)
-	case ERROR:
-		return parseError(content)
-	case INTEGER:
-		return parseInteger(content)
-	case DOUBLE:
-		return parseDouble(content)
-	case BULK_STRINGS:
-		return parseBulkString(content)
-	case ARRAYS:
-		return parseArray(content)
+	value, err := NewReader(bytes.NewReader(content)).ReadValue()
+	if err != nil {
+		return ErrInvalidSyntax
 	}
-
-	return errorMessageInvalidSyntax
+	return value
 }
 
 var CRLF = RespEncodedString("\r\n")
 
+func makeHeader(prefix byte, length int) RespEncodedString {
+
+	buffer := make(RespEncodedString, 0)
+	buffer = append(buffer, prefix)
+
+	buffer = append(buffer, RespEncodedString(strconv.Itoa(length))...)
+	buffer = append(buffer, CRLF[:]...)
+
+	return buffer
+}
+
 func makeInt(number int) RespEncodedString {
 
 	buffer := make(RespEncodedString, 0)
@@ -112,24 +216,69 @@ func makeInt(number int) RespEncodedString {
 	return buffer
 }
 
+func makeBool(value bool) RespEncodedString {
+
+	if value {
+		return RespEncodedString("#t\r\n")
+	}
+	return RespEncodedString("#f\r\n")
+}
+
 func makeDouble(number float64) RespEncodedString {
 
 	buffer := make(RespEncodedString, 0)
 	buffer = append(buffer, DOUBLE)
 
-	num := []byte(fmt.Sprintf("%f", number))
+	num := []byte(formatDouble(number))
 	buffer = append(buffer, num...)
 	buffer = append(buffer, CRLF[:]...)
 
 	return buffer
 }
 
+// formatDouble renders number in its shortest exact form,
+// using the RESP3 spelling for infinities and NaN
+func formatDouble(number float64) string {
+
+	switch {
+	case math.IsInf(number, 1):
+		return "inf"
+	case math.IsInf(number, -1):
+		return "-inf"
+	case math.IsNaN(number):
+		return "nan"
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+func makeBigNumber(number *big.Int) RespEncodedString {
+
+	buffer := make(RespEncodedString, 0)
+	buffer = append(buffer, BIG_NUMBER)
+
+	buffer = append(buffer, RespEncodedString(number.String())...)
+	buffer = append(buffer, CRLF[:]...)
+
+	return buffer
+}
+
 func makeError(err error) RespEncodedString {
 
 	buffer := make(RespEncodedString, 0)
 	buffer = append(buffer, ERROR)
 
+	// a simple error cannot span lines
+	raw := []byte(strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error()))
+	buffer = append(buffer, raw...)
+	buffer = append(buffer, CRLF[:]...)
+
+	return buffer
+}
+
+func makeBlobError(err error) RespEncodedString {
+
 	raw := []byte(err.Error())
+	buffer := makeHeader(BLOB_ERROR, len(raw))
 	buffer = append(buffer, raw...)
 	buffer = append(buffer, CRLF[:]...)
 
@@ -150,109 +299,71 @@ func makeString(str string) RespEncodedString {
 
 func makeBulkString(data []byte) RespEncodedString {
 
-	buffer := make(RespEncodedString, 0)
-	buffer = append(buffer, BULK_STRINGS)
-
-	buffer = append(buffer, RespEncodedString(strconv.Itoa(len(data)))...)
-	buffer = append(buffer, CRLF[:]...)
+	buffer := makeHeader(BULK_STRINGS, len(data))
 	buffer = append(buffer, data...)
 	buffer = append(buffer, CRLF[:]...)
 
 	return buffer
 }
 
-// excludeCRLFAndReturnIndex will read data until the first
-// occurence of CRLF
-func excludeCRLFAndReturnIndex(input RespEncodedString) ([]byte, int) {
+func makeVerbatim(verbatim Verbatim) RespEncodedString {
 
-	res := make(RespEncodedString, 0)
-	lastValidIndex := -1
-	for i := 0; i < len(input); i++ {
-
-		if input[i] == '\r' && i+1 < len(input) && input[i+1] == '\n' {
-			lastValidIndex = i
-			break
-		}
-
-		res = append(res, input[i])
+	format := verbatim.Format
+	if len(format) != 3 {
+		panic(ErrInvalidInput)
 	}
 
-	return res, lastValidIndex
-}
-
-func handleError(text string, err error) {
+	raw := []byte(format + ":" + verbatim.Text)
+	buffer := makeHeader(VERBATIM, len(raw))
+	buffer = append(buffer, raw...)
+	buffer = append(buffer, CRLF[:]...)
 
-	if err != nil {
-		log.Fatal(text, err)
-	}
+	return buffer
 }
 
-func parseSimpleString(input RespEncodedString) string {
+func makeAggregate(prefix byte, items []interface{}, version int) RespEncodedString {
 
-	output, _ := excludeCRLFAndReturnIndex(input[1:])
-	return string(output)
-}
-
-func parseError(input RespEncodedString) error {
+	buffer := makeHeader(prefix, len(items))
+	for _, item := range items {
+		buffer = append(buffer, EncodeVersion(item, version)...)
+	}
 
-	output, _ := excludeCRLFAndReturnIndex(input[1:])
-	return errors.New(string(output))
+	return buffer
 }
 
-func parseInteger(input RespEncodedString) int {
-
-	output, _ := excludeCRLFAndReturnIndex(input[1:])
-	num, err := strconv.Atoi(string(output))
-	handleError("parseError: ", err)
-	return num
-}
+// makeMap encodes the pairs of m sorted by key so that the output is
+// deterministic. In RESP2 a map is sent as a flat array of key, value.
+func makeMap(prefix byte, m map[string]interface{}, version int) RespEncodedString {
 
-func parseDouble(input RespEncodedString) float64 {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	output, _ := excludeCRLFAndReturnIndex(input[1:])
-	num, err := strconv.ParseFloat(string(output), 64)
-	handleError("parseDouble: ", err)
-	return num
-}
+	var buffer RespEncodedString
+	if version == RESP2 {
+		buffer = makeHeader(ARRAYS, len(m)*2)
+	} else {
+		buffer = makeHeader(prefix, len(m))
+	}
 
-func parseBulkString(input RespEncodedString) []byte {
+	for _, key := range keys {
+		buffer = append(buffer, makeBulkString([]byte(key))...)
+		buffer = append(buffer, EncodeVersion(m[key], version)...)
+	}
 
-	_, idx := excludeCRLFAndReturnIndex(input[1:])
-	output, _ := excludeCRLFAndReturnIndex(input[idx+3:]) // skip \r\n and 1 more since it is based on input[1:]
-	return output
+	return buffer
 }
 
-func parseArray(input RespEncodedString) []interface{} {
-
-	temp, idx := excludeCRLFAndReturnIndex(input[1:])
-	_, err := strconv.Atoi(string(temp))
-	handleError("parseArray: ", err)
-
-	arr := make([]interface{}, 0)
+// mapKey turns a decoded map key into the string used in Go maps
+func mapKey(key interface{}) string {
 
-	start := idx + 3
-	end := start
-
-	ignoreFirstInstanceCRLF := false
-	for start < len(input) && end < len(input) {
-
-		if input[end] == '$' {
-			ignoreFirstInstanceCRLF = true
-		}
-
-		if input[end] == '\r' && end+1 < len(input) && input[end+1] == '\n' {
-
-			if ignoreFirstInstanceCRLF {
-				end++
-				ignoreFirstInstanceCRLF = false
-				continue
-			}
-			arr = append(arr, Decode(input[start:end]))
-			end += 2
-			start = end
-			continue
-		}
-		end++
+	switch key := key.(type) {
+	case []byte:
+		return string(key)
+	case string:
+		return key
 	}
-	return arr
+	return fmt.Sprint(key)
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"math"
+	"math/big"
 	"reflect"
 	"testing"
 )
@@ -170,3 +171,70 @@ func compareDouble(a float64, b float64) bool {
 	var diff float64 = math.Abs(a - b)
 	return diff < tolerance
 }
+
+func TestResp3(t *testing.T) {
+
+	testCases := []struct {
+		input  interface{}
+		output string
+	}{
+		{nil, "_\r\n"},
+		{true, "#t\r\n"},
+		{false, "#f\r\n"},
+		{big.NewInt(0).Lsh(big.NewInt(1), 100), "(1267650600228229401496703205376\r\n"},
+		{Verbatim{Format: "txt", Text: "some text"}, "=13\r\ntxt:some text\r\n"},
+		{errors.New("line one\nline two"), "!17\r\nline one\nline two\r\n"},
+		{Set{[]byte("a"), 1}, "~2\r\n$1\r\na\r\n:1\r\n"},
+		{Push{"message", []byte("hi")}, ">2\r\n+message\r\n$2\r\nhi\r\n"},
+		{
+			map[string]interface{}{"b": 2, "a": []interface{}{true}},
+			"%2\r\n$1\r\na\r\n*1\r\n#t\r\n$1\r\nb\r\n:2\r\n",
+		},
+		{
+			Attribute{Attributes: map[string]interface{}{"ttl": 5}, Value: []byte("v")},
+			"|1\r\n$3\r\nttl\r\n:5\r\n$1\r\nv\r\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		// encode
+		got := Encode(testCase.input)
+		if string(got) != testCase.output {
+			log.Fatalf("encoding, input: %v, expected: %q, got: %q", testCase.input, testCase.output, got)
+		}
+
+		// decode
+		decoded := Decode([]byte(testCase.output))
+		if !reflect.DeepEqual(decoded, testCase.input) {
+			log.Fatalf("decoding, input: %q, expected: %v, got: %v", testCase.output, testCase.input, decoded)
+		}
+	}
+}
+
+func TestEncodeResp2(t *testing.T) {
+
+	testCases := []struct {
+		input  interface{}
+		output string
+	}{
+		{nil, "$-1\r\n"},
+		{NullArray{}, "*-1\r\n"},
+		{true, ":1\r\n"},
+		{1.5, "$3\r\n1.5\r\n"},
+		{big.NewInt(12), "$2\r\n12\r\n"},
+		{Verbatim{Format: "txt", Text: "hi"}, "$2\r\nhi\r\n"},
+		{errors.New("line one\nline two"), "-line one line two\r\n"},
+		{Set{1}, "*1\r\n:1\r\n"},
+		{map[string]interface{}{"a": nil}, "*2\r\n$1\r\na\r\n$-1\r\n"},
+		{Attribute{Attributes: map[string]interface{}{"x": 1}, Value: 2}, ":2\r\n"},
+	}
+
+	for _, testCase := range testCases {
+
+		got := EncodeVersion(testCase.input, RESP2)
+		if string(got) != testCase.output {
+			log.Fatalf("encoding, input: %v, expected: %q, got: %q", testCase.input, testCase.output, got)
+		}
+	}
+}
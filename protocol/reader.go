@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+const (
+	// maxLineLength caps the size of a single simple line (simple strings,
+	// errors, integers and length headers)
+	maxLineLength = 64 * 1024
+
+	// MaxBulkLength is the largest bulk string a Reader will accept
+	MaxBulkLength = 512 * 1024 * 1024
+
+	// MaxArrayLength is the largest number of elements a Reader will accept
+	// in a single aggregate
+	MaxArrayLength = 1024 * 1024
+)
+
+// Reader parses RESP values from a stream. Unlike Decode, it does not
+// assume that one read holds exactly one message: a value split across
+// several reads is waited for, and several values arriving together are
+// handed out one at a time.
+type Reader struct {
+	rd *bufio.Reader
+}
+
+// NewReader returns a Reader that buffers input from rd
+func NewReader(rd io.Reader) *Reader {
+
+	return &Reader{
+		rd: bufio.NewReader(rd),
+	}
+}
+
+// ReadValue blocks until one complete value has been received and returns
+// it using the same Go types as Decode: string, error, int, float64, []byte,
+// []interface{}, nil, bool, *big.Int, Verbatim, Set, Push, Attribute and
+// map[string]interface{}. Error replies are returned as the value, the
+// error result is reserved for I/O and syntax failures.
+func (reader *Reader) ReadValue() (interface{}, error) {
+
+	line, err := reader.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, syntaxError("empty line")
+	}
+
+	switch line[0] {
+
+	case SIMPLE_STRING:
+		return string(line[1:]), nil
+
+	case ERROR:
+		return errors.New(string(line[1:])), nil
+
+	case INTEGER:
+		num, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, syntaxError("invalid integer")
+		}
+		return num, nil
+
+	case DOUBLE:
+		num, err := strconv.ParseFloat(string(line[1:]), 64)
+		if err != nil {
+			return nil, syntaxError("invalid double")
+		}
+		return num, nil
+
+	case NULL:
+		if len(line) != 1 {
+			return nil, syntaxError("invalid null")
+		}
+		return nil, nil
+
+	case BOOLEAN:
+		if len(line) == 2 && line[1] == 't' {
+			return true, nil
+		}
+		if len(line) == 2 && line[1] == 'f' {
+			return false, nil
+		}
+		return nil, syntaxError("invalid boolean")
+
+	case BIG_NUMBER:
+		num, ok := new(big.Int).SetString(string(line[1:]), 10)
+		if !ok {
+			return nil, syntaxError("invalid big number")
+		}
+		return num, nil
+
+	case BULK_STRINGS:
+		return reader.readBulkString(line)
+
+	case BLOB_ERROR:
+		data, err := reader.readBulkString(line)
+		if err != nil || data == nil {
+			return nil, orSyntaxError(err, "invalid blob error")
+		}
+		return errors.New(string(data.([]byte))), nil
+
+	case VERBATIM:
+		data, err := reader.readBulkString(line)
+		raw, _ := data.([]byte)
+		if err != nil || len(raw) < 4 || raw[3] != ':' {
+			return nil, orSyntaxError(err, "invalid verbatim string")
+		}
+		return Verbatim{Format: string(raw[:3]), Text: string(raw[4:])}, nil
+
+	case ARRAYS:
+		return reader.readArray(line)
+
+	case SET:
+		arr, err := reader.readArray(line)
+		if err != nil || arr == nil {
+			return nil, orSyntaxError(err, "invalid set")
+		}
+		return Set(arr.([]interface{})), nil
+
+	case PUSH:
+		arr, err := reader.readArray(line)
+		if err != nil || arr == nil {
+			return nil, orSyntaxError(err, "invalid push")
+		}
+		return Push(arr.([]interface{})), nil
+
+	case MAP:
+		return reader.readMap(line)
+
+	case ATTRIBUTE:
+		attributes, err := reader.readMap(line)
+		if err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		return Attribute{Attributes: attributes.(map[string]interface{}), Value: value}, nil
+	}
+
+	return nil, syntaxError(fmt.Sprintf("unknown type byte %q", line[0]))
+}
+
+// Buffered returns the number of bytes that have been received
+// but not consumed yet
+func (reader *Reader) Buffered() int {
+
+	return reader.rd.Buffered()
+}
+
+// Wait blocks until there is input to read without consuming any of it.
+// It returns the error that ends the input, like io.EOF.
+func (reader *Reader) Wait() error {
+
+	_, err := reader.rd.Peek(1)
+	return err
+}
+
+func (reader *Reader) readBulkString(line []byte) (interface{}, error) {
+
+	length, err := parseLength(line, MaxBulkLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// null bulk string
+	if length < 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, length+2)
+	_, err = io.ReadFull(reader.rd, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, syntaxError("bulk string is not terminated by CRLF")
+	}
+	return data[:length], nil
+}
+
+func (reader *Reader) readArray(line []byte) (interface{}, error) {
+
+	length, err := parseLength(line, MaxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// null array
+	if length < 0 {
+		return nil, nil
+	}
+
+	capacity := length
+	if capacity > 1024 {
+		capacity = 1024
+	}
+
+	arr := make([]interface{}, 0, capacity)
+	for i := 0; i < length; i++ {
+		value, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, value)
+	}
+	return arr, nil
+}
+
+func (reader *Reader) readMap(line []byte) (interface{}, error) {
+
+	length, err := parseLength(line, MaxArrayLength)
+	if err != nil || length < 0 {
+		return nil, orSyntaxError(err, "invalid map length")
+	}
+
+	m := make(map[string]interface{})
+	for i := 0; i < length; i++ {
+		key, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		m[mapKey(key)] = value
+	}
+	return m, nil
+}
+
+// readLine returns the next line without its CRLF terminator
+func (reader *Reader) readLine() ([]byte, error) {
+
+	line, err := reader.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// the line is longer than the buffer, keep collecting it
+		// up to maxLineLength
+		long := append([]byte{}, line...)
+		for err == bufio.ErrBufferFull {
+			if len(long) > maxLineLength {
+				return nil, syntaxError("line too long")
+			}
+			line, err = reader.rd.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, syntaxError("line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// parseLength reads the length header of a bulk string or an aggregate,
+// -1 denotes a null value
+func parseLength(line []byte, limit int) (int, error) {
+
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < -1 {
+		return 0, syntaxError("invalid length")
+	}
+
+	if length > limit {
+		return 0, syntaxError("length exceeds limit")
+	}
+	return length, nil
+}
+
+// orSyntaxError returns err if there is one, a syntax error otherwise
+func orSyntaxError(err error, reason string) error {
+
+	if err != nil {
+		return err
+	}
+	return syntaxError(reason)
+}
+
+func syntaxError(reason string) error {
+
+	return fmt.Errorf("%w: %s", ErrInvalidSyntax, reason)
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReaderPartialFrames(t *testing.T) {
+
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	expected := []interface{}{[]byte("SET"), []byte("foo"), []byte("bar")}
+
+	// deliver the input one byte per read
+	reader := NewReader(iotest.OneByteReader(strings.NewReader(input)))
+	got, err := reader.ReadValue()
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		log.Fatalf("partial frames, expected: %v, got: %v, err: %v", expected, got, err)
+	}
+}
+
+func TestReaderMultipleValues(t *testing.T) {
+
+	input := "+OK\r\n:42\r\n-ERR nope\r\n$-1\r\n*2\r\n*1\r\n:1\r\n$2\r\nhi\r\n"
+	expected := []interface{}{
+		"OK",
+		42,
+		errors.New("ERR nope"),
+		nil,
+		[]interface{}{[]interface{}{1}, []byte("hi")},
+	}
+
+	reader := NewReader(strings.NewReader(input))
+	for _, want := range expected {
+		got, err := reader.ReadValue()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			log.Fatalf("multiple values, expected: %v, got: %v, err: %v", want, got, err)
+		}
+	}
+
+	_, err := reader.ReadValue()
+	if err != io.EOF {
+		log.Fatalf("multiple values, expected EOF, got: %v", err)
+	}
+}
+
+func TestReaderWait(t *testing.T) {
+
+	reader := NewReader(strings.NewReader(":1\r\n"))
+	err := reader.Wait()
+	if err != nil {
+		log.Fatalf("wait, expected no error, got: %v", err)
+	}
+
+	// waiting must leave the value in place
+	got, err := reader.ReadValue()
+	if err != nil || got != 1 {
+		log.Fatalf("wait, expected: 1, got: %v, err: %v", got, err)
+	}
+
+	err = reader.Wait()
+	if err != io.EOF {
+		log.Fatalf("wait, expected EOF, got: %v", err)
+	}
+}
+
+func TestReaderLargeBulkString(t *testing.T) {
+
+	large := bytes.Repeat([]byte("x"), 200*1024)
+	reader := NewReader(bytes.NewReader(Encode([][]byte{[]byte("SET"), []byte("key"), large})))
+
+	got, err := reader.ReadValue()
+	if err != nil {
+		log.Fatalf("large bulk string, got error: %v", err)
+	}
+
+	arr := got.([]interface{})
+	if !bytes.Equal(arr[2].([]byte), large) {
+		log.Fatalf("large bulk string, value was truncated to %d bytes", len(arr[2].([]byte)))
+	}
+}
+
+func TestReaderInvalidSyntax(t *testing.T) {
+
+	testCases := []string{
+		"?\r\n",
+		":abc\r\n",
+		"$3\r\nfoobar\r\n",
+		"+missing carriage return\n",
+		"*-5\r\n",
+	}
+
+	for _, testCase := range testCases {
+		_, err := NewReader(strings.NewReader(testCase)).ReadValue()
+		if !errors.Is(err, ErrInvalidSyntax) {
+			log.Fatalf("invalid syntax, input: %q, got: %v", testCase, err)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+
+	err := writer.WriteValue("OK")
+	if err == nil {
+		err = writer.WriteValue(7)
+	}
+	if err != nil {
+		log.Fatalf("writer, got error: %v", err)
+	}
+
+	if buffer.Len() != 0 {
+		log.Fatalf("writer, output was not buffered")
+	}
+
+	err = writer.Flush()
+	if err != nil || buffer.String() != "+OK\r\n:7\r\n" {
+		log.Fatalf("writer, got: %q, err: %v", buffer.String(), err)
+	}
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+)
+
+// Writer encodes RESP values onto a stream. Output is buffered,
+// call Flush to push it to the underlying writer.
+type Writer struct {
+	wr      *bufio.Writer
+	version int
+}
+
+// NewWriter returns a Writer that buffers output to wr. It starts
+// out speaking RESP2, as every connection does before HELLO.
+func NewWriter(wr io.Writer) *Writer {
+
+	return &Writer{
+		wr:      bufio.NewWriter(wr),
+		version: RESP2,
+	}
+}
+
+// SetVersion changes the protocol version used by WriteValue
+func (writer *Writer) SetVersion(version int) {
+
+	writer.version = version
+}
+
+// Version returns the protocol version used by WriteValue
+func (writer *Writer) Version() int {
+
+	return writer.version
+}
+
+// WriteValue encodes content as in EncodeVersion and buffers it
+func (writer *Writer) WriteValue(content interface{}) error {
+
+	return writer.WriteEncoded(EncodeVersion(content, writer.version))
+}
+
+// WriteEncoded buffers a value that is already RESP-encoded
+func (writer *Writer) WriteEncoded(encoded RespEncodedString) error {
+
+	_, err := writer.wr.Write(encoded)
+	return err
+}
+
+// Flush writes any buffered data to the underlying writer
+func (writer *Writer) Flush() error {
+
+	return writer.wr.Flush()
+}
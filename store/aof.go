@@ -0,0 +1,713 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/viveknathani/retain/protocol"
+)
+
+// FsyncPolicy decides how often the append only file is flushed to disk
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec flushes once per second, losing at most a
+	// second of writes on a crash
+	FsyncEverySec FsyncPolicy = iota
+
+	// FsyncAlways flushes after every write
+	FsyncAlways
+
+	// FsyncNo leaves flushing to the operating system
+	FsyncNo
+)
+
+var (
+	ErrAppendOnlyDisabled = errors.New("append only file is disabled")
+	ErrRewriteInProgress  = errors.New("append only file rewrite already in progress")
+)
+
+// ParseFsyncPolicy reads a policy spelled as in the appendfsync
+// setting of Redis: always, everysec or no
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+
+	switch name {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return FsyncEverySec, fmt.Errorf("unknown fsync policy %q", name)
+}
+
+func (policy FsyncPolicy) String() string {
+
+	switch policy {
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	}
+	return "everysec"
+}
+
+// appendOnlyFile logs every change made to the storage as a RESP array,
+// so that the changes can be replayed after a restart. Records describe
+// the effect of a change rather than the command that caused it, e.g. a
+// relative expiry is logged with its absolute deadline. A SELECT record
+// precedes the records of another database than the one before them.
+type appendOnlyFile struct {
+	path   string
+	policy FsyncPolicy
+
+	// mu guards file, appends also hold the locks of the keys they are
+	// about, which keeps the records of every key in the same order as
+	// the changes they describe
+	mu   sync.Mutex
+	file *os.File
+
+	// selected is the database the last record was about,
+	// -1 when the next record has to say which one it is
+	selected int
+
+	// while a rewrite runs, new records are also kept here so
+	// they can be added to the rewritten file once it is done
+	rewriting     bool
+	rewriteBuffer []byte
+
+	stop chan struct{}
+}
+
+func openAppendOnlyFile(path string, policy FsyncPolicy) (*appendOnlyFile, error) {
+
+	// leftovers of a rewrite that was interrupted by a crash
+	leftovers, _ := filepath.Glob(path + ".rewrite-*")
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	aof := &appendOnlyFile{
+		path:     path,
+		policy:   policy,
+		file:     file,
+		selected: -1,
+		stop:     make(chan struct{}),
+	}
+
+	if policy == FsyncEverySec {
+		go aof.syncEverySecond()
+	}
+	return aof, nil
+}
+
+// append writes one record about the database numbered index,
+// the caller must hold the locks of the keys it is about
+func (aof *appendOnlyFile) append(index int, args ...[]byte) {
+
+	record := protocol.Encode(args)
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if index != aof.selected {
+		record = append(selectRecord(index), record...)
+		aof.selected = index
+	}
+
+	_, err := aof.file.Write(record)
+	handleError("append only file: write", err)
+
+	if aof.policy == FsyncAlways {
+		handleError("append only file: fsync", aof.file.Sync())
+	}
+
+	if aof.rewriting {
+		aof.rewriteBuffer = append(aof.rewriteBuffer, record...)
+	}
+}
+
+func (aof *appendOnlyFile) syncEverySecond() {
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.stop:
+			return
+		case <-ticker.C:
+			aof.mu.Lock()
+			err := aof.file.Sync()
+			aof.mu.Unlock()
+			if err != nil {
+				log.Println("append only file: fsync", err)
+			}
+		}
+	}
+}
+
+func (aof *appendOnlyFile) close() error {
+
+	close(aof.stop)
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	err := aof.file.Sync()
+	if closeErr := aof.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// logEntry records the full state of key, the caller must hold its lock
+func (storage *Storage) logEntry(key string, e *entry) {
+
+	if storage.aof == nil {
+		return
+	}
+	storage.aof.append(storage.index, entryRecord(key, e)...)
+}
+
+// logCommand records a change, the caller must hold the locks of the
+// keys it changes
+func (storage *Storage) logCommand(args ...[]byte) {
+
+	if storage.aof == nil {
+		return
+	}
+	storage.aof.append(storage.index, args...)
+}
+
+func selectRecord(index int) []byte {
+
+	return protocol.Encode([][]byte{[]byte("SELECT"), []byte(strconv.Itoa(index))})
+}
+
+// entryRecord describes key with a SET record for plain bytes and a
+// RESTORE record carrying the serialized value for everything else
+func entryRecord(key string, e *entry) [][]byte {
+
+	var record [][]byte
+	if value, ok := e.value.([]byte); ok {
+		record = [][]byte{[]byte("SET"), []byte(key), value}
+	} else {
+		payload, err := encodeValue(e.value)
+		handleError("append only file: encode", err)
+		record = [][]byte{[]byte("RESTORE"), []byte(key), payload}
+	}
+
+	if e.expireAt != 0 {
+		record = append(record, []byte("PXAT"), []byte(strconv.FormatInt(e.expireAt, 10)))
+	}
+	return record
+}
+
+// replayAppendOnlyFile applies every record found at path. A record cut
+// short by a crash is dropped and the file is truncated before it.
+func (storage *Storage) replayAppendOnlyFile(path string) (bool, error) {
+
+	file, err := os.Open(path)
+	if err != nil && os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	reader := protocol.NewReader(counter)
+
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	// records before the first SELECT are about database 0,
+	// as they are in files written before there were more
+	selected := 0
+
+	var valid int64
+	for {
+		value, err := reader.ReadValue()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("corrupt append only file at offset %d: %w", valid, err)
+		}
+
+		args, ok := toArgs(value)
+		if !ok {
+			return false, fmt.Errorf("corrupt append only file at offset %d", valid)
+		}
+
+		if string(args[0]) == "SELECT" {
+			selected, err = replaySelect(args, len(databases))
+		} else {
+			err = databases[selected].apply(args)
+		}
+		if err != nil {
+			return false, fmt.Errorf("append only file at offset %d: %w", valid, err)
+		}
+		valid = counter.count - int64(reader.Buffered())
+	}
+
+	if valid < counter.count {
+		log.Printf("append only file: dropping %d bytes of truncated record", counter.count-valid)
+		err = os.Truncate(path, valid)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// replaySelect parses a SELECT record
+func replaySelect(args [][]byte, databases int) (int, error) {
+
+	if len(args) != 2 {
+		return 0, errors.New("malformed SELECT record")
+	}
+
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return 0, fmt.Errorf("malformed SELECT record: %w", err)
+	}
+	if index < 0 || index >= databases {
+		return 0, fmt.Errorf("%w: SELECT %d", ErrDatabaseOutOfRange, index)
+	}
+	return index, nil
+}
+
+// apply performs one record of the append only file, the
+// caller must hold the locks of every database
+func (storage *Storage) apply(args [][]byte) error {
+
+	switch string(args[0]) {
+
+	case "FLUSHDB":
+		return storage.flush()
+
+	case "FLUSHALL":
+		for _, db := range storage.owner().all() {
+			err := db.flush()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "SWAPDB":
+		if len(args) != 3 {
+			return errors.New("malformed SWAPDB record")
+		}
+
+		first, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return fmt.Errorf("malformed SWAPDB record: %w", err)
+		}
+		second, err := strconv.Atoi(string(args[2]))
+		if err != nil {
+			return fmt.Errorf("malformed SWAPDB record: %w", err)
+		}
+
+		// nothing else runs during a replay, so the read lock
+		// on layout is as good as the write lock here
+		root := storage.owner()
+		count := len(root.all())
+		if first < 0 || first >= count || second < 0 || second >= count {
+			return fmt.Errorf("%w: SWAPDB %d %d", ErrDatabaseOutOfRange, first, second)
+		}
+		if first != second {
+			root.swap(first, second)
+		}
+		return nil
+	}
+
+	if len(args) < 2 {
+		return errors.New("record too short")
+	}
+
+	key := string(args[1])
+	switch string(args[0]) {
+
+	case "SET", "RESTORE":
+		if len(args) != 3 && len(args) != 5 {
+			return errors.New("malformed " + string(args[0]) + " record")
+		}
+
+		var value RetainValue = args[2]
+		if string(args[0]) == "RESTORE" {
+			decoded, err := decodeValue(args[2])
+			if err != nil {
+				return err
+			}
+			value = decoded
+		}
+
+		e := &entry{value: value}
+		if len(args) == 5 {
+			deadline, err := strconv.ParseInt(string(args[4]), 10, 64)
+			if err != nil {
+				return err
+			}
+			e.expireAt = deadline
+		}
+
+		if e.expired(toMillis(time.Now())) {
+			return storage.remove(key)
+		}
+		return storage.store(key, e)
+
+	case "DEL":
+		return storage.remove(key)
+
+	case "PEXPIREAT":
+		if len(args) != 3 {
+			return errors.New("malformed PEXPIREAT record")
+		}
+
+		deadline, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		e, ok, err := storage.loadLocked(key)
+		if !ok || err != nil {
+			return err
+		}
+
+		updated := &entry{value: e.value, expireAt: deadline}
+		if updated.expired(toMillis(time.Now())) {
+			return storage.remove(key)
+		}
+		return storage.store(key, updated)
+
+	case "PERSIST":
+		e, ok, err := storage.loadLocked(key)
+		if !ok || err != nil {
+			return err
+		}
+		return storage.store(key, &entry{value: e.value})
+
+	default:
+		replay, ok := replayers[string(args[0])]
+		if !ok {
+			return errors.New("unknown record " + string(args[0]))
+		}
+		return replay(storage, args)
+	}
+}
+
+// replayers apply the records logged by the typed operations, they
+// call the same code as the operation itself minus the logging
+var replayers = map[string]func(storage *Storage, args [][]byte) error{
+	"LPUSH": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed LPUSH record")
+		}
+		_, err := storage.push(string(args[1]), args[2:], true)
+		return err
+	},
+	"RPUSH": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed RPUSH record")
+		}
+		_, err := storage.push(string(args[1]), args[2:], false)
+		return err
+	},
+	"LPOP": func(storage *Storage, args [][]byte) error {
+		return replayInts(args, 1, func(n []int) error {
+			_, err := storage.pop(string(args[1]), n[0], true)
+			return err
+		})
+	},
+	"RPOP": func(storage *Storage, args [][]byte) error {
+		return replayInts(args, 1, func(n []int) error {
+			_, err := storage.pop(string(args[1]), n[0], false)
+			return err
+		})
+	},
+	"LREM": func(storage *Storage, args [][]byte) error {
+		if len(args) != 4 {
+			return errors.New("malformed LREM record")
+		}
+		return replayInts(args[:3], 1, func(n []int) error {
+			_, err := storage.lrem(string(args[1]), n[0], args[3])
+			return err
+		})
+	},
+	"LTRIM": func(storage *Storage, args [][]byte) error {
+		return replayInts(args, 2, func(n []int) error {
+			return storage.ltrim(string(args[1]), n[0], n[1])
+		})
+	},
+	"LSET": func(storage *Storage, args [][]byte) error {
+		if len(args) != 4 {
+			return errors.New("malformed LSET record")
+		}
+		return replayInts(args[:3], 1, func(n []int) error {
+			return storage.lset(string(args[1]), n[0], args[3])
+		})
+	},
+	"LINSERT": func(storage *Storage, args [][]byte) error {
+		if len(args) != 5 {
+			return errors.New("malformed LINSERT record")
+		}
+		_, err := storage.linsert(string(args[1]), string(args[2]) == "BEFORE", args[3], args[4])
+		return err
+	},
+	"LMOVE": func(storage *Storage, args [][]byte) error {
+		if len(args) != 5 {
+			return errors.New("malformed LMOVE record")
+		}
+		_, err := storage.lmove(string(args[1]), string(args[2]), string(args[3]) == "LEFT", string(args[4]) == "LEFT")
+		return err
+	},
+	"HSET": func(storage *Storage, args [][]byte) error {
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errors.New("malformed HSET record")
+		}
+		_, err := storage.hset(string(args[1]), args[2:])
+		return err
+	},
+	"HDEL": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed HDEL record")
+		}
+		_, err := storage.hdel(string(args[1]), args[2:])
+		return err
+	},
+	"SADD": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed SADD record")
+		}
+		_, err := storage.sadd(string(args[1]), args[2:])
+		return err
+	},
+	"SREM": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed SREM record")
+		}
+		_, err := storage.srem(string(args[1]), args[2:])
+		return err
+	},
+	"ZADD": func(storage *Storage, args [][]byte) error {
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errors.New("malformed ZADD record")
+		}
+		return storage.zadd(string(args[1]), args[2:])
+	},
+	"ZREM": func(storage *Storage, args [][]byte) error {
+		if len(args) < 3 {
+			return errors.New("malformed ZREM record")
+		}
+		_, err := storage.zrem(string(args[1]), args[2:])
+		return err
+	},
+}
+
+// replayInts parses the count integers that follow the key in args and
+// hands them to apply. Records with the wrong shape are refused, which
+// also keeps the replayers from indexing past the end of args.
+func replayInts(args [][]byte, count int, apply func([]int) error) error {
+
+	if len(args) != count+2 {
+		return fmt.Errorf("malformed %s record", args[0])
+	}
+
+	numbers := make([]int, count)
+	for i := range numbers {
+		number, err := strconv.Atoi(string(args[i+2]))
+		if err != nil {
+			return fmt.Errorf("malformed %s record: %w", args[0], err)
+		}
+		numbers[i] = number
+	}
+	return apply(numbers)
+}
+
+// RewriteAppendOnlyFile compacts the append only file in the background
+// into the smallest log that produces the current data set. Changes made
+// while it runs are carried over to the new file before it replaces the
+// old one.
+func (storage *Storage) RewriteAppendOnlyFile() error {
+
+	entries, err := storage.startRewrite()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := storage.finishRewrite(entries)
+		if err != nil {
+			log.Println("append only file: rewrite", err)
+		}
+	}()
+	return nil
+}
+
+func (storage *Storage) startRewrite() ([]map[string]*entry, error) {
+
+	aof := storage.aof
+	if aof == nil {
+		return nil, ErrAppendOnlyDisabled
+	}
+
+	// with every database locked, each change is either in
+	// the copy or in the buffer but never in both
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	aof.mu.Lock()
+	if aof.rewriting {
+		aof.mu.Unlock()
+		return nil, ErrRewriteInProgress
+	}
+	aof.rewriting = true
+	aof.rewriteBuffer = nil
+
+	// the buffer has to start by saying which database it is about
+	aof.selected = -1
+	aof.mu.Unlock()
+
+	snapshot, _ := copyLocked(databases)
+	return snapshot, nil
+}
+
+func (storage *Storage) finishRewrite(snapshot []map[string]*entry) error {
+
+	aof := storage.aof
+	file, err := storage.writeRewrite(snapshot)
+
+	_, unlock := storage.lockAll()
+	defer unlock()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if err == nil {
+		err = swapRewrite(aof, file)
+	}
+
+	if err != nil && file != nil {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	aof.rewriting = false
+	aof.rewriteBuffer = nil
+	return err
+}
+
+// writeRewrite writes every database in snapshot to a temporary
+// file next to the append only file
+func (storage *Storage) writeRewrite(snapshot []map[string]*entry) (*os.File, error) {
+
+	aof := storage.aof
+	file, err := os.CreateTemp(filepath.Dir(aof.path), filepath.Base(aof.path)+".rewrite-*")
+	if err != nil {
+		return nil, err
+	}
+
+	now := toMillis(time.Now())
+	writer := bufio.NewWriter(file)
+	for index, entries := range snapshot {
+		if len(entries) == 0 {
+			continue
+		}
+
+		_, err = writer.Write(selectRecord(index))
+		if err != nil {
+			return file, err
+		}
+
+		for key, e := range entries {
+			if e.expired(now) {
+				continue
+			}
+
+			_, err = writer.Write(protocol.Encode(entryRecord(key, e)))
+			if err != nil {
+				return file, err
+			}
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	return file, err
+}
+
+// swapRewrite appends the records that arrived during the rewrite and
+// puts the new file in place, the caller must hold the locks of every
+// database and aof.mu
+func swapRewrite(aof *appendOnlyFile, file *os.File) error {
+
+	_, err := file.Write(aof.rewriteBuffer)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), aof.path)
+	if err != nil {
+		return err
+	}
+
+	aof.file.Close()
+	aof.file = file
+	return nil
+}
+
+// toArgs converts a decoded RESP array of bulk strings
+func toArgs(value interface{}) ([][]byte, bool) {
+
+	arr, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	args := make([][]byte, 0, len(arr))
+	for _, item := range arr {
+		arg, ok := item.([]byte)
+		if !ok {
+			return nil, false
+		}
+		args = append(args, arg)
+	}
+	return args, true
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
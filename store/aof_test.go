@@ -0,0 +1,147 @@
+package store
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendOnlyOptions(dir string) Options {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(dir, fileName)
+	options.AppendOnly = true
+	options.AppendOnlyPath = filepath.Join(dir, "appendonly.aof")
+	options.AppendFsync = FsyncAlways
+	return options
+}
+
+func TestAppendOnlyReplay(t *testing.T) {
+
+	options := appendOnlyOptions(t.TempDir())
+
+	mp, loaded, err := NewWithOptions(options)
+	if err != nil || loaded {
+		log.Fatalf("failed to open empty storage, loaded: %v, err: %v", loaded, err)
+	}
+
+	mp.Set(RetainKey("kept"), []byte("value"))
+	mp.Set(RetainKey("typed"), 42)
+	mp.Set(RetainKey("gone"), []byte("value"))
+	mp.Delete(RetainKey("gone"))
+	mp.SetWithOptions(RetainKey("volatile"), []byte("value"), SetOptions{ExpireAt: time.Now().Add(time.Hour)})
+	mp.Set(RetainKey("persisted"), []byte("value"))
+	mp.Expire(RetainKey("persisted"), time.Now().Add(time.Hour))
+	mp.Persist(RetainKey("persisted"))
+	mp.Close()
+
+	mp, loaded, err = NewWithOptions(options)
+	if err != nil || !loaded {
+		log.Fatalf("failed to replay, loaded: %v, err: %v", loaded, err)
+	}
+	defer mp.Close()
+
+	if v, ok, err := mp.Get(RetainKey("kept")); err != nil || !ok || string(v.([]byte)) != "value" {
+		log.Fatalf("failed replay of SET, got: %v", v)
+	}
+
+	if v, ok, err := mp.Get(RetainKey("typed")); err != nil || !ok || v != 42 {
+		log.Fatalf("failed replay of RESTORE, got: %v", v)
+	}
+
+	if _, ok, err := mp.Get(RetainKey("gone")); err != nil || ok {
+		log.Fatalf("failed replay of DEL")
+	}
+
+	if deadline, _, err := mp.ExpireTime(RetainKey("volatile")); err != nil || deadline.IsZero() {
+		log.Fatalf("failed replay of deadline")
+	}
+
+	if deadline, ok, err := mp.ExpireTime(RetainKey("persisted")); err != nil || !ok || !deadline.IsZero() {
+		log.Fatalf("failed replay of PERSIST")
+	}
+}
+
+func TestAppendOnlyTruncatedRecord(t *testing.T) {
+
+	options := appendOnlyOptions(t.TempDir())
+
+	mp, _, _ := NewWithOptions(options)
+	mp.Set(RetainKey("a"), []byte("1"))
+	mp.Close()
+
+	info, _ := os.Stat(options.AppendOnlyPath)
+	validSize := info.Size()
+
+	// simulate a crash in the middle of writing a record
+	file, _ := os.OpenFile(options.AppendOnlyPath, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$5\r\nab")
+	file.Close()
+
+	mp, _, err := NewWithOptions(options)
+	if err != nil {
+		log.Fatalf("failed to load truncated log, got: %v", err)
+	}
+	defer mp.Close()
+
+	if _, ok, err := mp.Get(RetainKey("a")); err != nil || !ok {
+		log.Fatalf("failed to keep the records before the truncated one")
+	}
+
+	info, _ = os.Stat(options.AppendOnlyPath)
+	if info.Size() != validSize {
+		log.Fatalf("failed to truncate log, expected size: %d, got: %d", validSize, info.Size())
+	}
+}
+
+func TestAppendOnlyRewrite(t *testing.T) {
+
+	options := appendOnlyOptions(t.TempDir())
+
+	mp, _, _ := NewWithOptions(options)
+	for i := 0; i < 100; i++ {
+		mp.Set(RetainKey("counter"), i)
+	}
+	before, _ := os.Stat(options.AppendOnlyPath)
+
+	entries, err := mp.startRewrite()
+	if err != nil {
+		log.Fatalf("failed to start rewrite, got: %v", err)
+	}
+
+	if mp.RewriteAppendOnlyFile() != ErrRewriteInProgress {
+		log.Fatalf("failed to refuse a second rewrite")
+	}
+
+	// a write that lands while the rewrite is in progress
+	mp.Set(RetainKey("late"), []byte("value"))
+
+	err = mp.finishRewrite(entries)
+	if err != nil {
+		log.Fatalf("failed to finish rewrite, got: %v", err)
+	}
+
+	mp.Set(RetainKey("after"), []byte("value"))
+	mp.Close()
+
+	after, _ := os.Stat(options.AppendOnlyPath)
+	if after.Size() >= before.Size() {
+		log.Fatalf("failed to compact log, before: %d, after: %d", before.Size(), after.Size())
+	}
+
+	mp, _, _ = NewWithOptions(options)
+	defer mp.Close()
+
+	for key, expected := range map[string]interface{}{"counter": 99, "late": "value", "after": "value"} {
+		v, ok, err := mp.Get(RetainKey(key))
+		handleError("failed Get", err)
+		if b, isBytes := v.([]byte); isBytes {
+			v = string(b)
+		}
+		if !ok || v != expected {
+			log.Fatalf("failed rewrite at %s, expected: %v, got: %v", key, expected, v)
+		}
+	}
+}
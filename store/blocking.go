@@ -0,0 +1,238 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// NoWait makes a blocking pop give up at once when there is nothing to
+// pop, which is how blocking commands behave inside a transaction
+const NoWait time.Duration = -1
+
+// waiter is a caller parked in a blocking pop. It sits in the queue of
+// every key it waits for and is signalled through ready when it gets
+// to the head of one whose list has elements.
+type waiter struct {
+	ready chan struct{}
+}
+
+// BPop pops an element from one end of the first non-empty list among
+// keys, waiting for one to get elements if they are all empty. Callers
+// waiting on the same key are served in the order they started waiting.
+// A timeout of 0 waits forever, NoWait does not wait at all. It returns
+// a nil key if it gave up because of the timeout or because cancel was
+// closed.
+func (storage *Storage) BPop(keys []RetainKey, front bool, timeout time.Duration, cancel <-chan struct{}) (RetainKey, []byte, error) {
+
+	var key RetainKey
+	var value []byte
+
+	err := storage.block(keys, keys, timeout, cancel, func(ready func(key string) bool) (bool, error) {
+
+		for _, candidate := range keys {
+			if !ready(string(candidate)) {
+				continue
+			}
+
+			l, err := storage.readList(string(candidate))
+			if err != nil {
+				return false, err
+			}
+			if l == nil {
+				continue
+			}
+
+			popped, _ := storage.pop(string(candidate), 1, front)
+			command := "RPOP"
+			if front {
+				command = "LPOP"
+			}
+			storage.logCommand([]byte(command), candidate, []byte("1"))
+
+			key, value = candidate, popped[0]
+			return true, nil
+		}
+		return false, nil
+	})
+	return key, value, err
+}
+
+// BLMove is LMove waiting for source to get elements the way BPop does.
+// It returns nil if it gave up.
+func (storage *Storage) BLMove(source RetainKey, destination RetainKey, fromFront bool, toFront bool, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
+
+	var value []byte
+
+	err := storage.block([]RetainKey{source}, []RetainKey{source, destination}, timeout, cancel, func(ready func(key string) bool) (bool, error) {
+
+		if !ready(string(source)) {
+			return false, nil
+		}
+
+		var err error
+		value, err = storage.move(source, destination, fromFront, toFront)
+		return value != nil, err
+	})
+	return value, err
+}
+
+// block calls attempt with the shards of locked held until it reports
+// that it is done, parking the caller in the queues of keys in between.
+// attempt may only take from the keys ready reports true for, which
+// keeps callers from jumping ahead of the ones that have been waiting
+// longer, and may only change the keys in locked.
+func (storage *Storage) block(keys []RetainKey, locked []RetainKey, timeout time.Duration, cancel <-chan struct{}, attempt func(ready func(key string) bool) (bool, error)) error {
+
+	shards := shardIndexes(locked)
+	unlock := storage.lockShards(shards, false)
+
+	if timeout == NoWait {
+		defer unlock()
+		_, err := attempt(func(string) bool { return true })
+		return err
+	}
+
+	w := &waiter{ready: make(chan struct{}, 1)}
+	ready := func(key string) bool {
+		queue := storage.shardOf(key).blocked[key]
+		return len(queue) == 0 || queue[0] == w
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	queued := false
+	for {
+		// nothing is served in the middle of a batch, EndBatch
+		// wakes whoever is waiting once it is over
+		if atomic.LoadInt32(&storage.owner().batches) == 0 {
+			done, err := attempt(ready)
+			if done || err != nil {
+				storage.dequeue(keys, w)
+				unlock()
+				return err
+			}
+		}
+
+		if !queued {
+			storage.enqueue(keys, w)
+			queued = true
+		}
+		unlock()
+
+		select {
+		case <-w.ready:
+			unlock = storage.lockShards(shards, false)
+		case <-expired:
+			unlock = storage.lockShards(shards, false)
+			storage.dequeue(keys, w)
+			unlock()
+			return nil
+		case <-cancel:
+			unlock = storage.lockShards(shards, false)
+			storage.dequeue(keys, w)
+			unlock()
+			return nil
+		}
+	}
+}
+
+func (storage *Storage) enqueue(keys []RetainKey, w *waiter) {
+
+	for _, key := range keys {
+		sh := storage.shardOf(string(key))
+		if sh.blocked == nil {
+			sh.blocked = make(map[string][]*waiter)
+		}
+
+		queue := sh.blocked[string(key)]
+		if len(queue) > 0 && queue[len(queue)-1] == w {
+			// the same key given twice
+			continue
+		}
+		sh.blocked[string(key)] = append(queue, w)
+	}
+}
+
+// dequeue takes w out of the queues of keys. Whoever it was holding up
+// gets a chance to look at the key, which may still have elements.
+func (storage *Storage) dequeue(keys []RetainKey, w *waiter) {
+
+	for _, key := range keys {
+		sh := storage.shardOf(string(key))
+		queue := sh.blocked[string(key)]
+		kept := queue[:0]
+		for _, other := range queue {
+			if other != w {
+				kept = append(kept, other)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(sh.blocked, string(key))
+			continue
+		}
+		sh.blocked[string(key)] = kept
+		storage.wake(string(key))
+	}
+}
+
+// wake signals the first caller waiting on key if key holds a list,
+// the caller must hold the lock of the shard of key
+func (storage *Storage) wake(key string) {
+
+	queue := storage.shardOf(key).blocked[key]
+	if len(queue) == 0 || atomic.LoadInt32(&storage.owner().batches) > 0 {
+		return
+	}
+
+	e, ok, err := storage.lookup(key)
+	if !ok || err != nil {
+		return
+	}
+	if _, isList := e.value.(*list); !isList {
+		return
+	}
+
+	select {
+	case queue[0].ready <- struct{}{}:
+	default:
+		// it has been signalled already
+	}
+}
+
+// BeginBatch holds back blocking pops in every database until the
+// matching EndBatch, so that a batch of commands meant to run as one,
+// like a transaction, is never seen half done by them
+func (storage *Storage) BeginBatch() {
+
+	atomic.AddInt32(&storage.owner().batches, 1)
+}
+
+// EndBatch ends what BeginBatch started
+func (storage *Storage) EndBatch() {
+
+	root := storage.owner()
+	if atomic.AddInt32(&root.batches, -1) > 0 {
+		return
+	}
+
+	root.layout.RLock()
+	defer root.layout.RUnlock()
+
+	// the changes made during the batch did not wake anyone
+	for _, db := range root.all() {
+		for i := range db.shards {
+			sh := &db.shards[i]
+			sh.mu.Lock()
+			for key := range sh.blocked {
+				db.wake(key)
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
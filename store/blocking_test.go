@@ -0,0 +1,188 @@
+package store
+
+import (
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until count callers are blocked on key
+func waitQueued(mp *Storage, key string, count int) {
+
+	for i := 0; i < 1000; i++ {
+		unlock := mp.rlock(RetainKey(key))
+		queued := len(mp.shardOf(key).blocked[key])
+		unlock()
+
+		if queued == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	log.Fatalf("failed waiting for %d callers blocked on %s", count, key)
+}
+
+type popped struct {
+	key   RetainKey
+	value []byte
+	err   error
+}
+
+func blockedPop(mp *Storage, keys []RetainKey, front bool, timeout time.Duration, cancel <-chan struct{}) chan popped {
+
+	result := make(chan popped, 1)
+	go func() {
+		key, value, err := mp.BPop(keys, front, timeout, cancel)
+		result <- popped{key, value, err}
+	}()
+	return result
+}
+
+func TestBPopAtOnce(t *testing.T) {
+
+	mp := &Storage{}
+	mp.RPush(RetainKey("second"), listOf("a", "b")...)
+
+	key, value, err := mp.BPop([]RetainKey{RetainKey("first"), RetainKey("second")}, false, time.Second, nil)
+	if err != nil || string(key) != "second" || string(value) != "b" {
+		log.Fatalf("failed BPop, expected: second b, got: %s %s %v", key, value, err)
+	}
+
+	// NoWait and a short timeout both give up on empty lists
+	for _, timeout := range []time.Duration{NoWait, 10 * time.Millisecond} {
+		key, value, err = mp.BPop([]RetainKey{RetainKey("first")}, true, timeout, nil)
+		if err != nil || key != nil || value != nil {
+			log.Fatalf("failed BPop timeout %v, got: %s %s %v", timeout, key, value, err)
+		}
+	}
+
+	mp.Set(RetainKey("string"), []byte("value"))
+	_, _, err = mp.BPop([]RetainKey{RetainKey("string")}, true, 0, nil)
+	if err != ErrWrongType {
+		log.Fatalf("failed BPop wrong type, got: %v", err)
+	}
+}
+
+func TestBPopOrder(t *testing.T) {
+
+	mp := &Storage{}
+	keys := []RetainKey{RetainKey("queue")}
+
+	results := make([]chan popped, 0)
+	for i := 0; i < 3; i++ {
+		results = append(results, blockedPop(mp, keys, true, 0, nil))
+		waitQueued(mp, "queue", i+1)
+	}
+
+	// the first to wait gets the first element
+	mp.RPush(keys[0], listOf("a", "b", "c")...)
+	for i, expected := range []string{"a", "b", "c"} {
+		got := <-results[i]
+		if got.err != nil || string(got.value) != expected {
+			log.Fatalf("failed BPop order, expected: %s, got: %s %v", expected, got.value, got.err)
+		}
+	}
+
+	length, _ := mp.LLen(keys[0])
+	if length != 0 {
+		log.Fatalf("failed BPop order, expected an empty list, got: %d", length)
+	}
+}
+
+func TestBPopBatch(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("queue")
+	result := blockedPop(mp, []RetainKey{key}, true, 0, nil)
+	waitQueued(mp, "queue", 1)
+
+	// the batch sees its own push, the blocked caller does not
+	mp.BeginBatch()
+	mp.RPush(key, listOf("a", "b")...)
+	time.Sleep(10 * time.Millisecond)
+	head, _ := mp.LPop(key, 1)
+	if !reflect.DeepEqual(head, listOf("a")) {
+		log.Fatalf("failed batch, expected: a, got: %s", head)
+	}
+	mp.EndBatch()
+
+	got := <-result
+	if got.err != nil || string(got.value) != "b" {
+		log.Fatalf("failed batch, expected: b, got: %s %v", got.value, got.err)
+	}
+}
+
+func TestBPopCancel(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("queue")
+	cancel := make(chan struct{})
+	result := blockedPop(mp, []RetainKey{key}, true, 0, cancel)
+	waitQueued(mp, "queue", 1)
+
+	close(cancel)
+	got := <-result
+	if got.key != nil || got.err != nil {
+		log.Fatalf("failed cancel, got: %s %s %v", got.key, got.value, got.err)
+	}
+
+	// nothing is taken on behalf of a caller that is gone
+	mp.RPush(key, []byte("a"))
+	length, _ := mp.LLen(key)
+	if length != 1 {
+		log.Fatalf("failed cancel, expected: 1, got: %d", length)
+	}
+}
+
+func TestBLMove(t *testing.T) {
+
+	mp := &Storage{}
+	source, destination := RetainKey("source"), RetainKey("destination")
+
+	result := make(chan []byte, 1)
+	go func() {
+		value, _ := mp.BLMove(source, destination, false, true, 0, nil)
+		result <- value
+	}()
+	waitQueued(mp, "source", 1)
+
+	mp.RPush(source, listOf("a", "b")...)
+	if got := <-result; string(got) != "b" {
+		log.Fatalf("failed BLMove, expected: b, got: %s", got)
+	}
+
+	moved, _ := mp.LRange(destination, 0, -1)
+	left, _ := mp.LRange(source, 0, -1)
+	if !reflect.DeepEqual(moved, listOf("b")) || !reflect.DeepEqual(left, listOf("a")) {
+		log.Fatalf("failed BLMove, destination: %s, source: %s", moved, left)
+	}
+
+	mp.Set(destination, []byte("value"))
+	_, err := mp.LMove(source, destination, true, true)
+	left, _ = mp.LRange(source, 0, -1)
+	if err != ErrWrongType || len(left) != 1 {
+		log.Fatalf("failed LMove wrong type, got: %v, source: %s", err, left)
+	}
+}
+
+func TestBPopPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+
+	mp, _, _ := NewWithOptions(options)
+	key := RetainKey("queue")
+	mp.RPush(key, listOf("a", "b", "c")...)
+	mp.BPop([]RetainKey{key}, true, 0, nil)
+	mp.BLMove(key, RetainKey("other"), false, false, 0, nil)
+	mp.Close()
+
+	mp, _, _ = NewWithOptions(options)
+	defer mp.Close()
+	queue, _ := mp.LRange(key, 0, -1)
+	other, _ := mp.LRange(RetainKey("other"), 0, -1)
+	if !reflect.DeepEqual(queue, listOf("b")) || !reflect.DeepEqual(other, listOf("c")) {
+		log.Fatalf("failed blocking pop replay, queue: %s, other: %s", queue, other)
+	}
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"hash/fnv"
+)
+
+// bloomBitsPerKey sizes the filters of tables, 10 bits per key lets
+// through about 1% of the keys that are not there
+const bloomBitsPerKey = 10
+
+// bloomFilter answers whether a table may hold a key, so that lookups
+// of keys it does not hold rarely have to read it. The last byte is the
+// number of hashes probed, the bits come before it.
+type bloomFilter []byte
+
+func newBloomFilter(keys [][]byte) bloomFilter {
+
+	// ln 2 times the bits per key is the best number of hashes
+	hashes := bloomBitsPerKey * 69 / 100
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	bits := len(keys) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	filter := make(bloomFilter, (bits+7)/8+1)
+	filter[len(filter)-1] = byte(hashes)
+
+	for _, key := range keys {
+		filter.probe(key, func(bit uint32) bool {
+			filter[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return filter
+}
+
+// mayContain reports false if key is surely not in the filter
+func (filter bloomFilter) mayContain(key []byte) bool {
+
+	if len(filter) < 2 {
+		return true
+	}
+	return filter.probe(key, func(bit uint32) bool {
+		return filter[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// probe calls f with the bits of key, derived from two halves of one
+// hash, until f returns false. It returns what the last call did.
+func (filter bloomFilter) probe(key []byte, f func(bit uint32) bool) bool {
+
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	first, second := uint32(sum), uint32(sum>>32)|1
+
+	bits := uint32(len(filter)-1) * 8
+	for i := 0; i < int(filter[len(filter)-1]); i++ {
+		if !f((first + uint32(i)*second) % bits) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrDatabaseOutOfRange = errors.New("DB index is out of range")
+	ErrSameDatabase       = errors.New("source and destination objects are the same")
+)
+
+// owner returns the root of the instance storage belongs to
+func (storage *Storage) owner() *Storage {
+
+	if storage.root == nil {
+		return storage
+	}
+	return storage.root
+}
+
+// all returns every database of the instance, the caller must be the
+// root and hold layout
+func (storage *Storage) all() []*Storage {
+
+	if len(storage.databases) == 0 {
+		return []*Storage{storage}
+	}
+	return storage.databases
+}
+
+// lockAll write locks every shard of every database, in the order of
+// the list, and returns the databases along with the function that
+// unlocks them. No database can be swapped in between.
+func (storage *Storage) lockAll() ([]*Storage, func()) {
+
+	root := storage.owner()
+	root.layout.RLock()
+
+	databases := root.all()
+	unlocks := make([]func(), 0, len(databases))
+	for _, db := range databases {
+		unlocks = append(unlocks, db.lockEvery())
+	}
+
+	return databases, func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+		root.layout.RUnlock()
+	}
+}
+
+// DB returns the database numbered index of the instance storage
+// belongs to, which is a Storage too. It keeps pointing to the same
+// data, which SwapDB may give another number.
+func (storage *Storage) DB(index int) (Engine, error) {
+
+	db, err := storage.database(index)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// database is DB for callers in need of the Storage itself
+func (storage *Storage) database(index int) (*Storage, error) {
+
+	root := storage.owner()
+	root.layout.RLock()
+	defer root.layout.RUnlock()
+
+	databases := root.all()
+	if index < 0 || index >= len(databases) {
+		return nil, ErrDatabaseOutOfRange
+	}
+	return databases[index], nil
+}
+
+// Databases returns how many databases the instance has
+func (storage *Storage) Databases() int {
+
+	root := storage.owner()
+	root.layout.RLock()
+	defer root.layout.RUnlock()
+
+	return len(root.all())
+}
+
+// Move moves key to the database numbered index. It reports false,
+// leaving both databases alone, if key does not exist or if the other
+// database already has it.
+func (storage *Storage) Move(key RetainKey, index int) (bool, error) {
+
+	root := storage.owner()
+	root.layout.RLock()
+	defer root.layout.RUnlock()
+
+	databases := root.all()
+	if index < 0 || index >= len(databases) {
+		return false, ErrDatabaseOutOfRange
+	}
+
+	target := databases[index]
+	if target == storage {
+		return false, ErrSameDatabase
+	}
+
+	// always lock in the order of the list, so that two
+	// moves in opposite directions cannot deadlock
+	first, second := storage, target
+	if storage.index > index {
+		first, second = target, storage
+	}
+	unlockFirst := first.lock(key)
+	defer unlockFirst()
+	unlockSecond := second.lock(key)
+	defer unlockSecond()
+
+	e, ok, err := storage.loadLocked(string(key))
+	if !ok || err != nil {
+		return false, err
+	}
+	_, exists, err := target.loadLocked(string(key))
+	if exists || err != nil {
+		return false, err
+	}
+
+	// should the second step fail, the key is left in both
+	// databases rather than in none
+	err = target.store(string(key), e)
+	if err == nil {
+		err = storage.remove(string(key))
+	}
+	if err != nil {
+		return false, err
+	}
+	storage.logCommand([]byte("DEL"), key)
+	target.logEntry(string(key), e)
+	return true, nil
+}
+
+// SwapDB exchanges the data of two databases, clients using one of the
+// numbers see the data of the other from then on
+func (storage *Storage) SwapDB(first int, second int) error {
+
+	return storage.swapDB(first, second, nil)
+}
+
+// swapDB is SwapDB calling record, unless it is nil, once the databases
+// are swapped and still locked. The swap is undone if record fails.
+func (storage *Storage) swapDB(first int, second int, record func() error) error {
+
+	root := storage.owner()
+	root.layout.Lock()
+	defer root.layout.Unlock()
+
+	databases := root.all()
+	if first < 0 || first >= len(databases) || second < 0 || second >= len(databases) {
+		return ErrDatabaseOutOfRange
+	}
+	if first == second {
+		return nil
+	}
+
+	// nobody else locks two databases without layout
+	for _, db := range []*Storage{databases[first], databases[second]} {
+		unlock := db.lockEvery()
+		defer unlock()
+	}
+
+	root.swap(first, second)
+	if record != nil {
+		err := record()
+		if err != nil {
+			root.swap(first, second)
+			return err
+		}
+	}
+	databases[first].logCommand([]byte("SWAPDB"), []byte(strconv.Itoa(first)), []byte(strconv.Itoa(second)))
+	return nil
+}
+
+// swap exchanges two databases in the list, the caller must hold
+// layout and every shard of both
+func (storage *Storage) swap(first int, second int) {
+
+	a, b := storage.databases[first], storage.databases[second]
+	storage.databases[first], storage.databases[second] = b, a
+	a.index, b.index = second, first
+
+	// what the keys of both numbers hold has changed, so watched keys
+	// have been modified and blocked clients may have something to pop
+	for _, db := range []*Storage{a, b} {
+		for i := range db.shards {
+			for key := range db.shards[i].watched {
+				db.bump(key)
+			}
+			for key := range db.shards[i].blocked {
+				db.wake(key)
+			}
+		}
+	}
+}
+
+// FlushDB removes every key of the database
+func (storage *Storage) FlushDB() error {
+
+	unlock := storage.lockEvery()
+	defer unlock()
+
+	err := storage.flush()
+	if err != nil {
+		return err
+	}
+	storage.logCommand([]byte("FLUSHDB"))
+	return nil
+}
+
+// FlushAll removes every key of every database
+func (storage *Storage) FlushAll() error {
+
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	for _, db := range databases {
+		err := db.flush()
+		if err != nil {
+			return err
+		}
+	}
+	databases[0].logCommand([]byte("FLUSHALL"))
+	return nil
+}
+
+// flush removes every key, the caller must hold every shard
+func (storage *Storage) flush() error {
+
+	var err error
+	storage.each(func(key string, _ *entry) {
+		if err == nil {
+			err = storage.remove(key)
+		}
+	})
+	return err
+}
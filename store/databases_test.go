@@ -0,0 +1,169 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// contents returns the plain values of every database by key
+func contents(mp *Storage) []map[string]string {
+
+	result := make([]map[string]string, 0)
+	for i := 0; i < mp.Databases(); i++ {
+		db, _ := mp.DB(i)
+		values := make(map[string]string)
+		keys, err := db.Keys("*")
+		handleError("failed Keys", err)
+		for _, key := range keys {
+			value, _, err := db.Get(key)
+			handleError("failed Get", err)
+			values[string(key)] = string(value.([]byte))
+		}
+		result = append(result, values)
+	}
+	return result
+}
+
+func TestDatabases(t *testing.T) {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), fileName)
+	options.Databases = 3
+
+	mp, _, err := NewWithOptions(options)
+	handleError("failed NewWithOptions", err)
+	defer mp.Close()
+
+	if _, err := mp.DB(3); err != ErrDatabaseOutOfRange {
+		log.Fatalf("failed DB out of range, got: %v", err)
+	}
+
+	first, _ := mp.DB(1)
+	second, _ := mp.DB(2)
+	mp.Set(RetainKey("key"), []byte("zero"))
+	first.Set(RetainKey("key"), []byte("one"))
+	first.Set(RetainKey("only"), []byte("one"))
+
+	expected := []map[string]string{{"key": "zero"}, {"key": "one", "only": "one"}, {}}
+	if got := contents(mp); !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed separate databases, got: %v", got)
+	}
+
+	moved, _ := first.Move(RetainKey("only"), 2)
+	blocked, _ := first.Move(RetainKey("key"), 0)
+	_, err = first.Move(RetainKey("key"), 1)
+	if !moved || blocked || err != ErrSameDatabase {
+		log.Fatalf("failed Move, got: %v %v %v", moved, blocked, err)
+	}
+
+	handleError("failed SwapDB", mp.SwapDB(0, 2))
+	expected = []map[string]string{{"only": "one"}, {"key": "one"}, {"key": "zero"}}
+	if got := contents(mp); !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed SwapDB, got: %v", got)
+	}
+
+	// handles follow the data rather than the number
+	if value, _, err := second.Get(RetainKey("only")); err != nil || string(value.([]byte)) != "one" {
+		log.Fatalf("failed SwapDB, the handle lost its data")
+	}
+
+	first.FlushDB()
+	if got := contents(mp); len(got[1]) != 0 || len(got[0]) != 1 {
+		log.Fatalf("failed FlushDB, got: %v", got)
+	}
+
+	mp.FlushAll()
+	if size := mp.DBSize() + second.DBSize(); size != 0 {
+		log.Fatalf("failed FlushAll, %d keys left", size)
+	}
+}
+
+func TestSwapDBWakesClients(t *testing.T) {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), fileName)
+	options.Databases = 2
+
+	mp, _, _ := NewWithOptions(options)
+	defer mp.Close()
+
+	first, _ := mp.DB(1)
+	version, err := mp.Watch(RetainKey("key"))
+	handleError("failed Watch", err)
+	first.Set(RetainKey("key"), []byte("value"))
+
+	handleError("failed SwapDB", mp.SwapDB(0, 1))
+	if versionOf(mp, RetainKey("key")) == version {
+		log.Fatalf("failed SwapDB, a watched key was not touched")
+	}
+}
+
+func TestDatabasesPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+	options.Databases = 4
+
+	mp, _, _ := NewWithOptions(options)
+	for i := 0; i < 4; i++ {
+		db, _ := mp.DB(i)
+		db.Set(RetainKey("key"), []byte{byte('a' + i)})
+		db.Set(RetainKey("temporary"), []byte("value"))
+		db.Expire(RetainKey("temporary"), time.Now().Add(time.Hour))
+	}
+
+	first, _ := mp.DB(1)
+	third, _ := mp.DB(3)
+	first.Move(RetainKey("temporary"), 0)
+	first.Set(RetainKey("moved"), []byte("value"))
+	first.Move(RetainKey("moved"), 3)
+	third.FlushDB()
+	third.Set(RetainKey("after"), []byte("flush"))
+	mp.SwapDB(1, 2)
+
+	// written after the swap, so it lands in what used to be database 2
+	first.Set(RetainKey("swapped"), []byte("value"))
+	expected := contents(mp)
+
+	handleError("failed Save", mp.Save())
+	mp.Close()
+
+	// from the append only file
+	mp, _, _ = NewWithOptions(options)
+	if got := contents(mp); !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed databases replay, expected: %v, got: %v", expected, got)
+	}
+
+	// and again once it has been rewritten
+	snapshot, err := mp.startRewrite()
+	handleError("failed startRewrite", err)
+	handleError("failed finishRewrite", mp.finishRewrite(snapshot))
+	mp.Close()
+
+	mp, _, _ = NewWithOptions(options)
+	got := contents(mp)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed databases rewrite, expected: %v, got: %v", expected, got)
+	}
+
+	// from the snapshot
+	snapshotOptions := Options{SnapshotPath: filepath.Join(dir, fileName), Databases: 4}
+	mp, _, _ = NewWithOptions(snapshotOptions)
+	got = contents(mp)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed databases snapshot, expected: %v, got: %v", expected, got)
+	}
+
+	// a snapshot with more databases than configured is refused
+	snapshotOptions.Databases = 2
+	_, _, err = NewWithOptions(snapshotOptions)
+	if !errors.Is(err, ErrDatabaseOutOfRange) {
+		log.Fatalf("failed to refuse a snapshot with too many databases, got: %v", err)
+	}
+}
@@ -0,0 +1,691 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LSMEngine names the engine that keeps keys on disk in a
+// log-structured merge tree, see NewLSM
+const LSMEngine = "lsm"
+
+// An LSMStorage keeps the records of every key in the tree, the shards
+// of its Storage only cache decoded entries so that values changed in
+// place, like lists, do not have to be decoded for every change. The
+// cache is written through: every change is in the tree before the lock
+// of its key is released, so cached entries can be dropped at any time
+// the lock is held. The records of a database are kept under a prefix
+// of its own, the list of prefixes in the order of the databases under
+// layoutKey. How many keys each database has is kept up to date in
+// memory and left under countsKey by Close for the next start.
+const (
+	// cacheEntries is how many entries every shard caches at most,
+	// once the sweeper is done with it
+	cacheEntries = 256
+
+	// sweepKeys is how many keys on disk the sweeper looks at for
+	// every database each time it runs
+	sweepKeys = 1000
+
+	// scanCursors is how many SCAN cursors are remembered, one that
+	// is older than the last scanCursors handed out starts over
+	scanCursors = 4096
+
+	databasePrefix = 'd'
+)
+
+var (
+	layoutKey = []byte("layout")
+	countsKey = []byte("counts")
+)
+
+// LSMStorage is one of the numbered databases of an instance of the
+// lsm engine. It is a Storage backed by the tree, which does what the
+// Storage does for a single key and takes over whatever needs every
+// key or the tree as a whole.
+type LSMStorage struct {
+	*Storage
+
+	disk    *lsm
+	cursors *cursorTable
+
+	// id picks the prefix of the keys of the database, see prefixOf
+	id int
+
+	// keys counts the keys of the database, expired ones included
+	// until they are deleted, whether they are cached or not
+	keys int64
+
+	// swept is the key expire goes on from the next time
+	sweeping sync.Mutex
+	swept    []byte
+}
+
+// cursorTable maps the cursors SCAN hands out to the keys their pages
+// start at, since a key does not fit in a cursor
+type cursorTable struct {
+	mu    sync.Mutex
+	last  uint64
+	slots [scanCursors]struct {
+		cursor uint64
+		key    []byte
+	}
+}
+
+func newCursorTable() *cursorTable {
+
+	// start anywhere, so that the cursors of an earlier run are
+	// unlikely to be taken for those of this one
+	return &cursorTable{last: uint64(randomIntn(1 << 30))}
+}
+
+// add returns a new cursor for key
+func (table *cursorTable) add(key []byte) uint64 {
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	table.last++
+	slot := &table.slots[table.last%scanCursors]
+	slot.cursor, slot.key = table.last, key
+	return table.last
+}
+
+// find returns the key of cursor, false if it is not remembered
+func (table *cursorTable) find(cursor uint64) ([]byte, bool) {
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	slot := &table.slots[cursor%scanCursors]
+	if slot.cursor != cursor {
+		return nil, false
+	}
+	return slot.key, true
+}
+
+// NewLSM is like NewWithOptions but keeps every key on disk in the
+// directory at options.LSMPath, so that the data set does not have to
+// fit in memory. The tree replaces the snapshot and the append only
+// file: Save only makes sure every change is in a table, and the
+// options about them are ignored along with the memory limit.
+func NewLSM(options Options) (*LSMStorage, bool, error) {
+
+	disk, err := openLSM(options.LSMPath, options.AppendFsync, defaultLSMConfig())
+	if err != nil {
+		return nil, false, err
+	}
+
+	root := &Storage{
+		stopSweeper:    make(chan struct{}),
+		sweeperStopped: make(chan struct{}),
+	}
+	cursors := newCursorTable()
+	storage := &LSMStorage{Storage: root, disk: disk, cursors: cursors}
+	root.backing = storage
+
+	if options.Databases > 1 {
+		root.databases = []*Storage{root}
+		for i := 1; i < options.Databases; i++ {
+			db := &Storage{index: i, root: root}
+			db.backing = &LSMStorage{Storage: db, disk: disk, cursors: cursors}
+			root.databases = append(root.databases, db)
+		}
+	}
+
+	err = storage.readLayout()
+	if err == nil {
+		err = storage.readCounts()
+	}
+	if err != nil {
+		disk.close()
+		return nil, false, err
+	}
+
+	it := disk.iterate([]byte{databasePrefix}, []byte{databasePrefix + 1})
+	loadedFromDisk := it.valid()
+	it.close()
+
+	root.resetDirty()
+	go root.sweep()
+	return storage, loadedFromDisk, nil
+}
+
+// lsmOf returns the LSMStorage of db, a database of the lsm engine
+func lsmOf(db *Storage) *LSMStorage {
+
+	return db.backing.(*LSMStorage)
+}
+
+// readLayout gives every database the prefix it had before, databases
+// that are new get prefixes nobody uses. It refuses to drop databases
+// that still have keys.
+func (storage *LSMStorage) readLayout() error {
+
+	var layout []int
+	rec, ok, err := storage.disk.get(layoutKey)
+	if err != nil {
+		return err
+	}
+	for data := rec.value; ok && len(data) > 0; {
+		id, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad database layout", ErrCorruptTable)
+		}
+		layout, data = append(layout, int(id)), data[n:]
+	}
+
+	databases := storage.all()
+	used := make(map[int]bool)
+	for index := range databases {
+		if index < len(layout) {
+			lsmOf(databases[index]).id = layout[index]
+			used[layout[index]] = true
+		}
+	}
+	next := 0
+	for index := len(layout); index < len(databases); index++ {
+		for used[next] {
+			next++
+		}
+		lsmOf(databases[index]).id = next
+		used[next] = true
+	}
+
+	for index := len(databases); index < len(layout); index++ {
+		it := storage.disk.iterate(prefixOf(layout[index]), prefixOf(layout[index]+1))
+		dropped := it.valid()
+		it.close()
+		if dropped {
+			return fmt.Errorf("%s: %w: it holds database %d", storage.disk.dir, ErrDatabaseOutOfRange, index)
+		}
+	}
+	return storage.saveLayout()
+}
+
+// saveLayout records the prefix of every database in order, the caller
+// must hold layout
+func (storage *LSMStorage) saveLayout() error {
+
+	var layout []byte
+	for _, db := range storage.owner().all() {
+		layout = appendUvarint(layout, uint64(lsmOf(db).id))
+	}
+	return storage.disk.put(layoutKey, record{value: layout})
+}
+
+// readCounts sets how many keys every database has from what Close
+// left, or else by counting them. What Close left is deleted right
+// away since it only holds until the next change.
+func (storage *LSMStorage) readCounts() error {
+
+	rec, ok, err := storage.disk.get(countsKey)
+	if err != nil {
+		return err
+	}
+	counts := make(map[int]int64)
+	for data := rec.value; ok && len(data) > 0; {
+		id, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad key counts", ErrCorruptTable)
+		}
+		count, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return fmt.Errorf("%w: bad key counts", ErrCorruptTable)
+		}
+		counts[int(id)], data = int64(count), data[n+m:]
+	}
+
+	for _, db := range storage.all() {
+		db := lsmOf(db)
+		if ok {
+			db.keys = counts[db.id]
+			continue
+		}
+
+		it := storage.disk.iterate(prefixOf(db.id), prefixOf(db.id+1))
+		for ; it.valid(); it.next() {
+			db.keys++
+		}
+		err := it.err()
+		it.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ok {
+		return nil
+	}
+	return storage.disk.put(countsKey, record{deleted: true})
+}
+
+// saveCounts records how many keys every database has for readCounts,
+// the caller must hold every shard of every database
+func (storage *LSMStorage) saveCounts(databases []*Storage) error {
+
+	var counts []byte
+	for _, db := range databases {
+		db := lsmOf(db)
+		counts = appendUvarint(appendUvarint(counts, uint64(db.id)), uint64(atomic.LoadInt64(&db.keys)))
+	}
+	return storage.disk.put(countsKey, record{value: counts})
+}
+
+// prefixOf returns the prefix of the keys of the database with id.
+// Prefixes have the same length, so the keys of one database all sort
+// between its prefix and the next one.
+func prefixOf(id int) []byte {
+
+	prefix := []byte{databasePrefix, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(id))
+	return prefix
+}
+
+func (storage *LSMStorage) diskKey(key string) []byte {
+
+	return append(prefixOf(storage.id), key...)
+}
+
+// read returns the entry at key as it is on disk, expired or not
+func (storage *LSMStorage) read(key string) (*entry, bool, error) {
+
+	rec, ok, err := storage.disk.get(storage.diskKey(key))
+	if !ok || err != nil {
+		return nil, false, err
+	}
+
+	e, err := decodeEntry(key, rec)
+	if err != nil {
+		return nil, false, err
+	}
+	return e, true, nil
+}
+
+func decodeEntry(key string, rec record) (*entry, error) {
+
+	value, err := decodeValue(rec.value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad value at %q: %v", ErrCorruptTable, key, err)
+	}
+
+	e := &entry{value: value, expireAt: rec.expireAt, size: sizeOf(key, value)}
+	e.hits, e.accessed = initialHits, toMillis(time.Now())
+	return e, nil
+}
+
+// write puts e, the new state of key, on disk. A key that was not
+// cached is looked up first, to know whether it is a new one.
+func (storage *LSMStorage) write(key string, e *entry, existing bool) error {
+
+	value, err := encodeValue(e.value)
+	if err != nil {
+		return err
+	}
+	if !existing {
+		_, existing, err = storage.disk.get(storage.diskKey(key))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = storage.disk.put(storage.diskKey(key), record{value: value, expireAt: e.expireAt})
+	if err != nil {
+		return err
+	}
+	if !existing {
+		atomic.AddInt64(&storage.keys, 1)
+	}
+	return nil
+}
+
+// erase deletes key from disk
+func (storage *LSMStorage) erase(key string) error {
+
+	err := storage.disk.put(storage.diskKey(key), record{deleted: true})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&storage.keys, -1)
+	return nil
+}
+
+// trim drops cached entries of sh until there are no more than
+// cacheEntries, the caller must hold its lock
+func (storage *LSMStorage) trim(sh *shard) {
+
+	for key := range sh.entries {
+		if len(sh.entries) <= cacheEntries {
+			return
+		}
+		storage.uncache(key)
+	}
+}
+
+// expire deletes the expired keys among the next sweepKeys on disk,
+// from where it stopped the time before, so that keys nobody reads
+// again do not stay in the tree and in DBSize for good
+func (storage *LSMStorage) expire() error {
+
+	storage.sweeping.Lock()
+	defer storage.sweeping.Unlock()
+
+	prefix := prefixOf(storage.id)
+	it := storage.disk.iterate(append(prefix, storage.swept...), prefixOf(storage.id+1))
+	now := toMillis(time.Now())
+	expired := make([]string, 0)
+	for looked := 0; it.valid() && looked < sweepKeys; it.next() {
+		if rec := it.record(); rec.expireAt != 0 && rec.expireAt <= now {
+			expired = append(expired, string(it.key()[len(prefix):]))
+		}
+		looked++
+	}
+
+	storage.swept = nil
+	if it.valid() {
+		storage.swept = append([]byte{}, it.key()[len(prefix):]...)
+	}
+	err := it.err()
+	it.close()
+	if err != nil {
+		return err
+	}
+
+	// loading a key that has expired deletes it
+	for _, key := range expired {
+		unlock := storage.lock(RetainKey(key))
+		_, _, err = storage.loadLocked(key)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeOnDisk returns the keys from start up to but not including end
+// that have not expired, in order, a nil end meaning no end
+func (storage *LSMStorage) rangeOnDisk(start []byte, end []byte) ([]string, error) {
+
+	names := make([]string, 0)
+	err := storage.walkOnDisk(start, end, func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// walkOnDisk is rangeOnDisk calling f with each key in turn, until f
+// returns false
+func (storage *LSMStorage) walkOnDisk(start []byte, end []byte, f func(name string) bool) error {
+
+	prefix := prefixOf(storage.id)
+	last := prefixOf(storage.id + 1)
+	if end != nil {
+		last = append(append([]byte{}, prefix...), end...)
+	}
+	it := storage.disk.iterate(append(append([]byte{}, prefix...), start...), last)
+	defer it.close()
+
+	now := toMillis(time.Now())
+	for ; it.valid(); it.next() {
+		rec := it.record()
+		if (rec.expireAt == 0 || rec.expireAt > now) && !f(string(it.key()[len(prefix):])) {
+			break
+		}
+	}
+	return it.err()
+}
+
+// Keys is Storage.Keys for the keys on disk
+func (storage *LSMStorage) Keys(pattern string) ([]RetainKey, error) {
+
+	names, err := storage.rangeOnDisk(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return matching(names, pattern), nil
+}
+
+// Scan is Storage.Scan walking the keys on disk in order, the cursor
+// stands for the key the next page starts at. A cursor that is not
+// remembered anymore starts over, which returns keys more than once
+// but skips none.
+func (storage *LSMStorage) Scan(cursor uint64, pattern string, count int, kind string) (uint64, []RetainKey, error) {
+
+	if count < 1 {
+		count = 1
+	}
+
+	var start []byte
+	if cursor != 0 {
+		start, _ = storage.cursors.find(cursor)
+	}
+
+	prefix := prefixOf(storage.id)
+	it := storage.disk.iterate(append(prefix, start...), prefixOf(storage.id+1))
+	defer it.close()
+
+	now := toMillis(time.Now())
+	page := make([]string, 0)
+	for looked := 0; it.valid() && looked < count; it.next() {
+		if rec := it.record(); rec.expireAt == 0 || rec.expireAt > now {
+			page = append(page, string(it.key()[len(prefix):]))
+		}
+		looked++
+	}
+	if err := it.err(); err != nil {
+		return 0, nil, err
+	}
+
+	next := uint64(0)
+	if it.valid() {
+		next = storage.cursors.add(append([]byte{}, it.key()[len(prefix):]...))
+	}
+	keys, err := storage.filter(page, pattern, kind)
+	if err != nil {
+		return 0, nil, err
+	}
+	return next, keys, nil
+}
+
+// Range is Storage.Range reading the keys in order from the tables
+func (storage *LSMStorage) Range(start RetainKey, end RetainKey) ([]RetainKey, error) {
+
+	var last []byte
+	if len(end) > 0 {
+		last = end
+	}
+	names, err := storage.rangeOnDisk(start, last)
+	if err != nil {
+		return nil, err
+	}
+	return asKeys(names), nil
+}
+
+// DBSize returns the number of keys, which like with Redis includes
+// those that expired but were not deleted yet
+func (storage *LSMStorage) DBSize() int {
+
+	return int(atomic.LoadInt64(&storage.keys))
+}
+
+// RandomKey returns a key picked at random, or false if there are none.
+// Rather than walking every key, it starts at a block of a table picked
+// at random and skips a random number of the keys a block holds.
+func (storage *LSMStorage) RandomKey() (RetainKey, bool, error) {
+
+	keys := storage.DBSize()
+	if keys <= 0 {
+		return nil, false, nil
+	}
+
+	prefix, end := prefixOf(storage.id), prefixOf(storage.id+1)
+	start, blocks := storage.disk.sample(prefix, end)
+	if start == nil {
+		start = prefix
+	}
+	skip := randomIntn(keys/(blocks+1) + 1)
+
+	// past the last key, the first one does
+	for _, from := range [][]byte{start, prefix} {
+		var name string
+		found := false
+		err := storage.walkOnDisk(from[len(prefix):], nil, func(key string) bool {
+			name, found = key, true
+			skip--
+			return skip >= 0
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if found && skip < 0 {
+			return RetainKey(name), true, nil
+		}
+		skip = 0
+	}
+	return nil, false, nil
+}
+
+// Iterate is Storage.Iterate for the keys on disk
+func (storage *LSMStorage) Iterate(pattern string) *Iterator {
+
+	return &Iterator{storage: storage, pattern: pattern}
+}
+
+// DB returns the database numbered index of the instance storage
+// belongs to, which is an LSMStorage too
+func (storage *LSMStorage) DB(index int) (Engine, error) {
+
+	db, err := storage.database(index)
+	if err != nil {
+		return nil, err
+	}
+	return lsmOf(db), nil
+}
+
+// SwapDB is Storage.SwapDB recording the new order of the prefixes
+func (storage *LSMStorage) SwapDB(first int, second int) error {
+
+	return storage.swapDB(first, second, storage.saveLayout)
+}
+
+// FlushDB removes every key of the database
+func (storage *LSMStorage) FlushDB() error {
+
+	unlock := storage.lockEvery()
+	defer unlock()
+
+	return storage.flush()
+}
+
+// FlushAll removes every key of every database
+func (storage *LSMStorage) FlushAll() error {
+
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	for _, db := range databases {
+		err := lsmOf(db).flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush removes every key on disk, expired or not, the caller must
+// hold every shard
+func (storage *LSMStorage) flush() error {
+
+	prefix := prefixOf(storage.id)
+	it := storage.disk.iterate(prefix, prefixOf(storage.id+1))
+	defer it.close()
+
+	for ; it.valid(); it.next() {
+		err := storage.remove(string(it.key()[len(prefix):]))
+		if err != nil {
+			return err
+		}
+	}
+	return it.err()
+}
+
+// Save makes sure every change is in a table rather than only in the
+// write-ahead log
+func (storage *LSMStorage) Save() error {
+
+	root := storage.owner()
+	if !atomic.CompareAndSwapInt32(&root.saving, 0, 1) {
+		return ErrSaveInProgress
+	}
+	defer atomic.StoreInt32(&root.saving, 0)
+
+	return storage.sync()
+}
+
+// BackgroundSave is Save on another goroutine
+func (storage *LSMStorage) BackgroundSave() error {
+
+	root := storage.owner()
+	if !atomic.CompareAndSwapInt32(&root.saving, 0, 1) {
+		return ErrSaveInProgress
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&root.saving, 0)
+
+		err := storage.sync()
+		if err != nil {
+			log.Println("background save:", err)
+		}
+	}()
+	return nil
+}
+
+// sync writes the tree out and records the changes up to now as saved
+func (storage *LSMStorage) sync() error {
+
+	root := storage.owner()
+	root.layout.RLock()
+	changes := changes(root.all())
+	root.layout.RUnlock()
+
+	err := storage.disk.sync()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&root.saved, changes)
+	atomic.StoreInt64(&root.lastSave, time.Now().Unix())
+	return nil
+}
+
+// Close is Storage.Close flushing the tree as well, along with how
+// many keys every database has. Nothing changes after that.
+func (storage *LSMStorage) Close() error {
+
+	root := storage.owner()
+	var err error
+	root.closeOnce.Do(func() {
+		err = root.stop()
+
+		databases, unlock := root.lockAll()
+		defer unlock()
+
+		if countsErr := storage.saveCounts(databases); err == nil {
+			err = countsErr
+		}
+		if closeErr := storage.disk.close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
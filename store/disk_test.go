@@ -0,0 +1,316 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func lsmOptions(dir string) Options {
+
+	options := DefaultOptions()
+	options.LSMPath = filepath.Join(dir, "retain.lsm")
+	options.Databases = 3
+	return options
+}
+
+func TestLSMStorage(t *testing.T) {
+
+	options := lsmOptions(t.TempDir())
+	mp, loaded, err := NewLSM(options)
+	handleError("failed NewLSM", err)
+	if loaded {
+		log.Fatalf("failed NewLSM, an empty directory was loaded")
+	}
+
+	mp.Set(RetainKey("string"), []byte("value"))
+	mp.Set(RetainKey("gone"), []byte("value"))
+	mp.Delete(RetainKey("gone"))
+	mp.Set(RetainKey("expired"), []byte("value"))
+	mp.Expire(RetainKey("expired"), time.Now().Add(20*time.Millisecond))
+	mp.Set(RetainKey("later"), []byte("value"))
+	mp.Expire(RetainKey("later"), time.Now().Add(time.Hour))
+
+	// collections changed in place make it to disk too
+	mp.RPush(RetainKey("list"), []byte("a"), []byte("b"), []byte("c"))
+	mp.LPop(RetainKey("list"), 1)
+	mp.HSet(RetainKey("hash"), []byte("field"), []byte("value"))
+	mp.HIncrBy(RetainKey("hash"), []byte("count"), 3)
+	mp.SAdd(RetainKey("set"), []byte("member"))
+	mp.ZAdd(RetainKey("zset"), []ScoredMember{{Member: []byte("member"), Score: 2}}, ZAddOptions{})
+
+	first, _ := mp.DB(1)
+	second, _ := mp.DB(2)
+	first.Set(RetainKey("string"), []byte("one"))
+	second.Set(RetainKey("moved"), []byte("two"))
+	second.Move(RetainKey("moved"), 1)
+	handleError("failed SwapDB", mp.SwapDB(1, 2))
+	time.Sleep(30 * time.Millisecond)
+
+	check := func(mp *LSMStorage) {
+		expected := []RetainKey{RetainKey("hash"), RetainKey("later"), RetainKey("list"), RetainKey("set"), RetainKey("string"), RetainKey("zset")}
+		keys, err := mp.Range(nil, nil)
+		handleError("failed Range", err)
+		if !reflect.DeepEqual(keys, expected) {
+			log.Fatalf("failed Range, got: %q", keys)
+		}
+		keys, err = mp.Range(RetainKey("l"), RetainKey("s"))
+		handleError("failed Range", err)
+		if len(keys) != 2 || string(keys[1]) != "list" {
+			log.Fatalf("failed Range, got: %q", keys)
+		}
+
+		list, _ := mp.LRange(RetainKey("list"), 0, -1)
+		count, _, _ := mp.HGet(RetainKey("hash"), []byte("count"))
+		isMember, _ := mp.SIsMember(RetainKey("set"), []byte("member"))
+		score, _, _ := mp.ZScore(RetainKey("zset"), []byte("member"))
+		if fmt.Sprintf("%s", list) != "[b c]" || string(count) != "3" || !isMember || score != 2 {
+			log.Fatalf("failed collections, got: %s %s %v %v", list, count, isMember, score)
+		}
+		if deadline, _, err := mp.ExpireTime(RetainKey("later")); err != nil || deadline.IsZero() {
+			log.Fatalf("failed ExpireTime, the deadline was lost")
+		}
+
+		// database 1 and 2 were swapped after the move
+		first, _ := mp.DB(1)
+		second, _ := mp.DB(2)
+		keys, err = first.Keys("*")
+		handleError("failed Keys", err)
+		if len(keys) != 0 {
+			log.Fatalf("failed SwapDB, database 1 holds: %q", keys)
+		}
+		keys, err = second.Keys("*")
+		handleError("failed Keys", err)
+		if value, _, err := second.Get(RetainKey("moved")); err != nil || string(value.([]byte)) != "two" || len(keys) != 2 || second.DBSize() != 2 {
+			log.Fatalf("failed SwapDB, database 2 holds: %q", keys)
+		}
+	}
+
+	check(mp)
+	handleError("failed Save", mp.Save())
+	if mp.Dirty() != 0 {
+		log.Fatalf("failed Save, %d changes left", mp.Dirty())
+	}
+	handleError("failed Close", mp.Close())
+
+	mp, loaded, err = NewLSM(options)
+	handleError("failed NewLSM", err)
+	if !loaded {
+		log.Fatalf("failed NewLSM, nothing was loaded")
+	}
+	check(mp)
+
+	handleError("failed FlushAll", mp.FlushAll())
+	keys, err := mp.Range(nil, nil)
+	handleError("failed Range", err)
+	if mp.DBSize() != 0 || len(keys) != 0 {
+		log.Fatalf("failed FlushAll, %d keys left", mp.DBSize())
+	}
+	handleError("failed Close", mp.Close())
+
+	// empty databases can be dropped, databases with keys cannot
+	options.Databases = 1
+	mp, _, err = NewLSM(options)
+	handleError("failed NewLSM with fewer empty databases", err)
+	mp.Close()
+
+	options.Databases = 3
+	mp, _, err = NewLSM(options)
+	handleError("failed NewLSM", err)
+	second, _ = mp.DB(2)
+	second.Set(RetainKey("key"), []byte("value"))
+	mp.Close()
+
+	options.Databases = 2
+	if _, _, err := NewLSM(options); !errors.Is(err, ErrDatabaseOutOfRange) {
+		log.Fatalf("failed NewLSM, dropped a database with keys, got: %v", err)
+	}
+}
+
+func TestLSMCache(t *testing.T) {
+
+	mp, _, err := NewLSM(lsmOptions(t.TempDir()))
+	handleError("failed NewLSM", err)
+	defer mp.Close()
+
+	const count = 4 * shardCount * cacheEntries
+	for i := 0; i < count; i++ {
+		mp.RPush(RetainKey(fmt.Sprint("list:", i)), []byte("element"))
+	}
+	mp.removeExpired()
+
+	for i := range mp.shards {
+		if cached := len(mp.shards[i].entries); cached > cacheEntries {
+			log.Fatalf("failed to trim the cache, shard %d holds %d entries", i, cached)
+		}
+	}
+
+	// what fell out of the cache is read back from disk
+	for i := 0; i < count; i += 97 {
+		length, err := mp.RPush(RetainKey(fmt.Sprint("list:", i)), []byte("element"))
+		if err != nil || length != 2 {
+			log.Fatalf("failed RPush after trimming the cache, got: %d %v", length, err)
+		}
+	}
+	if mp.DBSize() != count {
+		log.Fatalf("failed DBSize, got: %d", mp.DBSize())
+	}
+
+	// and so are the keys of a scan
+	seen := make(map[string]bool)
+	for cursor := uint64(0); ; {
+		var keys []RetainKey
+		cursor, keys, err = mp.Scan(cursor, "list:*", 1000, "")
+		handleError("failed Scan", err)
+		for _, key := range keys {
+			seen[string(key)] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != count {
+		log.Fatalf("failed Scan, expected %d keys, got: %d", count, len(seen))
+	}
+}
+
+func TestLSMKeyCount(t *testing.T) {
+
+	options := lsmOptions(t.TempDir())
+	mp, _, err := NewLSM(options)
+	handleError("failed NewLSM", err)
+
+	// uncache makes the next change to key find it on disk
+	uncache := func(key string) {
+		unlock := mp.lock(RetainKey(key))
+		mp.uncache(key)
+		unlock()
+	}
+
+	for i := 0; i < 100; i++ {
+		mp.Set(RetainKey(fmt.Sprint("key:", i)), []byte("value"))
+	}
+	uncache("key:1")
+	mp.Set(RetainKey("key:1"), []byte("again"))
+	uncache("key:2")
+	mp.Delete(RetainKey("key:2"))
+	mp.Delete(RetainKey("missing"))
+	first, _ := mp.DB(1)
+	mp.Move(RetainKey("key:3"), 1)
+	if mp.DBSize() != 98 || first.DBSize() != 1 {
+		log.Fatalf("failed DBSize, got: %d and %d", mp.DBSize(), first.DBSize())
+	}
+
+	// keys nobody reads are deleted by the sweeper once expired
+	mp.Expire(RetainKey("key:4"), time.Now().Add(10*time.Millisecond))
+	uncache("key:4")
+	time.Sleep(20 * time.Millisecond)
+	mp.removeExpired()
+	if mp.DBSize() != 97 {
+		log.Fatalf("failed to delete an expired key on disk, DBSize: %d", mp.DBSize())
+	}
+
+	// the counts are left for the next start, or else counted again
+	handleError("failed Close", mp.Close())
+	mp, _, err = NewLSM(options)
+	handleError("failed NewLSM", err)
+	first, _ = mp.DB(1)
+	if mp.DBSize() != 97 || first.DBSize() != 1 {
+		log.Fatalf("failed DBSize after a restart, got: %d and %d", mp.DBSize(), first.DBSize())
+	}
+	handleError("failed Close", mp.Close())
+
+	tree, err := openLSM(options.LSMPath, options.AppendFsync, defaultLSMConfig())
+	handleError("failed openLSM", err)
+	handleError("failed put", tree.put(countsKey, record{deleted: true}))
+	handleError("failed close", tree.close())
+
+	mp, _, err = NewLSM(options)
+	handleError("failed NewLSM", err)
+	defer mp.Close()
+	first, _ = mp.DB(1)
+	if mp.DBSize() != 97 || first.DBSize() != 1 {
+		log.Fatalf("failed DBSize after counting again, got: %d and %d", mp.DBSize(), first.DBSize())
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key, ok, err := mp.RandomKey()
+		handleError("failed RandomKey", err)
+		if !ok {
+			log.Fatalf("failed RandomKey, no key")
+		}
+		seen[string(key)] = true
+	}
+	if len(seen) < 10 {
+		log.Fatalf("failed RandomKey, picked %d keys out of 100 tries", len(seen))
+	}
+}
+
+func TestLSMScan(t *testing.T) {
+
+	mp, _, err := NewLSM(lsmOptions(t.TempDir()))
+	handleError("failed NewLSM", err)
+	defer mp.Close()
+
+	for i := 0; i < 100; i++ {
+		mp.Set(RetainKey(fmt.Sprintf("key:%03d", i)), []byte("value"))
+	}
+
+	// keys come in order, and those written in between do not
+	// keep the others from coming
+	seen := make(map[string]bool)
+	for cursor := uint64(0); ; {
+		var keys []RetainKey
+		cursor, keys, err = mp.Scan(cursor, "key:*", 7, "")
+		handleError("failed Scan", err)
+		for _, key := range keys {
+			seen[string(key)] = true
+		}
+		if cursor == 0 {
+			break
+		}
+		mp.Set(RetainKey(fmt.Sprint("key:", cursor)), []byte("new"))
+	}
+	for i := 0; i < 100; i++ {
+		if !seen[fmt.Sprintf("key:%03d", i)] {
+			log.Fatalf("failed Scan, key:%03d was skipped", i)
+		}
+	}
+
+	// a cursor that is not remembered starts over
+	if _, keys, err := mp.Scan(1<<40, "", 1, ""); err != nil || len(keys) != 1 || string(keys[0]) != "key:000" {
+		log.Fatalf("failed Scan with an unknown cursor, got: %q", keys)
+	}
+}
+
+func TestLSMErrors(t *testing.T) {
+
+	mp, _, err := NewLSM(lsmOptions(t.TempDir()))
+	handleError("failed NewLSM", err)
+	defer mp.Close()
+
+	// a value that does not decode is an error for its key alone
+	err = mp.disk.put(mp.diskKey("broken"), record{value: []byte{0xff}})
+	handleError("failed to write a broken value", err)
+	if _, _, err := mp.Get(RetainKey("broken")); !errors.Is(err, ErrCorruptTable) {
+		log.Fatalf("failed Get of a broken value, got: %v", err)
+	}
+	handleError("failed Set", mp.Set(RetainKey("key"), "value"))
+
+	// once the disk fails writes do too, and nothing is kept of them
+	mp.disk.fail(errors.New("disk full"))
+	if err := mp.Set(RetainKey("other"), "value"); err == nil || err.Error() != "disk full" {
+		log.Fatalf("failed Set on a failed disk, got: %v", err)
+	}
+	if _, ok, err := mp.Get(RetainKey("other")); err != nil || ok {
+		log.Fatalf("failed Set on a failed disk, the key was kept")
+	}
+	if value, ok, err := mp.Get(RetainKey("key")); err != nil || !ok || value != "value" {
+		log.Fatalf("failed Get on a failed disk, got: %v, %v", value, err)
+	}
+}
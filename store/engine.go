@@ -0,0 +1,219 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Engine is everything a server needs from the place keys are kept.
+// Storage, which keeps them in memory, is one implementation, Open
+// picks one by name. It is made of smaller interfaces by kind of
+// value, so that code only needing some of it can ask for less.
+type Engine interface {
+	Keyspace
+	Strings
+	Lists
+	Hashes
+	Sets
+	SortedSets
+	Blocking
+	Watching
+	Databases
+	Memory
+	Persistence
+}
+
+// Keyspace is about keys whatever their value
+type Keyspace interface {
+	Get(key RetainKey) (interface{}, bool, error)
+	Set(key RetainKey, value RetainValue) error
+	Update(key RetainKey, update func(value RetainValue, exists bool) (RetainValue, error)) (RetainValue, error)
+	Delete(key RetainKey) error
+	Expire(key RetainKey, at time.Time) (bool, error)
+	Persist(key RetainKey) (bool, error)
+	ExpireTime(key RetainKey) (time.Time, bool, error)
+	Keys(pattern string) ([]RetainKey, error)
+	Scan(cursor uint64, pattern string, count int, kind string) (uint64, []RetainKey, error)
+	Range(start RetainKey, end RetainKey) ([]RetainKey, error)
+	DBSize() int
+	RandomKey() (RetainKey, bool, error)
+	Exists(keys ...RetainKey) (int, error)
+	Type(key RetainKey) (string, error)
+}
+
+// Strings is about plain values
+type Strings interface {
+	SetWithOptions(key RetainKey, value RetainValue, options SetOptions) (interface{}, bool, error)
+	GetEx(key RetainKey, at time.Time, persist bool) (interface{}, bool, error)
+	MSet(pairs ...[]byte) error
+	MGet(keys ...RetainKey) ([]RetainValue, error)
+}
+
+// Lists is about list values
+type Lists interface {
+	LPush(key RetainKey, values ...[]byte) (int, error)
+	RPush(key RetainKey, values ...[]byte) (int, error)
+	LPop(key RetainKey, count int) ([][]byte, error)
+	RPop(key RetainKey, count int) ([][]byte, error)
+	LRange(key RetainKey, start int, stop int) ([][]byte, error)
+	LIndex(key RetainKey, index int) ([]byte, bool, error)
+	LLen(key RetainKey) (int, error)
+	LRem(key RetainKey, count int, value []byte) (int, error)
+	LTrim(key RetainKey, start int, stop int) error
+	LSet(key RetainKey, index int, value []byte) error
+	LInsert(key RetainKey, before bool, pivot []byte, value []byte) (int, error)
+	LMove(source RetainKey, destination RetainKey, fromFront bool, toFront bool) ([]byte, error)
+}
+
+// Hashes is about hash values
+type Hashes interface {
+	HSet(key RetainKey, pairs ...[]byte) (int, error)
+	HGet(key RetainKey, field []byte) ([]byte, bool, error)
+	HMGet(key RetainKey, fields ...[]byte) ([][]byte, error)
+	HDel(key RetainKey, fields ...[]byte) (int, error)
+	HGetAll(key RetainKey) (map[string][]byte, error)
+	HKeys(key RetainKey) ([][]byte, error)
+	HVals(key RetainKey) ([][]byte, error)
+	HExists(key RetainKey, field []byte) (bool, error)
+	HLen(key RetainKey) (int, error)
+	HIncrBy(key RetainKey, field []byte, delta int64) (int64, error)
+	HIncrByFloat(key RetainKey, field []byte, delta float64) (float64, error)
+	HScan(key RetainKey, cursor uint64, pattern string, count int) (uint64, [][]byte, error)
+}
+
+// Sets is about set values
+type Sets interface {
+	SAdd(key RetainKey, members ...[]byte) (int, error)
+	SRem(key RetainKey, members ...[]byte) (int, error)
+	SMembers(key RetainKey) ([][]byte, error)
+	SIsMember(key RetainKey, member []byte) (bool, error)
+	SCard(key RetainKey) (int, error)
+	SInter(keys ...RetainKey) ([][]byte, error)
+	SUnion(keys ...RetainKey) ([][]byte, error)
+	SDiff(keys ...RetainKey) ([][]byte, error)
+	SInterStore(destination RetainKey, keys ...RetainKey) (int, error)
+	SUnionStore(destination RetainKey, keys ...RetainKey) (int, error)
+	SDiffStore(destination RetainKey, keys ...RetainKey) (int, error)
+	SRandMember(key RetainKey, count int) ([][]byte, error)
+	SPop(key RetainKey, count int) ([][]byte, error)
+}
+
+// SortedSets is about sorted set values
+type SortedSets interface {
+	ZAdd(key RetainKey, members []ScoredMember, options ZAddOptions) (int, error)
+	ZAddIncr(key RetainKey, member []byte, increment float64, options ZAddOptions) (float64, bool, error)
+	ZIncrBy(key RetainKey, member []byte, increment float64) (float64, error)
+	ZRem(key RetainKey, members ...[]byte) (int, error)
+	ZScore(key RetainKey, member []byte) (float64, bool, error)
+	ZCard(key RetainKey) (int, error)
+	ZRank(key RetainKey, member []byte, reverse bool) (int, bool, error)
+	ZRange(key RetainKey, start int, stop int, reverse bool) ([]ScoredMember, error)
+	ZRangeByScore(key RetainKey, min ScoreBound, max ScoreBound, reverse bool, limit Limit) ([]ScoredMember, error)
+	ZRangeByLex(key RetainKey, min LexBound, max LexBound, reverse bool, limit Limit) ([]ScoredMember, error)
+	ZCount(key RetainKey, min ScoreBound, max ScoreBound) (int, error)
+	ZPopMin(key RetainKey, count int) ([]ScoredMember, error)
+	ZPopMax(key RetainKey, count int) ([]ScoredMember, error)
+}
+
+// Blocking is about callers waiting for lists to be pushed to
+type Blocking interface {
+	BPop(keys []RetainKey, front bool, timeout time.Duration, cancel <-chan struct{}) (RetainKey, []byte, error)
+	BLMove(source RetainKey, destination RetainKey, fromFront bool, toFront bool, timeout time.Duration, cancel <-chan struct{}) ([]byte, error)
+	BeginBatch()
+	EndBatch()
+}
+
+// Watching is about noticing changes to keys, for transactions
+type Watching interface {
+	Watch(key RetainKey) (uint64, error)
+	Unwatch(key RetainKey)
+	Version(key RetainKey) (uint64, error)
+}
+
+// Databases is about the numbered databases of an instance
+type Databases interface {
+	DB(index int) (Engine, error)
+	Databases() int
+	Move(key RetainKey, index int) (bool, error)
+	SwapDB(first int, second int) error
+	FlushDB() error
+	FlushAll() error
+}
+
+// Memory is about the memory limit and eviction
+type Memory interface {
+	FreeMemory() error
+	MemoryUsage(key RetainKey) (int64, bool, error)
+	UsedMemory() int64
+	MaxMemory() (int64, EvictionPolicy)
+	EvictedKeys() int64
+}
+
+// Persistence is about snapshots, the append only file and shutting
+// the engine down
+type Persistence interface {
+	Save() error
+	BackgroundSave() error
+	LastSave() time.Time
+	Dirty() int64
+	RewriteAppendOnlyFile() error
+	Close() error
+}
+
+var (
+	_ Engine = (*Storage)(nil)
+	_ Engine = (*LSMStorage)(nil)
+)
+
+var ErrUnknownEngine = errors.New("unknown storage engine")
+
+// MemoryEngine is the name of the engine that keeps every key in
+// memory, which Open picks when no other is asked for
+const MemoryEngine = "memory"
+
+// engines builds the engines Open knows by name
+var engines = map[string]func(options Options) (Engine, bool, error){
+	MemoryEngine: func(options Options) (Engine, bool, error) {
+		storage, loadedFromDisk, err := NewWithOptions(options)
+		if err != nil {
+			return nil, false, err
+		}
+		return storage, loadedFromDisk, nil
+	},
+	LSMEngine: func(options Options) (Engine, bool, error) {
+		storage, loadedFromDisk, err := NewLSM(options)
+		if err != nil {
+			return nil, false, err
+		}
+		return storage, loadedFromDisk, nil
+	},
+}
+
+// Open creates the engine named by options.Engine and reports whether
+// any data was loaded from disk. It returns ErrUnknownEngine for a name
+// that is not one of Engines.
+func Open(options Options) (Engine, bool, error) {
+
+	name := options.Engine
+	if name == "" {
+		name = MemoryEngine
+	}
+
+	open, ok := engines[name]
+	if !ok {
+		return nil, false, ErrUnknownEngine
+	}
+	return open(options)
+}
+
+// Engines returns the names of the engines Open knows, sorted
+func Engines() []string {
+
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), fileName)
+
+	engine, loaded, err := Open(options)
+	handleError("failed Open", err)
+	defer engine.Close()
+
+	if _, ok := engine.(*Storage); !ok || loaded {
+		log.Fatalf("failed Open, the default engine is not a fresh Storage")
+	}
+
+	// databases are engines too
+	db, err := engine.DB(1)
+	handleError("failed DB", err)
+	db.Set(RetainKey("key"), []byte("value"))
+	if existing(engine, RetainKey("key")) != 0 || db.DBSize() != 1 {
+		log.Fatalf("failed DB, the databases are not separate")
+	}
+
+	options.Engine = "tape"
+	if _, _, err := Open(options); err != ErrUnknownEngine {
+		log.Fatalf("failed Open of an unknown engine, got: %v", err)
+	}
+
+	if !reflect.DeepEqual(Engines(), []string{LSMEngine, MemoryEngine}) {
+		log.Fatalf("failed Engines, got: %v", Engines())
+	}
+}
@@ -0,0 +1,362 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrHashValueNotInteger = errors.New("hash value is not an integer")
+	ErrHashValueNotFloat   = errors.New("hash value is not a float")
+	ErrIncrementOverflow   = errors.New("increment or decrement would overflow")
+	ErrIncrementNaN        = errors.New("increment would produce NaN or Infinity")
+)
+
+// hash maps the fields of a key to their values
+type hash map[string][]byte
+
+func (h hash) clone() hash {
+
+	copied := make(hash, len(h))
+	for field, value := range h {
+		copied[field] = value
+	}
+	return copied
+}
+
+// readHash returns the hash at key for readers holding the read lock
+func (storage *Storage) readHash(key string) (hash, error) {
+
+	e, ok, err := storage.lookup(key)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	h, isHash := e.value.(hash)
+	if !isHash {
+		return nil, ErrWrongType
+	}
+	return h, nil
+}
+
+// writableHash returns the hash at key ready to be changed in place,
+// creating an empty one if create is set. The caller must hold the
+// lock of key.
+func (storage *Storage) writableHash(key string, create bool) (hash, error) {
+
+	e, ok, err := storage.loadLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		h := make(hash)
+		err = storage.store(key, &entry{value: h, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	h, isHash := e.value.(hash)
+	if !isHash {
+		return nil, ErrWrongType
+	}
+
+	if e.generation != storage.generation {
+		h = h.clone()
+		err = storage.store(key, &entry{value: h, expireAt: e.expireAt, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// HSet sets fields of the hash at key, pairs alternates between field
+// names and values. It returns how many of the fields are new.
+func (storage *Storage) HSet(key RetainKey, pairs ...[]byte) (int, error) {
+
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return 0, errors.New("HSet needs pairs of field and value")
+	}
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	added, err := storage.hset(string(key), pairs)
+	if err == nil {
+		storage.logCommand(append([][]byte{[]byte("HSET"), key}, pairs...)...)
+	}
+	return added, err
+}
+
+func (storage *Storage) hset(key string, pairs [][]byte) (int, error) {
+
+	h, err := storage.writableHash(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if _, exists := h[string(pairs[i])]; !exists {
+			added++
+		}
+		h[string(pairs[i])] = pairs[i+1]
+	}
+
+	err = storage.touch(key)
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// HGet returns the value of field in the hash at key
+func (storage *Storage) HGet(key RetainKey, field []byte) ([]byte, bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if h == nil || err != nil {
+		return nil, false, err
+	}
+
+	value, ok := h[string(field)]
+	return value, ok, nil
+}
+
+// HMGet returns the values of fields in the hash at key, with nil
+// in place of the fields that do not exist
+func (storage *Storage) HMGet(key RetainKey, fields ...[]byte) ([][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		values[i] = h[string(field)]
+	}
+	return values, nil
+}
+
+// HDel removes fields from the hash at key and returns how many were
+// there. The key goes away along with its last field.
+func (storage *Storage) HDel(key RetainKey, fields ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	removed, err := storage.hdel(string(key), fields)
+	if removed > 0 {
+		storage.logCommand(append([][]byte{[]byte("HDEL"), key}, fields...)...)
+	}
+	return removed, err
+}
+
+func (storage *Storage) hdel(key string, fields [][]byte) (int, error) {
+
+	h, err := storage.writableHash(key, false)
+	if h == nil || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, field := range fields {
+		if _, exists := h[string(field)]; exists {
+			delete(h, string(field))
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		err = storage.touch(key)
+	}
+	if err == nil && len(h) == 0 {
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// HGetAll returns a copy of the hash at key
+func (storage *Storage) HGetAll(key RetainKey) (map[string][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return h.clone(), nil
+}
+
+// HKeys returns the field names of the hash at key
+func (storage *Storage) HKeys(key RetainKey) ([][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([][]byte, 0, len(h))
+	for field := range h {
+		fields = append(fields, []byte(field))
+	}
+	return fields, nil
+}
+
+// HVals returns the values of the hash at key
+func (storage *Storage) HVals(key RetainKey) ([][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, 0, len(h))
+	for _, value := range h {
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// HExists reports whether field exists in the hash at key
+func (storage *Storage) HExists(key RetainKey, field []byte) (bool, error) {
+
+	_, ok, err := storage.HGet(key, field)
+	return ok, err
+}
+
+// HLen returns the number of fields in the hash at key
+func (storage *Storage) HLen(key RetainKey) (int, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	return len(h), err
+}
+
+// HIncrBy adds delta to the integer stored in field of the hash at key,
+// a missing field counts as 0. It returns the new value.
+func (storage *Storage) HIncrBy(key RetainKey, field []byte, delta int64) (int64, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	h, err := storage.writableHash(string(key), false)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	if value, exists := h[string(field)]; exists {
+		current, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, ErrHashValueNotInteger
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrIncrementOverflow
+	}
+
+	result := current + delta
+	err = storage.setField(key, field, []byte(strconv.FormatInt(result, 10)))
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// HIncrByFloat adds delta to the number stored in field of the hash at
+// key, a missing field counts as 0. It returns the new value.
+func (storage *Storage) HIncrByFloat(key RetainKey, field []byte, delta float64) (float64, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	h, err := storage.writableHash(string(key), false)
+	if err != nil {
+		return 0, err
+	}
+
+	var current float64
+	if value, exists := h[string(field)]; exists {
+		current, err = strconv.ParseFloat(string(value), 64)
+		if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+			return 0, ErrHashValueNotFloat
+		}
+	}
+
+	result := current + delta
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, ErrIncrementNaN
+	}
+
+	err = storage.setField(key, field, []byte(strconv.FormatFloat(result, 'f', -1, 64)))
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// setField stores the outcome of an increment. It is logged as a
+// plain HSET, so that replaying the log cannot drift from what the
+// increment computed.
+func (storage *Storage) setField(key RetainKey, field []byte, value []byte) error {
+
+	_, err := storage.hset(string(key), [][]byte{field, value})
+	if err != nil {
+		return err
+	}
+	storage.logCommand([]byte("HSET"), key, field, value)
+	return nil
+}
+
+// HScan returns a page of the fields of the hash at key matching
+// pattern, as field and value pairs, along with the cursor of the
+// next page. Cursor 0 starts the scan and is returned once it is over.
+func (storage *Storage) HScan(key RetainKey, cursor uint64, pattern string, count int) (uint64, [][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	h, err := storage.readHash(string(key))
+	if h == nil || err != nil {
+		return 0, [][]byte{}, err
+	}
+
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+
+	page, next := scanPage(fields, cursor, count, pattern)
+	pairs := make([][]byte, 0, 2*len(page))
+	for _, field := range page {
+		pairs = append(pairs, []byte(field), h[field])
+	}
+	return next, pairs, nil
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"log"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashFields(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("user")
+
+	added, _ := mp.HSet(key, listOf("name", "ada", "lang", "go")...)
+	if added != 2 {
+		log.Fatalf("failed HSet, expected: 2, got: %d", added)
+	}
+	added, _ = mp.HSet(key, listOf("name", "grace", "city", "nyc")...)
+	if added != 1 {
+		log.Fatalf("failed HSet overwrite, expected: 1, got: %d", added)
+	}
+
+	value, ok, _ := mp.HGet(key, []byte("name"))
+	if !ok || string(value) != "grace" {
+		log.Fatalf("failed HGet, got: %s", value)
+	}
+
+	values, _ := mp.HMGet(key, listOf("lang", "missing")...)
+	if !reflect.DeepEqual(values, [][]byte{[]byte("go"), nil}) {
+		log.Fatalf("failed HMGet, got: %q", values)
+	}
+
+	length, _ := mp.HLen(key)
+	exists, _ := mp.HExists(key, []byte("city"))
+	if length != 3 || !exists {
+		log.Fatalf("failed HLen or HExists, got: %d, %v", length, exists)
+	}
+
+	all, _ := mp.HGetAll(key)
+	expected := map[string][]byte{"name": []byte("grace"), "lang": []byte("go"), "city": []byte("nyc")}
+	if !reflect.DeepEqual(all, expected) {
+		log.Fatalf("failed HGetAll, got: %q", all)
+	}
+
+	removed, _ := mp.HDel(key, listOf("name", "lang", "city", "missing")...)
+	if removed != 3 {
+		log.Fatalf("failed HDel, expected: 3, got: %d", removed)
+	}
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete the emptied hash")
+	}
+}
+
+func TestHashIncrement(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("counters")
+
+	mp.HIncrBy(key, []byte("visits"), 5)
+	result, _ := mp.HIncrBy(key, []byte("visits"), -2)
+	if result != 3 {
+		log.Fatalf("failed HIncrBy, expected: 3, got: %d", result)
+	}
+
+	mp.HSet(key, listOf("big", strconv.FormatInt(1<<62, 10), "text", "abc")...)
+	if _, err := mp.HIncrBy(key, []byte("big"), 1<<62); err != ErrIncrementOverflow {
+		log.Fatalf("failed overflow check, got: %v", err)
+	}
+	if _, err := mp.HIncrBy(key, []byte("text"), 1); err != ErrHashValueNotInteger {
+		log.Fatalf("failed integer check, got: %v", err)
+	}
+
+	score, _ := mp.HIncrByFloat(key, []byte("score"), 10.5)
+	score, _ = mp.HIncrByFloat(key, []byte("score"), 0.1)
+	value, _, _ := mp.HGet(key, []byte("score"))
+	if score != 10.6 || string(value) != "10.6" {
+		log.Fatalf("failed HIncrByFloat, got: %v, %s", score, value)
+	}
+	if _, err := mp.HIncrByFloat(key, []byte("text"), 1); err != ErrHashValueNotFloat {
+		log.Fatalf("failed float check, got: %v", err)
+	}
+
+	mp.Set(RetainKey("string"), []byte("1"))
+	if _, err := mp.HIncrBy(RetainKey("string"), []byte("f"), 1); err != ErrWrongType {
+		log.Fatalf("failed HIncrBy on a string, got: %v", err)
+	}
+}
+
+func TestHashScan(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("big")
+	for i := 0; i < 100; i++ {
+		mp.HSet(key, []byte("field:"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		next, pairs, err := mp.HScan(key, cursor, "field:1*", 7)
+		if err != nil {
+			log.Fatalf("failed HScan: %v", err)
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			seen[string(pairs[i])]++
+		}
+
+		// changes in between calls must not hide the fields left alone
+		mp.HDel(key, []byte("field:5"+strconv.Itoa(int(cursor%10))))
+		mp.HSet(key, []byte("new:"+strconv.FormatUint(cursor, 10)), []byte("v"))
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	names := make([]string, 0)
+	for name, count := range seen {
+		if count != 1 {
+			log.Fatalf("failed HScan, %s returned %d times", name, count)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	expected := []string{"field:1"}
+	for i := 10; i < 20; i++ {
+		expected = append(expected, "field:"+strconv.Itoa(i))
+	}
+	if !reflect.DeepEqual(names, expected) {
+		log.Fatalf("failed HScan, got: %v", names)
+	}
+
+	// any count is taken, however large
+	size, _ := mp.HLen(key)
+	next, pairs, err := mp.HScan(key, 0, "", math.MaxInt)
+	if err != nil || next != 0 || len(pairs) != 2*size {
+		log.Fatalf("failed HScan with the largest count, got: %d %d %v", next, len(pairs), err)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+
+	testCases := []struct {
+		pattern string
+		name    string
+		output  bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a\\", "a\\", true},
+		{"*[0-9]", "key:42", true},
+		{"*a*a*b", "aaab", true},
+		{"*a*a*b", "aaa", false},
+		{"user:*:name", "user:1:name:x", false},
+	}
+
+	for _, testCase := range testCases {
+		if MatchPattern(testCase.pattern, testCase.name) != testCase.output {
+			log.Fatalf("failed MatchPattern %q %q, expected: %v", testCase.pattern, testCase.name, testCase.output)
+		}
+	}
+
+	// stars that could each take any part of a long name do not
+	// make the work grow exponentially
+	name := strings.Repeat("a", 10000)
+	started := time.Now()
+	if MatchPattern(strings.Repeat("*a", 20)+"*b", name) {
+		log.Fatalf("failed MatchPattern, matched a name without b")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		log.Fatalf("failed MatchPattern, took %v", elapsed)
+	}
+}
+
+func TestHashPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+
+	mp, _, _ := NewWithOptions(options)
+	key := RetainKey("user")
+	mp.HSet(key, listOf("name", "ada", "lang", "go", "year", "1815")...)
+	mp.HDel(key, []byte("lang"))
+	mp.HIncrBy(key, []byte("year"), 1)
+	mp.HIncrByFloat(key, []byte("score"), 1.5)
+	expected, _ := mp.HGetAll(key)
+
+	handleError("failed Save", mp.Save())
+	mp.Close()
+
+	mp, _, _ = NewWithOptions(options)
+	got, _ := mp.HGetAll(key)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) || string(got["year"]) != "1816" {
+		log.Fatalf("failed hash replay, expected: %q, got: %q", expected, got)
+	}
+
+	mp, _, _ = NewWithOptions(Options{SnapshotPath: filepath.Join(dir, fileName)})
+	got, _ = mp.HGetAll(key)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed hash snapshot, expected: %q, got: %q", expected, got)
+	}
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// iteratorPageSize is how many keys an Iterator asks Scan for at a time
+const iteratorPageSize = 100
+
+// names returns the keys that have not expired
+func (storage *Storage) names() []string {
+
+	now := toMillis(time.Now())
+	names := make([]string, 0)
+	for i := range storage.shards {
+		sh := &storage.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.entries {
+			if !e.expired(now) {
+				names = append(names, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return names
+}
+
+// Keys returns every key matching the glob style pattern, in no
+// particular order. See MatchPattern for the syntax.
+func (storage *Storage) Keys(pattern string) ([]RetainKey, error) {
+
+	return matching(storage.names(), pattern), nil
+}
+
+// matching returns the names that match pattern as keys
+func matching(names []string, pattern string) []RetainKey {
+
+	keys := make([]RetainKey, 0)
+	for _, name := range names {
+		if MatchPattern(pattern, name) {
+			keys = append(keys, RetainKey(name))
+		}
+	}
+	return keys
+}
+
+// Scan returns a page of keys starting at cursor along with the cursor
+// of the next page, 0 once the scan is over. Only keys matching pattern
+// and, unless kind is empty, holding a value of that type as named by
+// Type are returned. A key present from the first call to the last is
+// returned at least once, whatever is written in between. Like Redis,
+// count bounds the keys looked at rather than the keys returned.
+func (storage *Storage) Scan(cursor uint64, pattern string, count int, kind string) (uint64, []RetainKey, error) {
+
+	if count < 1 {
+		count = 1
+	}
+
+	page, next := storage.scanShards(cursor, count)
+	keys, err := storage.filter(page, pattern, kind)
+	if err != nil {
+		return 0, nil, err
+	}
+	return next, keys, nil
+}
+
+// filter returns the names of a Scan page that match pattern and hold
+// a value of type kind, as keys
+func (storage *Storage) filter(page []string, pattern string, kind string) ([]RetainKey, error) {
+
+	keys := make([]RetainKey, 0, len(page))
+	for _, name := range page {
+		if pattern != "" && !MatchPattern(pattern, name) {
+			continue
+		}
+		if kind != "" {
+			found, err := storage.Type(RetainKey(name))
+			if err != nil {
+				return nil, err
+			}
+			if found != kind {
+				continue
+			}
+		}
+		keys = append(keys, RetainKey(name))
+	}
+	return keys, nil
+}
+
+// scanShards picks the keys of a Scan page, walking whole buckets of one shard after the other from cursor on
+// until count keys have been looked at
+func (storage *Storage) scanShards(cursor uint64, count int) ([]string, uint64) {
+
+	now := toMillis(time.Now())
+	names := make([]string, 0)
+	visited := 0
+	for slot := cursor; slot < scanSlots; {
+		sh := &storage.shards[slot/scanBuckets]
+		end := (slot/scanBuckets + 1) * scanBuckets
+
+		sh.mu.RLock()
+		for ; slot < end && visited < count; slot++ {
+			for _, key := range sh.buckets[int(slot%scanBuckets)] {
+				visited++
+				if !sh.entries[key].expired(now) {
+					names = append(names, key)
+				}
+			}
+		}
+		sh.mu.RUnlock()
+
+		if visited >= count && slot < scanSlots {
+			return names, slot
+		}
+	}
+	return names, 0
+}
+
+// Range returns the keys from start up to but not including end, in
+// order, an empty end meaning up to the last key. Every key has to be
+// sorted for it, the lsm engine reads them in order instead.
+func (storage *Storage) Range(start RetainKey, end RetainKey) ([]RetainKey, error) {
+
+	var names []string
+	for _, name := range storage.names() {
+		if name >= string(start) && (len(end) == 0 || name < string(end)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return asKeys(names), nil
+}
+
+// asKeys converts names to keys
+func asKeys(names []string) []RetainKey {
+
+	keys := make([]RetainKey, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, RetainKey(name))
+	}
+	return keys
+}
+
+// DBSize returns the number of keys
+func (storage *Storage) DBSize() int {
+
+	return len(storage.names())
+}
+
+// RandomKey returns a key picked at random, or false if there are none
+func (storage *Storage) RandomKey() (RetainKey, bool, error) {
+
+	names := storage.names()
+	if len(names) == 0 {
+		return nil, false, nil
+	}
+	return RetainKey(names[randomIntn(len(names))]), true, nil
+}
+
+// Exists returns how many of keys exist, a key given twice counts twice
+func (storage *Storage) Exists(keys ...RetainKey) (int, error) {
+
+	unlock := storage.rlock(keys...)
+	defer unlock()
+
+	count := 0
+	for _, key := range keys {
+		_, ok, err := storage.lookup(string(key))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Type names the type of the value at key: string, list, hash, set
+// or zset, and none if there is no such key
+func (storage *Storage) Type(key RetainKey) (string, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	e, ok, err := storage.lookup(string(key))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "none", nil
+	}
+	return typeName(e.value), nil
+}
+
+// Iterator goes over the keys of a Storage a page at a time with Scan,
+// so it holds no lock in between and gives the same guarantees
+type Iterator struct {
+	storage Keyspace
+	pattern string
+	cursor  uint64
+	done    bool
+	page    []RetainKey
+	key     RetainKey
+	err     error
+}
+
+// Iterate returns an Iterator over the keys matching pattern, an empty
+// pattern matches every key. Call Next before the first Key.
+func (storage *Storage) Iterate(pattern string) *Iterator {
+
+	return &Iterator{storage: storage, pattern: pattern}
+}
+
+// Next moves to the next key and reports whether there is one. It
+// stops early if Scan fails, see Err.
+func (it *Iterator) Next() bool {
+
+	for len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+		it.cursor, it.page, it.err = it.storage.Scan(it.cursor, it.pattern, iteratorPageSize, "")
+		it.done = it.cursor == 0 || it.err != nil
+	}
+
+	it.key, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Key returns the key Next moved to
+func (it *Iterator) Key() RetainKey {
+
+	return it.key
+}
+
+// Err returns the error that stopped Next, if any
+func (it *Iterator) Err() error {
+
+	return it.err
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func sortedKeys(keys []RetainKey) []string {
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, string(key))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// existing is Exists failing the test on an error
+func existing(engine Keyspace, keys ...RetainKey) int {
+
+	count, err := engine.Exists(keys...)
+	handleError("failed Exists", err)
+	return count
+}
+
+func TestKeys(t *testing.T) {
+
+	mp := &Storage{}
+	mp.Set(RetainKey("user:1"), []byte("a"))
+	mp.Set(RetainKey("user:2"), []byte("b"))
+	mp.RPush(RetainKey("queue"), []byte("c"))
+	mp.HSet(RetainKey("profile"), []byte("name"), []byte("d"))
+	mp.SAdd(RetainKey("tags"), []byte("e"))
+	mp.ZAdd(RetainKey("board"), []ScoredMember{{Member: []byte("f"), Score: 1}}, ZAddOptions{})
+	mp.Set(RetainKey("gone"), []byte("g"))
+	mp.Expire(RetainKey("gone"), time.Now().Add(-time.Second))
+
+	found, err := mp.Keys("user:*")
+	handleError("failed Keys", err)
+	got := sortedKeys(found)
+	if !reflect.DeepEqual(got, []string{"user:1", "user:2"}) {
+		log.Fatalf("failed Keys, got: %v", got)
+	}
+
+	if size := mp.DBSize(); size != 6 {
+		log.Fatalf("failed DBSize, expected: 6, got: %d", size)
+	}
+
+	if count := existing(mp, RetainKey("user:1"), RetainKey("user:1"), RetainKey("gone"), RetainKey("none")); count != 2 {
+		log.Fatalf("failed Exists, expected: 2, got: %d", count)
+	}
+
+	types := map[string]string{
+		"user:1":  "string",
+		"queue":   "list",
+		"profile": "hash",
+		"tags":    "set",
+		"board":   "zset",
+		"gone":    "none",
+	}
+	for key, expected := range types {
+		if got, err := mp.Type(RetainKey(key)); err != nil || got != expected {
+			log.Fatalf("failed Type of %s, expected: %s, got: %s", key, expected, got)
+		}
+	}
+
+	key, ok, err := mp.RandomKey()
+	handleError("failed RandomKey", err)
+	if !ok || existing(mp, key) != 1 {
+		log.Fatalf("failed RandomKey, got: %s %v", key, ok)
+	}
+
+	_, ok, _ = (&Storage{}).RandomKey()
+	if ok {
+		log.Fatalf("failed RandomKey, expected no key in an empty storage")
+	}
+}
+
+func TestScan(t *testing.T) {
+
+	mp := &Storage{}
+	for i := 0; i < 100; i++ {
+		mp.Set(RetainKey(fmt.Sprintf("stable:%d", i)), []byte("value"))
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for round := 0; ; round++ {
+		var keys []RetainKey
+		var err error
+		cursor, keys, err = mp.Scan(cursor, "stable:*", 7, "")
+		handleError("failed Scan", err)
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+
+		// keys coming and going must not throw the scan off
+		mp.Set(RetainKey(fmt.Sprintf("churn:%d", round)), []byte("value"))
+		mp.Delete(RetainKey(fmt.Sprintf("churn:%d", round-1)))
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if len(seen) != 100 {
+		log.Fatalf("failed Scan, expected 100 keys, got: %d", len(seen))
+	}
+	for key, times := range seen {
+		if times != 1 {
+			log.Fatalf("failed Scan, %s returned %d times", key, times)
+		}
+	}
+
+	mp.RPush(RetainKey("queue"), []byte("a"))
+	found := make([]RetainKey, 0)
+	for cursor = 0; ; {
+		var keys []RetainKey
+		var err error
+		cursor, keys, err = mp.Scan(cursor, "", 10, "list")
+		handleError("failed Scan", err)
+		found = append(found, keys...)
+		if cursor == 0 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(sortedKeys(found), []string{"queue"}) {
+		log.Fatalf("failed Scan by type, got: %s", found)
+	}
+}
+
+func TestIterator(t *testing.T) {
+
+	mp := &Storage{}
+	expected := make([]string, 0)
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		mp.Set(RetainKey(key), []byte("value"))
+		expected = append(expected, key)
+	}
+	mp.Set(RetainKey("other"), []byte("value"))
+
+	got := make([]RetainKey, 0)
+	it := mp.Iterate("key:*")
+	for it.Next() {
+		got = append(got, it.Key())
+	}
+
+	if !reflect.DeepEqual(sortedKeys(got), expected) {
+		log.Fatalf("failed Iterate, expected %d keys, got: %d", len(expected), len(got))
+	}
+
+	if (&Storage{}).Iterate("").Next() {
+		log.Fatalf("failed Iterate, expected no key in an empty storage")
+	}
+}
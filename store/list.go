@@ -0,0 +1,606 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrWrongType       = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrIndexOutOfRange = errors.New("index out of range")
+)
+
+// list is a double-ended queue kept in a ring buffer, which gives
+// O(1) pushes and pops at both ends as well as O(1) access by index
+type list struct {
+	items [][]byte
+	head  int
+	size  int
+}
+
+const minListCapacity = 8
+
+func newList() *list {
+
+	return &list{items: make([][]byte, minListCapacity)}
+}
+
+func (l *list) len() int {
+
+	return l.size
+}
+
+// at returns the element at position i, which must be in range
+func (l *list) at(i int) []byte {
+
+	return l.items[(l.head+i)%len(l.items)]
+}
+
+func (l *list) set(i int, value []byte) {
+
+	l.items[(l.head+i)%len(l.items)] = value
+}
+
+func (l *list) pushBack(value []byte) {
+
+	l.grow()
+	l.items[(l.head+l.size)%len(l.items)] = value
+	l.size++
+}
+
+func (l *list) pushFront(value []byte) {
+
+	l.grow()
+	l.head = (l.head - 1 + len(l.items)) % len(l.items)
+	l.items[l.head] = value
+	l.size++
+}
+
+func (l *list) popFront() []byte {
+
+	value := l.items[l.head]
+	l.items[l.head] = nil
+	l.head = (l.head + 1) % len(l.items)
+	l.size--
+	l.shrink()
+	return value
+}
+
+func (l *list) popBack() []byte {
+
+	i := (l.head + l.size - 1) % len(l.items)
+	value := l.items[i]
+	l.items[i] = nil
+	l.size--
+	l.shrink()
+	return value
+}
+
+// slice returns a copy of the elements from start to stop, inclusive
+func (l *list) slice(start int, stop int) [][]byte {
+
+	result := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		result = append(result, l.at(i))
+	}
+	return result
+}
+
+// replace swaps the content of the list for items
+func (l *list) replace(items [][]byte) {
+
+	capacity := minListCapacity
+	for capacity < len(items) {
+		capacity *= 2
+	}
+
+	l.items = make([][]byte, capacity)
+	copy(l.items, items)
+	l.head = 0
+	l.size = len(items)
+}
+
+func (l *list) clone() *list {
+
+	cloned := &list{}
+	cloned.replace(l.slice(0, l.size-1))
+	return cloned
+}
+
+func (l *list) grow() {
+
+	if l.size < len(l.items) {
+		return
+	}
+	l.resize(len(l.items) * 2)
+}
+
+func (l *list) shrink() {
+
+	if len(l.items) > minListCapacity && l.size < len(l.items)/4 {
+		l.resize(len(l.items) / 2)
+	}
+}
+
+func (l *list) resize(capacity int) {
+
+	items := make([][]byte, capacity)
+	for i := 0; i < l.size; i++ {
+		items[i] = l.at(i)
+	}
+	l.items = items
+	l.head = 0
+}
+
+// normalizeRange turns Redis style start and stop indexes, where negative
+// values count from the end, into a valid inclusive range. It returns
+// false if the range is empty.
+func normalizeRange(start int, stop int, length int) (int, int, bool) {
+
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// readList returns the list at key for readers holding the read lock
+func (storage *Storage) readList(key string) (*list, error) {
+
+	e, ok, err := storage.lookup(key)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	l, isList := e.value.(*list)
+	if !isList {
+		return nil, ErrWrongType
+	}
+	return l, nil
+}
+
+// writableList returns the list at key ready to be changed in place,
+// creating an empty one if create is set. The caller must hold the
+// lock of key.
+func (storage *Storage) writableList(key string, create bool) (*list, error) {
+
+	e, ok, err := storage.loadLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		l := newList()
+		err = storage.store(key, &entry{value: l, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	l, isList := e.value.(*list)
+	if !isList {
+		return nil, ErrWrongType
+	}
+
+	if e.generation != storage.generation {
+		l = l.clone()
+		err = storage.store(key, &entry{value: l, expireAt: e.expireAt, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// LPush inserts values at the head of the list at key, one after the
+// other, creating the list if needed. It returns the new length.
+func (storage *Storage) LPush(key RetainKey, values ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	length, err := storage.push(string(key), values, true)
+	if err == nil {
+		storage.logCommand(append([][]byte{[]byte("LPUSH"), key}, values...)...)
+	}
+	return length, err
+}
+
+// RPush appends values to the tail of the list at key,
+// creating the list if needed. It returns the new length.
+func (storage *Storage) RPush(key RetainKey, values ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	length, err := storage.push(string(key), values, false)
+	if err == nil {
+		storage.logCommand(append([][]byte{[]byte("RPUSH"), key}, values...)...)
+	}
+	return length, err
+}
+
+func (storage *Storage) push(key string, values [][]byte, front bool) (int, error) {
+
+	l, err := storage.writableList(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, value := range values {
+		if front {
+			l.pushFront(value)
+		} else {
+			l.pushBack(value)
+		}
+	}
+
+	err = storage.touch(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.len(), nil
+}
+
+// LPop removes and returns up to count elements from the head of the
+// list at key. It returns nil if the key does not exist.
+func (storage *Storage) LPop(key RetainKey, count int) ([][]byte, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	popped, err := storage.pop(string(key), count, true)
+	if len(popped) > 0 {
+		storage.logCommand([]byte("LPOP"), key, []byte(strconv.Itoa(len(popped))))
+	}
+	return popped, err
+}
+
+// RPop removes and returns up to count elements from the tail of the
+// list at key. It returns nil if the key does not exist.
+func (storage *Storage) RPop(key RetainKey, count int) ([][]byte, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	popped, err := storage.pop(string(key), count, false)
+	if len(popped) > 0 {
+		storage.logCommand([]byte("RPOP"), key, []byte(strconv.Itoa(len(popped))))
+	}
+	return popped, err
+}
+
+func (storage *Storage) pop(key string, count int, front bool) ([][]byte, error) {
+
+	l, err := storage.writableList(key, false)
+	if l == nil || err != nil {
+		return nil, err
+	}
+
+	popped := make([][]byte, 0)
+	for i := 0; i < count && l.len() > 0; i++ {
+		if front {
+			popped = append(popped, l.popFront())
+		} else {
+			popped = append(popped, l.popBack())
+		}
+	}
+
+	if len(popped) > 0 {
+		err = storage.touch(key)
+	}
+	if err == nil && l.len() == 0 {
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return popped, nil
+}
+
+// LRange returns the elements of the list at key between start and
+// stop inclusive, negative indexes count from the end of the list
+func (storage *Storage) LRange(key RetainKey, start int, stop int) ([][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	l, err := storage.readList(string(key))
+	if l == nil || err != nil {
+		return [][]byte{}, err
+	}
+
+	start, stop, ok := normalizeRange(start, stop, l.len())
+	if !ok {
+		return [][]byte{}, nil
+	}
+	return l.slice(start, stop), nil
+}
+
+// LIndex returns the element at index in the list at key, negative
+// indexes count from the end. It returns false if there is none.
+func (storage *Storage) LIndex(key RetainKey, index int) ([]byte, bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	l, err := storage.readList(string(key))
+	if l == nil || err != nil {
+		return nil, false, err
+	}
+
+	if index < 0 {
+		index += l.len()
+	}
+	if index < 0 || index >= l.len() {
+		return nil, false, nil
+	}
+	return l.at(index), true, nil
+}
+
+// LLen returns the length of the list at key, 0 if it does not exist
+func (storage *Storage) LLen(key RetainKey) (int, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	l, err := storage.readList(string(key))
+	if l == nil || err != nil {
+		return 0, err
+	}
+	return l.len(), nil
+}
+
+// LRem removes elements equal to value from the list at key. A positive
+// count removes that many from the head, a negative count that many from
+// the tail and zero removes all of them. It returns how many were removed.
+func (storage *Storage) LRem(key RetainKey, count int, value []byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	removed, err := storage.lrem(string(key), count, value)
+	if removed > 0 {
+		storage.logCommand([]byte("LREM"), key, []byte(strconv.Itoa(count)), value)
+	}
+	return removed, err
+}
+
+func (storage *Storage) lrem(key string, count int, value []byte) (int, error) {
+
+	l, err := storage.writableList(key, false)
+	if l == nil || err != nil {
+		return 0, err
+	}
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	// walk from the end the elements are removed from
+	drop := make([]bool, l.len())
+	removed := 0
+	for n := 0; n < l.len() && (limit == 0 || removed < limit); n++ {
+		i := n
+		if count < 0 {
+			i = l.len() - 1 - n
+		}
+		if bytes.Equal(l.at(i), value) {
+			drop[i] = true
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	kept := make([][]byte, 0, l.len()-removed)
+	for i := 0; i < l.len(); i++ {
+		if !drop[i] {
+			kept = append(kept, l.at(i))
+		}
+	}
+	l.replace(kept)
+
+	err = storage.touch(key)
+	if err == nil && l.len() == 0 {
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// LTrim keeps only the elements between start and stop inclusive in
+// the list at key, negative indexes count from the end of the list
+func (storage *Storage) LTrim(key RetainKey, start int, stop int) error {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	err := storage.ltrim(string(key), start, stop)
+	if err == nil {
+		storage.logCommand([]byte("LTRIM"), key, []byte(strconv.Itoa(start)), []byte(strconv.Itoa(stop)))
+	}
+	return err
+}
+
+func (storage *Storage) ltrim(key string, start int, stop int) error {
+
+	l, err := storage.writableList(key, false)
+	if l == nil || err != nil {
+		return err
+	}
+
+	start, stop, ok := normalizeRange(start, stop, l.len())
+	if !ok {
+		return storage.remove(key)
+	}
+
+	l.replace(l.slice(start, stop))
+	return storage.touch(key)
+}
+
+// LSet replaces the element at index in the list at key
+func (storage *Storage) LSet(key RetainKey, index int, value []byte) error {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	err := storage.lset(string(key), index, value)
+	if err == nil {
+		storage.logCommand([]byte("LSET"), key, []byte(strconv.Itoa(index)), value)
+	}
+	return err
+}
+
+func (storage *Storage) lset(key string, index int, value []byte) error {
+
+	l, err := storage.writableList(key, false)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return ErrNoSuchKey
+	}
+
+	if index < 0 {
+		index += l.len()
+	}
+	if index < 0 || index >= l.len() {
+		return ErrIndexOutOfRange
+	}
+
+	l.set(index, value)
+	return storage.touch(key)
+}
+
+// LInsert inserts value before or after the first element equal to
+// pivot in the list at key. It returns the new length, -1 if pivot
+// was not found and 0 if the key does not exist.
+func (storage *Storage) LInsert(key RetainKey, before bool, pivot []byte, value []byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	length, err := storage.linsert(string(key), before, pivot, value)
+	if length > 0 {
+		where := []byte("AFTER")
+		if before {
+			where = []byte("BEFORE")
+		}
+		storage.logCommand([]byte("LINSERT"), key, where, pivot, value)
+	}
+	return length, err
+}
+
+func (storage *Storage) linsert(key string, before bool, pivot []byte, value []byte) (int, error) {
+
+	l, err := storage.readList(key)
+	if l == nil || err != nil {
+		return 0, err
+	}
+
+	position := -1
+	for i := 0; i < l.len(); i++ {
+		if bytes.Equal(l.at(i), pivot) {
+			position = i
+			break
+		}
+	}
+	if position == -1 {
+		return -1, nil
+	}
+
+	if !before {
+		position++
+	}
+
+	l, err = storage.writableList(key, false)
+	if err != nil {
+		return 0, err
+	}
+	items := make([][]byte, 0, l.len()+1)
+	items = append(items, l.slice(0, position-1)...)
+	items = append(items, value)
+	items = append(items, l.slice(position, l.len()-1)...)
+	l.replace(items)
+
+	err = storage.touch(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.len(), nil
+}
+
+// LMove pops an element from one end of the list at source and pushes
+// it to one end of the list at destination, which may be the same key.
+// It returns the element, or nil if source does not exist.
+func (storage *Storage) LMove(source RetainKey, destination RetainKey, fromFront bool, toFront bool) ([]byte, error) {
+
+	unlock := storage.lock(source, destination)
+	defer unlock()
+
+	return storage.move(source, destination, fromFront, toFront)
+}
+
+// move is LMove for callers holding the locks of both keys
+func (storage *Storage) move(source RetainKey, destination RetainKey, fromFront bool, toFront bool) ([]byte, error) {
+
+	value, err := storage.lmove(string(source), string(destination), fromFront, toFront)
+	if value != nil {
+		storage.logCommand([]byte("LMOVE"), source, destination, []byte(listEnd(fromFront)), []byte(listEnd(toFront)))
+	}
+	return value, err
+}
+
+func (storage *Storage) lmove(source string, destination string, fromFront bool, toFront bool) ([]byte, error) {
+
+	l, err := storage.readList(source)
+	if l == nil || err != nil {
+		return nil, err
+	}
+
+	// a destination of the wrong type has to leave the source untouched
+	if _, err := storage.readList(destination); err != nil {
+		return nil, err
+	}
+
+	popped, err := storage.pop(source, 1, fromFront)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := storage.push(destination, popped, toFront); err != nil {
+		return nil, err
+	}
+	return popped[0], nil
+}
+
+// listEnd names an end of a list the way LMOVE does
+func listEnd(front bool) string {
+
+	if front {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
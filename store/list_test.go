@@ -0,0 +1,199 @@
+package store
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func listOf(items ...string) [][]byte {
+
+	result := make([][]byte, 0, len(items))
+	for _, item := range items {
+		result = append(result, []byte(item))
+	}
+	return result
+}
+
+func TestListPushPop(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("queue")
+
+	// enough elements to make the ring buffer grow and wrap around
+	for i := 0; i < 20; i++ {
+		mp.RPush(key, []byte{byte('a' + i)})
+		mp.LPush(key, []byte{byte('A' + i)})
+	}
+
+	length, _ := mp.LLen(key)
+	if length != 40 {
+		log.Fatalf("failed LLen, expected: 40, got: %d", length)
+	}
+
+	head, _ := mp.LPop(key, 2)
+	tail, _ := mp.RPop(key, 2)
+	if !reflect.DeepEqual(head, listOf("T", "S")) || !reflect.DeepEqual(tail, listOf("t", "s")) {
+		log.Fatalf("failed pops, head: %s, tail: %s", head, tail)
+	}
+
+	popped, _ := mp.LPop(key, 100)
+	if len(popped) != 36 {
+		log.Fatalf("failed to pop everything, got: %d", len(popped))
+	}
+
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete the emptied list")
+	}
+
+	if popped, err := mp.LPop(key, 1); popped != nil || err != nil {
+		log.Fatalf("failed pop on missing key, got: %v, %v", popped, err)
+	}
+}
+
+func TestListRange(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("list")
+	mp.RPush(key, listOf("a", "b", "c", "d", "e")...)
+
+	testCases := []struct {
+		start  int
+		stop   int
+		output [][]byte
+	}{
+		{0, -1, listOf("a", "b", "c", "d", "e")},
+		{1, 2, listOf("b", "c")},
+		{-2, 100, listOf("d", "e")},
+		{-100, 0, listOf("a")},
+		{3, 1, listOf()},
+		{10, 20, listOf()},
+	}
+
+	for _, testCase := range testCases {
+		got, err := mp.LRange(key, testCase.start, testCase.stop)
+		if err != nil || !reflect.DeepEqual(got, testCase.output) {
+			log.Fatalf("failed LRange %d %d, expected: %s, got: %s", testCase.start, testCase.stop, testCase.output, got)
+		}
+	}
+
+	value, ok, _ := mp.LIndex(key, -1)
+	if !ok || string(value) != "e" {
+		log.Fatalf("failed LIndex, got: %s", value)
+	}
+
+	if _, ok, _ := mp.LIndex(key, 5); ok {
+		log.Fatalf("failed LIndex out of range")
+	}
+}
+
+func TestListEdits(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("list")
+	mp.RPush(key, listOf("x", "a", "x", "b", "x")...)
+
+	removed, _ := mp.LRem(key, -2, []byte("x"))
+	got, _ := mp.LRange(key, 0, -1)
+	if removed != 2 || !reflect.DeepEqual(got, listOf("x", "a", "b")) {
+		log.Fatalf("failed LRem, removed: %d, got: %s", removed, got)
+	}
+
+	length, _ := mp.LInsert(key, true, []byte("b"), []byte("before-b"))
+	mp.LInsert(key, false, []byte("b"), []byte("after-b"))
+	if missing, _ := mp.LInsert(key, true, []byte("nope"), []byte("v")); missing != -1 {
+		log.Fatalf("failed LInsert with missing pivot, got: %d", missing)
+	}
+
+	got, _ = mp.LRange(key, 0, -1)
+	if length != 4 || !reflect.DeepEqual(got, listOf("x", "a", "before-b", "b", "after-b")) {
+		log.Fatalf("failed LInsert, got: %s", got)
+	}
+
+	if mp.LSet(key, 0, []byte("first")) != nil || mp.LSet(key, 10, []byte("v")) != ErrIndexOutOfRange {
+		log.Fatalf("failed LSet")
+	}
+	if mp.LSet(RetainKey("missing"), 0, []byte("v")) != ErrNoSuchKey {
+		log.Fatalf("failed LSet on missing key")
+	}
+
+	mp.LTrim(key, 1, -2)
+	got, _ = mp.LRange(key, 0, -1)
+	if !reflect.DeepEqual(got, listOf("a", "before-b", "b")) {
+		log.Fatalf("failed LTrim, got: %s", got)
+	}
+
+	mp.LTrim(key, 5, 10)
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete the list emptied by LTrim")
+	}
+}
+
+func TestListWrongType(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("string")
+	mp.Set(key, []byte("value"))
+
+	if _, err := mp.LPush(key, []byte("v")); err != ErrWrongType {
+		log.Fatalf("failed LPush on a string, got: %v", err)
+	}
+	if _, err := mp.LRange(key, 0, -1); err != ErrWrongType {
+		log.Fatalf("failed LRange on a string, got: %v", err)
+	}
+}
+
+func TestListCopyOnWrite(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("list")
+	mp.RPush(key, listOf("a", "b")...)
+
+	entries, _ := mp.copyEntries()
+	mp.RPush(key, []byte("c"))
+	mp.LSet(key, 0, []byte("changed"))
+
+	copied := entries[0]["list"].value.(*list)
+	if !reflect.DeepEqual(copied.slice(0, copied.len()-1), listOf("a", "b")) {
+		log.Fatalf("failed copy on write, the copy changed to: %s", copied.slice(0, copied.len()-1))
+	}
+}
+
+func TestListPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+
+	mp, _, _ := NewWithOptions(options)
+	key := RetainKey("list")
+	mp.RPush(key, listOf("a", "b", "c", "d")...)
+	mp.LPush(key, []byte("z"))
+	mp.LPop(key, 1)
+	mp.RPop(key, 1)
+	mp.LSet(key, 0, []byte("A"))
+	mp.LInsert(key, false, []byte("b"), []byte("b2"))
+	mp.LRem(key, 0, []byte("c"))
+	mp.LTrim(key, 0, 1)
+	mp.LMove(key, key, true, false)
+	expected, _ := mp.LRange(key, 0, -1)
+
+	handleError("failed Save", mp.Save())
+	mp.Close()
+
+	// from the append only file
+	mp, _, _ = NewWithOptions(options)
+	got, _ := mp.LRange(key, 0, -1)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) || !reflect.DeepEqual(got, listOf("b", "A")) {
+		log.Fatalf("failed list replay, expected: %s, got: %s", expected, got)
+	}
+
+	// from the snapshot
+	mp, _, _ = NewWithOptions(Options{SnapshotPath: filepath.Join(dir, fileName)})
+	got, _ = mp.LRange(key, 0, -1)
+	mp.Close()
+	if !reflect.DeepEqual(got, expected) {
+		log.Fatalf("failed list snapshot, expected: %s, got: %s", expected, got)
+	}
+}
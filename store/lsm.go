@@ -0,0 +1,1141 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lsm is a log-structured merge tree, which keeps records sorted by key
+// on disk so that the data set does not have to fit in memory.
+//
+// Writes go to the write-ahead log and to the memtable, a sorted map in
+// memory. Once the memtable is large enough it is frozen and written
+// out in the background as a table, see tableWriter, in level 0. The
+// tables of level 0 may overlap each other. Once there are enough of
+// them they are merged with level 1, whose tables hold disjoint ranges
+// of keys, and so on down: every level holds ten times as much as the
+// one above it and a level over its size has one of its tables merged
+// into the next. Merging drops the records that newer ones replace,
+// along with deletions that have nothing left to hide below them.
+// Expired records stay until they are deleted, the tree does not
+// decide on its own that a key is gone.
+//
+// A lookup tries the memtables, then the tables of level 0 from the
+// newest, then the one table of every other level whose range holds
+// the key, and stops at the first record it finds.
+type lsm struct {
+	dir    string
+	policy FsyncPolicy
+	config lsmConfig
+
+	// mu guards what follows. Writers hold it while they log and add a
+	// record, readers while they pick what to look at. Only the worker
+	// changes the levels, so it reads them without mu.
+	mu         sync.RWMutex
+	written    *sync.Cond
+	mem        *memtable
+	wal        *writeAheadLog
+	immutables []*memtable
+	levels     [lsmLevels][]*table
+	nextNumber uint64
+
+	// compactPointer is the largest key of the last table of every
+	// level merged into the next, the next one picked comes after it
+	compactPointer [lsmLevels][]byte
+
+	// failed is the error that stopped the worker, writes fail with
+	// it from then on since nothing would write their records out
+	failed error
+
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// lsmConfig sizes the parts of a tree
+type lsmConfig struct {
+	// memtableSize is roughly how many bytes of records the memtable
+	// holds before it is written out, writers wait once maxImmutables
+	// memtables are waiting to be written
+	memtableSize  int
+	maxImmutables int
+
+	// blockSize is roughly how many bytes of records a block holds,
+	// tableSize how many a table merged into a level does
+	blockSize int
+	tableSize uint64
+
+	// level0Tables is how many tables level 0 holds before they are
+	// merged into level 1, levelSize how many bytes level 1 holds
+	level0Tables int
+	levelSize    int64
+}
+
+func defaultLSMConfig() lsmConfig {
+
+	return lsmConfig{
+		memtableSize:  4 << 20,
+		maxImmutables: 2,
+		blockSize:     4 << 10,
+		tableSize:     2 << 20,
+		level0Tables:  4,
+		levelSize:     10 << 20,
+	}
+}
+
+const (
+	lsmLevels           = 7
+	levelSizeMultiplier = 10
+
+	// what a record costs in the memtable on top of its bytes
+	memtableOverhead = 32
+
+	manifestName = "MANIFEST"
+)
+
+// memtable holds the latest records in memory, in key order
+type memtable struct {
+	records map[string]record
+
+	// index keeps the keys sorted, they all have the same score so
+	// they are ordered by key alone
+	index *skiplist
+	size  int
+
+	// log is the number of the write-ahead log holding the records
+	log uint64
+}
+
+func newMemtable(log uint64) *memtable {
+
+	return &memtable{records: make(map[string]record), index: newSkiplist(), log: log}
+}
+
+func (mem *memtable) put(key []byte, rec record) {
+
+	old, exists := mem.records[string(key)]
+	if exists {
+		mem.size -= len(old.value)
+	} else {
+		mem.index.insert(0, string(key))
+		mem.size += len(key) + memtableOverhead
+	}
+	mem.records[string(key)] = rec
+	mem.size += len(rec.value)
+}
+
+func (mem *memtable) get(key []byte) (record, bool) {
+
+	rec, ok := mem.records[string(key)]
+	return rec, ok
+}
+
+// iterator returns an iterator over a copy of the records from start
+// on, so that it can be used without the lock of the tree
+func (mem *memtable) iterator(start []byte) *sliceIterator {
+
+	it := &sliceIterator{}
+	node := mem.index.firstAbove(func(node *skiplistNode) bool {
+		return node.member < string(start)
+	})
+	for ; node != nil; node = node.levels[0].forward {
+		it.keys = append(it.keys, []byte(node.member))
+		it.records = append(it.records, mem.records[node.member])
+	}
+	return it
+}
+
+// sliceIterator goes over records already in memory
+type sliceIterator struct {
+	keys     [][]byte
+	records  []record
+	position int
+}
+
+func (it *sliceIterator) valid() bool {
+
+	return it.position < len(it.keys)
+}
+
+func (it *sliceIterator) key() []byte {
+
+	return it.keys[it.position]
+}
+
+func (it *sliceIterator) record() record {
+
+	return it.records[it.position]
+}
+
+func (it *sliceIterator) next() {
+
+	it.position++
+}
+
+func (it *sliceIterator) err() error {
+
+	return nil
+}
+
+func tablePath(dir string, number uint64) string {
+
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", number))
+}
+
+func logPath(dir string, number uint64) string {
+
+	return filepath.Join(dir, fmt.Sprintf("%06d.log", number))
+}
+
+// openLSM opens the tree kept in dir, creating it if there is none.
+// Records that were only in the write-ahead log are written out as a
+// table right away.
+func openLSM(dir string, policy FsyncPolicy, config lsmConfig) (*lsm, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &lsm{
+		dir:        dir,
+		policy:     policy,
+		config:     config,
+		nextNumber: 1,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	tree.written = sync.NewCond(&tree.mu)
+
+	logNumber, err := tree.readManifest()
+	if err != nil {
+		tree.closeTables()
+		return nil, err
+	}
+
+	// numbers are never reused, even those of files a crash left
+	// behind before the manifest listed them
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		name := file.Name()
+		number, err := strconv.ParseUint(strings.TrimSuffix(name, filepath.Ext(name)), 10, 64)
+		if err == nil && number >= tree.nextNumber {
+			tree.nextNumber = number + 1
+		}
+	}
+
+	// the records of logs that were never written out, in order
+	recovered := newMemtable(0)
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	sort.Strings(logs)
+	for _, path := range logs {
+		number, _ := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".log"), 10, 64)
+		if number < logNumber {
+			continue
+		}
+
+		err = replayWriteAheadLog(path, func(key []byte, rec record) {
+			rec.value = append([]byte{}, rec.value...)
+			recovered.put(key, rec)
+		})
+		if err != nil {
+			tree.closeTables()
+			return nil, err
+		}
+	}
+
+	if len(recovered.records) > 0 {
+		t, err := tree.writeMemtable(recovered)
+		if err != nil {
+			tree.closeTables()
+			return nil, err
+		}
+		tree.levels[0] = append([]*table{t}, tree.levels[0]...)
+	}
+
+	number := tree.newNumber()
+	tree.wal, err = createWriteAheadLog(logPath(dir, number), number, policy)
+	if err != nil {
+		tree.closeTables()
+		return nil, err
+	}
+	tree.mem = newMemtable(number)
+
+	err = tree.writeManifest()
+	if err != nil {
+		tree.wal.close()
+		tree.closeTables()
+		return nil, err
+	}
+	tree.removeObsoleteFiles()
+
+	go tree.work()
+	tree.signal()
+	return tree, nil
+}
+
+// readManifest opens the tables the manifest lists and returns the
+// number of the oldest write-ahead log that was not written out. The
+// manifest holds one fact per line: "next <number>" for the next file
+// number, "log <number>" for that log and "table <level> <number>" for
+// every table.
+func (tree *lsm) readManifest() (uint64, error) {
+
+	file, err := os.Open(filepath.Join(tree.dir, manifestName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	logNumber := uint64(0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		numbers := make([]uint64, len(fields))
+		for i := 1; i < len(fields); i++ {
+			numbers[i], err = strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: bad line %q", manifestName, scanner.Text())
+			}
+		}
+
+		switch {
+		case len(fields) == 2 && fields[0] == "next":
+			tree.nextNumber = numbers[1]
+		case len(fields) == 2 && fields[0] == "log":
+			logNumber = numbers[1]
+		case len(fields) == 3 && fields[0] == "table" && numbers[1] < lsmLevels:
+			t, err := openTable(tablePath(tree.dir, numbers[2]), numbers[2])
+			if err != nil {
+				return 0, err
+			}
+			tree.levels[numbers[1]] = append(tree.levels[numbers[1]], t)
+		default:
+			return 0, fmt.Errorf("%s: bad line %q", manifestName, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	for level := 1; level < lsmLevels; level++ {
+		sortTables(tree.levels[level])
+	}
+	return logNumber, nil
+}
+
+// writeManifest replaces the manifest with the current state of the
+// tree, in the same way as a snapshot. The caller must hold mu or be
+// the only one using the tree.
+func (tree *lsm) writeManifest() error {
+
+	logNumber := tree.wal.number
+	if len(tree.immutables) > 0 {
+		logNumber = tree.immutables[0].log
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "next %d\nlog %d\n", tree.nextNumber, logNumber)
+	for level, tables := range tree.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&builder, "table %d %d\n", level, t.number)
+		}
+	}
+
+	path := filepath.Join(tree.dir, manifestName)
+	file, err := os.CreateTemp(tree.dir, manifestName+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(builder.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	syncDirectory(tree.dir)
+	return nil
+}
+
+// removeObsoleteFiles removes the tables and logs that are not part of
+// the tree anymore, left over by a crash, at startup
+func (tree *lsm) removeObsoleteFiles() {
+
+	live := map[string]bool{filepath.Base(tree.wal.file.Name()): true, manifestName: true}
+	for _, tables := range tree.levels {
+		for _, t := range tables {
+			live[filepath.Base(t.path)] = true
+		}
+	}
+
+	files, _ := os.ReadDir(tree.dir)
+	for _, file := range files {
+		name := file.Name()
+		obsolete := strings.HasSuffix(name, ".sst") || strings.HasSuffix(name, ".log") || strings.HasPrefix(name, manifestName+".tmp-")
+		if obsolete && !live[name] {
+			os.Remove(filepath.Join(tree.dir, name))
+		}
+	}
+}
+
+func (tree *lsm) newNumber() uint64 {
+
+	number := tree.nextNumber
+	tree.nextNumber++
+	return number
+}
+
+// signal tells the worker there may be something to do
+func (tree *lsm) signal() {
+
+	select {
+	case tree.wake <- struct{}{}:
+	default:
+	}
+}
+
+// put logs and adds the record of key
+func (tree *lsm) put(key []byte, rec record) error {
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	// let the worker catch up rather than pile up memtables
+	for tree.failed == nil && len(tree.immutables) >= tree.config.maxImmutables {
+		tree.written.Wait()
+	}
+	if tree.failed != nil {
+		return tree.failed
+	}
+
+	err := tree.wal.append(key, rec)
+	if err != nil {
+		return err
+	}
+
+	tree.mem.put(key, rec)
+	if tree.mem.size >= tree.config.memtableSize {
+		return tree.rotate()
+	}
+	return nil
+}
+
+// rotate freezes the memtable for the worker to write it out and
+// starts a new one with its own log, the caller must hold mu
+func (tree *lsm) rotate() error {
+
+	number := tree.newNumber()
+	wal, err := createWriteAheadLog(logPath(tree.dir, number), number, tree.policy)
+	if err != nil {
+		return err
+	}
+
+	err = tree.wal.close()
+	if err != nil {
+		wal.close()
+		return err
+	}
+
+	tree.immutables = append(tree.immutables, tree.mem)
+	tree.mem, tree.wal = newMemtable(number), wal
+	tree.signal()
+	return nil
+}
+
+// get returns the latest record of key, false if there is none or if it
+// is a deletion
+func (tree *lsm) get(key []byte) (record, bool, error) {
+
+	tree.mu.RLock()
+	if rec, ok := tree.mem.get(key); ok {
+		tree.mu.RUnlock()
+		return rec, !rec.deleted, nil
+	}
+	for i := len(tree.immutables) - 1; i >= 0; i-- {
+		if rec, ok := tree.immutables[i].get(key); ok {
+			tree.mu.RUnlock()
+			return rec, !rec.deleted, nil
+		}
+	}
+
+	candidates := append([]*table{}, tree.levels[0]...)
+	for level := 1; level < lsmLevels; level++ {
+		if t := findTable(tree.levels[level], key); t != nil {
+			candidates = append(candidates, t)
+		}
+	}
+	for _, t := range candidates {
+		t.ref()
+	}
+	tree.mu.RUnlock()
+
+	defer func() {
+		for _, t := range candidates {
+			t.unref()
+		}
+	}()
+
+	for _, t := range candidates {
+		if bytes.Compare(key, t.smallest) < 0 || bytes.Compare(key, t.largest) > 0 {
+			continue
+		}
+
+		rec, ok, err := t.get(key)
+		if err != nil || ok {
+			return rec, ok && !rec.deleted, err
+		}
+	}
+	return record{}, false, nil
+}
+
+// sample returns the largest key of a block picked at random among the
+// blocks of tables that may hold keys from start up to but not including
+// end, along with how many blocks there were to pick from. It returns
+// nil if there were none, as when every record is still in memory.
+func (tree *lsm) sample(start []byte, end []byte) ([]byte, int) {
+
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	// the blocks of a table in the range are a run of its index
+	type run struct {
+		t      *table
+		first  int
+		blocks int
+	}
+	runs := make([]run, 0)
+	total := 0
+	for level := range tree.levels {
+		for _, t := range tree.levels[level] {
+			first, last := t.findBlock(start), t.findBlock(end)
+			if last > first {
+				runs = append(runs, run{t, first, last - first})
+				total += last - first
+			}
+		}
+	}
+	if total == 0 {
+		return nil, 0
+	}
+
+	picked := randomIntn(total)
+	for _, r := range runs {
+		if picked < r.blocks {
+			return append([]byte{}, r.t.blocks[r.first+picked].largest...), total
+		}
+		picked -= r.blocks
+	}
+	return nil, 0
+}
+
+// findTable returns the table of a level other than 0 whose range
+// holds key, or nil
+func findTable(tables []*table, key []byte) *table {
+
+	i := sort.Search(len(tables), func(i int) bool {
+		return bytes.Compare(tables[i].largest, key) >= 0
+	})
+	if i == len(tables) || bytes.Compare(tables[i].smallest, key) > 0 {
+		return nil
+	}
+	return tables[i]
+}
+
+func sortTables(tables []*table) {
+
+	sort.Slice(tables, func(i, j int) bool {
+		return bytes.Compare(tables[i].smallest, tables[j].smallest) < 0
+	})
+}
+
+// iterate returns an iterator over the live records from start up to
+// but not including end, a nil end meaning no end. It sees the tree as
+// it was when it was called. It has to be closed once done with.
+func (tree *lsm) iterate(start []byte, end []byte) *lsmIterator {
+
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	it := &lsmIterator{end: end}
+	sources := []recordIterator{tree.mem.iterator(start)}
+	for i := len(tree.immutables) - 1; i >= 0; i-- {
+		sources = append(sources, tree.immutables[i].iterator(start))
+	}
+	for _, t := range tree.levels[0] {
+		t.ref()
+		it.tables = append(it.tables, t)
+		sources = append(sources, t.iterator(start))
+	}
+	for level := 1; level < lsmLevels; level++ {
+		for _, t := range tree.levels[level] {
+			t.ref()
+			it.tables = append(it.tables, t)
+		}
+		sources = append(sources, newLevelIterator(tree.levels[level], start))
+	}
+
+	it.merged = newMergingIterator(sources)
+	it.skip()
+	return it
+}
+
+// lsmIterator goes over the live records of the tree
+type lsmIterator struct {
+	merged *mergingIterator
+	end    []byte
+	tables []*table
+}
+
+func (it *lsmIterator) valid() bool {
+
+	return it.merged.valid() && (it.end == nil || bytes.Compare(it.merged.key(), it.end) < 0)
+}
+
+func (it *lsmIterator) key() []byte {
+
+	return it.merged.key()
+}
+
+func (it *lsmIterator) record() record {
+
+	return it.merged.record()
+}
+
+func (it *lsmIterator) next() {
+
+	it.merged.next()
+	it.skip()
+}
+
+// skip moves past deletions
+func (it *lsmIterator) skip() {
+
+	for it.merged.valid() && it.merged.record().deleted {
+		it.merged.next()
+	}
+}
+
+func (it *lsmIterator) err() error {
+
+	return it.merged.err()
+}
+
+// close lets go of the tables the iterator was reading
+func (it *lsmIterator) close() {
+
+	for _, t := range it.tables {
+		t.unref()
+	}
+	it.tables = nil
+}
+
+// mergingIterator merges the records of several iterators in key order.
+// sources go from the newest to the oldest, for a key found in several
+// of them only the record of the newest one is seen.
+type mergingIterator struct {
+	sources []recordIterator
+	current int
+	failure error
+}
+
+func newMergingIterator(sources []recordIterator) *mergingIterator {
+
+	it := &mergingIterator{sources: sources}
+	it.pick()
+	return it
+}
+
+// pick finds the source with the smallest key
+func (it *mergingIterator) pick() {
+
+	it.current = -1
+	for i, source := range it.sources {
+		if !source.valid() {
+			if err := source.err(); err != nil {
+				it.failure = err
+				return
+			}
+			continue
+		}
+		if it.current == -1 || bytes.Compare(source.key(), it.sources[it.current].key()) < 0 {
+			it.current = i
+		}
+	}
+}
+
+func (it *mergingIterator) valid() bool {
+
+	return it.failure == nil && it.current >= 0
+}
+
+func (it *mergingIterator) key() []byte {
+
+	return it.sources[it.current].key()
+}
+
+func (it *mergingIterator) record() record {
+
+	return it.sources[it.current].record()
+}
+
+func (it *mergingIterator) next() {
+
+	key := it.key()
+	for _, source := range it.sources {
+		if source.valid() && bytes.Equal(source.key(), key) {
+			source.next()
+		}
+	}
+	it.pick()
+}
+
+func (it *mergingIterator) err() error {
+
+	return it.failure
+}
+
+// levelIterator goes over the tables of a level other than 0 one after
+// the other, which works since they hold disjoint ranges in order
+type levelIterator struct {
+	tables  []*table
+	index   int
+	current *tableIterator
+}
+
+func newLevelIterator(tables []*table, start []byte) *levelIterator {
+
+	it := &levelIterator{tables: tables}
+	it.index = sort.Search(len(tables), func(i int) bool {
+		return bytes.Compare(tables[i].largest, start) >= 0
+	})
+	if it.index < len(tables) {
+		it.current = tables[it.index].iterator(start)
+		it.advance()
+	}
+	return it
+}
+
+// advance moves on to the next tables while the current one is done
+func (it *levelIterator) advance() {
+
+	for !it.current.valid() && it.current.err() == nil && it.index+1 < len(it.tables) {
+		it.index++
+		it.current = it.tables[it.index].iterator(nil)
+	}
+}
+
+func (it *levelIterator) valid() bool {
+
+	return it.current != nil && it.current.valid()
+}
+
+func (it *levelIterator) key() []byte {
+
+	return it.current.key()
+}
+
+func (it *levelIterator) record() record {
+
+	return it.current.record()
+}
+
+func (it *levelIterator) next() {
+
+	it.current.next()
+	it.advance()
+}
+
+func (it *levelIterator) err() error {
+
+	if it.current == nil {
+		return nil
+	}
+	return it.current.err()
+}
+
+// sync writes the memtable out and waits for it, after which every
+// record is in a table
+func (tree *lsm) sync() error {
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.failed != nil {
+		return tree.failed
+	}
+	if len(tree.mem.records) > 0 {
+		err := tree.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	for tree.failed == nil && len(tree.immutables) > 0 {
+		tree.written.Wait()
+	}
+	return tree.failed
+}
+
+// close stops the worker and closes every file. Records that were not
+// written out are still in the write-ahead log for the next openLSM.
+func (tree *lsm) close() error {
+
+	close(tree.stop)
+	<-tree.stopped
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	err := tree.wal.close()
+	tree.closeTables()
+	return err
+}
+
+func (tree *lsm) closeTables() {
+
+	for level, tables := range tree.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+		tree.levels[level] = nil
+	}
+}
+
+// work writes out frozen memtables and merges levels that are too large
+// until there is nothing left to do, then waits to be woken up again.
+// It stops at the first failure, see fail, the records are still in the
+// logs for the next start.
+func (tree *lsm) work() {
+
+	defer close(tree.stopped)
+
+	for {
+		select {
+		case <-tree.stop:
+			return
+		case <-tree.wake:
+		}
+
+		for {
+			select {
+			case <-tree.stop:
+				return
+			default:
+			}
+
+			worked, err := tree.step()
+			if err != nil {
+				tree.fail(err)
+				return
+			}
+			if !worked {
+				break
+			}
+		}
+	}
+}
+
+// fail records the error that stopped the worker and wakes up the
+// writers waiting for it
+func (tree *lsm) fail(err error) {
+
+	log.Println("lsm:", err)
+
+	tree.mu.Lock()
+	tree.failed = err
+	tree.written.Broadcast()
+	tree.mu.Unlock()
+}
+
+// step does one piece of background work and reports whether it found
+// any to do
+func (tree *lsm) step() (bool, error) {
+
+	tree.mu.RLock()
+	var mem *memtable
+	if len(tree.immutables) > 0 {
+		mem = tree.immutables[0]
+	}
+	tree.mu.RUnlock()
+
+	if mem != nil {
+		return true, tree.flushMemtable(mem)
+	}
+
+	c := tree.pickCompaction()
+	if c == nil {
+		return false, nil
+	}
+	return true, tree.compact(c)
+}
+
+// flushMemtable writes out the oldest frozen memtable as a table
+// of level 0 and removes its log
+func (tree *lsm) flushMemtable(mem *memtable) error {
+
+	t, err := tree.writeMemtable(mem)
+	if err != nil {
+		return err
+	}
+
+	tree.mu.Lock()
+	tree.levels[0] = append([]*table{t}, tree.levels[0]...)
+	tree.immutables = tree.immutables[1:]
+	err = tree.writeManifest()
+	tree.written.Broadcast()
+	tree.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(logPath(tree.dir, mem.log))
+	return nil
+}
+
+// writeMemtable writes every record of mem to a new table, deletions
+// included since older tables may hold what they delete
+func (tree *lsm) writeMemtable(mem *memtable) (*table, error) {
+
+	tree.mu.Lock()
+	number := tree.newNumber()
+	tree.mu.Unlock()
+
+	path := tablePath(tree.dir, number)
+	writer, err := createTable(path, tree.config.blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for it := mem.iterator(nil); it.valid(); it.next() {
+		err = writer.add(it.key(), it.record())
+		if err != nil {
+			writer.abort()
+			return nil, err
+		}
+	}
+
+	err = writer.finish()
+	if err != nil {
+		return nil, err
+	}
+	return openTable(path, number)
+}
+
+// compaction merges tables of a level with those of the next level
+// they overlap
+type compaction struct {
+	level  int
+	inputs []*table
+	next   []*table
+
+	// bottom is set when no deeper level overlaps the tables, so
+	// deletions have nothing left to hide
+	bottom bool
+}
+
+// levelLimit returns how many bytes level may hold
+func (tree *lsm) levelLimit(level int) int64 {
+
+	limit := tree.config.levelSize
+	for i := 1; i < level; i++ {
+		limit *= levelSizeMultiplier
+	}
+	return limit
+}
+
+// pickCompaction returns the compaction to do next, or nil
+func (tree *lsm) pickCompaction() *compaction {
+
+	c := &compaction{level: -1}
+	if len(tree.levels[0]) >= tree.config.level0Tables {
+		c.level, c.inputs = 0, append([]*table{}, tree.levels[0]...)
+	}
+
+	for level := 1; c.level == -1 && level < lsmLevels-1; level++ {
+		size := int64(0)
+		for _, t := range tree.levels[level] {
+			size += t.size
+		}
+		if size <= tree.levelLimit(level) {
+			continue
+		}
+
+		// take turns over the range of the level
+		tables := tree.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return bytes.Compare(tables[i].smallest, tree.compactPointer[level]) > 0
+		})
+		if i == len(tables) || tree.compactPointer[level] == nil {
+			i = 0
+		}
+		c.level, c.inputs = level, []*table{tables[i]}
+	}
+
+	if c.level == -1 {
+		return nil
+	}
+
+	smallest, largest := c.inputs[0].smallest, c.inputs[0].largest
+	for _, t := range c.inputs {
+		if bytes.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if bytes.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+
+	tree.compactPointer[c.level] = largest
+	for _, t := range tree.levels[c.level+1] {
+		if t.overlaps(smallest, largest) {
+			c.next = append(c.next, t)
+		}
+	}
+
+	// the tables of the next level may reach past the inputs, and
+	// their deletions are merged too
+	for _, t := range c.next {
+		if bytes.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if bytes.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+
+	c.bottom = true
+	for level := c.level + 2; level < lsmLevels; level++ {
+		for _, t := range tree.levels[level] {
+			if t.overlaps(smallest, largest) {
+				c.bottom = false
+			}
+		}
+	}
+	return c
+}
+
+// compact merges the tables of c into new tables of the next level
+func (tree *lsm) compact(c *compaction) error {
+
+	// inputs of level 0 are newest first, and all of them are
+	// newer than those of the next level
+	sources := make([]recordIterator, 0, len(c.inputs)+1)
+	for _, t := range c.inputs {
+		sources = append(sources, t.iterator(nil))
+	}
+	sources = append(sources, newLevelIterator(c.next, nil))
+	merged := newMergingIterator(sources)
+
+	outputs := make([]*table, 0)
+	var writer *tableWriter
+	var number uint64
+
+	finish := func() error {
+		err := writer.finish()
+		if err != nil {
+			return err
+		}
+		t, err := openTable(tablePath(tree.dir, number), number)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		writer = nil
+		return nil
+	}
+	abort := func(err error) error {
+		if writer != nil {
+			writer.abort()
+		}
+		for _, t := range outputs {
+			t.retire()
+		}
+		return err
+	}
+
+	for ; merged.valid(); merged.next() {
+		rec := merged.record()
+		if rec.deleted && c.bottom {
+			continue
+		}
+
+		if writer == nil {
+			tree.mu.Lock()
+			number = tree.newNumber()
+			tree.mu.Unlock()
+
+			var err error
+			writer, err = createTable(tablePath(tree.dir, number), tree.config.blockSize)
+			if err != nil {
+				return abort(err)
+			}
+		}
+
+		err := writer.add(merged.key(), rec)
+		if err == nil && writer.size() >= tree.config.tableSize {
+			err = finish()
+		}
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if err := merged.err(); err != nil {
+		return abort(err)
+	}
+	if writer != nil {
+		if err := finish(); err != nil {
+			return abort(err)
+		}
+	}
+
+	tree.mu.Lock()
+	tree.levels[c.level] = without(tree.levels[c.level], c.inputs)
+	tree.levels[c.level+1] = append(without(tree.levels[c.level+1], c.next), outputs...)
+	sortTables(tree.levels[c.level+1])
+	err := tree.writeManifest()
+	if err == nil {
+		for _, t := range append(c.inputs, c.next...) {
+			t.retire()
+		}
+	}
+	tree.mu.Unlock()
+	return err
+}
+
+// without returns tables but those in removed
+func without(tables []*table, removed []*table) []*table {
+
+	gone := make(map[*table]bool, len(removed))
+	for _, t := range removed {
+		gone[t] = true
+	}
+
+	kept := make([]*table, 0, len(tables))
+	for _, t := range tables {
+		if !gone[t] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
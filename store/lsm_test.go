@@ -0,0 +1,248 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// smallLSMConfig makes trees write out and merge tables after a few
+// records, so that tests go through every level of the tree
+func smallLSMConfig() lsmConfig {
+
+	return lsmConfig{
+		memtableSize:  2 << 10,
+		maxImmutables: 2,
+		blockSize:     256,
+		tableSize:     4 << 10,
+		level0Tables:  2,
+		levelSize:     8 << 10,
+	}
+}
+
+func lsmKey(i int) []byte {
+
+	return []byte(fmt.Sprintf("key:%05d", i))
+}
+
+// settle waits until the worker of tree has nothing left to do
+func settle(tree *lsm) {
+
+	handleError("failed sync", tree.sync())
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		tree.mu.RLock()
+		settled := len(tree.levels[0]) < tree.config.level0Tables
+		for level := 1; level < lsmLevels-1; level++ {
+			size := int64(0)
+			for _, t := range tree.levels[level] {
+				size += t.size
+			}
+			settled = settled && size <= tree.levelLimit(level)
+		}
+		tree.mu.RUnlock()
+
+		if settled {
+			return
+		}
+	}
+	log.Fatalf("failed to settle the tree")
+}
+
+// contentsOf returns every live key and value of tree, in order
+func contentsOf(tree *lsm, start []byte, end []byte) ([]string, []string) {
+
+	it := tree.iterate(start, end)
+	defer it.close()
+
+	keys, values := []string{}, []string{}
+	for ; it.valid(); it.next() {
+		keys = append(keys, string(it.key()))
+		values = append(values, string(it.record().value))
+	}
+	handleError("failed iterate", it.err())
+	return keys, values
+}
+
+func TestLSM(t *testing.T) {
+
+	dir := t.TempDir()
+	tree, err := openLSM(dir, FsyncNo, smallLSMConfig())
+	handleError("failed openLSM", err)
+
+	// every key is written twice and every third one deleted,
+	// so that newer records have older ones to hide
+	const count = 2000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < count; i++ {
+			value := []byte(fmt.Sprintf("value %d of %d", round, i))
+			handleError("failed put", tree.put(lsmKey(i), record{value: value}))
+		}
+	}
+	for i := 0; i < count; i += 3 {
+		handleError("failed put", tree.put(lsmKey(i), record{deleted: true}))
+	}
+
+	check := func(tree *lsm) {
+		for i := 0; i < count; i++ {
+			rec, ok, err := tree.get(lsmKey(i))
+			handleError("failed get", err)
+			if ok != (i%3 != 0) || (ok && string(rec.value) != fmt.Sprintf("value 1 of %d", i)) {
+				log.Fatalf("failed get of %s, got: %q %v", lsmKey(i), rec.value, ok)
+			}
+		}
+
+		keys, _ := contentsOf(tree, lsmKey(100), lsmKey(110))
+		expected := []string{"key:00100", "key:00101", "key:00103", "key:00104", "key:00106", "key:00107", "key:00109"}
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			log.Fatalf("failed iterate, got: %v", keys)
+		}
+
+		keys, _ = contentsOf(tree, nil, nil)
+		if len(keys) != count-(count+2)/3 {
+			log.Fatalf("failed iterate, got %d keys", len(keys))
+		}
+	}
+
+	check(tree)
+	settle(tree)
+	check(tree)
+
+	deepest := 0
+	for level, tables := range tree.levels {
+		if len(tables) > 0 {
+			deepest = level
+		}
+	}
+	if deepest < 2 {
+		log.Fatalf("failed compaction, nothing made it past level %d", deepest)
+	}
+
+	// tables that were merged away are gone from the directory
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	live := 0
+	for _, level := range tree.levels {
+		live += len(level)
+	}
+	if len(tables) != live {
+		log.Fatalf("failed compaction, %d tables on disk for %d in the tree", len(tables), live)
+	}
+
+	handleError("failed close", tree.close())
+	tree, err = openLSM(dir, FsyncNo, smallLSMConfig())
+	handleError("failed openLSM", err)
+	defer tree.close()
+	check(tree)
+}
+
+func TestLSMRecovery(t *testing.T) {
+
+	dir := t.TempDir()
+	config := smallLSMConfig()
+	config.memtableSize = 1 << 20
+
+	tree, err := openLSM(dir, FsyncAlways, config)
+	handleError("failed openLSM", err)
+	handleError("failed put", tree.put([]byte("kept"), record{value: []byte("value"), expireAt: 42}))
+	handleError("failed put", tree.put([]byte("deleted"), record{value: []byte("value")}))
+	handleError("failed put", tree.put([]byte("deleted"), record{deleted: true}))
+	logNumber := tree.wal.number
+
+	// the memtable is never written out, as if the process crashed,
+	// and the last entry of the log is torn
+	close(tree.stop)
+	<-tree.stopped
+	tree.wal.close()
+	tree.closeTables()
+
+	file, err := os.OpenFile(logPath(dir, logNumber), os.O_WRONLY|os.O_APPEND, 0644)
+	handleError("failed to open the log", err)
+	file.Write([]byte{0, 0, 0, 1, 0, 0, 0, 200, 'x'})
+	file.Close()
+
+	tree, err = openLSM(dir, FsyncAlways, config)
+	handleError("failed openLSM after a crash", err)
+	defer tree.close()
+
+	rec, ok, err := tree.get([]byte("kept"))
+	if err != nil || !ok || string(rec.value) != "value" || rec.expireAt != 42 {
+		log.Fatalf("failed recovery, got: %v %v %v", rec, ok, err)
+	}
+	if _, ok, _ := tree.get([]byte("deleted")); ok {
+		log.Fatalf("failed recovery, a deletion was lost")
+	}
+	if _, err := os.Stat(logPath(dir, logNumber)); !os.IsNotExist(err) {
+		log.Fatalf("failed recovery, the replayed log was kept")
+	}
+}
+
+func TestTableCorruption(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writer, err := createTable(path, 64)
+	handleError("failed createTable", err)
+	for i := 0; i < 100; i++ {
+		handleError("failed add", writer.add(lsmKey(i), record{value: []byte("value")}))
+	}
+	handleError("failed finish", writer.finish())
+
+	tab, err := openTable(path, 1)
+	handleError("failed openTable", err)
+	rec, ok, err := tab.get(lsmKey(50))
+	if err != nil || !ok || string(rec.value) != "value" {
+		log.Fatalf("failed get, got: %v %v %v", rec, ok, err)
+	}
+	if !bytes.Equal(tab.smallest, lsmKey(0)) || !bytes.Equal(tab.largest, lsmKey(99)) || tab.count != 100 {
+		log.Fatalf("failed openTable, got the range %s to %s", tab.smallest, tab.largest)
+	}
+
+	// a flipped bit in a block is noticed when the block is read
+	block := tab.blocks[tab.findBlock(lsmKey(50))]
+	content, _ := os.ReadFile(path)
+	content[block.offset+1] ^= 1
+	os.WriteFile(path, content, 0644)
+	tab.unref()
+
+	tab, err = openTable(path, 1)
+	handleError("failed openTable", err)
+	defer tab.unref()
+	if _, _, err := tab.get(lsmKey(50)); !errors.Is(err, ErrCorruptTable) {
+		log.Fatalf("failed get of a corrupt block, got: %v", err)
+	}
+
+	// and in the index when the table is opened
+	content[len(content)-tableFooterLength-1] ^= 1
+	os.WriteFile(path, content, 0644)
+	if _, err := openTable(path, 1); !errors.Is(err, ErrCorruptTable) {
+		log.Fatalf("failed openTable of a corrupt index, got: %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+
+	keys := [][]byte{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, lsmKey(i))
+	}
+	filter := newBloomFilter(keys)
+
+	for _, key := range keys {
+		if !filter.mayContain(key) {
+			log.Fatalf("failed bloom filter, %s is missing", key)
+		}
+	}
+
+	positives := 0
+	for i := 1000; i < 11000; i++ {
+		if filter.mayContain(lsmKey(i)) {
+			positives++
+		}
+	}
+	if positives > 300 {
+		log.Fatalf("failed bloom filter, %d false positives out of 10000", positives)
+	}
+}
@@ -0,0 +1,366 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy decides which keys are evicted to make room once the
+// memory limit is reached
+type EvictionPolicy int
+
+const (
+	// NoEviction evicts nothing, writes that need memory are refused
+	NoEviction EvictionPolicy = iota
+
+	// AllKeysLRU evicts the keys that were used the longest time ago
+	AllKeysLRU
+
+	// AllKeysLFU evicts the keys that are used the least often
+	AllKeysLFU
+
+	// AllKeysRandom evicts keys at random
+	AllKeysRandom
+
+	// VolatileLRU is AllKeysLRU among the keys with a deadline
+	VolatileLRU
+
+	// VolatileTTL evicts the keys with the nearest deadline
+	VolatileTTL
+)
+
+var ErrOutOfMemory = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// ParseEvictionPolicy reads a policy spelled as in the maxmemory-policy
+// setting of Redis, e.g. allkeys-lru
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+
+	for policy, candidates := range evictionPolicies {
+		if candidates.name == name {
+			return policy, nil
+		}
+	}
+	return NoEviction, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+func (policy EvictionPolicy) String() string {
+
+	return evictionPolicies[policy].name
+}
+
+// evictionPolicy describes a policy: whether it only evicts keys with
+// a deadline and how it ranks them, the key ranked highest goes first.
+// A policy without rank never evicts.
+type evictionPolicy struct {
+	name     string
+	volatile bool
+	rank     func(e *entry, now int64) int64
+}
+
+var evictionPolicies = map[EvictionPolicy]evictionPolicy{
+	NoEviction: {name: "noeviction"},
+	AllKeysLRU: {name: "allkeys-lru", rank: idleTime},
+	AllKeysLFU: {name: "allkeys-lfu", rank: func(e *entry, now int64) int64 {
+		return maxHits - e.frequency(now)
+	}},
+	AllKeysRandom: {name: "allkeys-random", rank: func(*entry, int64) int64 {
+		return int64(randomIntn(math.MaxInt32))
+	}},
+	VolatileLRU: {name: "volatile-lru", volatile: true, rank: idleTime},
+	VolatileTTL: {name: "volatile-ttl", volatile: true, rank: func(e *entry, now int64) int64 {
+		return math.MaxInt64 - e.expireAt
+	}},
+}
+
+func idleTime(e *entry, now int64) int64 {
+
+	return now - atomic.LoadInt64(&e.accessed)
+}
+
+// how many keys of every database are looked at to pick one to evict
+const evictionSamples = 5
+
+// hits is a logarithmic counter of how often a key is used, as in the
+// LFU policy of Redis. New keys start at initialHits so that they are
+// not evicted right away, the count goes down by one every minute the
+// key is not used and goes up more slowly the higher it is.
+const (
+	initialHits     = 5
+	maxHits         = 255
+	hitsLogFactor   = 10
+	hitsDecayMillis = 60 * 1000
+)
+
+// use records that the key of e has just been used. Counting the hits
+// costs a random number, so it is only done if counting is set.
+func (e *entry) use(now int64, counting bool) {
+
+	if counting {
+		hits := e.frequency(now)
+		base := hits - initialHits
+		if hits < maxHits && (base <= 0 || randomIntn(int(base*hitsLogFactor+1)) == 0) {
+			atomic.StoreInt64(&e.hits, hits+1)
+		} else {
+			atomic.StoreInt64(&e.hits, hits)
+		}
+	}
+
+	// keys read over and over in the same millisecond
+	// do not all write to the entry
+	if atomic.LoadInt64(&e.accessed) != now {
+		atomic.StoreInt64(&e.accessed, now)
+	}
+}
+
+// counting reports whether the hits of keys are counted, which
+// only the LFU policy needs
+func (storage *Storage) counting() bool {
+
+	return storage.owner().policy == AllKeysLFU
+}
+
+// frequency returns the hits of e decayed for the time it was not used
+func (e *entry) frequency(now int64) int64 {
+
+	hits := atomic.LoadInt64(&e.hits)
+	hits -= (now - atomic.LoadInt64(&e.accessed)) / hitsDecayMillis
+	if hits < 0 {
+		return 0
+	}
+	return hits
+}
+
+// rough costs in bytes of the bookkeeping around a key and around every
+// element of a collection, on top of the bytes of the data itself
+const (
+	entryOverhead   = 96
+	elementOverhead = 32
+	zsetOverhead    = 96
+
+	// how many elements of a collection are measured to
+	// estimate the size of the others
+	sizeSamples = 5
+)
+
+// sizeOf estimates how much memory key and value take, looking at no
+// more than a few elements of a collection so that it takes O(1)
+func sizeOf(key string, value RetainValue) int64 {
+
+	size := int64(entryOverhead + len(key))
+	sampled, bytes := 0, 0
+
+	switch value := value.(type) {
+
+	case []byte:
+		return size + int64(len(value))
+
+	case string:
+		return size + int64(len(value))
+
+	case int, float64:
+		return size + 8
+
+	case *list:
+		for ; sampled < value.len() && sampled < sizeSamples; sampled++ {
+			bytes += len(value.at(sampled))
+		}
+		return size + estimateSize(value.len(), sampled, bytes+sampled*elementOverhead)
+
+	case hash:
+		for field, item := range value {
+			if sampled == sizeSamples {
+				break
+			}
+			bytes += len(field) + len(item) + elementOverhead
+			sampled++
+		}
+		return size + estimateSize(len(value), sampled, bytes)
+
+	case set:
+		for member := range value {
+			if sampled == sizeSamples {
+				break
+			}
+			bytes += len(member) + elementOverhead
+			sampled++
+		}
+		return size + estimateSize(len(value), sampled, bytes)
+
+	case *zset:
+		for node := value.index.first(); node != nil && sampled < sizeSamples; node = node.levels[0].forward {
+			bytes += len(node.member) + zsetOverhead
+			sampled++
+		}
+		return size + estimateSize(value.len(), sampled, bytes)
+	}
+	return size
+}
+
+// estimateSize extrapolates the bytes taken by the sampled elements
+// of a collection to all count of them
+func estimateSize(count int, sampled int, bytes int) int64 {
+
+	if sampled == 0 {
+		return 0
+	}
+	return int64(count) * int64(bytes) / int64(sampled)
+}
+
+// account sets the size of e, which is about to be stored at key in
+// place of old, and adds the difference to the memory used. old is e
+// itself when the value was changed in place.
+func (storage *Storage) account(key string, e *entry, old *entry) {
+
+	size := sizeOf(key, e.value)
+	previous := int64(0)
+	if old != nil {
+		previous = atomic.LoadInt64(&old.size)
+	}
+	atomic.StoreInt64(&e.size, size)
+	atomic.AddInt64(&storage.owner().used, size-previous)
+}
+
+// FreeMemory evicts keys from every database as the eviction policy
+// says until the memory used is back under the limit. It returns
+// ErrOutOfMemory if the policy does not allow it, in which case writes
+// that need more memory should be refused. The Storage never calls it
+// on its own, callers do before such writes.
+func (storage *Storage) FreeMemory() error {
+
+	root := storage.owner()
+	if root.maxMemory == 0 {
+		return nil
+	}
+
+	for atomic.LoadInt64(&root.used) > root.maxMemory {
+		evicted, err := root.evict()
+		if err != nil {
+			return err
+		}
+		if !evicted {
+			return ErrOutOfMemory
+		}
+	}
+	return nil
+}
+
+// evict evicts the key ranked highest by the policy among a sample of
+// the keys of every database. It returns false if there is no key the
+// policy may evict. It is called on the root.
+func (storage *Storage) evict() (bool, error) {
+
+	policy := evictionPolicies[storage.policy]
+	if policy.rank == nil {
+		return false, nil
+	}
+
+	storage.layout.RLock()
+	defer storage.layout.RUnlock()
+
+	var victim *Storage
+	var victimKey string
+	best := int64(math.MinInt64)
+
+	now := toMillis(time.Now())
+	for _, db := range storage.all() {
+		db.sample(policy.volatile, func(key string, e *entry) {
+			// an expired key is as good as gone, evict it first
+			rank := int64(math.MaxInt64)
+			if !e.expired(now) {
+				rank = policy.rank(e, now)
+			}
+
+			if victim == nil || rank > best {
+				victim, victimKey, best = db, key, rank
+			}
+		})
+	}
+
+	if victim == nil {
+		return false, nil
+	}
+
+	unlock := victim.lock(RetainKey(victimKey))
+	defer unlock()
+
+	// it may have gone meanwhile, which frees memory all the same
+	_, ok, err := victim.loadLocked(victimKey)
+	if ok && err == nil {
+		err = victim.remove(victimKey)
+		if err == nil {
+			victim.logCommand([]byte("DEL"), []byte(victimKey))
+			atomic.AddInt64(&storage.evicted, 1)
+		}
+	}
+	return err == nil, err
+}
+
+// sample calls f with up to evictionSamples keys, only keys with a
+// deadline if volatile is set. It starts at a random shard and goes on
+// to the next ones until it has enough.
+func (storage *Storage) sample(volatile bool, f func(key string, e *entry)) {
+
+	sampled := 0
+	first := randomIntn(shardCount)
+	for i := 0; i < shardCount && sampled < evictionSamples; i++ {
+		sh := &storage.shards[(first+i)%shardCount]
+		sh.mu.RLock()
+		if volatile {
+			for key := range sh.expires {
+				if sampled == evictionSamples {
+					break
+				}
+				f(key, sh.entries[key])
+				sampled++
+			}
+		} else {
+			for key, e := range sh.entries {
+				if sampled == evictionSamples {
+					break
+				}
+				f(key, e)
+				sampled++
+			}
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// MemoryUsage returns roughly how many bytes key and its value take,
+// or false if there is no such key
+func (storage *Storage) MemoryUsage(key RetainKey) (int64, bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	// unlike lookup, this does not count as a use of the key
+	e, ok, err := storage.peek(string(key))
+	if !ok || err != nil || e.expired(toMillis(time.Now())) {
+		return 0, false, err
+	}
+	return atomic.LoadInt64(&e.size), true, nil
+}
+
+// UsedMemory returns roughly how many bytes the keys of every
+// database take
+func (storage *Storage) UsedMemory() int64 {
+
+	return atomic.LoadInt64(&storage.owner().used)
+}
+
+// MaxMemory returns the memory limit, 0 if there is none, and the
+// policy used to stay under it
+func (storage *Storage) MaxMemory() (int64, EvictionPolicy) {
+
+	root := storage.owner()
+	return root.maxMemory, root.policy
+}
+
+// EvictedKeys returns how many keys have been evicted
+func (storage *Storage) EvictedKeys() int64 {
+
+	return atomic.LoadInt64(&storage.owner().evicted)
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+
+	mp := &Storage{}
+	mp.Set(RetainKey("key"), []byte("value"))
+	if used := mp.UsedMemory(); used != sizeOf("key", []byte("value")) {
+		log.Fatalf("failed UsedMemory, got: %d", used)
+	}
+
+	size, ok, err := mp.MemoryUsage(RetainKey("key"))
+	handleError("failed MemoryUsage", err)
+	if !ok || size != mp.UsedMemory() {
+		log.Fatalf("failed MemoryUsage, got: %d %v", size, ok)
+	}
+	if _, ok, err := mp.MemoryUsage(RetainKey("missing")); err != nil || ok {
+		log.Fatalf("failed MemoryUsage of a missing key")
+	}
+
+	// collections grow with the elements changed in place
+	mp.RPush(RetainKey("list"), []byte("a"))
+	before := mp.UsedMemory()
+	for i := 0; i < 100; i++ {
+		mp.RPush(RetainKey("list"), []byte("element"))
+	}
+	if mp.UsedMemory() <= before {
+		log.Fatalf("failed UsedMemory, a growing list did not count")
+	}
+
+	mp.HSet(RetainKey("hash"), []byte("field"), []byte("value"))
+	mp.SAdd(RetainKey("set"), []byte("member"))
+	mp.ZAdd(RetainKey("zset"), []ScoredMember{{Member: []byte("member"), Score: 1}}, ZAddOptions{})
+	mp.Delete(RetainKey("key"))
+	mp.Delete(RetainKey("list"))
+	mp.Delete(RetainKey("hash"))
+	mp.Delete(RetainKey("set"))
+	mp.Delete(RetainKey("zset"))
+	if used := mp.UsedMemory(); used != 0 {
+		log.Fatalf("failed UsedMemory, %d bytes left with no keys", used)
+	}
+}
+
+// limited returns a storage already holding keys named 0 to count-1
+// and just over a limit of that many keys
+func limited(policy EvictionPolicy, count int) *Storage {
+
+	mp := &Storage{policy: policy}
+	for i := 0; i < count; i++ {
+		mp.Set(RetainKey(fmt.Sprint(i)), []byte("value"))
+	}
+	mp.maxMemory = mp.UsedMemory() - 1
+	return mp
+}
+
+func TestEvictionPolicies(t *testing.T) {
+
+	mp := limited(NoEviction, 3)
+	if err := mp.FreeMemory(); err != ErrOutOfMemory {
+		log.Fatalf("failed noeviction, got: %v", err)
+	}
+
+	// every key is sampled, so the least recently used one goes
+	mp = limited(AllKeysLRU, 3)
+	time.Sleep(5 * time.Millisecond)
+	mp.Get(RetainKey("0"))
+	mp.Get(RetainKey("2"))
+	handleError("failed allkeys-lru", mp.FreeMemory())
+	if existing(mp, RetainKey("0"), RetainKey("1"), RetainKey("2")) != 2 || existing(mp, RetainKey("1")) != 0 {
+		log.Fatalf("failed allkeys-lru, evicted the wrong key")
+	}
+
+	mp = limited(AllKeysLFU, 3)
+	for i := 0; i < 100; i++ {
+		mp.Get(RetainKey("0"))
+		mp.Get(RetainKey("1"))
+	}
+	handleError("failed allkeys-lfu", mp.FreeMemory())
+	if existing(mp, RetainKey("2")) != 0 || mp.EvictedKeys() != 1 {
+		log.Fatalf("failed allkeys-lfu, evicted the wrong key")
+	}
+
+	mp = limited(AllKeysRandom, 3)
+	handleError("failed allkeys-random", mp.FreeMemory())
+	if mp.DBSize() != 2 {
+		log.Fatalf("failed allkeys-random, %d keys left", mp.DBSize())
+	}
+
+	// keys without a deadline are never evicted by volatile policies
+	mp = limited(VolatileLRU, 3)
+	if err := mp.FreeMemory(); err != ErrOutOfMemory {
+		log.Fatalf("failed volatile-lru without deadlines, got: %v", err)
+	}
+	mp.Expire(RetainKey("1"), time.Now().Add(time.Hour))
+	handleError("failed volatile-lru", mp.FreeMemory())
+	if existing(mp, RetainKey("1")) != 0 || mp.DBSize() != 2 {
+		log.Fatalf("failed volatile-lru, evicted the wrong key")
+	}
+
+	mp = limited(VolatileTTL, 3)
+	mp.Expire(RetainKey("0"), time.Now().Add(2*time.Hour))
+	mp.Expire(RetainKey("1"), time.Now().Add(time.Hour))
+	handleError("failed volatile-ttl", mp.FreeMemory())
+	if existing(mp, RetainKey("1")) != 0 || mp.DBSize() != 2 {
+		log.Fatalf("failed volatile-ttl, evicted the wrong key")
+	}
+}
+
+func TestEvictionAcrossDatabases(t *testing.T) {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), fileName)
+	options.Databases = 2
+	options.MaxMemoryPolicy = AllKeysLRU
+
+	mp, _, err := NewWithOptions(options)
+	handleError("failed NewWithOptions", err)
+	defer mp.Close()
+
+	second, _ := mp.DB(1)
+	second.Set(RetainKey("old"), []byte("value"))
+	time.Sleep(5 * time.Millisecond)
+	mp.Set(RetainKey("new"), []byte("value"))
+
+	mp.maxMemory = mp.UsedMemory() - 1
+	handleError("failed FreeMemory", mp.FreeMemory())
+	if second.DBSize() != 0 || mp.DBSize() != 1 || mp.EvictedKeys() != 1 {
+		log.Fatalf("failed to evict from another database")
+	}
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+
+	for _, name := range []string{"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-ttl"} {
+		policy, err := ParseEvictionPolicy(name)
+		if err != nil || policy.String() != name {
+			log.Fatalf("failed ParseEvictionPolicy of %s, got: %v %v", name, policy, err)
+		}
+	}
+
+	if _, err := ParseEvictionPolicy("sometimes"); err == nil {
+		log.Fatalf("failed ParseEvictionPolicy, accepted an unknown policy")
+	}
+}
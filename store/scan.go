@@ -0,0 +1,253 @@
+package store
+
+import (
+	"container/heap"
+	"hash/fnv"
+)
+
+// The SCAN family walks a collection in the order of a hash of each
+// name, and the cursor is the place to resume from. Since that place
+// does not depend on what else is in the collection, a name that is
+// there for the whole iteration is returned at least once no matter how
+// the collection changes between calls. Cursor 0 starts and ends a scan.
+//
+// The keys of a database are walked a bucket at a time: every shard is
+// split into scanBuckets buckets by hash, and the cursor is the number
+// of the next bucket counting across shards, so that a page costs about
+// what it returns. Fields of a hash are walked by scanPosition instead.
+
+// scanBuckets is how many buckets each shard is split into
+const scanBuckets = 1024
+
+// scanSlots is how many buckets there are across every shard, no
+// cursor of a keyspace scan gets past it
+const scanSlots = shardCount * scanBuckets
+
+// scanHash is the 64 bit FNV-1a hash of name
+func scanHash(name string) uint64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// scanBucket returns the bucket of its shard name falls in
+func scanBucket(name string) int {
+
+	return int(scanHash(name) % scanBuckets)
+}
+
+// scanSlot returns the cursor of the bucket name falls in
+func scanSlot(name string) uint64 {
+
+	return uint64(shardIndex(name)*scanBuckets + scanBucket(name))
+}
+
+// scanPosition is where name sits in the order of a scan
+func scanPosition(name string) uint64 {
+
+	// keep cursors positive when read as signed integers, and
+	// clear of 0 which has to mean that the scan is over
+	position := scanHash(name) >> 1
+	if position == 0 {
+		position = 1
+	}
+	return position
+}
+
+// scanPage picks up to count names, starting at cursor, among those
+// that match pattern. An empty pattern matches everything. It returns
+// them along with the cursor of the next page. Names sharing a position
+// always end up on the same page so that none of them is skipped.
+func scanPage(names []string, cursor uint64, count int, pattern string) ([]string, uint64) {
+
+	// count comes from the client, the heap is no bigger than names
+	if count > len(names) {
+		count = len(names)
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	// the page ends at the count-th smallest position from cursor
+	// on, which a heap of count positions finds without sorting
+	// every name
+	last := make(positionHeap, 0, count)
+	for _, name := range names {
+		position := scanPosition(name)
+		switch {
+		case position < cursor:
+		case len(last) < count:
+			heap.Push(&last, position)
+		case position < last[0]:
+			last[0] = position
+			heap.Fix(&last, 0)
+		}
+	}
+	if len(last) == 0 {
+		return []string{}, 0
+	}
+
+	// like Redis, count bounds the work done rather
+	// than the number of names that come back
+	page := make([]string, 0)
+	next := uint64(0)
+	for _, name := range names {
+		position := scanPosition(name)
+		switch {
+		case position < cursor:
+		case position <= last[0]:
+			if pattern == "" || MatchPattern(pattern, name) {
+				page = append(page, name)
+			}
+		case next == 0 || position < next:
+			next = position
+		}
+	}
+	return page, next
+}
+
+// positionHeap is a heap.Interface keeping the largest position on top
+type positionHeap []uint64
+
+func (h positionHeap) Len() int {
+
+	return len(h)
+}
+
+func (h positionHeap) Less(i int, j int) bool {
+
+	return h[i] > h[j]
+}
+
+func (h positionHeap) Swap(i int, j int) {
+
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *positionHeap) Push(x interface{}) {
+
+	*h = append(*h, x.(uint64))
+}
+
+func (h *positionHeap) Pop() interface{} {
+
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// MatchPattern reports whether name matches the glob style pattern,
+// using the syntax of Redis: "*" is any sequence of characters, "?" any
+// single character, "[abc]" one of the characters listed ("[^abc]" for
+// the opposite), "[a-z]" a character in the range and "\x" the
+// character x itself.
+func MatchPattern(pattern string, name string) bool {
+
+	// p and n are where pattern and name are matched up to. On a
+	// mismatch the last "*" seen takes one more character of name
+	// and matching starts over right after it, earlier stars never
+	// need to take more so the work stays proportional to
+	// len(pattern) * len(name)
+	p, n := 0, 0
+	star, starName := -1, 0
+	for n < len(name) {
+		if p < len(pattern) {
+			switch pattern[p] {
+
+			case '*':
+				star, starName = p, n
+				p++
+				continue
+
+			case '?':
+				p++
+				n++
+				continue
+
+			case '[':
+				rest, ok := matchClass(pattern[p+1:], name[n])
+				if ok {
+					p = len(pattern) - len(rest)
+					n++
+					continue
+				}
+
+			case '\\':
+				literal := p
+				if p+1 < len(pattern) {
+					literal = p + 1
+				}
+				if pattern[literal] == name[n] {
+					p = literal + 1
+					n++
+					continue
+				}
+
+			default:
+				if pattern[p] == name[n] {
+					p++
+					n++
+					continue
+				}
+			}
+		}
+
+		if star < 0 {
+			return false
+		}
+		starName++
+		p, n = star+1, starName
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the character class at the start of
+// pattern, just past the opening bracket. It returns what follows the
+// class. An unterminated class runs to the end of the pattern.
+func matchClass(pattern string, c byte) (string, bool) {
+
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+
+		case pattern[0] == '\\' && len(pattern) > 1:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			pattern = pattern[3:]
+
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
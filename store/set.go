@@ -0,0 +1,440 @@
+package store
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxRandomMembers is the most members SRandMember returns when they may
+// repeat, as many as the elements of the largest array a client accepts
+const maxRandomMembers = 1024 * 1024
+
+// ErrCountOutOfRange is returned for a count of random members over
+// maxRandomMembers
+var ErrCountOutOfRange = errors.New("count is out of range")
+
+// set holds unique members without any order
+type set map[string]struct{}
+
+func (s set) clone() set {
+
+	copied := make(set, len(s))
+	for member := range s {
+		copied[member] = struct{}{}
+	}
+	return copied
+}
+
+func (s set) members() [][]byte {
+
+	members := make([][]byte, 0, len(s))
+	for member := range s {
+		members = append(members, []byte(member))
+	}
+	return members
+}
+
+// the kinds of set algebra SInter, SUnion and SDiff perform
+const (
+	setIntersection = iota
+	setUnion
+	setDifference
+)
+
+// math/rand sources are not safe for concurrent use on their own
+var (
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomMu sync.Mutex
+)
+
+// randomIntn returns a random number in [0, n)
+func randomIntn(n int) int {
+
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Intn(n)
+}
+
+// readSet returns the set at key for callers holding its lock
+func (storage *Storage) readSet(key string) (set, error) {
+
+	e, ok, err := storage.lookup(key)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	s, isSet := e.value.(set)
+	if !isSet {
+		return nil, ErrWrongType
+	}
+	return s, nil
+}
+
+// writableSet returns the set at key ready to be changed in place,
+// creating an empty one if create is set. The caller must hold the
+// lock of key.
+func (storage *Storage) writableSet(key string, create bool) (set, error) {
+
+	e, ok, err := storage.loadLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		s := make(set)
+		err = storage.store(key, &entry{value: s, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	s, isSet := e.value.(set)
+	if !isSet {
+		return nil, ErrWrongType
+	}
+
+	if e.generation != storage.generation {
+		s = s.clone()
+		err = storage.store(key, &entry{value: s, expireAt: e.expireAt, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SAdd adds members to the set at key, creating it if needed.
+// It returns how many of them were not there already.
+func (storage *Storage) SAdd(key RetainKey, members ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	added, err := storage.sadd(string(key), members)
+	if added > 0 {
+		storage.logCommand(append([][]byte{[]byte("SADD"), key}, members...)...)
+	}
+	return added, err
+}
+
+func (storage *Storage) sadd(key string, members [][]byte) (int, error) {
+
+	s, err := storage.writableSet(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, member := range members {
+		if _, exists := s[string(member)]; !exists {
+			s[string(member)] = struct{}{}
+			added++
+		}
+	}
+
+	if added > 0 {
+		err = storage.touch(key)
+	}
+	if err == nil && len(s) == 0 {
+		// SAdd without members must not leave an empty set behind
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many were
+// there. The key goes away along with its last member.
+func (storage *Storage) SRem(key RetainKey, members ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	removed, err := storage.srem(string(key), members)
+	if removed > 0 {
+		storage.logCommand(append([][]byte{[]byte("SREM"), key}, members...)...)
+	}
+	return removed, err
+}
+
+func (storage *Storage) srem(key string, members [][]byte) (int, error) {
+
+	s, err := storage.writableSet(key, false)
+	if s == nil || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if _, exists := s[string(member)]; exists {
+			delete(s, string(member))
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		err = storage.touch(key)
+	}
+	if err == nil && len(s) == 0 {
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// SMembers returns the members of the set at key
+func (storage *Storage) SMembers(key RetainKey) ([][]byte, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	s, err := storage.readSet(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return s.members(), nil
+}
+
+// SIsMember reports whether member belongs to the set at key
+func (storage *Storage) SIsMember(key RetainKey, member []byte) (bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	s, err := storage.readSet(string(key))
+	if err != nil {
+		return false, err
+	}
+
+	_, exists := s[string(member)]
+	return exists, nil
+}
+
+// SCard returns the number of members of the set at key
+func (storage *Storage) SCard(key RetainKey) (int, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	s, err := storage.readSet(string(key))
+	return len(s), err
+}
+
+// SInter returns the members found in every one of the sets at keys,
+// a missing key counts as an empty set
+func (storage *Storage) SInter(keys ...RetainKey) ([][]byte, error) {
+
+	return storage.algebra(setIntersection, keys)
+}
+
+// SUnion returns the members found in any of the sets at keys
+func (storage *Storage) SUnion(keys ...RetainKey) ([][]byte, error) {
+
+	return storage.algebra(setUnion, keys)
+}
+
+// SDiff returns the members of the first set at keys that are
+// in none of the others
+func (storage *Storage) SDiff(keys ...RetainKey) ([][]byte, error) {
+
+	return storage.algebra(setDifference, keys)
+}
+
+func (storage *Storage) algebra(operation int, keys []RetainKey) ([][]byte, error) {
+
+	unlock := storage.rlock(keys...)
+	defer unlock()
+
+	result, err := storage.combine(operation, keys)
+	if err != nil {
+		return nil, err
+	}
+	return result.members(), nil
+}
+
+// SInterStore is SInter storing its result at destination, which is
+// replaced as a whole. It returns the size of the result.
+func (storage *Storage) SInterStore(destination RetainKey, keys ...RetainKey) (int, error) {
+
+	return storage.algebraStore(setIntersection, destination, keys)
+}
+
+// SUnionStore is SUnion storing its result at destination
+func (storage *Storage) SUnionStore(destination RetainKey, keys ...RetainKey) (int, error) {
+
+	return storage.algebraStore(setUnion, destination, keys)
+}
+
+// SDiffStore is SDiff storing its result at destination
+func (storage *Storage) SDiffStore(destination RetainKey, keys ...RetainKey) (int, error) {
+
+	return storage.algebraStore(setDifference, destination, keys)
+}
+
+// algebraStore computes and stores the result with every key locked,
+// so that no other change can land between reading and writing
+func (storage *Storage) algebraStore(operation int, destination RetainKey, keys []RetainKey) (int, error) {
+
+	unlock := storage.lock(append([]RetainKey{destination}, keys...)...)
+	defer unlock()
+
+	result, err := storage.combine(operation, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	key := string(destination)
+	if len(result) == 0 {
+		_, ok, err := storage.loadLocked(key)
+		if ok && err == nil {
+			err = storage.remove(key)
+			if err == nil {
+				storage.logCommand([]byte("DEL"), destination)
+			}
+		}
+		return 0, err
+	}
+
+	e := &entry{value: result, generation: storage.generation}
+	err = storage.store(key, e)
+	if err != nil {
+		return 0, err
+	}
+	storage.logEntry(key, e)
+	return len(result), nil
+}
+
+// combine applies operation to the sets at keys and returns a new set,
+// the caller must hold their locks
+func (storage *Storage) combine(operation int, keys []RetainKey) (set, error) {
+
+	sets := make([]set, 0, len(keys))
+	for _, key := range keys {
+		s, err := storage.readSet(string(key))
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, s)
+	}
+
+	result := make(set)
+	if len(sets) == 0 {
+		return result, nil
+	}
+
+	switch operation {
+
+	case setIntersection:
+		for member := range sets[0] {
+			found := true
+			for _, other := range sets[1:] {
+				if _, ok := other[member]; !ok {
+					found = false
+					break
+				}
+			}
+			if found {
+				result[member] = struct{}{}
+			}
+		}
+
+	case setUnion:
+		for _, s := range sets {
+			for member := range s {
+				result[member] = struct{}{}
+			}
+		}
+
+	case setDifference:
+		for member := range sets[0] {
+			found := false
+			for _, other := range sets[1:] {
+				if _, ok := other[member]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result[member] = struct{}{}
+			}
+		}
+	}
+	return result, nil
+}
+
+// SRandMember returns random members of the set at key without removing
+// them. A positive count asks for that many distinct members, a negative
+// one for that many members which may repeat, no more than fit in a reply.
+func (storage *Storage) SRandMember(key RetainKey, count int) ([][]byte, error) {
+
+	if count < -maxRandomMembers {
+		return nil, ErrCountOutOfRange
+	}
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	s, err := storage.readSet(string(key))
+	if s == nil || err != nil {
+		return nil, err
+	}
+
+	members := s.members()
+	if count < 0 {
+		picked := make([][]byte, 0, -count)
+		for i := 0; i < -count; i++ {
+			picked = append(picked, members[randomIntn(len(members))])
+		}
+		return picked, nil
+	}
+	return pickDistinct(members, count), nil
+}
+
+// SPop removes up to count random members from the set at key and
+// returns them. It returns nil if the key does not exist.
+func (storage *Storage) SPop(key RetainKey, count int) ([][]byte, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	s, err := storage.writableSet(string(key), false)
+	if s == nil || err != nil {
+		return nil, err
+	}
+
+	popped := pickDistinct(s.members(), count)
+	if len(popped) > 0 {
+		// the log gets the members that were picked, replaying
+		// the pop itself would pick different ones
+		_, err = storage.srem(string(key), popped)
+		if err != nil {
+			return nil, err
+		}
+		storage.logCommand(append([][]byte{[]byte("SREM"), key}, popped...)...)
+	}
+	return popped, nil
+}
+
+// pickDistinct shuffles the first count members into place and returns them
+func pickDistinct(members [][]byte, count int) [][]byte {
+
+	if count > len(members) {
+		count = len(members)
+	}
+
+	for i := 0; i < count; i++ {
+		j := i + randomIntn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"log"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sorted returns members in order, sets come back in no particular one
+func sorted(members [][]byte) []string {
+
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		result = append(result, string(member))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestSetMembers(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("tags")
+
+	added, _ := mp.SAdd(key, listOf("go", "redis", "go")...)
+	if added != 2 {
+		log.Fatalf("failed SAdd, expected: 2, got: %d", added)
+	}
+
+	members, _ := mp.SMembers(key)
+	if !reflect.DeepEqual(sorted(members), []string{"go", "redis"}) {
+		log.Fatalf("failed SMembers, got: %s", members)
+	}
+
+	isMember, _ := mp.SIsMember(key, []byte("go"))
+	cardinality, _ := mp.SCard(key)
+	if !isMember || cardinality != 2 {
+		log.Fatalf("failed SIsMember or SCard, got: %v, %d", isMember, cardinality)
+	}
+
+	removed, _ := mp.SRem(key, listOf("go", "missing")...)
+	if removed != 1 {
+		log.Fatalf("failed SRem, expected: 1, got: %d", removed)
+	}
+
+	mp.SRem(key, []byte("redis"))
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete the emptied set")
+	}
+
+	mp.Set(RetainKey("string"), []byte("value"))
+	if _, err := mp.SAdd(RetainKey("string"), []byte("v")); err != ErrWrongType {
+		log.Fatalf("failed SAdd on a string, got: %v", err)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+
+	mp := &Storage{}
+	mp.SAdd(RetainKey("a"), listOf("1", "2", "3", "4")...)
+	mp.SAdd(RetainKey("b"), listOf("3", "4", "5")...)
+	mp.SAdd(RetainKey("c"), listOf("4", "6")...)
+
+	keys := []RetainKey{RetainKey("a"), RetainKey("b"), RetainKey("c")}
+	inter, _ := mp.SInter(keys...)
+	union, _ := mp.SUnion(keys...)
+	diff, _ := mp.SDiff(keys...)
+
+	if !reflect.DeepEqual(sorted(inter), []string{"4"}) {
+		log.Fatalf("failed SInter, got: %s", inter)
+	}
+	if !reflect.DeepEqual(sorted(union), []string{"1", "2", "3", "4", "5", "6"}) {
+		log.Fatalf("failed SUnion, got: %s", union)
+	}
+	if !reflect.DeepEqual(sorted(diff), []string{"1", "2"}) {
+		log.Fatalf("failed SDiff, got: %s", diff)
+	}
+
+	missing, _ := mp.SInter(RetainKey("a"), RetainKey("missing"))
+	if len(missing) != 0 {
+		log.Fatalf("failed SInter with a missing key, got: %s", missing)
+	}
+
+	size, _ := mp.SUnionStore(RetainKey("a"), RetainKey("a"), RetainKey("c"))
+	members, _ := mp.SMembers(RetainKey("a"))
+	if size != 5 || !reflect.DeepEqual(sorted(members), []string{"1", "2", "3", "4", "6"}) {
+		log.Fatalf("failed SUnionStore onto a source, got: %s", members)
+	}
+
+	size, _ = mp.SDiffStore(RetainKey("b"), RetainKey("c"), RetainKey("a"))
+	if _, ok, err := mp.Get(RetainKey("b")); err != nil || size != 0 || ok {
+		log.Fatalf("failed SDiffStore with an empty result")
+	}
+
+	mp.Set(RetainKey("string"), []byte("value"))
+	if _, err := mp.SInterStore(RetainKey("d"), RetainKey("a"), RetainKey("string")); err != ErrWrongType {
+		log.Fatalf("failed SInterStore with a string, got: %v", err)
+	}
+}
+
+func TestSetRandom(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("pool")
+	mp.SAdd(key, listOf("a", "b", "c", "d", "e")...)
+
+	picked, _ := mp.SRandMember(key, 3)
+	distinct := make(map[string]bool)
+	for _, member := range picked {
+		distinct[string(member)] = true
+	}
+	if len(picked) != 3 || len(distinct) != 3 {
+		log.Fatalf("failed SRandMember with distinct members, got: %s", picked)
+	}
+
+	picked, _ = mp.SRandMember(key, -20)
+	if len(picked) != 20 {
+		log.Fatalf("failed SRandMember with repeats, got: %d", len(picked))
+	}
+
+	// counts that could never be replied are refused before anything
+	// is allocated for them
+	for _, count := range []int{math.MinInt64, -1000000000} {
+		if _, err := mp.SRandMember(key, count); err != ErrCountOutOfRange {
+			log.Fatalf("failed SRandMember with count %d, got: %v", count, err)
+		}
+	}
+
+	popped, _ := mp.SPop(key, 2)
+	left, _ := mp.SMembers(key)
+	if len(popped) != 2 || len(left) != 3 {
+		log.Fatalf("failed SPop, popped: %s, left: %s", popped, left)
+	}
+	for _, member := range popped {
+		if isMember, _ := mp.SIsMember(key, member); isMember {
+			log.Fatalf("failed SPop, %s is still there", member)
+		}
+	}
+
+	mp.SPop(key, 10)
+	if popped, _ := mp.SPop(key, 1); popped != nil {
+		log.Fatalf("failed SPop on a missing key, got: %s", popped)
+	}
+}
+
+func TestSetPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+
+	mp, _, _ := NewWithOptions(options)
+	mp.SAdd(RetainKey("a"), listOf("1", "2", "3", "4")...)
+	mp.SAdd(RetainKey("b"), listOf("3", "4", "5")...)
+	mp.SRem(RetainKey("a"), []byte("1"))
+	mp.SPop(RetainKey("a"), 1)
+	mp.SInterStore(RetainKey("both"), RetainKey("a"), RetainKey("b"))
+	expected, _ := mp.SMembers(RetainKey("a"))
+	expectedBoth, _ := mp.SMembers(RetainKey("both"))
+
+	handleError("failed Save", mp.Save())
+	mp.Close()
+
+	for _, options := range []Options{options, {SnapshotPath: filepath.Join(dir, fileName)}} {
+		mp, _, _ = NewWithOptions(options)
+		got, _ := mp.SMembers(RetainKey("a"))
+		gotBoth, _ := mp.SMembers(RetainKey("both"))
+		mp.Close()
+
+		if !reflect.DeepEqual(sorted(got), sorted(expected)) || !reflect.DeepEqual(sorted(gotBoth), sorted(expectedBoth)) {
+			log.Fatalf("failed set persistence, expected: %s %s, got: %s %s", expected, expectedBoth, got, gotBoth)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// shardCount is how many shards the keys of a database are spread over
+const shardCount = 64
+
+// shard holds the keys of a database whose hash falls in it. Writers
+// hold mu, readers hold it shared, and it guards everything below.
+// Values that are changed in place, like lists, are only read with it
+// held too.
+type shard struct {
+	mu sync.RWMutex
+
+	// changes counts the changes made to the keys of the shard, it is
+	// only written with mu held but read without it
+	changes int64
+
+	entries map[string]*entry
+
+	// buckets lists the keys of entries by scanBucket, so that SCAN
+	// can walk the shard a few keys at a time. With a backing, entries
+	// only holds the keys it cached and the backing is walked instead.
+	buckets map[int][]string
+
+	// expires indexes the keys that have a deadline,
+	// so the sweeper does not have to visit every key
+	expires map[string]struct{}
+
+	// watched holds a version for every key clients are watching,
+	// bumped by every change to the key
+	watched map[string]*watchedKey
+
+	// blocked queues the callers waiting in a blocking pop by key
+	blocked map[string][]*waiter
+}
+
+// shardIndex returns the number of the shard key falls in, from the
+// FNV-1a hash of the key
+func shardIndex(key string) int {
+
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % shardCount)
+}
+
+// index adds key, new to the shard, to its bucket
+func (sh *shard) index(key string) {
+
+	if sh.buckets == nil {
+		sh.buckets = make(map[int][]string)
+	}
+	bucket := scanBucket(key)
+	sh.buckets[bucket] = append(sh.buckets[bucket], key)
+}
+
+// unindex takes key out of its bucket
+func (sh *shard) unindex(key string) {
+
+	bucket := scanBucket(key)
+	keys := sh.buckets[bucket]
+	for i := range keys {
+		if keys[i] == key {
+			keys[i] = keys[len(keys)-1]
+			keys = keys[:len(keys)-1]
+			break
+		}
+	}
+
+	if len(keys) == 0 {
+		delete(sh.buckets, bucket)
+	} else {
+		sh.buckets[bucket] = keys
+	}
+}
+
+// shardOf returns the shard key falls in
+func (storage *Storage) shardOf(key string) *shard {
+
+	return &storage.shards[shardIndex(key)]
+}
+
+// lock write locks the shards keys fall in and returns the function
+// that unlocks them. Shards are always locked in the order of their
+// number, so that callers locking overlapping sets of keys cannot
+// deadlock. A key may be given more than once.
+func (storage *Storage) lock(keys ...RetainKey) func() {
+
+	// most commands are about a single key
+	if len(keys) == 1 {
+		sh := storage.shardOf(string(keys[0]))
+		sh.mu.Lock()
+		return sh.mu.Unlock
+	}
+	return storage.lockShards(shardIndexes(keys), false)
+}
+
+// rlock is lock for readers
+func (storage *Storage) rlock(keys ...RetainKey) func() {
+
+	if len(keys) == 1 {
+		sh := storage.shardOf(string(keys[0]))
+		sh.mu.RLock()
+		return sh.mu.RUnlock
+	}
+	return storage.lockShards(shardIndexes(keys), true)
+}
+
+// lockEvery write locks every shard, for changes to the whole database
+func (storage *Storage) lockEvery() func() {
+
+	indexes := make([]int, shardCount)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return storage.lockShards(indexes, false)
+}
+
+// shardIndexes returns the numbers of the shards keys fall in, sorted
+// and without duplicates
+func shardIndexes(keys []RetainKey) []int {
+
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, shardIndex(string(key)))
+	}
+	sort.Ints(indexes)
+
+	unique := indexes[:0]
+	for i, index := range indexes {
+		if i == 0 || index != indexes[i-1] {
+			unique = append(unique, index)
+		}
+	}
+	return unique
+}
+
+// lockShards locks the shards numbered indexes, which must be sorted,
+// and returns the function that unlocks them
+func (storage *Storage) lockShards(indexes []int, shared bool) func() {
+
+	for _, index := range indexes {
+		if shared {
+			storage.shards[index].mu.RLock()
+		} else {
+			storage.shards[index].mu.Lock()
+		}
+	}
+
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			if shared {
+				storage.shards[indexes[i]].mu.RUnlock()
+			} else {
+				storage.shards[indexes[i]].mu.Unlock()
+			}
+		}
+	}
+}
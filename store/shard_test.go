@@ -0,0 +1,279 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardIndexes(t *testing.T) {
+
+	keys := []RetainKey{}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, RetainKey(fmt.Sprint("key", i)))
+	}
+	keys = append(keys, keys[0], keys[1])
+
+	indexes := shardIndexes(keys)
+	for i := 1; i < len(indexes); i++ {
+		if indexes[i] <= indexes[i-1] {
+			log.Fatalf("failed shardIndexes, not sorted and unique: %v", indexes)
+		}
+	}
+	if len(indexes) != shardCount {
+		log.Fatalf("failed shardIndexes, 200 keys fell in %d shards", len(indexes))
+	}
+
+	reversed := make([]RetainKey, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		reversed = append(reversed, keys[i])
+	}
+	if !reflect.DeepEqual(shardIndexes(reversed), indexes) {
+		log.Fatalf("failed shardIndexes, the order depends on the order of keys")
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+
+	mp := &Storage{}
+	accounts := []RetainKey{RetainKey("alice"), RetainKey("bob"), RetainKey("carol")}
+	for _, account := range accounts {
+		mp.Set(account, 1000)
+	}
+
+	// transfers in both directions at once neither deadlock
+	// nor lose money
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := accounts[i%3], accounts[(i+1)%3]
+			for j := 0; j < 200; j++ {
+				err := mp.UpdateKeys([]RetainKey{from, to}, func(values []RetainValue) ([]RetainValue, error) {
+					return []RetainValue{values[0].(int) - 1, values[1].(int) + 1}, nil
+				})
+				handleError("failed UpdateKeys", err)
+			}
+		}(i)
+	}
+
+	// and nobody sees a transfer half done
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			values, err := mp.MGet(accounts...)
+			handleError("failed MGet", err)
+			total := 0
+			for _, value := range values {
+				total += value.(int)
+			}
+			if total != 3000 {
+				log.Fatalf("failed MGet, saw a total of %d", total)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-stopped
+
+	values, err := mp.MGet(accounts...)
+	handleError("failed MGet", err)
+	if values[0].(int)+values[1].(int)+values[2].(int) != 3000 {
+		log.Fatalf("failed UpdateKeys, got: %v", values)
+	}
+
+	// a nil value deletes, a missing key reads as nil
+	err = mp.UpdateKeys([]RetainKey{RetainKey("alice"), RetainKey("dave")}, func(values []RetainValue) ([]RetainValue, error) {
+		if values[1] != nil {
+			log.Fatalf("failed UpdateKeys, a missing key was not nil")
+		}
+		return []RetainValue{nil, values[0]}, nil
+	})
+	handleError("failed UpdateKeys", err)
+	if existing(mp, RetainKey("alice")) != 0 || existing(mp, RetainKey("dave")) != 1 {
+		log.Fatalf("failed UpdateKeys, alice should have moved to dave")
+	}
+
+	if mp.UpdateKeys(accounts, func([]RetainValue) ([]RetainValue, error) { return nil, nil }) == nil {
+		log.Fatalf("failed UpdateKeys, accepted too few values")
+	}
+}
+
+func TestMSet(t *testing.T) {
+
+	mp := &Storage{}
+	handleError("failed MSet", mp.MSet([]byte("a"), []byte("1"), []byte("b"), []byte("2"), []byte("a"), []byte("3")))
+
+	values, err := mp.MGet(RetainKey("a"), RetainKey("b"), RetainKey("c"))
+	handleError("failed MGet", err)
+	if string(values[0].([]byte)) != "3" || string(values[1].([]byte)) != "2" || values[2] != nil {
+		log.Fatalf("failed MSet, got: %v", values)
+	}
+
+	if mp.MSet([]byte("a")) == nil {
+		log.Fatalf("failed MSet, accepted a key without a value")
+	}
+}
+
+// syncMapStorage stands in for the engine the shards replaced: one
+// sync.Map for every key, with writers serialized by a single lock and
+// readers going straight to the map. It keeps the same books about
+// every key as Storage, so that only the layout differs.
+type syncMapStorage struct {
+	internal sync.Map
+	mu       sync.Mutex
+	dirty    int64
+	used     int64
+}
+
+func (storage *syncMapStorage) Get(key RetainKey) (interface{}, bool, error) {
+
+	value, ok := storage.internal.Load(string(key))
+	now := toMillis(time.Now())
+	if !ok || value.(*entry).expired(now) {
+		return nil, false, nil
+	}
+
+	value.(*entry).use(now, false)
+	return value.(*entry).value, true, nil
+}
+
+func (storage *syncMapStorage) Set(key RetainKey, value RetainValue) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.store(string(key), &entry{value: value})
+	return nil
+}
+
+func (storage *syncMapStorage) Update(key RetainKey, update func(value RetainValue, exists bool) (RetainValue, error)) (RetainValue, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var current RetainValue
+	value, exists := storage.internal.Load(string(key))
+	if exists {
+		current = value.(*entry).value
+	}
+
+	next, err := update(current, exists)
+	if err != nil {
+		return nil, err
+	}
+	storage.store(string(key), &entry{value: next})
+	return next, nil
+}
+
+func (storage *syncMapStorage) store(key string, e *entry) {
+
+	atomic.AddInt64(&storage.dirty, 1)
+	atomic.StoreInt64(&e.accessed, toMillis(time.Now()))
+
+	size := sizeOf(key, e.value)
+	atomic.StoreInt64(&e.size, size)
+	if old, ok := storage.internal.Load(key); ok {
+		size -= atomic.LoadInt64(&old.(*entry).size)
+	}
+	atomic.AddInt64(&storage.used, size)
+	storage.internal.Store(key, e)
+}
+
+// engine is what the benchmarks need from both implementations
+type engine interface {
+	Get(key RetainKey) (interface{}, bool, error)
+	Set(key RetainKey, value RetainValue) error
+	Update(key RetainKey, update func(value RetainValue, exists bool) (RetainValue, error)) (RetainValue, error)
+}
+
+const benchmarkKeys = 10000
+
+func benchmarkKey(i int) RetainKey {
+
+	return RetainKey("key:" + strconv.Itoa(i%benchmarkKeys))
+}
+
+// benchmarkEngines runs the same mix of reads and writes in parallel
+// against both implementations, writes out of every 100 operations are
+// writes. Half of them set keys, the other half increment a few
+// counters. The shards only pay off with several CPUs to run on.
+func benchmarkEngines(b *testing.B, writes int) {
+
+	engines := []struct {
+		name   string
+		engine func() engine
+	}{
+		{"sharded", func() engine { return &Storage{} }},
+		{"syncmap", func() engine { return &syncMapStorage{} }},
+	}
+
+	value := []byte("value")
+	increment := func(current RetainValue, exists bool) (RetainValue, error) {
+		if !exists {
+			return 1, nil
+		}
+		return current.(int) + 1, nil
+	}
+
+	for _, candidate := range engines {
+		b.Run(candidate.name, func(b *testing.B) {
+			storage := candidate.engine()
+			for i := 0; i < benchmarkKeys; i++ {
+				storage.Set(benchmarkKey(i), value)
+			}
+
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&next, 1)) * 7919
+				for pb.Next() {
+					i++
+					key := benchmarkKey(i)
+					switch {
+					case i%100 >= writes:
+						storage.Get(key)
+					case i%2 == 0:
+						storage.Set(key, value)
+					default:
+						storage.Update(RetainKey("counter:"+strconv.Itoa(i%64)), increment)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReadOnly(b *testing.B) {
+
+	benchmarkEngines(b, 0)
+}
+
+func BenchmarkReadHeavy(b *testing.B) {
+
+	benchmarkEngines(b, 10)
+}
+
+func BenchmarkBalanced(b *testing.B) {
+
+	benchmarkEngines(b, 50)
+}
+
+func BenchmarkWriteOnly(b *testing.B) {
+
+	benchmarkEngines(b, 100)
+}
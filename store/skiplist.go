@@ -0,0 +1,218 @@
+package store
+
+// skiplist keeps the members of a sorted set ordered by score, then by
+// member for equal scores. Every link also records how many nodes it
+// skips over (its span), which is what makes finding the rank of a node
+// or the node at a rank O(log n), as in the skiplist of Redis.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	levels   []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+const (
+	skiplistMaxLevel = 32
+
+	// a node makes it to the next level with a chance of 1 in 4
+	skiplistBranching = 4
+)
+
+func newSkiplist() *skiplist {
+
+	return &skiplist{
+		header: &skiplistNode{levels: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+
+	level := 1
+	for level < skiplistMaxLevel && randomIntn(skiplistBranching) == 0 {
+		level++
+	}
+	return level
+}
+
+// before reports whether node sorts before score and member
+func (node *skiplistNode) before(score float64, member string) bool {
+
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// insert adds member, which must not be in the list already
+func (sl *skiplist) insert(score float64, member string) *skiplistNode {
+
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].levels[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = x
+
+		// the new node takes over the part of the span past itself
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// the levels above the new node now skip one more node
+	for i := level; i < sl.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// delete removes member, found at score. It reports whether it was there.
+func (sl *skiplist) delete(score float64, member string) bool {
+
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+
+	for sl.level > 1 && sl.header.levels[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// first returns the node with the lowest score, or nil
+func (sl *skiplist) first() *skiplistNode {
+
+	return sl.header.levels[0].forward
+}
+
+// rank returns the 1-based position of member, 0 if it is not there
+func (sl *skiplist) rank(score float64, member string) int {
+
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && (x.levels[i].forward.before(score, member) || x.levels[i].forward.member == member) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != sl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1-based position rank, or nil
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank && x != sl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstAbove returns the first node for which below is false. below
+// has to be true for a prefix of the list and false for the rest.
+func (sl *skiplist) firstAbove(below func(node *skiplistNode) bool) *skiplistNode {
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && below(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	return x.levels[0].forward
+}
+
+// lastWithin returns the last node for which within is true, or nil.
+// within has to be true for a prefix of the list and false for the rest.
+func (sl *skiplist) lastWithin(within func(node *skiplistNode) bool) *skiplistNode {
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && within(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == sl.header {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot file is laid out as follows, integers are big endian
+// unless noted otherwise:
+//
+//	magic      8 bytes, "RETAINDB"
+//	version    uint16
+//	created    int64, unix time in milliseconds
+//	key count  uint64, over all databases
+//	records    key count times:
+//	             database (uvarint)
+//	             key length (uvarint), key
+//	             deadline (uvarint, unix milliseconds, 0 for none)
+//	             value length (uvarint), value as written by encodeValue
+//	checksum   uint32, CRC-32 (Castagnoli) of everything before it
+//
+// New kinds of values only need a new tag in encodeValue. The version
+// is bumped when the layout itself changes, and readers keep the code
+// for every version they have ever written. Version 1 had no database
+// in its records, they all belong to database 0.
+const (
+	snapshotMagic   = "RETAINDB"
+	snapshotVersion = 2
+
+	snapshotHeaderLength = len(snapshotMagic) + 2 + 8 + 8
+	checksumLength       = 4
+
+	// maxSnapshotDatabase caps the database numbers a reader accepts,
+	// so that a bad one cannot make it allocate room for billions
+	maxSnapshotDatabase = 1 << 16
+)
+
+var (
+	ErrCorruptSnapshot     = errors.New("corrupt snapshot")
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot version")
+	ErrSaveInProgress      = errors.New("a save is already in progress")
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotHeader is the metadata found at the start of a snapshot
+type snapshotHeader struct {
+	version  uint16
+	created  time.Time
+	keyCount uint64
+}
+
+// writeSnapshot writes the databases in snapshot, indexed by number, to
+// path. The data goes to a temporary file that replaces path only once it
+// is completely on disk, so a crash at any point leaves either the old or
+// the new snapshot behind.
+func writeSnapshot(path string, snapshot []map[string]*entry) error {
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	err = encodeSnapshot(file, snapshot)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	syncDirectory(filepath.Dir(path))
+	return nil
+}
+
+func encodeSnapshot(w io.Writer, snapshot []map[string]*entry) error {
+
+	// drop what has expired first, the header needs the exact count
+	now := toMillis(time.Now())
+	count := 0
+	for _, entries := range snapshot {
+		for key, e := range entries {
+			if e.expired(now) {
+				delete(entries, key)
+			}
+		}
+		count += len(entries)
+	}
+
+	checksum := crc32.New(checksumTable)
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	header := make([]byte, 0, snapshotHeaderLength)
+	header = append(header, snapshotMagic...)
+	header = appendUint16(header, snapshotVersion)
+	header = appendUint64(header, uint64(now))
+	header = appendUint64(header, uint64(count))
+	_, err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 0, 64)
+	for index, entries := range snapshot {
+		for key, e := range entries {
+			value, err := encodeValue(e.value)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+
+			record = record[:0]
+			record = appendUvarint(record, uint64(index))
+			record = appendBytes(record, []byte(key))
+			record = appendUvarint(record, uint64(e.expireAt))
+			record = appendBytes(record, value)
+
+			_, err = writer.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(appendUint32(nil, checksum.Sum32()))
+	return err
+}
+
+// readSnapshot parses the content of a snapshot file into its databases,
+// indexed by number. Files from before the versioned format, which hold
+// a gob encoded map, are also accepted.
+func readSnapshot(content []byte) ([]map[string]*entry, error) {
+
+	if !bytes.HasPrefix(content, []byte(snapshotMagic)) {
+		entries, err := readLegacySnapshot(content)
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]*entry{entries}, nil
+	}
+
+	if len(content) < snapshotHeaderLength+checksumLength {
+		return nil, fmt.Errorf("%w: file is too short", ErrCorruptSnapshot)
+	}
+
+	body := content[:len(content)-checksumLength]
+	expected := binary.BigEndian.Uint32(content[len(body):])
+	if crc32.Checksum(body, checksumTable) != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	header := parseSnapshotHeader(body)
+	if header.version != 1 && header.version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSnapshot, header.version)
+	}
+
+	reader := bytes.NewReader(body[snapshotHeaderLength:])
+	snapshot := []map[string]*entry{make(map[string]*entry)}
+	for i := uint64(0); i < header.keyCount; i++ {
+		index := uint64(0)
+		if header.version > 1 {
+			var err error
+			index, err = binary.ReadUvarint(reader)
+			if err != nil || index > maxSnapshotDatabase {
+				return nil, fmt.Errorf("%w: bad database number", ErrCorruptSnapshot)
+			}
+		}
+		for uint64(len(snapshot)) <= index {
+			snapshot = append(snapshot, make(map[string]*entry))
+		}
+
+		key, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+
+		payload, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := decodeValue(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %v", ErrCorruptSnapshot, key, err)
+		}
+		snapshot[index][string(key)] = &entry{value: value, expireAt: int64(deadline)}
+	}
+
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data after %d keys", ErrCorruptSnapshot, header.keyCount)
+	}
+	return snapshot, nil
+}
+
+func parseSnapshotHeader(content []byte) snapshotHeader {
+
+	fields := content[len(snapshotMagic):]
+	return snapshotHeader{
+		version:  binary.BigEndian.Uint16(fields),
+		created:  fromMillis(int64(binary.BigEndian.Uint64(fields[2:]))),
+		keyCount: binary.BigEndian.Uint64(fields[10:]),
+	}
+}
+
+// legacySnapshot is what Save wrote before the versioned format
+type legacySnapshot struct {
+	Values  map[string]interface{}
+	Expires map[string]int64
+}
+
+func readLegacySnapshot(content []byte) (map[string]*entry, error) {
+
+	var temp legacySnapshot
+	err := gob.NewDecoder(bytes.NewReader(content)).Decode(&temp)
+	if err != nil {
+		// the very first files held a bare map
+		err = gob.NewDecoder(bytes.NewReader(content)).Decode(&temp.Values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	entries := make(map[string]*entry)
+	for key, value := range temp.Values {
+		entries[key] = &entry{value: value, expireAt: temp.Expires[key]}
+	}
+	return entries, nil
+}
+
+// syncDirectory makes a rename in dir durable, not every
+// platform supports it so errors are ignored
+func syncDirectory(dir string) {
+
+	directory, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	directory.Sync()
+	directory.Close()
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+
+	var raw [2]byte
+	binary.BigEndian.PutUint16(raw[:], value)
+	return append(buffer, raw[:]...)
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+
+	var raw [4]byte
+	binary.BigEndian.PutUint32(raw[:], value)
+	return append(buffer, raw[:]...)
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], value)
+	return append(buffer, raw[:]...)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+
+	var raw [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(raw[:], value)
+	return append(buffer, raw[:n]...)
+}
+
+// appendBytes writes data prefixed with its length
+func appendBytes(buffer []byte, data []byte) []byte {
+
+	buffer = appendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return nil, fmt.Errorf("%w: truncated record", ErrCorruptSnapshot)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
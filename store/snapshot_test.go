@@ -0,0 +1,165 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), fileName)
+	deadline := toMillis(time.Now().Add(time.Hour))
+
+	entries := map[string]*entry{
+		"bytes":   {value: []byte("value")},
+		"string":  {value: "value", expireAt: deadline},
+		"int":     {value: -7},
+		"float":   {value: 2.5},
+		"expired": {value: 1, expireAt: 1},
+	}
+
+	err := writeSnapshot(path, []map[string]*entry{entries})
+	handleError("failed writeSnapshot", err)
+
+	content, _ := os.ReadFile(path)
+	header := parseSnapshotHeader(content)
+	if header.version != snapshotVersion || header.keyCount != 4 || time.Since(header.created) > time.Minute {
+		log.Fatalf("failed snapshot header, got: %+v", header)
+	}
+
+	databases, err := readSnapshot(content)
+	if err != nil || len(databases) != 1 || len(databases[0]) != 4 {
+		log.Fatalf("failed readSnapshot, got: %v, %v", databases, err)
+	}
+
+	loaded := databases[0]
+	if string(loaded["bytes"].value.([]byte)) != "value" || loaded["string"].expireAt != deadline ||
+		loaded["int"].value != -7 || loaded["float"].value != 2.5 {
+		log.Fatalf("failed readSnapshot, values differ: %v", loaded)
+	}
+
+	// nothing but the snapshot is left in the directory
+	leftovers, _ := filepath.Glob(path + ".tmp-*")
+	if len(leftovers) != 0 {
+		log.Fatalf("failed writeSnapshot, temporary files left: %v", leftovers)
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), fileName)
+	err := writeSnapshot(path, []map[string]*entry{{"key": {value: []byte("value")}}})
+	handleError("failed writeSnapshot", err)
+	content, _ := os.ReadFile(path)
+
+	flipped := append([]byte{}, content...)
+	flipped[len(flipped)-8] ^= 0xff
+
+	tampered := append([]byte{}, content...)
+	tampered[len(snapshotMagic)+1] = 99
+
+	testCases := []struct {
+		name    string
+		content []byte
+		err     error
+	}{
+		{"flipped byte", flipped, ErrCorruptSnapshot},
+		{"truncated", content[:len(content)-3], ErrCorruptSnapshot},
+		{"garbage", []byte("not a snapshot"), ErrCorruptSnapshot},
+		{"tampered version", tampered, ErrCorruptSnapshot},
+	}
+
+	for _, testCase := range testCases {
+
+		handleError("failed to write test file", os.WriteFile(path, testCase.content, 0644))
+
+		mp := &Storage{}
+		loaded, err := mp.LoadFromDisk(path)
+		if loaded || !errors.Is(err, testCase.err) {
+			log.Fatalf("failed to refuse %s snapshot, got: %v", testCase.name, err)
+		}
+	}
+}
+
+func TestSnapshotVersionCheck(t *testing.T) {
+
+	// a file from a future version with a valid checksum
+	header := []byte(snapshotMagic)
+	header = appendUint16(header, snapshotVersion+1)
+	header = appendUint64(header, 0)
+	header = appendUint64(header, 0)
+	content := appendUint32(header, crc32.Checksum(header, checksumTable))
+
+	_, err := readSnapshot(content)
+	if !errors.Is(err, ErrUnsupportedSnapshot) {
+		log.Fatalf("failed to refuse newer version, got: %v", err)
+	}
+}
+
+func TestLegacySnapshot(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), fileName)
+	file, _ := os.Create(path)
+	err := gob.NewEncoder(file).Encode(map[string]interface{}{"old": "value"})
+	file.Close()
+	handleError("failed to write legacy file", err)
+
+	mp := &Storage{}
+	loaded, err := mp.LoadFromDisk(path)
+	handleError("failed to load legacy snapshot", err)
+	if v, ok, err := mp.Get(RetainKey("old")); !loaded || err != nil || !ok || v != "value" {
+		log.Fatalf("failed to load legacy snapshot, got: %v, %v", v, err)
+	}
+}
+
+func TestBackgroundSave(t *testing.T) {
+
+	options := DefaultOptions()
+	options.SnapshotPath = filepath.Join(t.TempDir(), fileName)
+
+	mp, _, err := NewWithOptions(options)
+	handleError("failed NewWithOptions", err)
+	defer mp.Close()
+
+	mp.Set(RetainKey("a"), 1)
+	mp.Set(RetainKey("b"), 2)
+	if mp.Dirty() != 2 {
+		log.Fatalf("failed dirty count, expected: 2, got: %d", mp.Dirty())
+	}
+
+	before := mp.LastSave()
+	time.Sleep(1100 * time.Millisecond)
+
+	err = mp.BackgroundSave()
+	handleError("failed BackgroundSave", err)
+
+	// a write after the copy was taken stays dirty
+	mp.Set(RetainKey("c"), 3)
+
+	for atomic.LoadInt32(&mp.saving) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if mp.Dirty() != 1 || !mp.LastSave().After(before) {
+		log.Fatalf("failed background save bookkeeping, dirty: %d, last save: %v", mp.Dirty(), mp.LastSave())
+	}
+
+	content, _ := os.ReadFile(options.SnapshotPath)
+	databases, err := readSnapshot(content)
+	if err != nil || len(databases[0]) != 2 || databases[0]["c"] != nil {
+		log.Fatalf("failed point-in-time snapshot, got: %v, %v", databases, err)
+	}
+
+	atomic.StoreInt32(&mp.saving, 1)
+	if mp.Save() != ErrSaveInProgress || mp.BackgroundSave() != ErrSaveInProgress {
+		log.Fatalf("failed to refuse concurrent saves")
+	}
+	atomic.StoreInt32(&mp.saving, 0)
+}
@@ -0,0 +1,486 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// A table file holds records sorted by key and is never changed once
+// written. It is laid out as follows, integers are big endian unless
+// noted otherwise:
+//
+//	data blocks   one after the other, each a run of records followed
+//	              by the CRC-32 (Castagnoli) of the run. A record is:
+//	                key length (uvarint), key
+//	                kind (byte, 0 for a value, 1 for a deletion)
+//	                deadline (uvarint, unix milliseconds, 0 for none)
+//	                value length (uvarint), value
+//	index         smallest key (length prefixed), then for every block:
+//	                largest key (length prefixed)
+//	                offset (uvarint), length (uvarint, without the CRC)
+//	bloom filter  see bloomFilter
+//	footer        offset and length of the index and of the filter and
+//	              record count, all uint64
+//	              checksum uint32, CRC-32 of the index and the filter
+//	              magic 8 bytes, "RETAINST"
+//
+// The index and the filter are kept in memory while the table is open,
+// so a lookup reads at most one block.
+const (
+	tableMagic        = "RETAINST"
+	tableFooterLength = 5*8 + 4 + len(tableMagic)
+
+	recordValue    byte = 0
+	recordDeletion byte = 1
+)
+
+var ErrCorruptTable = errors.New("corrupt table")
+
+// record is what the tree holds for a key: a value and its deadline,
+// or the deletion of the key
+type record struct {
+	value    []byte
+	expireAt int64
+	deleted  bool
+}
+
+// appendRecord encodes key and rec as they are laid out in blocks
+// and in the write-ahead log
+func appendRecord(buffer []byte, key []byte, rec record) []byte {
+
+	buffer = appendBytes(buffer, key)
+	if rec.deleted {
+		buffer = append(buffer, recordDeletion)
+	} else {
+		buffer = append(buffer, recordValue)
+	}
+	buffer = appendUvarint(buffer, uint64(rec.expireAt))
+	return appendBytes(buffer, rec.value)
+}
+
+// readRecord decodes what appendRecord wrote at the start of data and
+// returns the rest of it
+func readRecord(data []byte) ([]byte, record, []byte, error) {
+
+	key, data, ok := cutBytes(data)
+	if !ok || len(data) == 0 {
+		return nil, record{}, nil, ErrCorruptTable
+	}
+
+	rec := record{deleted: data[0] == recordDeletion}
+	deadline, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, record{}, nil, ErrCorruptTable
+	}
+	rec.expireAt = int64(deadline)
+
+	rec.value, data, ok = cutBytes(data[1+n:])
+	if !ok {
+		return nil, record{}, nil, ErrCorruptTable
+	}
+	return key, rec, data, nil
+}
+
+// cutBytes splits a length prefixed slice off the start of data,
+// the slice shares the memory of data
+func cutBytes(data []byte) ([]byte, []byte, bool) {
+
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, false
+	}
+	end := n + int(length)
+	return data[n:end:end], data[end:], true
+}
+
+// tableWriter writes a table from records added in key order
+type tableWriter struct {
+	file      *os.File
+	writer    *bufio.Writer
+	blockSize int
+
+	offset   uint64
+	block    []byte
+	lastKey  []byte
+	smallest []byte
+	index    []byte
+	keys     [][]byte
+	count    uint64
+}
+
+func createTable(path string, blockSize int) (*tableWriter, error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{file: file, writer: bufio.NewWriter(file), blockSize: blockSize}, nil
+}
+
+// add appends a record, key has to sort after the previous one
+func (w *tableWriter) add(key []byte, rec record) error {
+
+	if w.count == 0 {
+		w.smallest = append([]byte{}, key...)
+	}
+	w.block = appendRecord(w.block, key, rec)
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.keys = append(w.keys, append([]byte{}, key...))
+	w.count++
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size returns roughly how many bytes the table takes so far
+func (w *tableWriter) size() uint64 {
+
+	return w.offset + uint64(len(w.block))
+}
+
+func (w *tableWriter) flushBlock() error {
+
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	w.index = appendBytes(w.index, w.lastKey)
+	w.index = appendUvarint(w.index, w.offset)
+	w.index = appendUvarint(w.index, uint64(len(w.block)))
+
+	block := appendUint32(w.block, crc32.Checksum(w.block, checksumTable))
+	if _, err := w.writer.Write(block); err != nil {
+		return err
+	}
+	w.offset += uint64(len(block))
+	w.block = w.block[:0]
+	return nil
+}
+
+// finish writes what is left, the index, the filter and the footer and
+// makes the table durable
+func (w *tableWriter) finish() error {
+
+	err := w.flushBlock()
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	index := append(appendBytes(nil, w.smallest), w.index...)
+	filter := newBloomFilter(w.keys)
+
+	footer := appendUint64(nil, w.offset)
+	footer = appendUint64(footer, uint64(len(index)))
+	footer = appendUint64(footer, w.offset+uint64(len(index)))
+	footer = appendUint64(footer, uint64(len(filter)))
+	footer = appendUint64(footer, w.count)
+	checksum := crc32.Update(crc32.Checksum(index, checksumTable), checksumTable, filter)
+	footer = appendUint32(footer, checksum)
+	footer = append(footer, tableMagic...)
+
+	for _, part := range [][]byte{index, filter, footer} {
+		if _, err = w.writer.Write(part); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	err = w.writer.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return err
+}
+
+// abort gives up on the table and removes what was written of it
+func (w *tableWriter) abort() {
+
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// table is an open table file
+type table struct {
+	number uint64
+	path   string
+	file   *os.File
+	size   int64
+	count  uint64
+
+	smallest []byte
+	largest  []byte
+	blocks   []blockHandle
+	filter   bloomFilter
+
+	// refs counts the users of the table, the version of the tree it
+	// belongs to being one. The file is closed when the last one is
+	// done with it and removed too if obsolete is set by then.
+	refs     int32
+	obsolete int32
+}
+
+// blockHandle says where a block is and the largest key in it
+type blockHandle struct {
+	largest []byte
+	offset  uint64
+	length  uint64
+}
+
+func openTable(path string, number uint64) (*table, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := readTable(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.number, t.path, t.refs = number, path, 1
+	return t, nil
+}
+
+func readTable(file *os.File) (*table, error) {
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(tableFooterLength) {
+		return nil, ErrCorruptTable
+	}
+
+	footer := make([]byte, tableFooterLength)
+	if _, err := file.ReadAt(footer, info.Size()-int64(tableFooterLength)); err != nil {
+		return nil, err
+	}
+	if string(footer[tableFooterLength-len(tableMagic):]) != tableMagic {
+		return nil, ErrCorruptTable
+	}
+
+	field := func(i int) uint64 {
+		return binary.BigEndian.Uint64(footer[i*8:])
+	}
+	indexOffset, indexLength, filterOffset, filterLength := field(0), field(1), field(2), field(3)
+	end := uint64(info.Size()) - uint64(tableFooterLength)
+	if indexOffset+indexLength != filterOffset || filterOffset+filterLength != end {
+		return nil, ErrCorruptTable
+	}
+
+	metadata := make([]byte, indexLength+filterLength)
+	if _, err := file.ReadAt(metadata, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(metadata, checksumTable) != binary.BigEndian.Uint32(footer[5*8:]) {
+		return nil, ErrCorruptTable
+	}
+
+	t := &table{file: file, size: info.Size(), count: field(4), filter: bloomFilter(metadata[indexLength:])}
+	index := metadata[:indexLength]
+	smallest, index, ok := cutBytes(index)
+	if !ok {
+		return nil, ErrCorruptTable
+	}
+	t.smallest = smallest
+
+	for len(index) > 0 {
+		var handle blockHandle
+		var n int
+		handle.largest, index, ok = cutBytes(index)
+		if !ok {
+			return nil, ErrCorruptTable
+		}
+		if handle.offset, n = binary.Uvarint(index); n <= 0 {
+			return nil, ErrCorruptTable
+		}
+		index = index[n:]
+		if handle.length, n = binary.Uvarint(index); n <= 0 || handle.offset+handle.length+4 > indexOffset {
+			return nil, ErrCorruptTable
+		}
+		index = index[n:]
+		t.blocks = append(t.blocks, handle)
+	}
+
+	if len(t.blocks) > 0 {
+		t.largest = t.blocks[len(t.blocks)-1].largest
+	}
+	return t, nil
+}
+
+func (t *table) ref() {
+
+	atomic.AddInt32(&t.refs, 1)
+}
+
+func (t *table) unref() {
+
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+	t.file.Close()
+	if atomic.LoadInt32(&t.obsolete) == 1 {
+		os.Remove(t.path)
+	}
+}
+
+// retire takes t out of the tree, its file is removed once the last
+// user is done with it
+func (t *table) retire() {
+
+	atomic.StoreInt32(&t.obsolete, 1)
+	t.unref()
+}
+
+// overlaps reports whether the table may hold keys from smallest to
+// largest, both included
+func (t *table) overlaps(smallest []byte, largest []byte) bool {
+
+	return bytes.Compare(t.smallest, largest) <= 0 && bytes.Compare(t.largest, smallest) >= 0
+}
+
+// readBlock reads and checks the block numbered i
+func (t *table) readBlock(i int) ([][]byte, []record, error) {
+
+	handle := t.blocks[i]
+	data := make([]byte, handle.length+4)
+	if _, err := t.file.ReadAt(data, int64(handle.offset)); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	content := data[:handle.length]
+	if crc32.Checksum(content, checksumTable) != binary.BigEndian.Uint32(data[handle.length:]) {
+		return nil, nil, fmt.Errorf("%s: %w: block %d", t.path, ErrCorruptTable, i)
+	}
+
+	keys, records := make([][]byte, 0), make([]record, 0)
+	for len(content) > 0 {
+		key, rec, rest, err := readRecord(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w: block %d", t.path, err, i)
+		}
+		keys, records, content = append(keys, key), append(records, rec), rest
+	}
+	return keys, records, nil
+}
+
+// findBlock returns the number of the first block that may hold keys
+// from key onwards, len(t.blocks) if there is none
+func (t *table) findBlock(key []byte) int {
+
+	return sort.Search(len(t.blocks), func(i int) bool {
+		return bytes.Compare(t.blocks[i].largest, key) >= 0
+	})
+}
+
+// get returns the record of key and whether the table has one
+func (t *table) get(key []byte) (record, bool, error) {
+
+	if !t.filter.mayContain(key) {
+		return record{}, false, nil
+	}
+
+	i := t.findBlock(key)
+	if i == len(t.blocks) {
+		return record{}, false, nil
+	}
+
+	keys, records, err := t.readBlock(i)
+	if err != nil {
+		return record{}, false, err
+	}
+	j := sort.Search(len(keys), func(j int) bool {
+		return bytes.Compare(keys[j], key) >= 0
+	})
+	if j < len(keys) && bytes.Equal(keys[j], key) {
+		return records[j], true, nil
+	}
+	return record{}, false, nil
+}
+
+// recordIterator goes over records in key order. Once it is not valid
+// anymore, err says whether it ran out or failed.
+type recordIterator interface {
+	valid() bool
+	key() []byte
+	record() record
+	next()
+	err() error
+}
+
+// tableIterator goes over the records of a table a block at a time
+type tableIterator struct {
+	table    *table
+	block    int
+	keys     [][]byte
+	records  []record
+	position int
+	failure  error
+}
+
+// iterator returns an iterator over the records of t from start on
+func (t *table) iterator(start []byte) *tableIterator {
+
+	it := &tableIterator{table: t, block: t.findBlock(start) - 1}
+	it.load()
+	for it.valid() && bytes.Compare(it.key(), start) < 0 {
+		it.next()
+	}
+	return it
+}
+
+// load moves to the start of the next block that has records
+func (it *tableIterator) load() {
+
+	it.keys, it.records, it.position = nil, nil, 0
+	for it.failure == nil && len(it.keys) == 0 && it.block+1 < len(it.table.blocks) {
+		it.block++
+		it.keys, it.records, it.failure = it.table.readBlock(it.block)
+	}
+}
+
+func (it *tableIterator) valid() bool {
+
+	return it.failure == nil && it.position < len(it.keys)
+}
+
+func (it *tableIterator) key() []byte {
+
+	return it.keys[it.position]
+}
+
+func (it *tableIterator) record() record {
+
+	return it.records[it.position]
+}
+
+func (it *tableIterator) next() {
+
+	it.position++
+	if it.position == len(it.keys) {
+		it.load()
+	}
+}
+
+func (it *tableIterator) err() error {
+
+	return it.failure
+}
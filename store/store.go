@@ -1,103 +1,1103 @@
 package store
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const fileName = "retain.db"
 
+// how often the background sweeper looks for expired keys
+// and for how long it may hold the write lock each time
+const (
+	sweepInterval = 100 * time.Millisecond
+	sweepBudget   = 25 * time.Millisecond
+)
+
+// Storage is one of the numbered databases of an instance. The one New
+// returns is database 0, the others are reached through DB.
 type Storage struct {
-	internal sync.Map
+	// keys are spread over shards by hash, each with its own lock, so
+	// that writers of different keys do not wait for each other
+	shards [shardCount]shard
+
+	// generation is bumped every time a point-in-time copy of the data
+	// set is taken. A value changed in place is cloned first unless it
+	// was created in the current generation, so the copy never changes.
+	// It is only written with every shard locked.
+	generation uint64
+
+	// aof is nil unless the append only file is enabled
+	aof          *appendOnlyFile
+	snapshotPath string
+
+	// backing keeps the entries that are not in the shards, nil when
+	// the shards hold all of them, see backed
+	backing backing
+
+	// index is the number of the database, it only changes
+	// with every shard locked by a swap
+	index int
+
+	// root is the Storage New returned, nil for the root itself. The
+	// root holds what the databases of an instance share: the list of
+	// databases, the counters below and the sweeper. layout guards the
+	// list, which is only set if there is more than one database.
+	root      *Storage
+	layout    sync.RWMutex
+	databases []*Storage
+
+	// used is roughly how many bytes the keys of every database take,
+	// maxMemory the limit FreeMemory keeps it under as policy says, 0
+	// for none, and evicted counts the keys it evicted
+	used      int64
+	maxMemory int64
+	policy    EvictionPolicy
+	evicted   int64
+
+	// saved is how many changes had been made to the instance as of
+	// the last successful save, see changes
+	saved int64
+
+	// saving is 1 while a snapshot is being written, lastSave
+	// holds the unix time in seconds of the last successful one
+	saving   int32
+	lastSave int64
+
+	// batches counts the batches in progress, see BeginBatch
+	batches int32
+
+	stopSweeper    chan struct{}
+	sweeperStopped chan struct{}
+	closeOnce      sync.Once
+}
+
+// backing is what keeps the entries of a Storage out of memory, the
+// shards only caching those it reads. It is told about every change
+// once the shards have it, with the lock of the key held.
+type backing interface {
+	// read returns the entry at key, expired or not, if it is not
+	// in the shards
+	read(key string) (*entry, bool, error)
+
+	// write and erase record that key was set to e or deleted.
+	// existing is set when the shards already held key, which
+	// erase can always count on.
+	write(key string, e *entry, existing bool) error
+	erase(key string) error
+
+	// trim drops cached entries of sh, the caller must hold its lock
+	trim(sh *shard)
+
+	// expire deletes some of the keys whose deadline has passed, it
+	// is called by the sweeper, which only sees the keys in the shards
+	expire() error
+}
+
+// inMemory is the backing of a Storage whose shards hold every entry
+type inMemory struct{}
+
+func (inMemory) read(key string) (*entry, bool, error) {
+
+	return nil, false, nil
+}
+
+func (inMemory) write(key string, e *entry, existing bool) error {
+
+	return nil
+}
+
+func (inMemory) erase(key string) error {
+
+	return nil
+}
+
+func (inMemory) trim(sh *shard) {}
+
+func (inMemory) expire() error {
+
+	return nil
+}
+
+// backed returns the backing of storage, the shards themselves unless
+// another engine keeps the entries
+func (storage *Storage) backed() backing {
+
+	if storage.backing == nil {
+		return inMemory{}
+	}
+	return storage.backing
+}
+
+// Options configures a Storage created with NewWithOptions
+type Options struct {
+	// Engine names the engine Open creates, see Engines.
+	// NewWithOptions always creates a Storage.
+	Engine string
+
+	// SnapshotPath is where Save writes the data set and
+	// where it is loaded from at startup
+	SnapshotPath string
+
+	// AppendOnly logs every change to AppendOnlyPath, flushed to disk
+	// as often as AppendFsync says. At startup the data set is rebuilt
+	// from this log instead of the snapshot.
+	AppendOnly     bool
+	AppendOnlyPath string
+	AppendFsync    FsyncPolicy
+
+	// Databases is the number of databases, numbered from 0.
+	// Leaving it out gives a single one.
+	Databases int
+
+	// MaxMemory is roughly how many bytes the keys may take, 0 for no
+	// limit, see FreeMemory. MaxMemoryPolicy picks what to evict.
+	MaxMemory       int64
+	MaxMemoryPolicy EvictionPolicy
+
+	// LSMPath is the directory the lsm engine keeps its files in
+	LSMPath string
+}
+
+// DefaultOptions returns the options used by New
+func DefaultOptions() Options {
+
+	return Options{
+		SnapshotPath:   fileName,
+		AppendOnlyPath: "appendonly.aof",
+		AppendFsync:    FsyncEverySec,
+		Databases:      16,
+		LSMPath:        "retain.lsm",
+	}
 }
 
 type RetainKey []byte
 type RetainValue interface{}
 
+// entry is what the internal map holds for every key
+type entry struct {
+	// size is roughly how many bytes the key takes. accessed is the unix
+	// time in milliseconds the key was last used at and hits how often
+	// it is used, see use. They are only accessed atomically.
+	size     int64
+	accessed int64
+	hits     int64
+
+	value RetainValue
+
+	// unix time in milliseconds after which the key is gone, 0 means never
+	expireAt int64
+
+	// generation the value was created in, only meaningful
+	// for values that are changed in place
+	generation uint64
+}
+
+func (e *entry) expired(now int64) bool {
+
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+// SetOptions changes the behaviour of SetWithOptions
+type SetOptions struct {
+	// ExpireAt gives the key a deadline, the zero value means none
+	ExpireAt time.Time
+
+	// KeepTTL retains the deadline of the key being overwritten
+	KeepTTL bool
+
+	// OnlyIfMissing and OnlyIfExists make the write conditional
+	// on the existence of the key (NX and XX)
+	OnlyIfMissing bool
+	OnlyIfExists  bool
+
+	// Get refuses to overwrite a collection, whose previous
+	// value could not be handed back as a string (SET ... GET)
+	Get bool
+}
+
 // New will return a new instance of store.Storage
 // It will have content loaded from disk if retain.db exists.
+// Expired keys are removed lazily when they are read and
+// actively by a background sweeper until Close is called.
 func New() (*Storage, bool) {
 
-	storage := Storage{
-		internal: *new(sync.Map),
+	storage, loadedFromDisk, err := NewWithOptions(DefaultOptions())
+	handleError("New: ", err)
+	return storage, loadedFromDisk
+}
+
+// NewWithOptions is like New but lets you pick where data is kept and
+// whether the append only file is used. It reports whether any data
+// was loaded from disk.
+func NewWithOptions(options Options) (*Storage, bool, error) {
+
+	storage := &Storage{
+		snapshotPath:   options.SnapshotPath,
+		maxMemory:      options.MaxMemory,
+		policy:         options.MaxMemoryPolicy,
+		stopSweeper:    make(chan struct{}),
+		sweeperStopped: make(chan struct{}),
+	}
+
+	if options.Databases > 1 {
+		storage.databases = []*Storage{storage}
+		for i := 1; i < options.Databases; i++ {
+			storage.databases = append(storage.databases, &Storage{index: i, root: storage})
+		}
+	}
+
+	if !options.AppendOnly {
+		loadedFromDisk, err := storage.LoadFromDisk(options.SnapshotPath)
+		if err != nil {
+			return nil, false, err
+		}
+
+		storage.resetDirty()
+		go storage.sweep()
+		return storage, loadedFromDisk, nil
+	}
+
+	replayed, err := storage.replayAppendOnlyFile(options.AppendOnlyPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the first time the log is enabled, start it off with the snapshot
+	loadedFromDisk := replayed
+	if !replayed {
+		loadedFromDisk, err = storage.LoadFromDisk(options.SnapshotPath)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	aof, err := openAppendOnlyFile(options.AppendOnlyPath, options.AppendFsync)
+	if err != nil {
+		return nil, false, err
+	}
+
+	databases, unlock := storage.lockAll()
+	for _, db := range databases {
+		db.aof = aof
+		if !replayed && loadedFromDisk {
+			db.each(func(key string, e *entry) {
+				db.logEntry(key, e)
+			})
+		}
 	}
+	unlock()
+
+	storage.resetDirty()
+	go storage.sweep()
+	return storage, loadedFromDisk, nil
+}
+
+// resetDirty marks the data set as just saved, which is
+// what it is right after it has been loaded
+func (storage *Storage) resetDirty() {
+
+	root := storage.owner()
+	root.layout.RLock()
+	atomic.StoreInt64(&root.saved, changes(root.all()))
+	root.layout.RUnlock()
+	atomic.StoreInt64(&root.lastSave, time.Now().Unix())
+}
+
+// Close stops the background work of the storage and flushes the
+// append only file if there is one, for every database at once
+func (storage *Storage) Close() error {
 
-	loadedFromDisk := storage.LoadFromDisk(fileName)
-	return &storage, loadedFromDisk
+	root := storage.owner()
+	var err error
+	root.closeOnce.Do(func() {
+		err = root.stop()
+	})
+	return err
+}
+
+// stop is Close for the root, which only calls it once
+func (storage *Storage) stop() error {
+
+	close(storage.stopSweeper)
+	<-storage.sweeperStopped
+	if storage.aof != nil {
+		return storage.aof.close()
+	}
+	return nil
 }
 
 // Get gives you the value stored at key
-func (storage *Storage) Get(key RetainKey) (interface{}, bool) {
+func (storage *Storage) Get(key RetainKey) (interface{}, bool, error) {
 
-	value, ok := storage.internal.Load(string(key))
-	if !ok {
-		return nil, false
+	e, ok, err := storage.load(string(key))
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return e.value, ok, nil
+}
+
+// Set lets you store/update a key-value pair,
+// any deadline the key had is cleared
+func (storage *Storage) Set(key RetainKey, value RetainValue) error {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	e := &entry{value: value}
+	err := storage.store(string(key), e)
+	if err != nil {
+		return err
+	}
+	storage.logEntry(string(key), e)
+	return nil
+}
+
+// SetWithOptions stores value at key as allowed by options. It returns
+// the value that was there before, if any, and whether the write happened.
+func (storage *Storage) SetWithOptions(key RetainKey, value RetainValue, options SetOptions) (interface{}, bool, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	var previous interface{}
+	old, exists, err := storage.loadLocked(string(key))
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		previous = old.value
+	}
+
+	if (options.OnlyIfMissing && exists) || (options.OnlyIfExists && !exists) {
+		return previous, false, nil
+	}
+	if options.Get && isCollection(previous) {
+		return previous, false, nil
+	}
+
+	e := &entry{value: value}
+	if !options.ExpireAt.IsZero() {
+		e.expireAt = toMillis(options.ExpireAt)
+	} else if options.KeepTTL && exists {
+		e.expireAt = old.expireAt
+	}
+
+	err = storage.store(string(key), e)
+	if err != nil {
+		return nil, false, err
+	}
+	storage.logEntry(string(key), e)
+	return previous, true, nil
+}
+
+// Update replaces the value at key with what update returns, with no
+// other write in between. update receives the current value, or nil and
+// false if the key does not exist. Returning a nil value deletes the key
+// and returning an error leaves it alone. The key keeps its deadline.
+// Update returns the new value, update must not change the current one
+// in place since readers may be looking at it.
+func (storage *Storage) Update(key RetainKey, update func(value RetainValue, exists bool) (RetainValue, error)) (RetainValue, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	var current RetainValue
+	old, exists, err := storage.loadLocked(string(key))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		current = old.value
+	}
+
+	value, err := update(current, exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		if exists {
+			err = storage.remove(string(key))
+			if err != nil {
+				return nil, err
+			}
+			storage.logCommand([]byte("DEL"), key)
+		}
+		return nil, nil
+	}
+
+	e := &entry{value: value}
+	if exists {
+		e.expireAt = old.expireAt
+	}
+	err = storage.store(string(key), e)
+	if err != nil {
+		return nil, err
+	}
+	storage.logEntry(string(key), e)
+	return value, nil
+}
+
+// UpdateKeys is Update for several keys at once. update receives the
+// current values of keys, nil for the ones that do not exist, and
+// returns their new values in the same order. The keys are locked
+// together for the whole call, so nothing else changes them in between
+// and nobody sees some of the new values without the others. A key
+// given twice ends up with the last of its new values.
+func (storage *Storage) UpdateKeys(keys []RetainKey, update func(values []RetainValue) ([]RetainValue, error)) error {
+
+	unlock := storage.lock(keys...)
+	defer unlock()
+
+	current := make([]RetainValue, len(keys))
+	old := make([]*entry, len(keys))
+	for i, key := range keys {
+		e, ok, err := storage.loadLocked(string(key))
+		if err != nil {
+			return err
+		}
+		if ok {
+			current[i], old[i] = e.value, e
+		}
+	}
+
+	values, err := update(current)
+	if err != nil {
+		return err
+	}
+	if len(values) != len(keys) {
+		return fmt.Errorf("UpdateKeys got %d values for %d keys", len(values), len(keys))
+	}
+
+	for i, key := range keys {
+		if values[i] == nil {
+			_, exists, err := storage.loadLocked(string(key))
+			if err == nil && exists {
+				err = storage.remove(string(key))
+				if err == nil {
+					storage.logCommand([]byte("DEL"), key)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		e := &entry{value: values[i]}
+		if old[i] != nil {
+			e.expireAt = old[i].expireAt
+		}
+		err = storage.store(string(key), e)
+		if err != nil {
+			return err
+		}
+		storage.logEntry(string(key), e)
 	}
-	return value, ok
+	return nil
 }
 
-// Set lets you store/update a key-value pair
-func (storage *Storage) Set(key RetainKey, value RetainValue) {
+// MSet sets several keys at once, pairs alternates between keys and
+// values. Nobody sees some of the keys set without the others.
+func (storage *Storage) MSet(pairs ...[]byte) error {
+
+	if len(pairs)%2 != 0 {
+		return errors.New("MSet needs pairs of key and value")
+	}
+
+	keys := make([]RetainKey, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		keys = append(keys, pairs[i])
+	}
+
+	unlock := storage.lock(keys...)
+	defer unlock()
 
-	storage.internal.Store(string(key), value)
+	for i := 0; i < len(pairs); i += 2 {
+		e := &entry{value: pairs[i+1]}
+		err := storage.store(string(pairs[i]), e)
+		if err != nil {
+			return err
+		}
+		storage.logEntry(string(pairs[i]), e)
+	}
+	return nil
+}
+
+// MGet returns the values of keys, nil for the ones that do not exist,
+// as they all were at one point in time
+func (storage *Storage) MGet(keys ...RetainKey) ([]RetainValue, error) {
+
+	unlock := storage.rlock(keys...)
+	defer unlock()
+
+	values := make([]RetainValue, len(keys))
+	for i, key := range keys {
+		e, ok, err := storage.lookup(string(key))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[i] = e.value
+		}
+	}
+	return values, nil
+}
+
+// GetEx returns the value at key and changes its deadline in the same
+// step: at becomes the new deadline unless it is the zero time, and
+// persist removes the deadline. Like GET, it leaves collections alone.
+func (storage *Storage) GetEx(key RetainKey, at time.Time, persist bool) (interface{}, bool, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	e, ok, err := storage.loadLocked(string(key))
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	if isCollection(e.value) {
+		return e.value, true, nil
+	}
+
+	if !at.IsZero() {
+		deadline := toMillis(at)
+		err = storage.store(string(key), &entry{value: e.value, expireAt: deadline, generation: e.generation})
+		if err == nil {
+			storage.logCommand([]byte("PEXPIREAT"), key, []byte(strconv.FormatInt(deadline, 10)))
+		}
+	} else if persist && e.expireAt != 0 {
+		err = storage.store(string(key), &entry{value: e.value, generation: e.generation})
+		if err == nil {
+			storage.logCommand([]byte("PERSIST"), key)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return e.value, true, nil
 }
 
 // Delete will wipe out the relevant key-value pair
-func (storage *Storage) Delete(key RetainKey) {
+func (storage *Storage) Delete(key RetainKey) error {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	_, ok, err := storage.loadLocked(string(key))
+	if !ok || err != nil {
+		return err
+	}
+
+	err = storage.remove(string(key))
+	if err != nil {
+		return err
+	}
+	storage.logCommand([]byte("DEL"), key)
+	return nil
+}
+
+// Expire sets the deadline of key, a deadline in the past deletes it
+// right away. It returns false if the key does not exist.
+func (storage *Storage) Expire(key RetainKey, at time.Time) (bool, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	e, ok, err := storage.loadLocked(string(key))
+	if !ok || err != nil {
+		return false, err
+	}
+
+	deadline := toMillis(at)
+	if deadline <= toMillis(time.Now()) {
+		err = storage.remove(string(key))
+		if err != nil {
+			return false, err
+		}
+		storage.logCommand([]byte("DEL"), key)
+		return true, nil
+	}
+
+	err = storage.store(string(key), &entry{value: e.value, expireAt: deadline})
+	if err != nil {
+		return false, err
+	}
+	storage.logCommand([]byte("PEXPIREAT"), key, []byte(strconv.FormatInt(deadline, 10)))
+	return true, nil
+}
+
+// Persist removes the deadline of key. It returns false if the
+// key does not exist or has no deadline.
+func (storage *Storage) Persist(key RetainKey) (bool, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	e, ok, err := storage.loadLocked(string(key))
+	if !ok || err != nil || e.expireAt == 0 {
+		return false, err
+	}
+
+	err = storage.store(string(key), &entry{value: e.value})
+	if err != nil {
+		return false, err
+	}
+	storage.logCommand([]byte("PERSIST"), key)
+	return true, nil
+}
+
+// ExpireTime returns the deadline of key, which is the zero time if
+// the key does not expire, and whether the key exists at all
+func (storage *Storage) ExpireTime(key RetainKey) (time.Time, bool, error) {
+
+	e, ok, err := storage.load(string(key))
+	if !ok || err != nil {
+		return time.Time{}, false, err
+	}
+
+	if e.expireAt == 0 {
+		return time.Time{}, true, nil
+	}
+	return fromMillis(e.expireAt), true, nil
+}
 
-	storage.internal.Delete(string(key))
+// load returns the live entry at key, deleting it if it has expired.
+// Callers holding the lock of the shard of key use lookup or loadLocked.
+func (storage *Storage) load(key string) (*entry, bool, error) {
+
+	unlock := storage.rlock(RetainKey(key))
+	e, ok, err := storage.peek(key)
+	now := toMillis(time.Now())
+	if err != nil || !ok || !e.expired(now) {
+		if ok {
+			e.use(now, storage.counting())
+		}
+		unlock()
+		return e, ok, err
+	}
+	unlock()
+
+	unlock = storage.lock(RetainKey(key))
+	defer unlock()
+
+	// look again, a writer may have replaced the entry meanwhile
+	return storage.loadLocked(key)
+}
+
+// lookup returns the live entry at key without removing it if it has
+// expired, for readers holding the read lock of the shard of key
+func (storage *Storage) lookup(key string) (*entry, bool, error) {
+
+	e, ok, err := storage.peek(key)
+	now := toMillis(time.Now())
+	if err != nil || !ok || e.expired(now) {
+		return nil, false, err
+	}
+
+	e.use(now, storage.counting())
+	return e, true, nil
+}
+
+// loadLocked is load for callers holding the lock of the shard of key.
+// An entry read from the backing is cached, since the caller may change
+// it in place.
+func (storage *Storage) loadLocked(key string) (*entry, bool, error) {
+
+	e, ok := storage.shardOf(key).entries[key]
+	if !ok {
+		var err error
+		e, ok, err = storage.backed().read(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			storage.cache(key, e)
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	now := toMillis(time.Now())
+	if e.expired(now) {
+		return nil, false, storage.remove(key)
+	}
+
+	e.use(now, storage.counting())
+	return e, true, nil
 }
 
-// LoadFromDisk lets you load your data from a given path
-func (storage *Storage) LoadFromDisk(path string) bool {
+// peek returns the entry at key, expired or not, for callers holding
+// the read lock of the shard of key. Entries that are not in the shards
+// are read from the backing without caching them.
+func (storage *Storage) peek(key string) (*entry, bool, error) {
 
-	file, err := os.Open(path)
+	e, ok := storage.shardOf(key).entries[key]
+	if ok {
+		return e, ok, nil
+	}
+	return storage.backed().read(key)
+}
+
+// cache keeps e, just read from the backing, in the shard of key, the
+// caller must hold its lock
+func (storage *Storage) cache(key string, e *entry) {
+
+	sh := storage.shardOf(key)
+	if sh.entries == nil {
+		sh.entries = make(map[string]*entry)
+	}
+	sh.entries[key] = e
+	sh.index(key)
+	atomic.AddInt64(&storage.owner().used, atomic.LoadInt64(&e.size))
+
+	if e.expireAt != 0 {
+		if sh.expires == nil {
+			sh.expires = make(map[string]struct{})
+		}
+		sh.expires[key] = struct{}{}
+	}
+}
+
+// uncache drops the entry of key from its shard, leaving the backing
+// alone, the caller must hold its lock
+func (storage *Storage) uncache(key string) {
+
+	sh := storage.shardOf(key)
+	if e, ok := sh.entries[key]; ok {
+		delete(sh.entries, key)
+		sh.unindex(key)
+		atomic.AddInt64(&storage.owner().used, -atomic.LoadInt64(&e.size))
+	}
+	delete(sh.expires, key)
+}
+
+// store, touch and remove must be called with the lock of the shard
+// of key held. When the backing fails to record a change, the entry
+// of key is dropped from the shard so that it is read again as the
+// backing has it.
+func (storage *Storage) store(key string, e *entry) error {
+
+	atomic.AddInt64(&storage.shardOf(key).changes, 1)
+	storage.bump(key)
+
+	// a key that is overwritten keeps how often it was used
+	sh := storage.shardOf(key)
+	old := sh.entries[key]
+	if atomic.LoadInt64(&e.accessed) == 0 {
+		now := toMillis(time.Now())
+		hits := int64(initialHits)
+		if old != nil {
+			hits = old.frequency(now)
+		}
+		atomic.StoreInt64(&e.hits, hits)
+		atomic.StoreInt64(&e.accessed, now)
+	}
+	storage.account(key, e, old)
+
+	if sh.entries == nil {
+		sh.entries = make(map[string]*entry)
+	}
+	sh.entries[key] = e
+	if old == nil {
+		sh.index(key)
+	}
+
+	if e.expireAt != 0 {
+		if sh.expires == nil {
+			sh.expires = make(map[string]struct{})
+		}
+		sh.expires[key] = struct{}{}
+	} else {
+		delete(sh.expires, key)
+	}
+
+	err := storage.backed().write(key, e, old != nil)
+	if err != nil {
+		storage.uncache(key)
+		return err
+	}
+	storage.wake(key)
+	return nil
+}
+
+// touch records a change made in place to the value at key
+func (storage *Storage) touch(key string) error {
+
+	atomic.AddInt64(&storage.shardOf(key).changes, 1)
+	storage.bump(key)
+	if e, ok := storage.shardOf(key).entries[key]; ok {
+		storage.account(key, e, e)
+		err := storage.backed().write(key, e, true)
+		if err != nil {
+			storage.uncache(key)
+			return err
+		}
+	}
+	storage.wake(key)
+	return nil
+}
+
+// remove is only called for keys that exist, which may only be in
+// the backing
+func (storage *Storage) remove(key string) error {
+
+	sh := storage.shardOf(key)
+	storage.uncache(key)
+	atomic.AddInt64(&sh.changes, 1)
+	storage.bump(key)
+	return storage.backed().erase(key)
+}
+
+// each calls f with every entry in the shards, expired or not, the
+// caller must hold the lock of every shard
+func (storage *Storage) each(f func(key string, e *entry)) {
+
+	for i := range storage.shards {
+		for key, e := range storage.shards[i].entries {
+			f(key, e)
+		}
+	}
+}
+
+// sweep periodically deletes the keys whose deadline has passed,
+// so that keys nobody reads again do not linger in memory
+func (storage *Storage) sweep() {
+
+	defer close(storage.sweeperStopped)
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stopSweeper:
+			return
+		case <-ticker.C:
+			storage.layout.RLock()
+			databases := storage.all()
+			storage.layout.RUnlock()
+
+			for _, db := range databases {
+				db.removeExpired()
+			}
+		}
+	}
+}
+
+// removeExpired goes over the shards one at a time, so that writers of
+// the others go on meanwhile. It starts at a random one since it may
+// not get to all of them. Only the keys in the shards are looked at,
+// the backing sees to the others, and its cache is trimmed on the way.
+func (storage *Storage) removeExpired() {
+
+	err := storage.backed().expire()
+	if err != nil {
+		log.Println("sweep:", err)
+	}
+
+	start := time.Now()
+	now := toMillis(start)
+	first := randomIntn(shardCount)
+	for i := 0; i < shardCount; i++ {
+		sh := &storage.shards[(first+i)%shardCount]
+		sh.mu.Lock()
+		for key := range sh.expires {
+			if e, ok := sh.entries[key]; !ok || e.expired(now) {
+				err := storage.remove(key)
+				if err != nil {
+					log.Println("sweep:", err)
+				}
+			}
+
+			// do not hold up writers for too long, whatever is
+			// left over gets picked up on the next tick
+			if time.Since(start) >= sweepBudget {
+				sh.mu.Unlock()
+				return
+			}
+		}
+		storage.backed().trim(sh)
+		sh.mu.Unlock()
+	}
+}
+
+// LoadFromDisk lets you load your data from a given path. It reports
+// whether a snapshot was found, a snapshot that fails its checksum or
+// cannot be parsed is refused with an error and nothing is loaded.
+func (storage *Storage) LoadFromDisk(path string) (bool, error) {
+
+	content, err := os.ReadFile(path)
 	if err != nil && os.IsNotExist(err) {
-		return false
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
-	handleError("LoadFromDisk: file open", err)
-	defer file.Close()
 
-	var temp map[string]interface{}
-	err = gob.NewDecoder(file).Decode(&temp)
-	handleError("LoadFromDisk: file decode", err)
+	snapshot, err := readSnapshot(content)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
 
-	storage.internal = *toInternalMap(&temp)
-	return true
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	if len(snapshot) > len(databases) {
+		return false, fmt.Errorf("%s: %w: it holds database %d", path, ErrDatabaseOutOfRange, len(snapshot)-1)
+	}
+
+	now := toMillis(time.Now())
+	for index, db := range databases {
+		err := db.flush()
+		if err != nil {
+			return false, err
+		}
+		if index >= len(snapshot) {
+			continue
+		}
+
+		for key, e := range snapshot[index] {
+			if e.expired(now) {
+				continue
+			}
+			err := db.store(key, e)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
 }
 
-// Save will dump the in-memory map to disk
-func (storage *Storage) Save() {
+// Save will dump the in-memory map of every database to disk
+func (storage *Storage) Save() error {
 
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
-	handleError("Save: file open", err)
-	defer file.Close()
+	root := storage.owner()
+	if !atomic.CompareAndSwapInt32(&root.saving, 0, 1) {
+		return ErrSaveInProgress
+	}
+	defer atomic.StoreInt32(&root.saving, 0)
+
+	snapshot, changes := storage.copyEntries()
+	return root.writeSnapshot(snapshot, changes)
+}
 
-	temp := fromInternalMap(&storage.internal)
+// BackgroundSave is like Save but returns as soon as a point-in-time
+// copy of the data set is taken, the copy is written to disk on another
+// goroutine while writes continue. Failures are logged and can be
+// noticed through LastSave not moving forward.
+func (storage *Storage) BackgroundSave() error {
+
+	root := storage.owner()
+	if !atomic.CompareAndSwapInt32(&root.saving, 0, 1) {
+		return ErrSaveInProgress
+	}
 
-	err = gob.NewEncoder(file).Encode(temp)
-	handleError("Save: file encode", err)
+	snapshot, changes := storage.copyEntries()
+	go func() {
+		defer atomic.StoreInt32(&root.saving, 0)
+
+		err := root.writeSnapshot(snapshot, changes)
+		if err != nil {
+			log.Println("background save:", err)
+		}
+	}()
+	return nil
 }
 
-func toInternalMap(temp *map[string]interface{}) *sync.Map {
+// LastSave returns when the data set was last saved successfully,
+// or loaded if it has not been saved since
+func (storage *Storage) LastSave() time.Time {
+
+	return time.Unix(atomic.LoadInt64(&storage.owner().lastSave), 0)
+}
+
+// Dirty returns the number of changes since the last save
+func (storage *Storage) Dirty() int64 {
+
+	root := storage.owner()
+	root.layout.RLock()
+	defer root.layout.RUnlock()
 
-	m := sync.Map{}
-	for key, value := range *temp {
-		m.Store(key, value)
+	return changes(root.all()) - atomic.LoadInt64(&root.saved)
+}
+
+// changes returns how many changes have been made to databases, every
+// shard keeps its own count so that writers do not share a counter
+func changes(databases []*Storage) int64 {
+
+	total := int64(0)
+	for _, db := range databases {
+		for i := range db.shards {
+			total += atomic.LoadInt64(&db.shards[i].changes)
+		}
 	}
-	return &m
+	return total
 }
 
-func fromInternalMap(m *sync.Map) *map[string]interface{} {
+// writeSnapshot saves snapshot and on success records the changes it
+// was copied at as saved, changes made in the meantime still need a
+// save. It is called on the root.
+func (storage *Storage) writeSnapshot(snapshot []map[string]*entry, changes int64) error {
 
-	temp := make(map[string]interface{})
-	m.Range(func(key interface{}, value interface{}) bool {
-		temp[key.(string)] = value
-		return true
-	})
-	return &temp
+	err := writeSnapshot(storage.snapshotPath, snapshot)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&storage.saved, changes)
+	atomic.StoreInt64(&storage.lastSave, time.Now().Unix())
+	return nil
+}
+
+// copyEntries returns a point-in-time copy of every database, indexed
+// by number, along with the count of changes at that point. Entries are never
+// modified in place and values that are get cloned before their next
+// change, so holding on to the pointers is enough.
+func (storage *Storage) copyEntries() ([]map[string]*entry, int64) {
+
+	databases, unlock := storage.lockAll()
+	defer unlock()
+
+	return copyLocked(databases)
+}
+
+// copyLocked is copyEntries for callers holding the lock of every shard
+// of every database
+func copyLocked(databases []*Storage) ([]map[string]*entry, int64) {
+
+	snapshot := make([]map[string]*entry, 0, len(databases))
+	for _, db := range databases {
+		// generations move in step, which lets MOVE and SWAPDB
+		// take values from one database to another as they are
+		db.generation++
+
+		entries := make(map[string]*entry)
+		db.each(func(key string, e *entry) {
+			entries[key] = e
+		})
+		snapshot = append(snapshot, entries)
+	}
+	return snapshot, changes(databases)
+}
+
+func toMillis(t time.Time) int64 {
+
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
 func handleError(text string, err error) {
@@ -1,9 +1,12 @@
 package store
 
 import (
+	"errors"
 	"log"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testCases = []struct {
@@ -21,7 +24,8 @@ func TestGetAndSet(t *testing.T) {
 
 		mp.Set(testCase.key, testCase.value)
 
-		v, ok := mp.Get(testCase.key)
+		v, ok, err := mp.Get(testCase.key)
+		handleError("failed Get", err)
 
 		if !ok || v != testCase.value {
 			log.Fatalf("failed Get at %v, got: %v", testCase, v)
@@ -36,7 +40,8 @@ func TestDelete(t *testing.T) {
 
 		mp.Set(testCase.key, testCase.value)
 		mp.Delete(testCase.key)
-		_, ok := mp.Get(testCase.key)
+		_, ok, err := mp.Get(testCase.key)
+		handleError("failed Get", err)
 
 		if ok {
 			log.Fatalf("failed Delete at %v", testCase)
@@ -51,23 +56,193 @@ func TestSaveAndLoad(t *testing.T) {
 		mp.Set(testCase.key, testCase.value)
 	}
 
-	mp.Save()
+	mp.Expire(testCases[0].key, time.Now().Add(time.Hour))
+	err := mp.Save()
+	handleError("failed TestLoadAndSave save", err)
 
 	for _, testCase := range testCases {
 		mp.Delete(testCase.key)
 	}
 
-	mp.LoadFromDisk(fileName)
+	loaded, err := mp.LoadFromDisk(fileName)
+	if !loaded || err != nil {
+		log.Fatalf("failed TestLoadAndSave load, got: %v", err)
+	}
 
 	for _, testCase := range testCases {
 
-		v, ok := mp.Get(testCase.key)
+		v, ok, err := mp.Get(testCase.key)
+		handleError("failed Get", err)
 		if !ok || v != testCase.value {
 			log.Fatalf("failed TestLoadAndSave at %v", testCase)
 		}
 	}
 
+	if deadline, _, err := mp.ExpireTime(testCases[0].key); err != nil || deadline.IsZero() {
+		log.Fatalf("failed TestLoadAndSave, deadline was not persisted")
+	}
+
 	// clean up
-	err := os.Remove(fileName)
+	err = os.Remove(fileName)
 	handleError("failed TestLoadAndSave cleanup", err)
 }
+
+func TestExpire(t *testing.T) {
+
+	mp, _ := New()
+	defer mp.Close()
+
+	key := RetainKey("session")
+	mp.Set(key, []byte("data"))
+
+	if found, err := mp.Expire(key, time.Now().Add(50*time.Millisecond)); err != nil || !found {
+		log.Fatalf("failed Expire on existing key")
+	}
+
+	deadline, ok, err := mp.ExpireTime(key)
+	handleError("failed ExpireTime", err)
+	if !ok || deadline.IsZero() {
+		log.Fatalf("failed ExpireTime, got: %v, %v", deadline, ok)
+	}
+
+	persisted, err := mp.Persist(key)
+	handleError("failed Persist", err)
+	again, err := mp.Persist(key)
+	handleError("failed Persist", err)
+	if !persisted || again {
+		log.Fatalf("failed Persist")
+	}
+
+	mp.Expire(key, time.Now().Add(50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed lazy expiry, key is still there")
+	}
+
+	if found, err := mp.Expire(key, time.Now().Add(time.Second)); err != nil || found {
+		log.Fatalf("failed Expire on missing key")
+	}
+}
+
+func TestActiveExpiry(t *testing.T) {
+
+	mp, _ := New()
+	defer mp.Close()
+
+	mp.SetWithOptions(RetainKey("temp"), 1, SetOptions{ExpireAt: time.Now().Add(10 * time.Millisecond)})
+	time.Sleep(3 * sweepInterval)
+
+	unlock := mp.rlock(RetainKey("temp"))
+	_, ok := mp.shardOf("temp").entries["temp"]
+	unlock()
+	if ok {
+		log.Fatalf("failed active expiry, key was not swept")
+	}
+}
+
+func TestSetWithOptions(t *testing.T) {
+
+	mp, _ := New()
+	defer mp.Close()
+
+	key := RetainKey("k")
+
+	if _, ok, err := mp.SetWithOptions(key, 1, SetOptions{OnlyIfExists: true}); err != nil || ok {
+		log.Fatalf("failed XX, wrote a missing key")
+	}
+
+	if _, ok, err := mp.SetWithOptions(key, 1, SetOptions{OnlyIfMissing: true, ExpireAt: time.Now().Add(time.Hour)}); err != nil || !ok {
+		log.Fatalf("failed NX, did not write a missing key")
+	}
+
+	previous, ok, err := mp.SetWithOptions(key, 2, SetOptions{OnlyIfMissing: true})
+	handleError("failed SetWithOptions", err)
+	if ok || previous != 1 {
+		log.Fatalf("failed NX, got: %v, %v", previous, ok)
+	}
+
+	mp.SetWithOptions(key, 3, SetOptions{KeepTTL: true})
+	if deadline, _, err := mp.ExpireTime(key); err != nil || deadline.IsZero() {
+		log.Fatalf("failed KEEPTTL, deadline was dropped")
+	}
+
+	mp.SetWithOptions(key, 4, SetOptions{})
+	if deadline, _, err := mp.ExpireTime(key); err != nil || !deadline.IsZero() {
+		log.Fatalf("failed plain set, deadline was kept")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("counter")
+
+	increment := func(value RetainValue, exists bool) (RetainValue, error) {
+		if !exists {
+			return 1, nil
+		}
+		return value.(int) + 1, nil
+	}
+
+	// increments from many goroutines must not get lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mp.Update(key, increment)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _, err := mp.Get(key); err != nil || value != 5000 {
+		log.Fatalf("failed Update, expected: 5000, got: %v", value)
+	}
+
+	mp.Expire(key, time.Now().Add(time.Hour))
+	mp.Update(key, increment)
+	if deadline, _, err := mp.ExpireTime(key); err != nil || deadline.IsZero() {
+		log.Fatalf("failed to keep the deadline on Update")
+	}
+
+	failure := errors.New("refused")
+	_, err := mp.Update(key, func(RetainValue, bool) (RetainValue, error) { return nil, failure })
+	if err != failure {
+		log.Fatalf("failed Update with an error, got: %v", err)
+	}
+	if value, _, err := mp.Get(key); err != nil || value != 5001 {
+		log.Fatalf("failed Update with an error, the value changed to: %v", value)
+	}
+
+	mp.Update(key, func(RetainValue, bool) (RetainValue, error) { return nil, nil })
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete with Update")
+	}
+}
+
+func TestGetEx(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("session")
+	mp.Set(key, []byte("token"))
+
+	value, ok, err := mp.GetEx(key, time.Now().Add(time.Hour), false)
+	handleError("failed GetEx", err)
+	deadline, _, err := mp.ExpireTime(key)
+	handleError("failed ExpireTime", err)
+	if !ok || string(value.([]byte)) != "token" || deadline.IsZero() {
+		log.Fatalf("failed GetEx with a deadline, got: %v, %v", value, deadline)
+	}
+
+	mp.GetEx(key, time.Time{}, true)
+	if deadline, _, err := mp.ExpireTime(key); err != nil || !deadline.IsZero() {
+		log.Fatalf("failed GetEx with persist, got: %v", deadline)
+	}
+
+	if _, ok, err := mp.GetEx(RetainKey("missing"), time.Time{}, true); err != nil || ok {
+		log.Fatalf("failed GetEx on a missing key")
+	}
+}
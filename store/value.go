@@ -0,0 +1,221 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// type tags used when a value is serialized on its own,
+// they must never be renumbered since they end up on disk
+const (
+	tagBytes  byte = 0
+	tagString byte = 1
+	tagInt    byte = 2
+	tagFloat  byte = 3
+	tagList   byte = 4
+	tagHash   byte = 5
+	tagSet    byte = 6
+	tagZset   byte = 7
+)
+
+var errorUnsupportedValue = errors.New("unsupported value type")
+
+// isCollection reports whether value is one of the container types,
+// as opposed to a plain value that GET can return
+func isCollection(value RetainValue) bool {
+
+	switch value.(type) {
+	case *list, hash, set, *zset:
+		return true
+	}
+	return false
+}
+
+// typeName names the type of value the way TYPE reports it
+func typeName(value RetainValue) string {
+
+	switch value.(type) {
+	case *list:
+		return "list"
+	case hash:
+		return "hash"
+	case set:
+		return "set"
+	case *zset:
+		return "zset"
+	}
+	return "string"
+}
+
+// encodeValue serializes value into a type tag followed by its payload
+func encodeValue(value RetainValue) ([]byte, error) {
+
+	switch value := value.(type) {
+
+	case []byte:
+		return append([]byte{tagBytes}, value...), nil
+
+	case string:
+		return append([]byte{tagString}, value...), nil
+
+	case int:
+		buffer := make([]byte, 9)
+		buffer[0] = tagInt
+		binary.BigEndian.PutUint64(buffer[1:], uint64(value))
+		return buffer, nil
+
+	case float64:
+		buffer := make([]byte, 9)
+		buffer[0] = tagFloat
+		binary.BigEndian.PutUint64(buffer[1:], math.Float64bits(value))
+		return buffer, nil
+
+	case *list:
+		buffer := appendUvarint([]byte{tagList}, uint64(value.len()))
+		for i := 0; i < value.len(); i++ {
+			buffer = appendBytes(buffer, value.at(i))
+		}
+		return buffer, nil
+
+	case hash:
+		// fields and values alternate, so there are twice as many items
+		buffer := appendUvarint([]byte{tagHash}, uint64(2*len(value)))
+		for field, item := range value {
+			buffer = appendBytes(buffer, []byte(field))
+			buffer = appendBytes(buffer, item)
+		}
+		return buffer, nil
+
+	case set:
+		buffer := appendUvarint([]byte{tagSet}, uint64(len(value)))
+		for member := range value {
+			buffer = appendBytes(buffer, []byte(member))
+		}
+		return buffer, nil
+
+	case *zset:
+		// members alternate with their scores, in order
+		buffer := appendUvarint([]byte{tagZset}, uint64(2*value.len()))
+		for node := value.index.first(); node != nil; node = node.levels[0].forward {
+			buffer = appendBytes(buffer, []byte(node.member))
+			buffer = appendBytes(buffer, appendUint64(nil, math.Float64bits(node.score)))
+		}
+		return buffer, nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", errorUnsupportedValue, value)
+}
+
+// decodeValue is the inverse of encodeValue
+func decodeValue(data []byte) (RetainValue, error) {
+
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+
+	payload := data[1:]
+	switch data[0] {
+
+	case tagBytes:
+		return append([]byte{}, payload...), nil
+
+	case tagString:
+		return string(payload), nil
+
+	case tagInt:
+		if len(payload) != 8 {
+			return nil, errors.New("malformed int value")
+		}
+		return int(binary.BigEndian.Uint64(payload)), nil
+
+	case tagFloat:
+		if len(payload) != 8 {
+			return nil, errors.New("malformed float value")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), nil
+
+	case tagList:
+		reader := bytes.NewReader(payload)
+		items, err := readItems(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		l := &list{}
+		l.replace(items)
+		return l, nil
+
+	case tagHash:
+		items, err := readItems(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, errors.New("malformed hash value")
+		}
+
+		h := make(hash, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			h[string(items[i])] = items[i+1]
+		}
+		return h, nil
+
+	case tagSet:
+		items, err := readItems(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		s := make(set, len(items))
+		for _, item := range items {
+			s[string(item)] = struct{}{}
+		}
+		return s, nil
+
+	case tagZset:
+		items, err := readItems(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, errors.New("malformed sorted set value")
+		}
+
+		z := newZset()
+		for i := 0; i < len(items); i += 2 {
+			if len(items[i+1]) != 8 {
+				return nil, errors.New("malformed sorted set score")
+			}
+			z.set(string(items[i]), math.Float64frombits(binary.BigEndian.Uint64(items[i+1])))
+		}
+		return z, nil
+	}
+
+	return nil, fmt.Errorf("unknown value type %d", data[0])
+}
+
+// readItems reads a count followed by that many length-prefixed items
+func readItems(reader *bytes.Reader) ([][]byte, error) {
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, errors.New("malformed item count")
+	}
+
+	items := make([][]byte, 0)
+	for i := uint64(0); i < count; i++ {
+		item, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if reader.Len() != 0 {
+		return nil, errors.New("trailing data after items")
+	}
+	return items, nil
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// writeAheadLog holds the records of the memtable of the tree until it
+// is written out as a table, so that they survive a crash. Every entry
+// is the CRC-32 (Castagnoli) of a record, uint32, its length, uint32,
+// and the record as laid out in tables.
+type writeAheadLog struct {
+	number uint64
+	policy FsyncPolicy
+
+	// mu guards file, it is only needed for the goroutine
+	// syncing every second, the tree serializes appends
+	mu   sync.Mutex
+	file *os.File
+	stop chan struct{}
+}
+
+const walHeaderLength = 8
+
+func createWriteAheadLog(path string, number uint64, policy FsyncPolicy) (*writeAheadLog, error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := &writeAheadLog{number: number, policy: policy, file: file, stop: make(chan struct{})}
+	if policy == FsyncEverySec {
+		go wal.syncEverySecond()
+	}
+	return wal, nil
+}
+
+// append logs key and rec
+func (wal *writeAheadLog) append(key []byte, rec record) error {
+
+	payload := appendRecord(nil, key, rec)
+	entry := make([]byte, walHeaderLength, walHeaderLength+len(payload))
+	binary.BigEndian.PutUint32(entry, crc32.Checksum(payload, checksumTable))
+	binary.BigEndian.PutUint32(entry[4:], uint32(len(payload)))
+	entry = append(entry, payload...)
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	_, err := wal.file.Write(entry)
+	if err == nil && wal.policy == FsyncAlways {
+		err = wal.file.Sync()
+	}
+	return err
+}
+
+func (wal *writeAheadLog) syncEverySecond() {
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wal.stop:
+			return
+		case <-ticker.C:
+			wal.mu.Lock()
+			err := wal.file.Sync()
+			wal.mu.Unlock()
+			if err != nil {
+				log.Println("write-ahead log: fsync", err)
+			}
+		}
+	}
+}
+
+func (wal *writeAheadLog) close() error {
+
+	close(wal.stop)
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.file.Sync()
+	if closeErr := wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replayWriteAheadLog calls f with every record logged at path in order.
+// A torn or corrupt entry ends the log, it can only be the last one
+// since every entry before it was completely written.
+func replayWriteAheadLog(path string, f func(key []byte, rec record)) error {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for len(content) >= walHeaderLength {
+		length := binary.BigEndian.Uint32(content[4:])
+		if uint64(length) > uint64(len(content)-walHeaderLength) {
+			break
+		}
+
+		payload := content[walHeaderLength : walHeaderLength+int(length)]
+		if crc32.Checksum(payload, checksumTable) != binary.BigEndian.Uint32(content) {
+			break
+		}
+
+		key, rec, _, err := readRecord(payload)
+		if err != nil {
+			break
+		}
+		f(key, rec)
+		content = content[walHeaderLength+int(length):]
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package store
+
+// watchedKey counts the changes made to a key while clients watch it
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// Watch starts counting the changes made to key and returns its current
+// version. Every Watch must be paired with an Unwatch.
+func (storage *Storage) Watch(key RetainKey) (uint64, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	sh := storage.shardOf(string(key))
+	if sh.watched == nil {
+		sh.watched = make(map[string]*watchedKey)
+	}
+
+	// reading the key drops it if it has expired, which
+	// has to happen now rather than count as a change later
+	_, _, err := storage.loadLocked(string(key))
+	if err != nil {
+		return 0, err
+	}
+
+	w, ok := sh.watched[string(key)]
+	if !ok {
+		w = &watchedKey{}
+		sh.watched[string(key)] = w
+	}
+	w.watchers++
+	return w.version, nil
+}
+
+// Unwatch undoes one Watch of key
+func (storage *Storage) Unwatch(key RetainKey) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	sh := storage.shardOf(string(key))
+	w, ok := sh.watched[string(key)]
+	if !ok {
+		return
+	}
+
+	w.watchers--
+	if w.watchers == 0 {
+		delete(sh.watched, string(key))
+	}
+}
+
+// Version returns the version of a watched key, it changes whenever
+// the key is written, deleted or expires. It is only meaningful
+// between Watch and Unwatch.
+func (storage *Storage) Version(key RetainKey) (uint64, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	// a key that expired since it was watched has changed
+	_, _, err := storage.loadLocked(string(key))
+	if err != nil {
+		return 0, err
+	}
+
+	if w, ok := storage.shardOf(string(key)).watched[string(key)]; ok {
+		return w.version, nil
+	}
+	return 0, nil
+}
+
+// bump records a change to key, the caller must hold the lock of
+// its shard
+func (storage *Storage) bump(key string) {
+
+	if w, ok := storage.shardOf(key).watched[key]; ok {
+		w.version++
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+// versionOf is Version failing the test on an error
+func versionOf(engine Watching, key RetainKey) uint64 {
+
+	version, err := engine.Version(key)
+	handleError("failed Version", err)
+	return version
+}
+
+func TestWatch(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("balance")
+	mp.Set(key, []byte("10"))
+
+	version, err := mp.Watch(key)
+	handleError("failed Watch", err)
+	mp.Get(key)
+	mp.Delete(RetainKey("other"))
+	if versionOf(mp, key) != version {
+		log.Fatalf("failed Watch, version changed without a write")
+	}
+
+	changes := []func(){
+		func() { mp.Set(key, []byte("20")) },
+		func() { mp.Expire(key, time.Now().Add(time.Hour)) },
+		func() { mp.Delete(key) },
+		func() { mp.RPush(key, []byte("a")) },
+		func() { mp.LSet(key, 0, []byte("b")) },
+		func() { mp.Expire(key, time.Now().Add(10*time.Millisecond)); time.Sleep(20 * time.Millisecond) },
+	}
+
+	for i, change := range changes {
+		version = versionOf(mp, key)
+		change()
+		if versionOf(mp, key) == version {
+			log.Fatalf("failed Watch, change %d went unnoticed", i)
+		}
+	}
+
+	// the count survives as long as someone watches the key
+	mp.Watch(key)
+	mp.Unwatch(key)
+	mp.Set(key, []byte("30"))
+	if versionOf(mp, key) == 0 {
+		log.Fatalf("failed Watch, version dropped while still watched")
+	}
+
+	mp.Unwatch(key)
+	if watched := len(mp.shardOf(string(key)).watched); watched != 0 {
+		log.Fatalf("failed Unwatch, %d keys still watched", watched)
+	}
+}
@@ -0,0 +1,607 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var ErrScoreNaN = errors.New("resulting score is not a number (NaN)")
+
+// ScoredMember is a member of a sorted set along with its score
+type ScoredMember struct {
+	Member []byte
+	Score  float64
+}
+
+// ScoreBound is one end of a range of scores
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// LexBound is one end of a range of members, compared byte by byte.
+// An Unbounded minimum is below every member and an Unbounded maximum
+// above every member.
+type LexBound struct {
+	Value     []byte
+	Exclusive bool
+	Unbounded bool
+}
+
+// Limit skips Offset results and returns at most Count of the rest,
+// a negative Count returns all of them
+type Limit struct {
+	Offset int
+	Count  int
+}
+
+// NoLimit returns every result of a range
+var NoLimit = Limit{Offset: 0, Count: -1}
+
+// ZAddOptions changes the behaviour of ZAdd
+type ZAddOptions struct {
+	// OnlyIfMissing and OnlyIfExists only add new members or only
+	// update existing ones (NX and XX)
+	OnlyIfMissing bool
+	OnlyIfExists  bool
+
+	// OnlyIfGreater and OnlyIfLess only update a score when the new
+	// one is greater or less than the current one (GT and LT)
+	OnlyIfGreater bool
+	OnlyIfLess    bool
+
+	// Changed counts the members whose score changed along with the
+	// new ones in the result of ZAdd (CH)
+	Changed bool
+}
+
+// zset is a sorted set, scores gives the score of a member in O(1)
+// and index keeps the members in order
+type zset struct {
+	scores map[string]float64
+	index  *skiplist
+}
+
+func newZset() *zset {
+
+	return &zset{scores: make(map[string]float64), index: newSkiplist()}
+}
+
+func (z *zset) len() int {
+
+	return len(z.scores)
+}
+
+// set gives member the score, adding it if needed
+func (z *zset) set(member string, score float64) {
+
+	if current, exists := z.scores[member]; exists {
+		if current == score {
+			return
+		}
+		z.index.delete(current, member)
+	}
+	z.index.insert(score, member)
+	z.scores[member] = score
+}
+
+func (z *zset) remove(member string) bool {
+
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	z.index.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+func (z *zset) clone() *zset {
+
+	copied := newZset()
+	for node := z.index.first(); node != nil; node = node.levels[0].forward {
+		copied.set(node.member, node.score)
+	}
+	return copied
+}
+
+// collect walks the list from node, forwards or backwards, skipping
+// offset nodes and then taking up to count of those for which within
+// holds. A negative count takes all of them.
+func collect(node *skiplistNode, reverse bool, limit Limit, within func(node *skiplistNode) bool) []ScoredMember {
+
+	next := func(node *skiplistNode) *skiplistNode {
+		if reverse {
+			return node.backward
+		}
+		return node.levels[0].forward
+	}
+
+	for i := 0; i < limit.Offset && node != nil && within(node); i++ {
+		node = next(node)
+	}
+
+	result := make([]ScoredMember, 0)
+	for ; node != nil && within(node) && (limit.Count < 0 || len(result) < limit.Count); node = next(node) {
+		result = append(result, ScoredMember{Member: []byte(node.member), Score: node.score})
+	}
+	return result
+}
+
+func (bound ScoreBound) belowMin(score float64) bool {
+
+	return score < bound.Value || (bound.Exclusive && score == bound.Value)
+}
+
+func (bound ScoreBound) aboveMax(score float64) bool {
+
+	return score > bound.Value || (bound.Exclusive && score == bound.Value)
+}
+
+func (bound LexBound) belowMin(member string) bool {
+
+	if bound.Unbounded {
+		return false
+	}
+	return member < string(bound.Value) || (bound.Exclusive && member == string(bound.Value))
+}
+
+func (bound LexBound) aboveMax(member string) bool {
+
+	if bound.Unbounded {
+		return false
+	}
+	return member > string(bound.Value) || (bound.Exclusive && member == string(bound.Value))
+}
+
+// scoreRange returns the first and last nodes with a score between min
+// and max, or nils if there are none
+func (z *zset) scoreRange(min ScoreBound, max ScoreBound) (*skiplistNode, *skiplistNode) {
+
+	first := z.index.firstAbove(func(node *skiplistNode) bool {
+		return min.belowMin(node.score)
+	})
+	last := z.index.lastWithin(func(node *skiplistNode) bool {
+		return !max.aboveMax(node.score)
+	})
+
+	if first == nil || last == nil || max.aboveMax(first.score) || min.belowMin(last.score) {
+		return nil, nil
+	}
+	return first, last
+}
+
+// lexRange is scoreRange for members, it assumes all scores are equal
+func (z *zset) lexRange(min LexBound, max LexBound) (*skiplistNode, *skiplistNode) {
+
+	first := z.index.firstAbove(func(node *skiplistNode) bool {
+		return min.belowMin(node.member)
+	})
+	last := z.index.lastWithin(func(node *skiplistNode) bool {
+		return !max.aboveMax(node.member)
+	})
+
+	if first == nil || last == nil || max.aboveMax(first.member) || min.belowMin(last.member) {
+		return nil, nil
+	}
+	return first, last
+}
+
+// readZset returns the sorted set at key for callers holding its lock
+func (storage *Storage) readZset(key string) (*zset, error) {
+
+	e, ok, err := storage.lookup(key)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	z, isZset := e.value.(*zset)
+	if !isZset {
+		return nil, ErrWrongType
+	}
+	return z, nil
+}
+
+// writableZset returns the sorted set at key ready to be changed in
+// place, creating an empty one if create is set. The caller must hold
+// the lock of key.
+func (storage *Storage) writableZset(key string, create bool) (*zset, error) {
+
+	e, ok, err := storage.loadLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		z := newZset()
+		err = storage.store(key, &entry{value: z, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	}
+
+	z, isZset := e.value.(*zset)
+	if !isZset {
+		return nil, ErrWrongType
+	}
+
+	if e.generation != storage.generation {
+		z = z.clone()
+		err = storage.store(key, &entry{value: z, expireAt: e.expireAt, generation: storage.generation})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
+// ZAdd adds members to the sorted set at key or updates their scores,
+// as allowed by options. It returns how many members were added, plus
+// how many were updated if options.Changed is set.
+func (storage *Storage) ZAdd(key RetainKey, members []ScoredMember, options ZAddOptions) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	z, err := storage.writableZset(string(key), true)
+	if err != nil {
+		return 0, err
+	}
+
+	added, updated := 0, 0
+	record := [][]byte{[]byte("ZADD"), key}
+	for _, member := range members {
+		score, isNew, ok := z.update(string(member.Member), member.Score, false, options)
+		if !ok {
+			continue
+		}
+
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+		record = append(record, formatScore(score), member.Member)
+	}
+
+	err = storage.finishZadd(string(key), z, record)
+	if err != nil {
+		return 0, err
+	}
+	if options.Changed {
+		return added + updated, nil
+	}
+	return added, nil
+}
+
+// ZAddIncr adds increment to the score of member in the sorted set at
+// key, as allowed by options. It returns the new score, or false if
+// options prevented the change.
+func (storage *Storage) ZAddIncr(key RetainKey, member []byte, increment float64, options ZAddOptions) (float64, bool, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	z, err := storage.writableZset(string(key), true)
+	if err != nil {
+		return 0, false, err
+	}
+
+	current := z.scores[string(member)]
+	if math.IsNaN(current + increment) {
+		err = storage.finishZadd(string(key), z, nil)
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, false, ErrScoreNaN
+	}
+
+	score, _, ok := z.update(string(member), increment, true, options)
+	var record [][]byte
+	if ok {
+		record = [][]byte{[]byte("ZADD"), key, formatScore(score), member}
+	}
+	err = storage.finishZadd(string(key), z, record)
+	if err != nil {
+		return 0, false, err
+	}
+	return score, ok, nil
+}
+
+// ZIncrBy adds increment to the score of member in the sorted set at
+// key, a missing member starts at 0. It returns the new score.
+func (storage *Storage) ZIncrBy(key RetainKey, member []byte, increment float64) (float64, error) {
+
+	score, _, err := storage.ZAddIncr(key, member, increment, ZAddOptions{})
+	return score, err
+}
+
+// update applies one member of ZADD. It returns the resulting score,
+// whether the member is new and whether anything changed.
+func (z *zset) update(member string, score float64, increment bool, options ZAddOptions) (float64, bool, bool) {
+
+	current, exists := z.scores[member]
+	if (exists && options.OnlyIfMissing) || (!exists && options.OnlyIfExists) {
+		return current, false, false
+	}
+
+	if increment {
+		score += current
+	}
+
+	if exists {
+		if (options.OnlyIfGreater && score <= current) || (options.OnlyIfLess && score >= current) || score == current {
+			return current, false, false
+		}
+	}
+
+	z.set(member, score)
+	return score, !exists, true
+}
+
+// finishZadd logs record, if it changed anything, and drops the
+// sorted set if it was created for nothing. The caller holds the lock
+// of key.
+func (storage *Storage) finishZadd(key string, z *zset, record [][]byte) error {
+
+	if z.len() == 0 {
+		return storage.remove(key)
+	}
+	if len(record) > 2 {
+		err := storage.touch(key)
+		if err != nil {
+			return err
+		}
+		storage.logCommand(record...)
+	}
+	return nil
+}
+
+// zadd applies a ZADD record while replaying the append only file
+func (storage *Storage) zadd(key string, pairs [][]byte) error {
+
+	z, err := storage.writableZset(key, true)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(string(pairs[i]), 64)
+		if err != nil {
+			return err
+		}
+		z.set(string(pairs[i+1]), score)
+	}
+	return storage.touch(key)
+}
+
+// ZRem removes members from the sorted set at key and returns how many
+// were there. The key goes away along with its last member.
+func (storage *Storage) ZRem(key RetainKey, members ...[]byte) (int, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	removed, err := storage.zrem(string(key), members)
+	if removed > 0 {
+		storage.logCommand(append([][]byte{[]byte("ZREM"), key}, members...)...)
+	}
+	return removed, err
+}
+
+func (storage *Storage) zrem(key string, members [][]byte) (int, error) {
+
+	z, err := storage.writableZset(key, false)
+	if z == nil || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if z.remove(string(member)) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		err = storage.touch(key)
+	}
+	if err == nil && z.len() == 0 {
+		err = storage.remove(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// ZScore returns the score of member in the sorted set at key
+func (storage *Storage) ZScore(key RetainKey, member []byte) (float64, bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return 0, false, err
+	}
+
+	score, ok := z.scores[string(member)]
+	return score, ok, nil
+}
+
+// ZCard returns the number of members of the sorted set at key
+func (storage *Storage) ZCard(key RetainKey) (int, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return 0, err
+	}
+	return z.len(), nil
+}
+
+// ZRank returns the 0-based position of member in the sorted set at
+// key, counting from the highest score if reverse is set
+func (storage *Storage) ZRank(key RetainKey, member []byte, reverse bool) (int, bool, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return 0, false, err
+	}
+
+	score, exists := z.scores[string(member)]
+	if !exists {
+		return 0, false, nil
+	}
+
+	rank := z.index.rank(score, string(member))
+	if reverse {
+		return z.len() - rank, true, nil
+	}
+	return rank - 1, true, nil
+}
+
+// ZRange returns the members of the sorted set at key between the
+// positions start and stop inclusive, negative positions count from
+// the end. With reverse set positions count from the highest score.
+func (storage *Storage) ZRange(key RetainKey, start int, stop int, reverse bool) ([]ScoredMember, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return []ScoredMember{}, err
+	}
+
+	start, stop, ok := normalizeRange(start, stop, z.len())
+	if !ok {
+		return []ScoredMember{}, nil
+	}
+
+	rank := start + 1
+	if reverse {
+		rank = z.len() - start
+	}
+
+	limit := Limit{Count: stop - start + 1}
+	return collect(z.index.byRank(rank), reverse, limit, func(*skiplistNode) bool { return true }), nil
+}
+
+// ZRangeByScore returns the members of the sorted set at key with a
+// score between min and max, from the highest score if reverse is set
+func (storage *Storage) ZRangeByScore(key RetainKey, min ScoreBound, max ScoreBound, reverse bool, limit Limit) ([]ScoredMember, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return []ScoredMember{}, err
+	}
+
+	first, last := z.scoreRange(min, max)
+	if reverse {
+		return collect(last, true, limit, func(node *skiplistNode) bool { return !min.belowMin(node.score) }), nil
+	}
+	return collect(first, false, limit, func(node *skiplistNode) bool { return !max.aboveMax(node.score) }), nil
+}
+
+// ZRangeByLex returns the members of the sorted set at key between min
+// and max. It is meant for sets where all members have the same score.
+func (storage *Storage) ZRangeByLex(key RetainKey, min LexBound, max LexBound, reverse bool, limit Limit) ([]ScoredMember, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return []ScoredMember{}, err
+	}
+
+	first, last := z.lexRange(min, max)
+	if reverse {
+		return collect(last, true, limit, func(node *skiplistNode) bool { return !min.belowMin(node.member) }), nil
+	}
+	return collect(first, false, limit, func(node *skiplistNode) bool { return !max.aboveMax(node.member) }), nil
+}
+
+// ZCount returns how many members of the sorted set at key have a
+// score between min and max
+func (storage *Storage) ZCount(key RetainKey, min ScoreBound, max ScoreBound) (int, error) {
+
+	unlock := storage.rlock(key)
+	defer unlock()
+
+	z, err := storage.readZset(string(key))
+	if z == nil || err != nil {
+		return 0, err
+	}
+
+	first, last := z.scoreRange(min, max)
+	if first == nil {
+		return 0, nil
+	}
+	return z.index.rank(last.score, last.member) - z.index.rank(first.score, first.member) + 1, nil
+}
+
+// ZPopMin removes and returns up to count members with the lowest
+// scores from the sorted set at key
+func (storage *Storage) ZPopMin(key RetainKey, count int) ([]ScoredMember, error) {
+
+	return storage.zpop(key, count, false)
+}
+
+// ZPopMax removes and returns up to count members with the highest
+// scores from the sorted set at key
+func (storage *Storage) ZPopMax(key RetainKey, count int) ([]ScoredMember, error) {
+
+	return storage.zpop(key, count, true)
+}
+
+func (storage *Storage) zpop(key RetainKey, count int, highest bool) ([]ScoredMember, error) {
+
+	unlock := storage.lock(key)
+	defer unlock()
+
+	z, err := storage.writableZset(string(key), false)
+	if z == nil || err != nil {
+		return []ScoredMember{}, err
+	}
+
+	node := z.index.first()
+	if highest {
+		node = z.index.tail
+	}
+	popped := collect(node, highest, Limit{Count: count}, func(*skiplistNode) bool { return true })
+
+	members := make([][]byte, 0, len(popped))
+	for _, member := range popped {
+		members = append(members, member.Member)
+	}
+	if len(members) > 0 {
+		_, err = storage.zrem(string(key), members)
+		if err != nil {
+			return []ScoredMember{}, err
+		}
+		storage.logCommand(append([][]byte{[]byte("ZREM"), key}, members...)...)
+	}
+	return popped, nil
+}
+
+// formatScore writes score so that parsing it gives back the same number
+func formatScore(score float64) []byte {
+
+	return []byte(strconv.FormatFloat(score, 'g', -1, 64))
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func membersOf(scored []ScoredMember) []string {
+
+	result := make([]string, 0, len(scored))
+	for _, member := range scored {
+		result = append(result, string(member.Member))
+	}
+	return result
+}
+
+func TestSkiplist(t *testing.T) {
+
+	sl := newSkiplist()
+	scores := make(map[string]float64)
+	for i := 0; i < 2000; i++ {
+		member := "m" + strconv.Itoa(rand.Intn(500))
+		if score, ok := scores[member]; ok {
+			sl.delete(score, member)
+			delete(scores, member)
+			continue
+		}
+		scores[member] = float64(rand.Intn(50))
+		sl.insert(scores[member], member)
+	}
+
+	expected := make([]string, 0, len(scores))
+	for member := range scores {
+		expected = append(expected, member)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		a, b := expected[i], expected[j]
+		return scores[a] < scores[b] || (scores[a] == scores[b] && a < b)
+	})
+
+	if sl.length != len(expected) {
+		log.Fatalf("failed skiplist length, expected: %d, got: %d", len(expected), sl.length)
+	}
+
+	for i, member := range expected {
+		if rank := sl.rank(scores[member], member); rank != i+1 {
+			log.Fatalf("failed rank of %s, expected: %d, got: %d", member, i+1, rank)
+		}
+		if node := sl.byRank(i + 1); node == nil || node.member != member {
+			log.Fatalf("failed byRank %d, expected: %s", i+1, member)
+		}
+	}
+
+	// walk backwards to check the backward links too
+	i := len(expected) - 1
+	for node := sl.tail; node != nil; node = node.backward {
+		if node.member != expected[i] {
+			log.Fatalf("failed backward walk at %d, expected: %s, got: %s", i, expected[i], node.member)
+		}
+		i--
+	}
+}
+
+func TestZAdd(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("board")
+
+	added, _ := mp.ZAdd(key, []ScoredMember{{[]byte("a"), 1}, {[]byte("b"), 2}, {[]byte("c"), 3}}, ZAddOptions{})
+	if added != 3 {
+		log.Fatalf("failed ZAdd, expected: 3, got: %d", added)
+	}
+
+	testCases := []struct {
+		options  ZAddOptions
+		member   string
+		score    float64
+		result   int
+		expected float64
+	}{
+		{ZAddOptions{OnlyIfMissing: true}, "a", 10, 0, 1},
+		{ZAddOptions{OnlyIfExists: true}, "d", 10, 0, 0},
+		{ZAddOptions{OnlyIfExists: true, Changed: true}, "a", 10, 1, 10},
+		{ZAddOptions{OnlyIfGreater: true, Changed: true}, "b", 1, 0, 2},
+		{ZAddOptions{OnlyIfGreater: true, Changed: true}, "b", 5, 1, 5},
+		{ZAddOptions{OnlyIfLess: true}, "c", 0, 0, 0},
+		{ZAddOptions{OnlyIfLess: true}, "e", 7, 1, 7},
+	}
+
+	for _, testCase := range testCases {
+		result, _ := mp.ZAdd(key, []ScoredMember{{[]byte(testCase.member), testCase.score}}, testCase.options)
+		score, _, _ := mp.ZScore(key, []byte(testCase.member))
+		if result != testCase.result || score != testCase.expected {
+			log.Fatalf("failed ZAdd %+v %s, expected: %d %v, got: %d %v", testCase.options, testCase.member, testCase.result, testCase.expected, result, score)
+		}
+	}
+
+	score, _ := mp.ZIncrBy(key, []byte("a"), 2.5)
+	if score != 12.5 {
+		log.Fatalf("failed ZIncrBy, expected: 12.5, got: %v", score)
+	}
+
+	if _, ok, _ := mp.ZAddIncr(key, []byte("a"), -1, ZAddOptions{OnlyIfGreater: true}); ok {
+		log.Fatalf("failed ZAddIncr with GT")
+	}
+
+	mp.ZAdd(key, []ScoredMember{{[]byte("inf"), math.Inf(1)}}, ZAddOptions{})
+	if _, err := mp.ZIncrBy(key, []byte("inf"), math.Inf(-1)); err != ErrScoreNaN {
+		log.Fatalf("failed NaN check, got: %v", err)
+	}
+
+	mp.Set(RetainKey("string"), []byte("value"))
+	if _, err := mp.ZAdd(RetainKey("string"), []ScoredMember{{[]byte("a"), 1}}, ZAddOptions{}); err != ErrWrongType {
+		log.Fatalf("failed ZAdd on a string, got: %v", err)
+	}
+}
+
+func TestZRange(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("board")
+	mp.ZAdd(key, []ScoredMember{{[]byte("a"), 1}, {[]byte("b"), 2}, {[]byte("c"), 2}, {[]byte("d"), 4}, {[]byte("e"), 5}}, ZAddOptions{})
+
+	ranked, _ := mp.ZRange(key, 1, -2, false)
+	reversed, _ := mp.ZRange(key, 0, 1, true)
+	if !reflect.DeepEqual(membersOf(ranked), []string{"b", "c", "d"}) || !reflect.DeepEqual(membersOf(reversed), []string{"e", "d"}) {
+		log.Fatalf("failed ZRange, got: %v, %v", membersOf(ranked), membersOf(reversed))
+	}
+
+	rank, _, _ := mp.ZRank(key, []byte("c"), false)
+	reverseRank, _, _ := mp.ZRank(key, []byte("c"), true)
+	if rank != 2 || reverseRank != 2 {
+		log.Fatalf("failed ZRank, got: %d, %d", rank, reverseRank)
+	}
+
+	testCases := []struct {
+		min     ScoreBound
+		max     ScoreBound
+		reverse bool
+		limit   Limit
+		output  []string
+	}{
+		{ScoreBound{Value: 2}, ScoreBound{Value: 4}, false, NoLimit, []string{"b", "c", "d"}},
+		{ScoreBound{Value: 2, Exclusive: true}, ScoreBound{Value: math.Inf(1)}, false, NoLimit, []string{"d", "e"}},
+		{ScoreBound{Value: math.Inf(-1)}, ScoreBound{Value: 5, Exclusive: true}, true, NoLimit, []string{"d", "c", "b", "a"}},
+		{ScoreBound{Value: 1}, ScoreBound{Value: 5}, false, Limit{Offset: 1, Count: 2}, []string{"b", "c"}},
+		{ScoreBound{Value: 1}, ScoreBound{Value: 5}, true, Limit{Offset: 4, Count: 2}, []string{"a"}},
+		{ScoreBound{Value: 3}, ScoreBound{Value: 3}, false, NoLimit, []string{}},
+		{ScoreBound{Value: 6}, ScoreBound{Value: 1}, false, NoLimit, []string{}},
+	}
+
+	for _, testCase := range testCases {
+		got, _ := mp.ZRangeByScore(key, testCase.min, testCase.max, testCase.reverse, testCase.limit)
+		count, _ := mp.ZCount(key, testCase.min, testCase.max)
+		if !reflect.DeepEqual(membersOf(got), testCase.output) {
+			log.Fatalf("failed ZRangeByScore %+v %+v, expected: %v, got: %v", testCase.min, testCase.max, testCase.output, membersOf(got))
+		}
+		if testCase.limit == NoLimit && count != len(testCase.output) {
+			log.Fatalf("failed ZCount %+v %+v, expected: %d, got: %d", testCase.min, testCase.max, len(testCase.output), count)
+		}
+	}
+}
+
+func TestZRangeByLex(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("names")
+	members := make([]ScoredMember, 0)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		members = append(members, ScoredMember{Member: []byte(name)})
+	}
+	mp.ZAdd(key, members, ZAddOptions{})
+
+	got, _ := mp.ZRangeByLex(key, LexBound{Value: []byte("b")}, LexBound{Value: []byte("dave"), Exclusive: true}, false, NoLimit)
+	if !reflect.DeepEqual(membersOf(got), []string{"bob", "carol"}) {
+		log.Fatalf("failed ZRangeByLex, got: %v", membersOf(got))
+	}
+
+	got, _ = mp.ZRangeByLex(key, LexBound{Unbounded: true}, LexBound{Unbounded: true}, true, Limit{Offset: 1, Count: 2})
+	if !reflect.DeepEqual(membersOf(got), []string{"dave", "carol"}) {
+		log.Fatalf("failed reverse ZRangeByLex, got: %v", membersOf(got))
+	}
+}
+
+func TestZPop(t *testing.T) {
+
+	mp := &Storage{}
+	key := RetainKey("queue")
+	mp.ZAdd(key, []ScoredMember{{[]byte("a"), 1}, {[]byte("b"), 2}, {[]byte("c"), 3}}, ZAddOptions{})
+
+	lowest, _ := mp.ZPopMin(key, 1)
+	highest, _ := mp.ZPopMax(key, 5)
+	if !reflect.DeepEqual(lowest, []ScoredMember{{[]byte("a"), 1}}) || !reflect.DeepEqual(membersOf(highest), []string{"c", "b"}) {
+		log.Fatalf("failed ZPopMin or ZPopMax, got: %v, %v", lowest, highest)
+	}
+
+	if _, ok, err := mp.Get(key); err != nil || ok {
+		log.Fatalf("failed to delete the emptied sorted set")
+	}
+}
+
+func TestZsetPersistence(t *testing.T) {
+
+	dir := t.TempDir()
+	options := appendOnlyOptions(dir)
+
+	mp, _, _ := NewWithOptions(options)
+	key := RetainKey("board")
+	mp.ZAdd(key, []ScoredMember{{[]byte("a"), 1}, {[]byte("b"), 2.5}, {[]byte("c"), -3}, {[]byte("d"), 4}}, ZAddOptions{})
+	mp.ZIncrBy(key, []byte("a"), 0.1)
+	mp.ZAdd(key, []ScoredMember{{[]byte("top"), math.Inf(1)}}, ZAddOptions{})
+	mp.ZRem(key, []byte("b"))
+	mp.ZPopMin(key, 1)
+
+	// a copy taken before a change keeps the old order
+	entries, _ := mp.copyEntries()
+	mp.ZIncrBy(key, []byte("a"), 100)
+	copied := entries[0]["board"].value.(*zset)
+	if copied.scores["a"] != 1.1 || copied.index.tail.member != "top" {
+		log.Fatalf("failed copy on write of a sorted set")
+	}
+	expected, _ := mp.ZRange(key, 0, -1, false)
+
+	handleError("failed Save", mp.Save())
+	mp.Close()
+
+	for _, options := range []Options{options, {SnapshotPath: filepath.Join(dir, fileName)}} {
+		mp, _, _ = NewWithOptions(options)
+		got, _ := mp.ZRange(key, 0, -1, false)
+		mp.Close()
+
+		if !reflect.DeepEqual(got, expected) {
+			log.Fatalf("failed sorted set persistence, expected: %v, got: %v", expected, got)
+		}
+	}
+}